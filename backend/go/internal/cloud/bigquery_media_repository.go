@@ -0,0 +1,350 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file implements `MediaRepository` on BigQuery.
+//
+// Logic Flow:
+//  1. Media objects are streamed into the media table with an `Inserter`; the
+//     client maps the `bigquery` struct tags of `model.Media` to the columns,
+//     including the nested, repeated cast and scenes. The media ID is the
+//     insert ID, so retried inserts are de-duplicated.
+//  2. Lookups and deletes are parameterized queries against the fully
+//     qualified table names.
+//  3. BigQuery rejects DML on rows still in the streaming buffer (roughly the
+//     first few minutes after insertion), so a deletion first streams a
+//     tombstone, and the lookups skip media with a tombstone newer than their
+//     last insert. The rows themselves are then deleted if BigQuery allows it.
+//  4. Vector searches use the native `VECTOR_SEARCH` function on the
+//     embeddings table.
+//  5. Usage records are streamed into the usage table and summed with a
+//     parameterized query.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// QrySequenceKnn defines the BigQuery query for performing a k-nearest neighbor (KNN)
+	// vector search. This is the core query for the semantic search functionality.
+	//
+	// How it works:
+	// - `VECTOR_SEARCH`: This is a BigQuery native function that efficiently finds the most similar
+	//   vectors in a table to a given query vector.
+	// - `TABLE %s`: The first placeholder is for the fully qualified name of the embeddings table.
+	// - `'embeddings'`: This is the name of the column in the table that stores the embedding vectors.
+	// - `(SELECT [ %s ] as embed)`: The second placeholder is for the query vector itself.
+	//   The application will generate an embedding from the user's search text and insert it
+	//   here as a comma-separated list of floating-point numbers.
+	// - `top_k => %d`: The third placeholder is for the 'k' in KNN. It specifies the number
+	//   of closest matches to return.
+	// - `distance_type => '%s'`: The fourth placeholder specifies the algorithm used to measure
+	//   the "distance" between vectors (`DistanceEuclidean` or `DistanceCosine`).
+	// - `ORDER BY distance asc`: This sorts the results by the calculated distance in ascending
+	//   order, ensuring that the most similar items (with the smallest distance) appear first.
+	//
+	// - `%s` (last): The filter of deleted media (see QryDeletedMedia), or nothing;
+	//   the scenes of deleted media count toward top_k.
+	//
+	// The query returns the `media_id` and `sequence_number` of the matching scenes.
+	QrySequenceKnn = "SELECT base.media_id, base.sequence_number FROM VECTOR_SEARCH(TABLE `%s`, 'embeddings', (SELECT [ %s ] as embed), top_k => %d, distance_type => '%s')%s ORDER BY distance asc"
+
+	// QryFindMediaById defines a simple lookup query to retrieve a complete media record
+	// from the media table using its unique ID.
+	//
+	// Placeholders:
+	// - `%s`: The fully qualified name of the `media` table.
+	// - `@id`: The query parameter holding the unique ID of the media object to find.
+	// - `%s`: The filter of deleted media (see QryDeletedMedia), or nothing.
+	QryFindMediaById = "SELECT * from `%s` WHERE id = @id%s"
+
+	// QryGetScene defines a query to extract a single, specific scene from the nested
+	// `scenes` array within a media record.
+	//
+	// How it works:
+	// - `UNNEST(scenes) as s`: This is a powerful BigQuery function that "flattens" the
+	//   repeated `scenes` field (which is an array of structs) into a relational,
+	//   table-like structure aliased as `s`. This allows us to query individual scenes
+	//   as if they were rows in a table.
+	// - `WHERE id = @id and s.sequence = @sequence`: This filters the unnested scenes, first by
+	//   finding the correct parent media document by its `id`, and then by finding the
+	//   specific scene within that document by its `sequence` number.
+	//
+	// Placeholders:
+	// - `%s`: The fully qualified name of the `media` table.
+	// - `%s`: The filter of deleted media (see QryDeletedMedia), or nothing.
+	QryGetScene = "SELECT sequence, start, `end`, script FROM `%s`, UNNEST(scenes) as s WHERE id = @id and s.sequence = @sequence%s"
+
+	// QryUnembeddedMedia finds all media records that do not have any rows in the
+	// embeddings table yet.
+	//
+	// Placeholders:
+	// - `%s`: The fully qualified name of the `media` table.
+	// - `%s`: The fully qualified name of the embeddings table.
+	// - `%s`: The filter of deleted media (see QryDeletedMedia), or nothing.
+	QryUnembeddedMedia = "SELECT * FROM `%s` WHERE ID NOT IN (SELECT MEDIA_ID FROM `%s`)%s"
+
+	// QryDeletedMedia is the filter of the lookups that skips deleted media:
+	// those whose last tombstone is newer than their last insert, so that a
+	// media object saved again after its deletion is found.
+	//
+	// Placeholders:
+	// - `%s`: The column holding the media ID in the filtered query.
+	// - `%s`: The fully qualified name of the tombstone table.
+	// - `%s`: The fully qualified name of the `media` table.
+	QryDeletedMedia = "%s NOT IN (SELECT t.media_id FROM `%s` t JOIN `%s` m ON m.id = t.media_id GROUP BY t.media_id HAVING MAX(t.deleted_at) >= MAX(m.create_date))"
+
+	// QryDeleteById deletes the rows of a table that belong to a media object.
+	//
+	// Placeholders:
+	// - `%s`: The fully qualified name of the table.
+	// - `%s`: The name of the column holding the media ID.
+	QryDeleteById = "DELETE FROM `%s` WHERE %s = @id"
+
+	// QrySumUsage sums the usage records recorded since a time.
+	//
+	// Placeholders:
+	//   - %s: The fully qualified name of the usage table.
+	//   - @since: The start of the period.
+	QrySumUsage = "SELECT COALESCE(SUM(input_tokens), 0) AS input_tokens, COALESCE(SUM(output_tokens), 0) AS output_tokens, COALESCE(SUM(cost), 0) AS cost FROM `%s` WHERE recorded_at >= @since"
+)
+
+// BigQueryMediaRepository stores media and embeddings in BigQuery tables.
+type BigQueryMediaRepository struct {
+	client         *bigquery.Client // Client for interacting with Google BigQuery.
+	dataset        string           // The name of the BigQuery dataset (e.g., "media_ds").
+	mediaTable     string           // The name of the table holding media metadata.
+	embeddingTable string           // The name of the table holding the scene embeddings.
+	usageTable     string           // The name of the table holding the usage records.
+	tombstoneTable string           // The name of the table marking deleted media; empty to delete with DML only.
+	distance       string           // The distance type for vector searches.
+}
+
+// NewBigQueryMediaRepository creates a repository on the configured dataset.
+//
+// Inputs:
+//   - client: An initialized *bigquery.Client.
+//   - source: The dataset and table names.
+//   - distance: The distance type for vector searches.
+//
+// Outputs:
+//   - *BigQueryMediaRepository: A pointer to the new repository.
+func NewBigQueryMediaRepository(client *bigquery.Client, source BigQueryDataSource, distance string) *BigQueryMediaRepository {
+	return &BigQueryMediaRepository{
+		client:         client,
+		dataset:        source.DatasetName,
+		mediaTable:     source.MediaTable,
+		embeddingTable: source.EmbeddingTable,
+		usageTable:     source.UsageTable,
+		tombstoneTable: source.TombstoneTable,
+		distance:       distance,
+	}
+}
+
+// fqn returns the fully qualified name of a table, formatted with dots instead
+// of colons for compatibility with standard SQL (e.g., `project.media_ds.media`).
+func (r *BigQueryMediaRepository) fqn(table string) string {
+	return strings.Replace(r.client.Dataset(r.dataset).Table(table).FullyQualifiedName(), ":", ".", -1)
+}
+
+// SaveMedia streams the media object into the media table. The media ID and
+// creation time are the insert ID, so that BigQuery de-duplicates a retried
+// insert, but not the insert of a media object indexed again.
+func (r *BigQueryMediaRepository) SaveMedia(ctx context.Context, media *model.Media) error {
+	row := &bigquery.StructSaver{Struct: media, InsertID: fmt.Sprintf("%s-%d", media.Id, media.CreateDate.UnixNano())}
+	if err := r.client.Dataset(r.dataset).Table(r.mediaTable).Inserter().Put(ctx, row); err != nil {
+		return fmt.Errorf("bigquery insert failed for title '%s': %w", media.Title, err)
+	}
+	return nil
+}
+
+// DeleteMedia deletes the media object and its embeddings. With a tombstone
+// table, the deletion is first recorded as a tombstone, which hides the media
+// from the lookups; the rows are then deleted too, unless BigQuery refuses
+// because they are still in the streaming buffer, which is only logged.
+// Without one, a refused delete is an error.
+func (r *BigQueryMediaRepository) DeleteMedia(ctx context.Context, id string) error {
+	if len(r.tombstoneTable) > 0 {
+		tombstone := &model.MediaTombstone{MediaId: id, DeletedAt: time.Now().UTC()}
+		if err := r.client.Dataset(r.dataset).Table(r.tombstoneTable).Inserter().Put(ctx, tombstone); err != nil {
+			return fmt.Errorf("failed to record the deletion of media %s: %w", id, err)
+		}
+	}
+	err := r.exec(ctx, fmt.Sprintf(QryDeleteById, r.fqn(r.embeddingTable), "media_id"), id)
+	if err != nil {
+		err = fmt.Errorf("failed to delete embeddings of media %s: %w", id, err)
+	} else if err = r.exec(ctx, fmt.Sprintf(QryDeleteById, r.fqn(r.mediaTable), "id"), id); err != nil {
+		err = fmt.Errorf("failed to delete media %s: %w", id, err)
+	}
+	if err != nil && len(r.tombstoneTable) > 0 {
+		log.Printf("media %s is hidden by its tombstone until its rows can be deleted: %v", id, err)
+		return nil
+	}
+	return err
+}
+
+// live returns the filter of a lookup that skips deleted media, or nothing
+// without a tombstone table.
+//
+// Inputs:
+//   - conjunction: The keyword joining the filter to the lookup ("WHERE" or "AND").
+//   - column: The column holding the media ID in the lookup.
+func (r *BigQueryMediaRepository) live(conjunction string, column string) string {
+	if len(r.tombstoneTable) == 0 {
+		return ""
+	}
+	return " " + conjunction + " " + fmt.Sprintf(QryDeletedMedia, column, r.fqn(r.tombstoneTable), r.fqn(r.mediaTable))
+}
+
+// exec runs a DML statement with an @id parameter and waits for it.
+func (r *BigQueryMediaRepository) exec(ctx context.Context, statement string, id string) error {
+	q := r.client.Query(statement)
+	q.Parameters = []bigquery.QueryParameter{{Name: "id", Value: id}}
+	job, err := q.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// GetMedia retrieves a single media object based on its unique ID.
+func (r *BigQueryMediaRepository) GetMedia(ctx context.Context, id string) (*model.Media, error) {
+	q := r.client.Query(fmt.Sprintf(QryFindMediaById, r.fqn(r.mediaTable), r.live("AND", "id")))
+	q.Parameters = []bigquery.QueryParameter{{Name: "id", Value: id}}
+	itr, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Since ID is a primary key, we expect only one result.
+	media := &model.Media{}
+	if err := itr.Next(media); err != nil {
+		return nil, notFound(err, "media %s", id)
+	}
+	return media, nil
+}
+
+// GetScene retrieves a specific scene from a media object by its sequence number.
+func (r *BigQueryMediaRepository) GetScene(ctx context.Context, id string, sequence int) (*model.Scene, error) {
+	q := r.client.Query(fmt.Sprintf(QryGetScene, r.fqn(r.mediaTable), r.live("AND", "id")))
+	q.Parameters = []bigquery.QueryParameter{{Name: "id", Value: id}, {Name: "sequence", Value: sequence}}
+	itr, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scene := &model.Scene{}
+	if err := itr.Next(scene); err != nil {
+		return nil, notFound(err, "scene %d of media %s", sequence, id)
+	}
+	return scene, nil
+}
+
+// ListUnembeddedMedia returns the media objects without rows in the embeddings table.
+func (r *BigQueryMediaRepository) ListUnembeddedMedia(ctx context.Context) ([]*model.Media, error) {
+	itr, err := r.client.Query(fmt.Sprintf(QryUnembeddedMedia, r.fqn(r.mediaTable), r.fqn(r.embeddingTable), r.live("AND", "id"))).Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*model.Media, 0)
+	for {
+		media := &model.Media{}
+		err := itr.Next(media)
+		if errors.Is(err, iterator.Done) {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, media)
+	}
+}
+
+// SaveEmbeddings streams the embeddings into the embeddings table.
+func (r *BigQueryMediaRepository) SaveEmbeddings(ctx context.Context, embeddings []*model.SceneEmbedding) error {
+	return r.client.Dataset(r.dataset).Table(r.embeddingTable).Inserter().Put(ctx, embeddings)
+}
+
+// FindScenes performs a k-nearest neighbor search with VECTOR_SEARCH.
+func (r *BigQueryMediaRepository) FindScenes(ctx context.Context, vector []float64, limit int) ([]*model.SceneMatchResult, error) {
+	out := make([]*model.SceneMatchResult, 0)
+
+	// The VECTOR_SEARCH function expects the query vector as a comma-separated
+	// list of float values.
+	values := make([]string, 0, len(vector))
+	for _, f := range vector {
+		values = append(values, strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	queryText := fmt.Sprintf(QrySequenceKnn, r.fqn(r.embeddingTable), strings.Join(values, ","), limit, r.distance, r.live("WHERE", "base.media_id"))
+
+	itr, err := r.client.Query(queryText).Read(ctx)
+	if err != nil {
+		return out, fmt.Errorf("failed to read from BigQuery: %w", err)
+	}
+	for {
+		result := &model.SceneMatchResult{}
+		err := itr.Next(result)
+		if errors.Is(err, iterator.Done) {
+			return out, nil
+		}
+		if err != nil {
+			return out, fmt.Errorf("failed to iterate results: %w", err)
+		}
+		out = append(out, result)
+	}
+}
+
+// notFound makes an exhausted iterator match ErrMediaNotFound.
+func notFound(err error, format string, args ...interface{}) error {
+	if errors.Is(err, iterator.Done) {
+		return fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), ErrMediaNotFound)
+	}
+	return err
+}
+
+// RecordUsage streams the usage record into the usage table.
+func (r *BigQueryMediaRepository) RecordUsage(ctx context.Context, record *model.UsageRecord) error {
+	if err := r.client.Dataset(r.dataset).Table(r.usageTable).Inserter().Put(ctx, record); err != nil {
+		return fmt.Errorf("bigquery insert failed for usage of %s: %w", record.Model, err)
+	}
+	return nil
+}
+
+// SumUsage sums the usage records since the time.
+func (r *BigQueryMediaRepository) SumUsage(ctx context.Context, since time.Time) (*model.TokenUsage, error) {
+	q := r.client.Query(fmt.Sprintf(QrySumUsage, r.fqn(r.usageTable)))
+	q.Parameters = []bigquery.QueryParameter{{Name: "since", Value: since}}
+	itr, err := q.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	usage := &model.TokenUsage{}
+	if err := itr.Next(usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines the `BlobStore` abstraction, which lets commands, services
+// and API handlers read and write media objects without depending on a
+// particular storage backend.
+//
+// Logic Flow:
+//  1. At startup, `NewBlobStore` reads the `[storage]` configuration and
+//     creates either a `GCSBlobStore` (the default) or a `LocalBlobStore`
+//     rooted in a directory tree, for running on a laptop or in CI.
+//  2. The store is shared through `ServiceClients.BlobStore`. Objects are
+//     always addressed by bucket and name, so the rest of the application does
+//     not change with the backend.
+//  3. A missing object is reported as `ErrBlobNotExist` by every
+//     implementation, so callers can check for it with `errors.Is`.
+//
+// Interfaces:
+//   - BlobStore: Open, Create, Stat, Delete, List and SignURL for objects.
+//   - BlobWriter: The writer returned by Create.
+//
+// Structs:
+//   - BlobInfo: The metadata of a stored object.
+//
+// Functions:
+//   - NewBlobStore: Creates the store selected by the configuration.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Storage backends that can be selected with `storage.backend`.
+const (
+	BlobBackendGCS   = "gcs"   // Google Cloud Storage; the default.
+	BlobBackendLocal = "local" // A local directory tree.
+)
+
+// ErrBlobNotExist is matched by the errors returned for objects that do not exist.
+var ErrBlobNotExist = errors.New("blob does not exist")
+
+// BlobInfo describes a stored object.
+type BlobInfo struct {
+	Bucket      string    // The bucket containing the object.
+	Name        string    // The name of the object within the bucket.
+	ContentType string    // The MIME type of the object, if known.
+	Size        int64     // The size of the object in bytes.
+	Generation  int64     // The generation of the object's content.
+	Updated     time.Time // When the object was last written.
+}
+
+// BlobWriter writes a new object. The object only becomes visible once Close
+// returns without an error. Canceling the context given to `BlobStore.Create`
+// before Close aborts the write, so a failed copy never leaves a partial object.
+type BlobWriter interface {
+	io.WriteCloser
+	// Info returns the metadata of the written object. It is only valid after
+	// Close returned without an error.
+	Info() *BlobInfo
+}
+
+// BlobStore reads and writes objects addressed by bucket and name.
+type BlobStore interface {
+	// Open returns a reader for the object's content.
+	Open(ctx context.Context, bucket string, name string) (io.ReadCloser, error)
+	// Create returns a writer that creates or replaces the object.
+	Create(ctx context.Context, bucket string, name string, contentType string) (BlobWriter, error)
+	// Stat returns the object's metadata.
+	Stat(ctx context.Context, bucket string, name string) (*BlobInfo, error)
+	// Delete removes the object. A non-zero generation only deletes the object
+	// if it still holds that generation; otherwise ErrBlobNotExist is returned.
+	Delete(ctx context.Context, bucket string, name string, generation int64) error
+	// List returns the objects of the bucket whose names start with the prefix.
+	List(ctx context.Context, bucket string, prefix string) ([]*BlobInfo, error)
+	// SignURL returns a URL that grants read access to the object until it expires.
+	SignURL(ctx context.Context, bucket string, name string, expires time.Duration) (string, error)
+}
+
+// NewBlobStore creates the store selected by the storage configuration.
+//
+// Inputs:
+//   - ctx: The context used to create the GCS client.
+//   - config: The storage configuration.
+//
+// Outputs:
+//   - BlobStore: The configured store.
+//   - error: An error if the backend is unknown or cannot be created.
+func NewBlobStore(ctx context.Context, config Storage) (BlobStore, error) {
+	switch config.Backend {
+	case "", BlobBackendGCS:
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return NewGCSBlobStore(client), nil
+	case BlobBackendLocal:
+		return NewLocalBlobStore(config.LocalRoot, config.PublicURL, []byte(config.SigningKey))
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
+	}
+}
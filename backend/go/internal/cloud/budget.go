@@ -0,0 +1,429 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines `BudgetManager`, which keeps the spend of ingestion within
+// daily, monthly and per-media budgets of tokens and estimated cost. Where the
+// quotas (see quota.go) cap the rate of requests, the budgets cap their total.
+//
+// Logic Flow:
+//  1. `[budget]` sets the budgets; zero is unlimited. `NewCloudServiceClients`
+//     creates one manager, and wraps every agent model in a `BudgetModel`,
+//     which records the usage of each response in the usage ledger of the
+//     media repository.
+//  2. The daily and monthly spend is summed from the ledger, so that it is
+//     shared by every instance and survives restarts, and kept in memory
+//     between reads. It is read again every minute and when a UTC day or month
+//     starts.
+//  3. The `budget-check` command calls `Check` before the summary and the
+//     scenes of a media file are generated. A daily or monthly budget that is
+//     spent fails the chain with a deferrable `BudgetExceededError`, and the
+//     listener moves the message to the deferral queue (see deferral.go). A
+//     media file whose estimated usage is over the per-media budget fails for
+//     good, and is dead-lettered.
+//  4. As the spend of a period crosses each alert threshold, a structured
+//     "budget threshold crossed" warning is logged and the `budget.alerts`
+//     counter increased. The spend is exported as the `budget.cost` and
+//     `budget.tokens` gauges, and listed by `/admin/budgets`.
+//
+// Structs:
+//   - BudgetManager: The budgets of ingestion and their spend, shared by all agent models.
+//   - BudgetState: A snapshot of the spend of a daily or monthly budget.
+//   - BudgetExceededError: A chain refused because a budget is spent.
+//   - BudgetModel: A GenerativeModel recording the usage of its responses.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// The names of the budgets.
+const (
+	BudgetDaily    = "daily"
+	BudgetMonthly  = "monthly"
+	BudgetPerMedia = "per-media"
+)
+
+// The units of the budgets.
+const (
+	BudgetUnitCost   = "cost"
+	BudgetUnitTokens = "tokens"
+)
+
+// budgetRefreshInterval is the time the spend read from the usage ledger is
+// used before it is read again, to take in the usage of other instances.
+const budgetRefreshInterval = time.Minute
+
+// DefaultAlertThresholds are the fractions of the daily and monthly budgets
+// that raise an alert when `alert_thresholds` is not configured.
+var DefaultAlertThresholds = []float64{0.5, 0.8, 1}
+
+// ErrBudgetExceeded is matched by every BudgetExceededError.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// BudgetExceededError is returned for a chain refused because a budget is
+// spent, or because a media file would overrun the per-media budget.
+type BudgetExceededError struct {
+	Budget  string    // The budget: "daily", "monthly" or "per-media".
+	Unit    string    // The unit of the limit: "cost" or "tokens".
+	Limit   float64   // The limit, in USD or tokens.
+	Spent   float64   // The spend of the period, or the estimated usage of the media file.
+	ResetAt time.Time // When the period of the budget ends; zero for the per-media budget.
+}
+
+func (e *BudgetExceededError) Error() string {
+	if e.Unit == BudgetUnitCost {
+		return fmt.Sprintf("%s %s budget exceeded: $%.2f of $%.2f", e.Budget, e.Unit, e.Spent, e.Limit)
+	}
+	return fmt.Sprintf("%s %s budget exceeded: %.0f of %.0f", e.Budget, e.Unit, e.Spent, e.Limit)
+}
+
+// Is matches ErrBudgetExceeded.
+func (e *BudgetExceededError) Is(target error) bool {
+	return target == ErrBudgetExceeded
+}
+
+// Retryable reports false: running the chain again at once would be refused
+// the same way (see `cor.IsRetryable`).
+func (e *BudgetExceededError) Retryable() bool {
+	return false
+}
+
+// Deferrable reports whether the chain can run once the period of the budget
+// ends: true for the daily and monthly budgets.
+func (e *BudgetExceededError) Deferrable() bool {
+	return e.Budget != BudgetPerMedia
+}
+
+// BudgetState is a snapshot of the spend of a daily or monthly budget.
+type BudgetState struct {
+	Budget    string    `json:"budget"`               // "daily" or "monthly".
+	MaxCost   float64   `json:"max_cost,omitempty"`   // The cost limit, in USD; unlimited if zero.
+	MaxTokens int       `json:"max_tokens,omitempty"` // The token limit; unlimited if zero.
+	Cost      float64   `json:"cost"`                 // The estimated cost of the period, in USD.
+	Tokens    int       `json:"tokens"`               // The input and output tokens of the period.
+	Start     time.Time `json:"start"`                // The start of the period.
+	ResetAt   time.Time `json:"reset_at"`             // The end of the period.
+}
+
+// budgetPeriod is the spend of a daily or monthly budget.
+type budgetPeriod struct {
+	name      string
+	maxCost   float64
+	maxTokens int
+	start     time.Time
+	end       time.Time
+	spent     model.TokenUsage
+	alerted   map[string]int // The thresholds crossed and alerted, keyed by unit.
+}
+
+// bounds returns the UTC period of the budget holding the time.
+func (p *budgetPeriod) bounds(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	if p.name == BudgetMonthly {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// limited reports whether the budget has a limit.
+func (p *budgetPeriod) limited() bool {
+	return p.maxCost > 0 || p.maxTokens > 0
+}
+
+// BudgetManager keeps the spend of ingestion within its budgets. It is safe
+// for concurrent use.
+type BudgetManager struct {
+	config     BudgetConfig
+	ledger     MediaRepository // Keeps the usage records the spend is summed from.
+	thresholds []float64       // The alert thresholds, ascending.
+	alerts     metric.Int64Counter
+
+	mu          sync.Mutex
+	periods     []*budgetPeriod // The daily and monthly budgets.
+	refreshedAt time.Time       // When the spend was last read from the ledger; zero to read it on the next check.
+}
+
+// NewBudgetManager creates the budgets of ingestion.
+//
+// Inputs:
+//   - config: The budgets.
+//   - ledger: The repository keeping the usage records.
+//
+// Outputs:
+//   - *BudgetManager: A pointer to the new manager, or nil if every budget is unlimited.
+func NewBudgetManager(config BudgetConfig, ledger MediaRepository) *BudgetManager {
+	b := &BudgetManager{
+		config: config,
+		ledger: ledger,
+		periods: []*budgetPeriod{
+			{name: BudgetDaily, maxCost: config.DailyMaxCost, maxTokens: config.DailyMaxTokens},
+			{name: BudgetMonthly, maxCost: config.MonthlyMaxCost, maxTokens: config.MonthlyMaxTokens},
+		},
+	}
+	if !b.periods[0].limited() && !b.periods[1].limited() && config.PerMediaMaxCost <= 0 && config.PerMediaMaxTokens <= 0 {
+		return nil
+	}
+	b.thresholds = append([]float64(nil), config.AlertThresholds...)
+	if len(b.thresholds) == 0 {
+		b.thresholds = DefaultAlertThresholds
+	}
+	sort.Float64s(b.thresholds)
+	now := time.Now()
+	for _, p := range b.periods {
+		p.start, p.end = p.bounds(now)
+		p.alerted = make(map[string]int)
+	}
+	b.registerMetrics()
+	return b
+}
+
+// Check returns a BudgetExceededError if the daily or monthly budget is
+// spent, or if the estimated usage of a media file is over the per-media
+// budget.
+//
+// Inputs:
+//   - ctx: The context of the check.
+//   - media: The estimated usage of the media file being indexed; zero if unknown.
+//
+// Outputs:
+//   - error: A *BudgetExceededError, an error if the ledger cannot be read, or nil.
+func (b *BudgetManager) Check(ctx context.Context, media model.TokenUsage) error {
+	if limit := b.config.PerMediaMaxCost; limit > 0 && media.Cost > limit {
+		return &BudgetExceededError{Budget: BudgetPerMedia, Unit: BudgetUnitCost, Limit: limit, Spent: media.Cost}
+	}
+	if limit := b.config.PerMediaMaxTokens; limit > 0 && media.InputTokens+media.OutputTokens > limit {
+		return &BudgetExceededError{Budget: BudgetPerMedia, Unit: BudgetUnitTokens, Limit: float64(limit), Spent: float64(media.InputTokens + media.OutputTokens)}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.refreshLocked(ctx, time.Now()); err != nil {
+		return err
+	}
+	for _, p := range b.periods {
+		if p.maxCost > 0 && p.spent.Cost >= p.maxCost {
+			return &BudgetExceededError{Budget: p.name, Unit: BudgetUnitCost, Limit: p.maxCost, Spent: p.spent.Cost, ResetAt: p.end}
+		}
+		if tokens := p.spent.InputTokens + p.spent.OutputTokens; p.maxTokens > 0 && tokens >= p.maxTokens {
+			return &BudgetExceededError{Budget: p.name, Unit: BudgetUnitTokens, Limit: float64(p.maxTokens), Spent: float64(tokens), ResetAt: p.end}
+		}
+	}
+	return nil
+}
+
+// Record appends the usage of a generation to the ledger and adds it to the
+// spend of the budgets. The spend is updated even if the ledger cannot be
+// written, since the tokens were paid for.
+//
+// Inputs:
+//   - ctx: The context of the generation.
+//   - modelName: The name of the model (e.g., "gemini-2.5-pro").
+//   - usage: The usage of the generation.
+//
+// Outputs:
+//   - error: An error if the ledger cannot be written.
+func (b *BudgetManager) Record(ctx context.Context, modelName string, usage Usage) error {
+	now := time.Now().UTC()
+	err := b.ledger.RecordUsage(ctx, &model.UsageRecord{
+		RecordedAt:   now,
+		Model:        modelName,
+		InputTokens:  usage.InputTokens,
+		OutputTokens: usage.OutputTokens,
+		Cost:         usage.Cost,
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollLocked(now)
+	for _, p := range b.periods {
+		p.spent.InputTokens += usage.InputTokens
+		p.spent.OutputTokens += usage.OutputTokens
+		p.spent.Cost += usage.Cost
+		b.alertLocked(ctx, p)
+	}
+	return err
+}
+
+// rollLocked starts the periods that have ended, and marks the spend to be
+// read again from the ledger.
+func (b *BudgetManager) rollLocked(now time.Time) {
+	for _, p := range b.periods {
+		if now.Before(p.end) {
+			continue
+		}
+		p.start, p.end = p.bounds(now)
+		p.spent = model.TokenUsage{}
+		p.alerted = make(map[string]int)
+		b.refreshedAt = time.Time{}
+	}
+}
+
+// refreshLocked reads the spend of the limited periods from the ledger, unless
+// it was read within the refresh interval.
+func (b *BudgetManager) refreshLocked(ctx context.Context, now time.Time) error {
+	b.rollLocked(now)
+	if now.Sub(b.refreshedAt) < budgetRefreshInterval {
+		return nil
+	}
+	for _, p := range b.periods {
+		if !p.limited() {
+			continue
+		}
+		spent, err := b.ledger.SumUsage(ctx, p.start)
+		if err != nil {
+			return fmt.Errorf("failed to read the %s spend: %w", p.name, err)
+		}
+		p.spent = *spent
+		b.alertLocked(ctx, p)
+	}
+	b.refreshedAt = now
+	return nil
+}
+
+// alertLocked raises an alert for the highest threshold the spend of a period
+// crossed since its last alert.
+func (b *BudgetManager) alertLocked(ctx context.Context, p *budgetPeriod) {
+	for _, unit := range []string{BudgetUnitCost, BudgetUnitTokens} {
+		spent, limit := p.spent.Cost, p.maxCost
+		if unit == BudgetUnitTokens {
+			spent, limit = float64(p.spent.InputTokens+p.spent.OutputTokens), float64(p.maxTokens)
+		}
+		if limit <= 0 {
+			continue
+		}
+		crossed := 0
+		for crossed < len(b.thresholds) && spent >= b.thresholds[crossed]*limit {
+			crossed++
+		}
+		if crossed <= p.alerted[unit] {
+			continue
+		}
+		p.alerted[unit] = crossed
+		threshold := b.thresholds[crossed-1]
+		slog.WarnContext(ctx, "budget threshold crossed",
+			"budget", p.name, "unit", unit, "threshold", threshold,
+			"spent", spent, "limit", limit, "reset_at", p.end)
+		if b.alerts != nil {
+			b.alerts.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("budget", p.name),
+				attribute.String("unit", unit),
+				attribute.Float64("threshold", threshold)))
+		}
+	}
+}
+
+// Snapshot returns the spend of the daily and monthly budgets, as last read
+// or recorded.
+//
+// Outputs:
+//   - []BudgetState: The budgets, daily first; empty if budgets are disabled.
+func (b *BudgetManager) Snapshot() []BudgetState {
+	out := make([]BudgetState, 0, 2)
+	if b == nil {
+		return out
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollLocked(time.Now())
+	for _, p := range b.periods {
+		out = append(out, BudgetState{
+			Budget:    p.name,
+			MaxCost:   p.maxCost,
+			MaxTokens: p.maxTokens,
+			Cost:      p.spent.Cost,
+			Tokens:    p.spent.InputTokens + p.spent.OutputTokens,
+			Start:     p.start,
+			ResetAt:   p.end,
+		})
+	}
+	return out
+}
+
+// registerMetrics creates the `budget.alerts` counter and exports the
+// snapshot as gauges, with a "budget" attribute.
+func (b *BudgetManager) registerMetrics() {
+	meter := otel.Meter("github.com/GoogleCloudPlatform/solutions/media")
+	alerts, err1 := meter.Int64Counter("budget.alerts",
+		metric.WithDescription("The alert thresholds of the daily and monthly budgets crossed."))
+	cost, err2 := meter.Float64ObservableGauge("budget.cost",
+		metric.WithDescription("The estimated cost of the period of a budget, in USD."))
+	tokens, err3 := meter.Int64ObservableGauge("budget.tokens",
+		metric.WithDescription("The input and output tokens of the period of a budget."))
+	if err := errors.Join(err1, err2, err3); err != nil {
+		log.Printf("error creating budget metrics: %v\n", err)
+		return
+	}
+	b.alerts = alerts
+	_, err := meter.RegisterCallback(func(_ context.Context, observer metric.Observer) error {
+		for _, state := range b.Snapshot() {
+			budget := metric.WithAttributes(attribute.String("budget", state.Budget))
+			observer.ObserveFloat64(cost, state.Cost, budget)
+			observer.ObserveInt64(tokens, int64(state.Tokens), budget)
+		}
+		return nil
+	}, cost, tokens)
+	if err != nil {
+		log.Printf("error registering budget gauges: %v\n", err)
+	}
+}
+
+// BudgetModel is a GenerativeModel recording the usage of its responses with
+// the budgets.
+type BudgetModel struct {
+	GenerativeModel
+	budgets *BudgetManager
+}
+
+// NewBudgetModel wraps a model with the budgets.
+//
+// Inputs:
+//   - model: The model to wrap; it should estimate the cost of its responses (see PricedModel).
+//   - budgets: The budgets; nil returns the model itself.
+//
+// Outputs:
+//   - GenerativeModel: The wrapped model.
+func NewBudgetModel(model GenerativeModel, budgets *BudgetManager) GenerativeModel {
+	if budgets == nil {
+		return model
+	}
+	return &BudgetModel{GenerativeModel: model, budgets: budgets}
+}
+
+// Generate sends the request and records its usage. A usage record that cannot
+// be written does not fail the request, which was already paid for.
+func (m *BudgetModel) Generate(ctx context.Context, request *GenerationRequest) (*GenerationResponse, error) {
+	resp, err := m.GenerativeModel.Generate(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.budgets.Record(context.WithoutCancel(ctx), m.Name(), resp.Usage); err != nil {
+		log.Printf("failed to record usage of %s: %v", m.Name(), err)
+	}
+	return resp, nil
+}
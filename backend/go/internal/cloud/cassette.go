@@ -0,0 +1,283 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file implements a record/replay HTTP transport for the GenAI client, so
+// that the Gemini and embedding calls of a test can be recorded once against
+// Vertex AI and then replayed without network access or credentials.
+//
+// Logic Flow:
+//  1. The test mode is read from `GCP_TEST_MODE`: "live" (the default; no
+//     cassettes), "record" or "replay". The cassettes live in the directory
+//     named by `GCP_CASSETTE_DIR`.
+//  2. Every request is keyed by the SHA-256 hash of its method, its URL path
+//     and its body, with JSON bodies re-encoded so that the order of their
+//     fields does not matter. Host names and credentials are not part of the
+//     key, so a cassette recorded in one region replays in any other.
+//  3. In record mode the request is sent, and the response is saved to
+//     `<hash>.json` together with the request and the usage metadata of the
+//     response, for review in code diffs.
+//  4. In replay mode the response is served from `<hash>.json`; a request
+//     without a cassette fails with `ErrCassetteNotFound` instead of reaching
+//     the network.
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"cloud.google.com/go/auth"
+	"cloud.google.com/go/auth/credentials"
+	"cloud.google.com/go/auth/httptransport"
+	"google.golang.org/genai"
+)
+
+// Test modes that can be selected with `GCP_TEST_MODE`.
+const (
+	TestModeLive   = "live"   // Requests go to the service; the default.
+	TestModeRecord = "record" // Requests go to the service and are saved as cassettes.
+	TestModeReplay = "replay" // Requests are answered from cassettes.
+)
+
+// ErrCassetteNotFound is returned in replay mode for a request that was not recorded.
+var ErrCassetteNotFound = errors.New("no cassette recorded for request")
+
+// cassette is the content of a cassette file.
+type cassette struct {
+	Request struct {
+		Method string          `json:"method"`
+		Path   string          `json:"path"`
+		Body   json.RawMessage `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		StatusCode  int             `json:"status_code"`
+		ContentType string          `json:"content_type,omitempty"`
+		Body        json.RawMessage `json:"body,omitempty"` // The body, if it is JSON.
+		Text        string          `json:"text,omitempty"` // The body, if it is not JSON.
+	} `json:"response"`
+	Usage json.RawMessage `json:"usage,omitempty"` // The `usageMetadata` of the response, if any.
+}
+
+// CassetteTransport is an http.RoundTripper that records or replays requests.
+type CassetteTransport struct {
+	mode  string            // TestModeRecord or TestModeReplay.
+	dir   string            // The directory holding the cassette files.
+	inner http.RoundTripper // The transport requests are sent with in record mode.
+}
+
+// NewCassetteTransport creates a recording or replaying transport.
+//
+// Inputs:
+//   - mode: TestModeRecord or TestModeReplay.
+//   - dir: The directory holding the cassette files; created in record mode.
+//   - inner: The transport requests are sent with in record mode; unused in replay mode.
+//
+// Outputs:
+//   - *CassetteTransport: A pointer to the new transport.
+//   - error: An error if the mode is unknown or the directory is unusable.
+func NewCassetteTransport(mode string, dir string, inner http.RoundTripper) (*CassetteTransport, error) {
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("test mode %s requires %s", mode, EnvCassetteDir)
+	}
+	switch mode {
+	case TestModeRecord:
+		if inner == nil {
+			inner = http.DefaultTransport
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	case TestModeReplay:
+	default:
+		return nil, fmt.Errorf("unknown test mode %q", mode)
+	}
+	return &CassetteTransport{mode: mode, dir: dir, inner: inner}, nil
+}
+
+// RoundTrip records or replays the request.
+func (t *CassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The path is cleaned, since base URLs with and without a trailing slash
+	// produce the same request.
+	urlPath := path.Clean(req.URL.Path)
+	key, canonical := cassetteKey(req.Method, urlPath, body)
+	file := filepath.Join(t.dir, key+".json")
+
+	if t.mode == TestModeReplay {
+		content, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s %s (%s)", ErrCassetteNotFound, req.Method, urlPath, key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var c cassette
+		if err := json.Unmarshal(content, &c); err != nil {
+			return nil, fmt.Errorf("failed to parse cassette %s: %w", file, err)
+		}
+		respBody := []byte(c.Response.Body)
+		if len(c.Response.Text) > 0 {
+			respBody = []byte(c.Response.Text)
+		}
+		return cassetteResponse(req, c.Response.StatusCode, c.Response.ContentType, respBody), nil
+	}
+
+	// Record mode: send the request with the original body.
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	resp, err := t.inner.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var c cassette
+	c.Request.Method = req.Method
+	c.Request.Path = urlPath
+	c.Request.Body = canonical
+	c.Response.StatusCode = resp.StatusCode
+	c.Response.ContentType = resp.Header.Get("Content-Type")
+	if json.Valid(respBody) {
+		c.Response.Body = respBody
+	} else {
+		c.Response.Text = string(respBody)
+	}
+	var usage struct {
+		UsageMetadata json.RawMessage `json:"usageMetadata"`
+	}
+	if json.Unmarshal(respBody, &usage) == nil {
+		c.Usage = usage.UsageMetadata
+	}
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, content, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write cassette %s: %w", file, err)
+	}
+	return cassetteResponse(req, resp.StatusCode, c.Response.ContentType, respBody), nil
+}
+
+// cassetteKey hashes a request into its cassette key. It also returns the
+// body as stored in the cassette: re-encoded JSON, or a JSON string.
+func cassetteKey(method string, urlPath string, body []byte) (string, json.RawMessage) {
+	var canonical json.RawMessage
+	var decoded interface{}
+	switch {
+	case len(body) == 0:
+		// No body, as for a GET request.
+	case json.Unmarshal(body, &decoded) == nil:
+		// Maps are encoded with sorted keys, which makes the key independent
+		// of the order of the fields.
+		canonical, _ = json.Marshal(decoded)
+	default:
+		canonical, _ = json.Marshal(string(body))
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", method, urlPath)
+	h.Write(canonical)
+	return hex.EncodeToString(h.Sum(nil)), canonical
+}
+
+// cassetteResponse builds the response handed to the client.
+func cassetteResponse(req *http.Request, status int, contentType string, body []byte) *http.Response {
+	header := make(http.Header)
+	if len(contentType) > 0 {
+		header.Set("Content-Type", contentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// replayToken is the token of the credentials used in replay mode, where no
+// request leaves the process.
+type replayToken struct{}
+
+func (replayToken) Token(context.Context) (*auth.Token, error) {
+	return &auth.Token{Value: "replay", Type: "Bearer"}, nil
+}
+
+// applyTestMode configures the GenAI client for the test mode selected by
+// `GCP_TEST_MODE`. In record mode, requests are sent with the default
+// credentials and saved; in replay mode, no credentials are needed.
+//
+// Inputs:
+//   - config: The client configuration to update.
+//
+// Outputs:
+//   - error: An error if the mode is unknown or the credentials cannot be found.
+func applyTestMode(config *genai.ClientConfig) error {
+	mode := os.Getenv(EnvTestMode)
+	dir := os.Getenv(EnvCassetteDir)
+	switch mode {
+	case "", TestModeLive:
+		return nil
+	case TestModeRecord:
+		creds, err := credentials.DetectDefault(&credentials.DetectOptions{
+			Scopes: []string{"https://www.googleapis.com/auth/cloud-platform"},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to find default credentials: %w", err)
+		}
+		client, err := httptransport.NewClient(&httptransport.Options{Credentials: creds})
+		if err != nil {
+			return err
+		}
+		transport, err := NewCassetteTransport(mode, dir, client.Transport)
+		if err != nil {
+			return err
+		}
+		config.Credentials = creds
+		config.HTTPClient = &http.Client{Transport: transport}
+	default:
+		transport, err := NewCassetteTransport(mode, dir, nil)
+		if err != nil {
+			return err
+		}
+		config.Credentials = auth.NewCredentials(&auth.CredentialsOptions{TokenProvider: replayToken{}})
+		config.HTTPClient = &http.Client{Transport: transport}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file implements `MessageSource` on an in-process Go channel, for local
+// development and tests.
+//
+// Logic Flow:
+//  1. `Publish` puts a message on a buffered channel, blocking while it is full.
+//  2. `Receive` takes messages off the channel and runs the handler for each
+//     one in its own goroutine, like the Pub/Sub client does. With
+//     `num_goroutines`, a fixed pool of workers runs the handlers instead,
+//     and the other messages wait on the channel.
+//  3. Every delivery holds a lease. Like the Pub/Sub client, the source keeps
+//     the lease while the handler runs; an unsettled message's lease expires
+//     one acknowledgement deadline after the handler returns. `Ack` ends the
+//     lease; `Nack` and an expired lease put the message back on the channel
+//     with the next delivery attempt. `ExtendDeadline` restarts the lease timer.
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultAckDeadline is the acknowledgement deadline used when none is configured.
+const defaultAckDeadline = 60 * time.Second
+
+// ChannelSource is an in-process queue with Pub/Sub-like delivery semantics.
+type ChannelSource struct {
+	name     string        // The name of the queue, for logs.
+	deadline time.Duration // The acknowledgement deadline of each delivery.
+	workers  int           // The number of handler workers; one goroutine per message if zero.
+	queue    chan *Message // The messages waiting for delivery.
+	done     chan struct{} // Closed by Close to stop pending redeliveries.
+
+	mu     sync.Mutex
+	leases map[*Message]*time.Timer // The deadline timers of the unsettled deliveries; nil while the handler runs.
+	nextID int64                    // The ID of the next published message.
+	closed bool
+}
+
+// NewChannelSource creates an empty queue.
+//
+// Inputs:
+//   - name: The name of the queue, for logs.
+//   - capacity: The number of messages that can wait for delivery before Publish blocks.
+//   - deadline: The acknowledgement deadline; 60 seconds if zero.
+//
+// Outputs:
+//   - *ChannelSource: A pointer to the new queue.
+func NewChannelSource(name string, capacity int, deadline time.Duration) *ChannelSource {
+	if deadline <= 0 {
+		deadline = defaultAckDeadline
+	}
+	return &ChannelSource{
+		name:     name,
+		deadline: deadline,
+		queue:    make(chan *Message, capacity),
+		done:     make(chan struct{}),
+		leases:   make(map[*Message]*time.Timer),
+	}
+}
+
+// Name returns the name of the queue.
+func (s *ChannelSource) Name() string {
+	return "channel:" + s.name
+}
+
+// Publish queues a message and returns its ID. It blocks while the queue is
+// full, until the context is canceled.
+//
+// Inputs:
+//   - ctx: The context bounding the wait for room in the queue.
+//   - data: The payload of the message.
+//   - attributes: The attributes of the message; may be nil.
+//
+// Outputs:
+//   - string: The ID of the message.
+//   - error: An error if the context is canceled or the queue is closed.
+func (s *ChannelSource) Publish(ctx context.Context, data []byte, attributes map[string]string) (string, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return "", fmt.Errorf("queue %s is closed", s.name)
+	}
+	s.nextID++
+	id := strconv.FormatInt(s.nextID, 10)
+	s.mu.Unlock()
+
+	msg := &Message{ID: id, Data: data, Attributes: attributes, DeliveryAttempt: 1, PublishTime: time.Now()}
+	select {
+	case s.queue <- msg:
+		return id, nil
+	case <-s.done:
+		return "", fmt.Errorf("queue %s is closed", s.name)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// SetFlowControl sets the number of handler workers from `num_goroutines`.
+// The outstanding limits are enforced by the listener.
+func (s *ChannelSource) SetFlowControl(fc FlowControl) {
+	s.workers = fc.NumGoroutines
+}
+
+// Receive delivers the queued messages until the context is canceled.
+func (s *ChannelSource) Receive(ctx context.Context, handler func(context.Context, *Message)) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if s.workers > 0 {
+		for range s.workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.receive(ctx, func(msg *Message) { s.deliver(ctx, msg, handler) })
+			}()
+		}
+		return nil
+	}
+	s.receive(ctx, func(msg *Message) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.deliver(ctx, msg, handler)
+		}()
+	})
+	return nil
+}
+
+// receive leases the queued messages and dispatches them until the context is
+// canceled or the queue is closed.
+func (s *ChannelSource) receive(ctx context.Context, dispatch func(*Message)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case msg := <-s.queue:
+			s.lease(msg)
+			dispatch(msg)
+		}
+	}
+}
+
+// deliver runs the handler of a leased message.
+func (s *ChannelSource) deliver(ctx context.Context, msg *Message, handler func(context.Context, *Message)) {
+	handler(ctx, msg)
+	s.startDeadline(msg)
+}
+
+// lease records a delivery whose handler is running.
+func (s *ChannelSource) lease(msg *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leases[msg] = nil
+}
+
+// startDeadline starts the deadline timer of a delivery that is still
+// unsettled after its handler returned.
+func (s *ChannelSource) startDeadline(msg *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if timer, ok := s.leases[msg]; ok && timer == nil {
+		s.leases[msg] = time.AfterFunc(s.deadline, func() {
+			if s.release(msg) {
+				s.redeliver(msg)
+			}
+		})
+	}
+}
+
+// release ends the lease of a delivery. It returns false if the delivery was
+// already settled or expired.
+func (s *ChannelSource) release(msg *Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	timer, ok := s.leases[msg]
+	if !ok {
+		return false
+	}
+	if timer != nil {
+		timer.Stop()
+	}
+	delete(s.leases, msg)
+	return true
+}
+
+// redeliver queues the next delivery attempt of a message. It does not block
+// the caller, since it is also called from timers and handlers.
+func (s *ChannelSource) redeliver(msg *Message) {
+	next := *msg
+	next.DeliveryAttempt++
+	go func() {
+		select {
+		case s.queue <- &next:
+		case <-s.done:
+		}
+	}()
+}
+
+// Ack ends the lease of the delivery; the message is not delivered again.
+func (s *ChannelSource) Ack(msg *Message) {
+	s.release(msg)
+}
+
+// Nack ends the lease of the delivery and queues the message again.
+func (s *ChannelSource) Nack(msg *Message) {
+	if s.release(msg) {
+		s.redeliver(msg)
+	}
+}
+
+// ExtendDeadline restarts the lease timer of the delivery with the extension.
+// It has no effect while the handler runs, since the lease is held anyway.
+func (s *ChannelSource) ExtendDeadline(msg *Message, extension time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	timer, ok := s.leases[msg]
+	if !ok {
+		return fmt.Errorf("message %s: %w", msg.ID, ErrMessageNotLeased)
+	}
+	if timer != nil {
+		timer.Reset(extension)
+	}
+	return nil
+}
+
+// Close stops Receive and drops the messages that wait for redelivery.
+func (s *ChannelSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+		for msg, timer := range s.leases {
+			if timer != nil {
+				timer.Stop()
+			}
+			delete(s.leases, msg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,462 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines `CircuitBreaker`, which stops calling an external service
+// that is down, so that an outage fails fast instead of sending every message
+// through the full chain and its retries.
+//
+// Logic Flow:
+//  1. `NewCloudServiceClients` creates one breaker per external service
+//     ("vertex-ai", "openai" and "repository"), configured by
+//     `[circuit_breaker]`, and wraps the agent models, the embedders and the
+//     media repository that use it.
+//  2. Closed: calls go through. `failure_threshold` consecutive outage
+//     failures (server and network errors; not quota, invalid or missing
+//     requests) open the circuit.
+//  3. Open: calls fail at once with a `CircuitOpenError`. The listeners stop
+//     taking messages until the circuit leaves this state; a chain that hits
+//     an open circuit is Nack'd without counting as a failed attempt.
+//  4. Half-open: after `open_timeout_seconds`, a single call is let through
+//     as a probe. Its success closes the circuit; its failure opens it again.
+//  5. The state of every breaker is exported as the `circuit_breaker.state`
+//     gauge (0 closed, 1 half-open, 2 open) and served by `/health`.
+//
+// Structs:
+//   - CircuitBreaker: The breaker of an external service.
+//   - CircuitOpenError: The error of a call refused by an open circuit.
+//   - CircuitBreakerStatus: A snapshot of the state of a breaker.
+//   - BreakerModel, BreakerEmbedder, BreakerRepository: Decorators calling
+//     through a breaker.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// CircuitState is the state of a circuit breaker.
+type CircuitState int
+
+// The states of a circuit breaker, in the order of the `circuit_breaker.state` gauge.
+const (
+	CircuitClosed   CircuitState = iota // Calls go through.
+	CircuitHalfOpen                     // A single probe call goes through.
+	CircuitOpen                         // Calls are refused.
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// ErrCircuitOpen is matched by the errors of calls refused by an open circuit.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// CircuitOpenError is returned for a call refused by an open circuit.
+type CircuitOpenError struct {
+	Breaker    string        // The name of the breaker.
+	RetryAfter time.Duration // The time until the circuit lets a probe through.
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker %s is open; retry in %s", e.Breaker, e.RetryAfter.Round(time.Second))
+}
+
+// Is matches ErrCircuitOpen.
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// Retryable reports that the call is not worth retrying at once: a retry is
+// refused too until the circuit lets a probe through. The listener redelivers
+// the message instead, without counting the attempt.
+func (e *CircuitOpenError) Retryable() bool {
+	return false
+}
+
+// CircuitBreaker guards the calls to an external service.
+type CircuitBreaker struct {
+	name             string
+	failureThreshold int              // The consecutive failures that open the circuit.
+	openTimeout      time.Duration    // The time the circuit stays open before a probe.
+	isFailure        func(error) bool // Whether an error is an outage of the service.
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int           // The consecutive failures while closed.
+	openedAt time.Time     // When the circuit last opened.
+	probing  bool          // Whether the half-open probe is running.
+	changed  chan struct{} // Closed, and replaced, on every state change.
+}
+
+// NewCircuitBreaker creates a closed breaker and registers its gauge.
+//
+// Inputs:
+//   - name: The name of the guarded service (e.g., "vertex-ai").
+//   - failureThreshold: The consecutive failures that open the circuit.
+//   - openTimeout: The time the circuit stays open before a probe.
+//   - isFailure: Whether an error is an outage of the service.
+//
+// Outputs:
+//   - *CircuitBreaker: A pointer to the new breaker, or nil (never open) if
+//     failureThreshold is zero or negative.
+func NewCircuitBreaker(name string, failureThreshold int, openTimeout time.Duration, isFailure func(error) bool) *CircuitBreaker {
+	if failureThreshold <= 0 {
+		return nil
+	}
+	b := &CircuitBreaker{
+		name:             name,
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		isFailure:        isFailure,
+		changed:          make(chan struct{}),
+	}
+	b.registerMetrics()
+	return b
+}
+
+// Name returns the name of the guarded service.
+func (b *CircuitBreaker) Name() string {
+	return b.name
+}
+
+// setState changes the state and wakes up the waiters. Must hold mu.
+func (b *CircuitBreaker) setState(state CircuitState) {
+	if b.state == state {
+		return
+	}
+	log.Printf("circuit breaker %s: %s -> %s", b.name, b.state, state)
+	b.state = state
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// current returns the state, moving an open circuit whose timeout expired to
+// half-open. Must hold mu.
+func (b *CircuitBreaker) current(now time.Time) CircuitState {
+	if b.state == CircuitOpen && !now.Before(b.openedAt.Add(b.openTimeout)) {
+		b.setState(CircuitHalfOpen)
+	}
+	return b.state
+}
+
+// Allow reports whether a call may go through now. Every allowed call must be
+// followed by a Record of its outcome.
+//
+// Outputs:
+//   - error: A *CircuitOpenError if the circuit is open, or half-open with its probe running.
+func (b *CircuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.current(now) {
+	case CircuitClosed:
+		return nil
+	case CircuitHalfOpen:
+		if !b.probing {
+			b.probing = true
+			return nil
+		}
+		return &CircuitOpenError{Breaker: b.name}
+	default:
+		return &CircuitOpenError{Breaker: b.name, RetryAfter: b.openedAt.Add(b.openTimeout).Sub(now)}
+	}
+}
+
+// Record records the outcome of an allowed call.
+//
+// Inputs:
+//   - err: The error of the call; nil on success.
+func (b *CircuitBreaker) Record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probe := b.state == CircuitHalfOpen && b.probing
+	if probe {
+		b.probing = false
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The caller gave up; the call says nothing about the service.
+	case err != nil && b.isFailure(err):
+		b.failures++
+		if probe || (b.state == CircuitClosed && b.failures >= b.failureThreshold) {
+			b.openedAt = time.Now()
+			b.setState(CircuitOpen)
+		}
+	default:
+		b.failures = 0
+		if probe {
+			b.setState(CircuitClosed)
+		}
+	}
+}
+
+// refusing reports whether a call would be refused now: the circuit is open,
+// or half-open with its probe running.
+func (b *CircuitBreaker) refusing() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.refusingLocked(time.Now())
+}
+
+// refusingLocked is refusing. Must hold mu.
+func (b *CircuitBreaker) refusingLocked(now time.Time) bool {
+	state := b.current(now)
+	return state == CircuitOpen || (state == CircuitHalfOpen && b.probing)
+}
+
+// Wait blocks while the circuit refuses calls, or until the context is canceled.
+//
+// Inputs:
+//   - ctx: The context bounding the wait.
+//
+// Outputs:
+//   - error: The error of the context if it was canceled first.
+func (b *CircuitBreaker) Wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		if !b.refusingLocked(now) {
+			b.mu.Unlock()
+			return nil
+		}
+		state := b.state
+		changed := b.changed
+		wait := time.Hour // Half-open: until the probe settles.
+		if state == CircuitOpen {
+			wait = b.openedAt.Add(b.openTimeout).Sub(now)
+		}
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// CircuitBreakerStatus is a snapshot of the state of a breaker.
+type CircuitBreakerStatus struct {
+	Name     string     `json:"name"`
+	State    string     `json:"state"`               // "closed", "half-open" or "open".
+	Failures int        `json:"failures"`            // The consecutive failures while closed.
+	OpenedAt *time.Time `json:"opened_at,omitempty"` // When the circuit opened; set unless closed.
+}
+
+// Status returns a snapshot of the state of the breaker.
+func (b *CircuitBreaker) Status() CircuitBreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.current(time.Now())
+	out := CircuitBreakerStatus{Name: b.name, State: state.String(), Failures: b.failures}
+	if state != CircuitClosed {
+		openedAt := b.openedAt
+		out.OpenedAt = &openedAt
+	}
+	return out
+}
+
+// registerMetrics exports the state as the `circuit_breaker.state` gauge.
+func (b *CircuitBreaker) registerMetrics() {
+	meter := otel.Meter("github.com/GoogleCloudPlatform/solutions/media")
+	gauge, err := meter.Int64ObservableGauge("circuit_breaker.state",
+		metric.WithDescription("The state of a circuit breaker: 0 closed, 1 half-open, 2 open."),
+		metric.WithInt64Callback(func(_ context.Context, observer metric.Int64Observer) error {
+			b.mu.Lock()
+			state := b.current(time.Now())
+			b.mu.Unlock()
+			observer.Observe(int64(state), metric.WithAttributes(attribute.String("breaker", b.name)))
+			return nil
+		}))
+	if err != nil || gauge == nil {
+		log.Printf("error creating circuit breaker gauge for %s: %v\n", b.name, err)
+	}
+}
+
+// call runs a call through the breaker.
+func call[T any](b *CircuitBreaker, fn func() (T, error)) (T, error) {
+	if err := b.Allow(); err != nil {
+		var zero T
+		return zero, err
+	}
+	out, err := fn()
+	b.Record(err)
+	return out, err
+}
+
+// IsServiceOutage reports whether the error of a model or embedder call is an
+// outage of the service: a server or network error, but not an exceeded
+// quota or a rejected request.
+func IsServiceOutage(err error) bool {
+	var genErr *GenerationError
+	return errors.As(ClassifyGenerationError("", err), &genErr) && genErr.Kind == GenerationTransient
+}
+
+// IsRepositoryOutage reports whether the error of a repository call is an
+// outage of the store: any error other than a missing media object or scene.
+func IsRepositoryOutage(err error) bool {
+	return !errors.Is(err, ErrMediaNotFound)
+}
+
+// BreakerModel is a GenerativeModel calling through a circuit breaker.
+type BreakerModel struct {
+	GenerativeModel
+	breaker *CircuitBreaker
+}
+
+// NewBreakerModel wraps a model with a breaker.
+//
+// Inputs:
+//   - model: The model to wrap.
+//   - breaker: The breaker of its service; nil returns the model itself.
+//
+// Outputs:
+//   - GenerativeModel: The wrapped model.
+func NewBreakerModel(model GenerativeModel, breaker *CircuitBreaker) GenerativeModel {
+	if breaker == nil {
+		return model
+	}
+	return &BreakerModel{GenerativeModel: model, breaker: breaker}
+}
+
+// Generate sends the request unless the circuit is open.
+func (m *BreakerModel) Generate(ctx context.Context, request *GenerationRequest) (*GenerationResponse, error) {
+	return call(m.breaker, func() (*GenerationResponse, error) { return m.GenerativeModel.Generate(ctx, request) })
+}
+
+// BreakerEmbedder is an Embedder calling through a circuit breaker.
+type BreakerEmbedder struct {
+	Embedder
+	breaker *CircuitBreaker
+}
+
+// NewBreakerEmbedder wraps an embedder with a breaker.
+//
+// Inputs:
+//   - embedder: The embedder to wrap.
+//   - breaker: The breaker of its service; nil returns the embedder itself.
+//
+// Outputs:
+//   - Embedder: The wrapped embedder.
+func NewBreakerEmbedder(embedder Embedder, breaker *CircuitBreaker) Embedder {
+	if breaker == nil {
+		return embedder
+	}
+	return &BreakerEmbedder{Embedder: embedder, breaker: breaker}
+}
+
+// Embed embeds the texts unless the circuit is open.
+func (e *BreakerEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	return call(e.breaker, func() ([][]float64, error) { return e.Embedder.Embed(ctx, texts) })
+}
+
+// BreakerRepository is a MediaRepository calling through a circuit breaker.
+type BreakerRepository struct {
+	repository MediaRepository
+	breaker    *CircuitBreaker
+}
+
+// NewBreakerRepository wraps a repository with a breaker.
+//
+// Inputs:
+//   - repository: The repository to wrap.
+//   - breaker: The breaker of its store; nil returns the repository itself.
+//
+// Outputs:
+//   - MediaRepository: The wrapped repository.
+func NewBreakerRepository(repository MediaRepository, breaker *CircuitBreaker) MediaRepository {
+	if breaker == nil {
+		return repository
+	}
+	return &BreakerRepository{repository: repository, breaker: breaker}
+}
+
+func (r *BreakerRepository) SaveMedia(ctx context.Context, media *model.Media) error {
+	_, err := call(r.breaker, func() (any, error) { return nil, r.repository.SaveMedia(ctx, media) })
+	return err
+}
+
+func (r *BreakerRepository) DeleteMedia(ctx context.Context, id string) error {
+	_, err := call(r.breaker, func() (any, error) { return nil, r.repository.DeleteMedia(ctx, id) })
+	return err
+}
+
+func (r *BreakerRepository) GetMedia(ctx context.Context, id string) (*model.Media, error) {
+	return call(r.breaker, func() (*model.Media, error) { return r.repository.GetMedia(ctx, id) })
+}
+
+func (r *BreakerRepository) GetScene(ctx context.Context, id string, sequence int) (*model.Scene, error) {
+	return call(r.breaker, func() (*model.Scene, error) { return r.repository.GetScene(ctx, id, sequence) })
+}
+
+func (r *BreakerRepository) ListUnembeddedMedia(ctx context.Context) ([]*model.Media, error) {
+	return call(r.breaker, func() ([]*model.Media, error) { return r.repository.ListUnembeddedMedia(ctx) })
+}
+
+func (r *BreakerRepository) SaveEmbeddings(ctx context.Context, embeddings []*model.SceneEmbedding) error {
+	_, err := call(r.breaker, func() (any, error) { return nil, r.repository.SaveEmbeddings(ctx, embeddings) })
+	return err
+}
+
+func (r *BreakerRepository) FindScenes(ctx context.Context, vector []float64, limit int) ([]*model.SceneMatchResult, error) {
+	return call(r.breaker, func() ([]*model.SceneMatchResult, error) { return r.repository.FindScenes(ctx, vector, limit) })
+}
+
+func (r *BreakerRepository) RecordUsage(ctx context.Context, record *model.UsageRecord) error {
+	_, err := call(r.breaker, func() (any, error) { return nil, r.repository.RecordUsage(ctx, record) })
+	return err
+}
+
+func (r *BreakerRepository) SumUsage(ctx context.Context, since time.Time) (*model.TokenUsage, error) {
+	return call(r.breaker, func() (*model.TokenUsage, error) { return r.repository.SumUsage(ctx, since) })
+}
+
+// Close closes the wrapped repository, if it holds resources.
+func (r *BreakerRepository) Close() error {
+	if closer, ok := r.repository.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -22,12 +22,19 @@
 //
 // Structs:
 //   - BigQueryDataSource: Configuration for BigQuery dataset and tables.
+//   - MetadataStore: Selects the media repository backend (BigQuery or SQLite).
 //   - PromptTemplates: Holds the text templates for prompts sent to GenAI models.
 //   - VertexAiEmbeddingModel: Configuration for a Vertex AI embedding model.
 //   - VertexAiLLMModel: Configuration for a Vertex AI Large Language Model (LLM).
-//   - TopicSubscription: Configuration for a single Pub/Sub topic subscription.
-//   - Storage: Configuration for Google Cloud Storage buckets.
+//   - ModelQuota: The per-minute quotas of a model, shared by the agent models using it.
+//   - ModelPricing: The price of the tokens of a model, used to estimate what indexing a media file cost.
+//   - CircuitBreakerConfig: The thresholds of the circuit breakers of the external services.
+//   - BudgetConfig: The spend budgets of ingestion, and where over-budget messages wait.
+//   - TopicSubscription: Configuration for a single listener's message source.
+//   - Storage: Configuration for the storage buckets and backend (GCS or local).
 //   - Category: Defines a media category and its associated LLM overrides.
+//   - WorkflowStep: Declares a single command of a declarative workflow.
+//   - WorkflowDefinition: Declares the ordered steps of a workflow.
 //   - Config: The top-level struct that aggregates all other configuration structs.
 //
 // Functions:
@@ -65,6 +72,15 @@ type BigQueryDataSource struct {
 	DatasetName    string `toml:"dataset"`         // The name of the BigQuery dataset.
 	MediaTable     string `toml:"media_table"`     // The name of the BigQuery table containing media information.
 	EmbeddingTable string `toml:"embedding_table"` // The name of the BigQuery table containing embedding vectors.
+	UsageTable     string `toml:"usage_table"`     // The name of the BigQuery table containing the usage records of the budgets.
+	TombstoneTable string `toml:"tombstone_table"` // The name of the BigQuery table marking deleted media; empty to delete with DML only.
+}
+
+// MetadataStore selects the backend of the media repository.
+type MetadataStore struct {
+	Backend      string `toml:"backend"`       // The metadata backend, "bigquery" (default) or "sqlite".
+	SQLitePath   string `toml:"sqlite_path"`   // The database file for the sqlite backend.
+	DistanceType string `toml:"distance_type"` // The vector search distance, "EUCLIDEAN" (default) or "COSINE".
 }
 
 // PromptTemplates holds the templates for different types of prompts.
@@ -73,13 +89,20 @@ type PromptTemplates struct {
 	ScenePrompt   string `toml:"scene"`   // The template for generating scene descriptions.
 }
 
-// VertexAiEmbeddingModel represents the configuration for a Vertex AI embedding model.
+// VertexAiEmbeddingModel represents the configuration for an embedding model. Despite
+// the name, the model can also be served by an OpenAI-compatible API or computed
+// locally (see `provider`).
 type VertexAiEmbeddingModel struct {
-	Model                string `toml:"model"`                   // The name of the Vertex AI embedding model.
-	MaxRequestsPerMinute int    `toml:"max_requests_per_minute"` // The maximum number of requests allowed per minute.
+	Model                string `toml:"model"`                   // The name of the embedding model.
+	MaxRequestsPerMinute int    `toml:"max_requests_per_minute"` // The maximum number of requests allowed per minute; unlimited if zero.
+	Provider             string `toml:"provider"`                // The model provider: "vertex" (default), "openai" or "hashing".
+	Endpoint             string `toml:"endpoint"`                // The base URL of an OpenAI-compatible API (e.g., "http://localhost:8000/v1").
+	APIKeyEnv            string `toml:"api_key_env"`             // The environment variable holding the API key of an OpenAI-compatible API.
+	Dimension            int    `toml:"dimension"`               // The length of the vectors; learned from the first embedding if zero.
 }
 
-// VertexAiLLMModel represents the configuration for a Vertex AI large language model (LLM).
+// VertexAiLLMModel represents the configuration for a large language model (LLM). Despite
+// the name, the model can also be served by an OpenAI-compatible API or faked (see `provider`).
 type VertexAiLLMModel struct {
 	Model              string  `toml:"model"`               // The name of the Vertex AI LLM.
 	SystemInstructions string  `toml:"system_instructions"` // The system instructions for the LLM.
@@ -89,20 +112,83 @@ type VertexAiLLMModel struct {
 	MaxTokens          int32   `toml:"max_tokens"`          // The maximum number of tokens for the LLM output.
 	OutputFormat       string  `toml:"output_format"`       // The desired output format for the LLM.
 	EnableGoogle       bool    `toml:"enable_google"`       // Whether to enable Google Search for the LLM.
-	RateLimit          int     `toml:"rate_limit"`          // The rate limit for the LLM in requests per second.
+	Provider           string  `toml:"provider"`            // The model provider: "vertex" (default), "openai" or "fake".
+	Endpoint           string  `toml:"endpoint"`            // The base URL of an OpenAI-compatible API (e.g., "http://localhost:8000/v1").
+	APIKeyEnv          string  `toml:"api_key_env"`         // The environment variable holding the API key of an OpenAI-compatible API.
+	FixtureDir         string  `toml:"fixture_dir"`         // The directory of response fixtures for the fake provider.
+}
+
+// ModelQuota represents the per-minute quotas of a model (see quota.go). Zero is unlimited.
+type ModelQuota struct {
+	RequestsPerMinute     int `toml:"requests_per_minute" json:"requests_per_minute"`           // The requests sent per minute.
+	InputTokensPerMinute  int `toml:"input_tokens_per_minute" json:"input_tokens_per_minute"`   // The input tokens, media included, sent per minute.
+	OutputTokensPerMinute int `toml:"output_tokens_per_minute" json:"output_tokens_per_minute"` // The output tokens generated per minute.
+}
+
+// ModelPricing represents the price of the tokens of a model (see pricing.go).
+type ModelPricing struct {
+	InputPerMillionTokens  float64 `toml:"input_per_million_tokens" json:"input_per_million_tokens"`   // The price of a million prompt tokens, media included, in USD.
+	OutputPerMillionTokens float64 `toml:"output_per_million_tokens" json:"output_per_million_tokens"` // The price of a million candidate tokens, in USD.
+}
+
+// CircuitBreakerConfig represents the thresholds of the circuit breakers of the
+// external services (see circuit_breaker.go).
+type CircuitBreakerConfig struct {
+	FailureThreshold   int `toml:"failure_threshold"`    // The consecutive outage failures that open a circuit; no breakers if zero.
+	OpenTimeoutSeconds int `toml:"open_timeout_seconds"` // The time an open circuit waits before a probe, in seconds; 30 if zero.
+}
+
+// BudgetConfig represents the spend budgets of ingestion (see budget.go). Tokens
+// are input and output tokens together; costs are estimated from the model
+// pricing. Zero is unlimited.
+type BudgetConfig struct {
+	DailyMaxCost         float64   `toml:"daily_max_cost" json:"daily_max_cost"`                 // The estimated cost of a UTC day, in USD.
+	DailyMaxTokens       int       `toml:"daily_max_tokens" json:"daily_max_tokens"`             // The tokens of a UTC day.
+	MonthlyMaxCost       float64   `toml:"monthly_max_cost" json:"monthly_max_cost"`             // The estimated cost of a UTC month, in USD.
+	MonthlyMaxTokens     int       `toml:"monthly_max_tokens" json:"monthly_max_tokens"`         // The tokens of a UTC month.
+	PerMediaMaxCost      float64   `toml:"per_media_max_cost" json:"per_media_max_cost"`         // The estimated cost of indexing one media file, in USD.
+	PerMediaMaxTokens    int       `toml:"per_media_max_tokens" json:"per_media_max_tokens"`     // The tokens of indexing one media file.
+	AlertThresholds      []float64 `toml:"alert_thresholds" json:"alert_thresholds"`             // The fractions of the daily and monthly budgets that raise an alert; 0.5, 0.8 and 1 if empty.
+	DeferredDir          string    `toml:"deferred_dir" json:"deferred_dir"`                     // Directory for the messages deferred until the budgets allow them; empty leaves them with their source.
+	RetryIntervalSeconds int       `toml:"retry_interval_seconds" json:"retry_interval_seconds"` // The interval between replays of the deferred messages, in seconds; 300 if zero.
 }
 
-// TopicSubscription represents the configuration for a Pub/Sub topic subscription.
+// TopicSubscription represents the configuration for a listener's message
+// source: a Pub/Sub subscription by default, or an in-process queue or a
+// watched local directory.
 type TopicSubscription struct {
-	Name             string `toml:"name"`               // The name of the Pub/Sub subscription.
-	DeadLetterTopic  string `toml:"dead_letter_topic"`  // The name of the dead-letter topic for the subscription.
-	TimeoutInSeconds int    `toml:"timeout_in_seconds"` // The timeout for the subscription in seconds.
+	Name                string `toml:"name"`                  // The name of the Pub/Sub subscription.
+	DeadLetterTopic     string `toml:"dead_letter_topic"`     // The Pub/Sub topic failed messages are published to after their last attempt; optional.
+	MaxDeliveryAttempts int    `toml:"max_delivery_attempts"` // The delivery attempts before a failing message is dead-lettered; 5 if zero, never if negative.
+	TimeoutInSeconds    int    `toml:"timeout_in_seconds"`    // The acknowledgement deadline of a message, in seconds.
+	Source              string `toml:"source"`                // The message source: "pubsub" (default), "channel" or "directory".
+	Workflow            string `toml:"workflow"`              // The workflow run for each message (e.g., "media-resize").
+	Bucket              string `toml:"bucket"`                // The bucket reported by a directory source.
+	WatchDir            string `toml:"watch_dir"`             // The directory watched by a directory source; defaults to storage.local_root/bucket.
+	PollIntervalSeconds int    `toml:"poll_interval_seconds"` // The poll interval of a directory source, in seconds.
+
+	MaxOutstandingMessages int `toml:"max_outstanding_messages"` // The messages processed at once; unlimited if zero.
+	MaxOutstandingBytes    int `toml:"max_outstanding_bytes"`    // The bytes (of media, for storage notifications) processed at once; unlimited if zero.
+	NumGoroutines          int `toml:"num_goroutines"`           // The Pub/Sub streaming pulls, or the handler workers of a local source; the source's default if zero.
+}
+
+// FlowControl returns the flow control settings of the subscription.
+func (s TopicSubscription) FlowControl() FlowControl {
+	return FlowControl{
+		MaxOutstandingMessages: s.MaxOutstandingMessages,
+		MaxOutstandingBytes:    s.MaxOutstandingBytes,
+		NumGoroutines:          s.NumGoroutines,
+	}
 }
 
-// Storage represents the configuration for storage buckets.
+// Storage represents the configuration for storage buckets and the backend that holds them.
 type Storage struct {
 	HiResInputBucket   string `toml:"high_res_input_bucket"` // The name of the bucket for high-resolution input files.
 	LowResOutputBucket string `toml:"low_res_output_bucket"` // The name of the bucket for low-resolution output files.
+	Backend            string `toml:"backend"`               // The storage backend, "gcs" (default) or "local".
+	LocalRoot          string `toml:"local_root"`            // The directory holding one directory per bucket for the local backend.
+	PublicURL          string `toml:"public_url"`            // The base URL of this server, used for local signed URLs.
+	SigningKey         string `toml:"signing_key"`           // The HMAC key for local signed URLs; random per process if empty.
 }
 
 // Category defines a specific type of media and allows for overriding LLM behaviors
@@ -115,6 +201,24 @@ type Category struct {
 	Scene              string `toml:"scene"`               // Optional override for the scene extraction prompt template.
 }
 
+// WorkflowStep declares one command in a declarative workflow. The command is
+// looked up by type in the workflow package's command registry.
+type WorkflowStep struct {
+	Name          string                 `toml:"name"`           // The unique name of the step, used for tracing, metrics and checkpoints.
+	Command       string                 `toml:"command"`        // The registered command type (e.g., "gcs-to-temp-file").
+	Input         string                 `toml:"input"`          // Optional context key for the primary input; defaults to the piped input.
+	Output        string                 `toml:"output"`         // Optional context key for the primary output; defaults to the piped output.
+	RetryAttempts int                    `toml:"retry_attempts"` // When greater than 1, the step is retried with the default backoff policy.
+	Params        map[string]interface{} `toml:"params"`         // Command specific parameters (e.g., "agent_model", "workers").
+}
+
+// WorkflowDefinition declares the ordered steps of a workflow. It replaces the
+// Go wiring of the workflow with the same name.
+type WorkflowDefinition struct {
+	ContinueOnFailure bool           `toml:"continue_on_failure"` // Whether the chain keeps going after a failed step.
+	Steps             []WorkflowStep `toml:"steps"`               // The steps, in execution order.
+}
+
 // Config represents the overall configuration for the application, loaded from TOML files.
 // It acts as the root container for all other configuration structs.
 type Config struct {
@@ -126,14 +230,28 @@ type Config struct {
 		GoogleAPIKey              string `toml:"google_api_key"`               // The Google Cloud API key.
 		ThreadPoolSize            int    `toml:"thread_pool_size"`             // The size of the worker pool for parallel processing tasks.
 		SignerServiceAccountEmail string `toml:"signer_service_account_email"` // The service account email used for signing GCS URLs.
+		CheckpointDir             string `toml:"checkpoint_dir"`               // Directory for workflow checkpoints; empty disables resumable runs.
+		DryRun                    bool   `toml:"dry_run"`                      // If true, workflows log an execution plan instead of running their commands, and each listener stops after its first plan.
+		EmbeddingIntervalSeconds  int    `toml:"embedding_interval_seconds"`   // The interval between runs of the embedding generator, in seconds; 60 if zero.
+		DeadLetterDir             string `toml:"dead_letter_dir"`              // Directory for the dead letters listed and replayed by the admin API; empty disables it.
+		AdminTokenEnv             string `toml:"admin_token_env"`              // The environment variable holding the bearer token of the admin API; the admin API is disabled if empty or unset.
+		MaxConcurrentFFmpeg       int    `toml:"max_concurrent_ffmpeg"`        // The FFmpeg processes running at once across workflows; unlimited if zero.
+		MaxConcurrentIngestions   int    `toml:"max_concurrent_ingestions"`    // The model requests with media running at once across workflows; unlimited if zero.
+		ShutdownTimeoutSeconds    int    `toml:"shutdown_timeout_seconds"`     // The time given to running workflows to finish on shutdown, in seconds; 30 if zero.
 	} `toml:"application"`
 	Storage            Storage                           `toml:"storage"`               // Storage configuration.
 	BigQueryDataSource BigQueryDataSource                `toml:"big_query_data_source"` // BigQuery data source configuration.
+	MetadataStore      MetadataStore                     `toml:"metadata_store"`        // Media repository backend configuration.
 	PromptTemplates    PromptTemplates                   `toml:"prompt_templates"`      // Prompt templates configuration.
 	TopicSubscriptions map[string]TopicSubscription      `toml:"topic_subscriptions"`   // A map of Pub/Sub topic subscriptions, keyed by a logical name (e.g., "HiResTopic").
 	EmbeddingModels    map[string]VertexAiEmbeddingModel `toml:"embedding_models"`      // A map of Vertex AI embedding models, keyed by a logical name (e.g., "multi-lingual").
 	AgentModels        map[string]VertexAiLLMModel       `toml:"agent_models"`          // A map of Vertex AI LLM models, keyed by a logical name (e.g., "creative-flash").
+	ModelQuotas        map[string]ModelQuota             `toml:"model_quotas"`          // The quotas of the models, keyed by model name (e.g., "gemini-2.5-pro").
+	ModelPricing       map[string]ModelPricing           `toml:"model_pricing"`         // The prices of the models' tokens, keyed by model name (e.g., "gemini-2.5-pro").
+	CircuitBreaker     CircuitBreakerConfig              `toml:"circuit_breaker"`       // The circuit breakers of the external services.
+	Budget             BudgetConfig                      `toml:"budget"`                // The spend budgets of ingestion.
 	Categories         map[string]Category               `toml:"categories"`            // A map of media categories, keyed by a logical name (e.g., "trailer").
+	Workflows          map[string]WorkflowDefinition     `toml:"workflows"`             // Declarative workflow definitions, keyed by workflow name (e.g., "media-reader").
 }
 
 // NewConfig is a constructor function that creates a new, initialized Config instance.
@@ -147,6 +265,9 @@ func NewConfig() *Config {
 		TopicSubscriptions: make(map[string]TopicSubscription),
 		EmbeddingModels:    make(map[string]VertexAiEmbeddingModel),
 		AgentModels:        make(map[string]VertexAiLLMModel),
+		ModelQuotas:        make(map[string]ModelQuota),
+		ModelPricing:       make(map[string]ModelPricing),
 		Categories:         make(map[string]Category),
+		Workflows:          make(map[string]WorkflowDefinition),
 	}
 }
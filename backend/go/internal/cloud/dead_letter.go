@@ -0,0 +1,280 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines dead letters: the messages a listener gives up on after
+// their last delivery attempt, together with the errors of the failing commands.
+//
+// Logic Flow:
+//  1. A listener's `DeadLetterPolicy` sets the number of delivery attempts
+//     after which a failing message is dead-lettered (`max_delivery_attempts`).
+//  2. A dead-lettered message is saved to the `DeadLetterStore`, from which
+//     the admin API lists it and replays it into the listener's workflow, and
+//     then published to the subscription's `dead_letter_topic`, with the
+//     failing commands and their errors as attributes. Saving first means a
+//     failed save never leaves a published letter behind to publish again.
+//  3. Once it is saved and published, the original message is acknowledged so
+//     that its source stops redelivering it.
+//
+// Structs:
+//   - DeadLetter: A message that was given up on, with the errors of its last attempt.
+//   - DeadLetterPolicy: When a listener gives up on a message, and where it goes.
+//   - FileDeadLetterStore: A DeadLetterStore keeping one JSON file per dead letter.
+package cloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// DefaultMaxDeliveryAttempts is the number of delivery attempts of a message
+// when a subscription does not set `max_delivery_attempts`; it matches the
+// default of Pub/Sub dead-letter policies.
+const DefaultMaxDeliveryAttempts = 5
+
+// Attributes added to the messages published to a dead-letter topic.
+const (
+	DeadLetterAttrListener        = "dead_letter_listener"         // The logical name of the listener.
+	DeadLetterAttrMessageID       = "dead_letter_message_id"       // The ID of the original message.
+	DeadLetterAttrDeliveryAttempt = "dead_letter_delivery_attempt" // The last delivery attempt.
+	DeadLetterAttrCommands        = "dead_letter_failed_commands"  // The comma-separated names of the failing commands.
+	DeadLetterAttrErrors          = "dead_letter_errors"           // The errors, as a JSON object keyed by command name.
+)
+
+// maxAttributeLength is the maximum length of a Pub/Sub attribute value.
+const maxAttributeLength = 1024
+
+// ErrDeadLetterNotFound is returned for an unknown dead letter ID.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is a message that a listener gave up on.
+type DeadLetter struct {
+	ID              string            `json:"id"`                   // A stable ID derived from the listener and message ID.
+	Listener        string            `json:"listener"`             // The logical name of the listener (e.g., "HiResTopic").
+	MessageID       string            `json:"message_id"`           // The ID of the original message.
+	Data            string            `json:"data"`                 // The payload of the original message.
+	Attributes      map[string]string `json:"attributes,omitempty"` // The attributes of the original message.
+	DeliveryAttempt int               `json:"delivery_attempt"`     // The last delivery attempt.
+	Errors          map[string]string `json:"errors"`               // The errors of the last attempt, keyed by failing command name.
+	Replays         int               `json:"replays"`              // The number of failed replays.
+	DeadLetteredAt  time.Time         `json:"dead_lettered_at"`     // When the message was last dead-lettered or replayed.
+}
+
+// NewDeadLetter creates the dead letter of a failed message.
+//
+// Inputs:
+//   - listener: The logical name of the listener.
+//   - msg: The failed message.
+//   - errs: The errors of the chain, keyed by command name.
+//
+// Outputs:
+//   - *DeadLetter: The new dead letter.
+func NewDeadLetter(listener string, msg *Message, errs map[string]error) *DeadLetter {
+	h := sha256.Sum256([]byte(listener + "/" + msg.ID))
+	return &DeadLetter{
+		ID:              hex.EncodeToString(h[:8]),
+		Listener:        listener,
+		MessageID:       msg.ID,
+		Data:            string(msg.Data),
+		Attributes:      msg.Attributes,
+		DeliveryAttempt: msg.DeliveryAttempt,
+		Errors:          ErrorStrings(errs),
+		DeadLetteredAt:  time.Now().UTC(),
+	}
+}
+
+// ErrorStrings converts the errors of a chain to their messages.
+func ErrorStrings(errs map[string]error) map[string]string {
+	out := make(map[string]string, len(errs))
+	for command, err := range errs {
+		out[command] = err.Error()
+	}
+	return out
+}
+
+// Commands returns the sorted names of the failing commands.
+func (d *DeadLetter) Commands() []string {
+	out := make([]string, 0, len(d.Errors))
+	for command := range d.Errors {
+		out = append(out, command)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// PubSubMessage builds the message published to a dead-letter topic: the
+// original payload and attributes, plus the dead-letter attributes.
+func (d *DeadLetter) PubSubMessage() *pubsub.Message {
+	attributes := make(map[string]string, len(d.Attributes)+5)
+	for k, v := range d.Attributes {
+		attributes[k] = v
+	}
+	errs, _ := json.Marshal(d.Errors)
+	attributes[DeadLetterAttrListener] = d.Listener
+	attributes[DeadLetterAttrMessageID] = d.MessageID
+	attributes[DeadLetterAttrDeliveryAttempt] = strconv.Itoa(d.DeliveryAttempt)
+	attributes[DeadLetterAttrCommands] = truncate(strings.Join(d.Commands(), ","), maxAttributeLength)
+	attributes[DeadLetterAttrErrors] = truncate(string(errs), maxAttributeLength)
+	return &pubsub.Message{Data: []byte(d.Data), Attributes: attributes}
+}
+
+// truncate shortens a string to at most limit bytes, without splitting a rune.
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit]
+}
+
+// DeadLetterPolicy decides when a listener gives up on a failing message, and
+// where the message goes.
+type DeadLetterPolicy struct {
+	Listener            string          // The logical name of the listener, recorded with its dead letters.
+	MaxDeliveryAttempts int             // The delivery attempts after which a failing message is dead-lettered.
+	Topic               *pubsub.Topic   // The topic dead letters are published to; may be nil.
+	Store               DeadLetterStore // The store dead letters are saved to for replay; may be nil.
+}
+
+// enabled reports whether the policy has somewhere to send dead letters.
+func (p *DeadLetterPolicy) enabled() bool {
+	return p != nil && p.MaxDeliveryAttempts > 0 && (p.Topic != nil || p.Store != nil)
+}
+
+// DeadLetterStore keeps dead letters until they are replayed or discarded.
+type DeadLetterStore interface {
+	// Save creates or replaces a dead letter.
+	Save(ctx context.Context, letter *DeadLetter) error
+	// List returns all dead letters, oldest first.
+	List(ctx context.Context) ([]*DeadLetter, error)
+	// Get returns a dead letter, or ErrDeadLetterNotFound.
+	Get(ctx context.Context, id string) (*DeadLetter, error)
+	// Delete removes a dead letter, or returns ErrDeadLetterNotFound.
+	Delete(ctx context.Context, id string) error
+}
+
+// FileDeadLetterStore keeps each dead letter in a `<id>.json` file of a directory.
+type FileDeadLetterStore struct {
+	dir string // The directory holding the files.
+}
+
+// NewFileDeadLetterStore creates a store in a directory, creating the directory if needed.
+//
+// Inputs:
+//   - dir: The directory holding the dead letters.
+//
+// Outputs:
+//   - *FileDeadLetterStore: A pointer to the new store.
+//   - error: An error if the directory cannot be created.
+func NewFileDeadLetterStore(dir string) (*FileDeadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterStore{dir: dir}, nil
+}
+
+// path returns the file of a dead letter, rejecting IDs that are not plain file names.
+func (s *FileDeadLetterStore) path(id string) (string, error) {
+	if len(id) == 0 || id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("%w: %q", ErrDeadLetterNotFound, id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+// Save writes the dead letter to a temporary file and renames it into place.
+func (s *FileDeadLetterStore) Save(_ context.Context, letter *DeadLetter) error {
+	p, err := s.path(letter.ID)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(letter, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// List reads every dead letter of the directory.
+func (s *FileDeadLetterStore) List(ctx context.Context) ([]*DeadLetter, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*DeadLetter, 0, len(files))
+	for _, file := range files {
+		letter, err := s.Get(ctx, strings.TrimSuffix(filepath.Base(file), ".json"))
+		if errors.Is(err, ErrDeadLetterNotFound) {
+			// Deleted since the directory was listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, letter)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DeadLetteredAt.Before(out[j].DeadLetteredAt) })
+	return out, nil
+}
+
+// Get reads a dead letter.
+func (s *FileDeadLetterStore) Get(_ context.Context, id string) (*DeadLetter, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var letter DeadLetter
+	if err := json.Unmarshal(content, &letter); err != nil {
+		return nil, fmt.Errorf("failed to parse dead letter %s: %w", p, err)
+	}
+	return &letter, nil
+}
+
+// Delete removes the file of a dead letter.
+func (s *FileDeadLetterStore) Delete(_ context.Context, id string) error {
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrDeadLetterNotFound, id)
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines `DeferralQueue`, which holds the messages refused because
+// a daily or monthly budget was spent (see budget.go) until the budget allows
+// them, rather than failing them.
+//
+// Logic Flow:
+//  1. A listener whose chain is refused by a spent budget saves the message to
+//     the queue, in the same form as a dead letter, and acknowledges it. The
+//     refusal does not count toward the message's dead-letter attempts.
+//  2. Every `retry_interval_seconds`, the queue checks the budgets. Once they
+//     allow it, it replays the deferred messages, oldest first, through the
+//     workflows of the listeners that received them.
+//  3. A replay that succeeds deletes the message. A replay refused by a budget
+//     again, or by an open circuit breaker, keeps it without counting an
+//     attempt, and ends the round. A replay that fails otherwise counts
+//     as a failed delivery under the listener's dead-letter policy: the message
+//     is dead-lettered once its attempts are used up, or if the failure is
+//     permanent, and is otherwise kept for the next round.
+//
+// Structs:
+//   - DeferralQueue: The messages waiting for the budgets.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+)
+
+// defaultDeferralInterval is the interval between replays of the deferred
+// messages when `retry_interval_seconds` is zero.
+const defaultDeferralInterval = 5 * time.Minute
+
+// DeferralQueue holds the messages refused by a spent budget.
+type DeferralQueue struct {
+	store     DeadLetterStore             // The deferred messages.
+	budgets   *BudgetManager              // The budgets checked before each round of replays.
+	listeners map[string]*MessageListener // The listeners replaying the messages, keyed by logical name.
+	interval  time.Duration               // The time between two rounds of replays.
+
+	stopOnce    sync.Once          // Guards the closing of closeTicker.
+	closeTicker chan struct{}      // Closed by Stop to end the timer; set by Start.
+	done        chan struct{}      // Closed when the timer goroutine returns; set by Start.
+	cancel      context.CancelFunc // Cancels the running round; set by Start.
+}
+
+// NewDeferralQueue creates the queue of the messages refused by a spent budget.
+//
+// Inputs:
+//   - config: The budgets, with the directory and replay interval of the queue.
+//   - budgets: The budgets; nil if they are disabled.
+//   - listeners: The listeners replaying the messages, keyed by logical name.
+//
+// Outputs:
+//   - *DeferralQueue: A pointer to the new queue, or nil if budgets are disabled or `deferred_dir` is not set.
+//   - error: An error if the directory cannot be created.
+func NewDeferralQueue(config BudgetConfig, budgets *BudgetManager, listeners map[string]*MessageListener) (*DeferralQueue, error) {
+	if budgets == nil || len(config.DeferredDir) == 0 {
+		return nil, nil
+	}
+	store, err := NewFileDeadLetterStore(config.DeferredDir)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(config.RetryIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultDeferralInterval
+	}
+	return &DeferralQueue{store: store, budgets: budgets, listeners: listeners, interval: interval}, nil
+}
+
+// Defer saves a message until the budgets allow it.
+//
+// Inputs:
+//   - ctx: The context of the message.
+//   - letter: The message, with the errors of its chain.
+//
+// Outputs:
+//   - error: An error if the message cannot be saved.
+func (q *DeferralQueue) Defer(ctx context.Context, letter *DeadLetter) error {
+	return q.store.Save(ctx, letter)
+}
+
+// List returns the deferred messages, oldest first.
+func (q *DeferralQueue) List(ctx context.Context) ([]*DeadLetter, error) {
+	return q.store.List(ctx)
+}
+
+// Start replays the deferred messages every interval until Stop is called.
+func (q *DeferralQueue) Start() {
+	ticker := time.NewTicker(q.interval)
+	q.closeTicker = make(chan struct{})
+	q.done = make(chan struct{})
+	var runCtx context.Context
+	runCtx, q.cancel = context.WithCancel(context.Background())
+
+	go func() {
+		defer close(q.done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := q.ReplayDeferred(runCtx); err != nil {
+					log.Printf("error replaying deferred messages: %v", err)
+				}
+			case <-q.closeTicker:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the timer started by Start and waits for the running round, if
+// any, to finish. If the context expires first, the round is canceled; the
+// message it was replaying stays deferred.
+//
+// Inputs:
+//   - ctx: The context bounding the wait for the running round.
+//
+// Outputs:
+//   - error: The context's error if the round had to be canceled.
+func (q *DeferralQueue) Stop(ctx context.Context) error {
+	if q.closeTicker == nil {
+		// Start was never called.
+		return nil
+	}
+	q.stopOnce.Do(func() { close(q.closeTicker) })
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-q.done
+		return ctx.Err()
+	}
+}
+
+// ReplayDeferred runs one round of replays: if the budgets allow it, the
+// deferred messages are replayed, oldest first, until one is refused by a
+// budget again or by an open circuit breaker.
+//
+// Inputs:
+//   - ctx: The context of the replays.
+//
+// Outputs:
+//   - int: The messages replayed successfully.
+//   - error: An error if the budgets or the queue cannot be read.
+func (q *DeferralQueue) ReplayDeferred(ctx context.Context) (int, error) {
+	if err := q.budgets.Check(ctx, model.TokenUsage{}); err != nil {
+		if errors.Is(err, ErrBudgetExceeded) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	letters, err := q.store.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for _, letter := range letters {
+		listener, ok := q.listeners[letter.Listener]
+		if !ok {
+			log.Printf("deferred message %s: unknown listener %q", letter.ID, letter.Listener)
+			continue
+		}
+		errs := listener.Replay(ctx, letter)
+		if ctx.Err() != nil {
+			return replayed, ctx.Err()
+		}
+		if len(errs) == 0 {
+			log.Printf("replayed deferred message %s", letter.ID)
+			replayed++
+			if err := q.store.Delete(ctx, letter.ID); err != nil {
+				return replayed, err
+			}
+			continue
+		}
+		letter.Errors = ErrorStrings(errs)
+		letter.DeadLetteredAt = time.Now().UTC()
+		if deferrable(errs) || circuitOpen(errs) {
+			// The budget is spent again, or a dependency is down; the rest
+			// wait for the next round, and the refusal is not an attempt.
+			return replayed, q.store.Save(ctx, letter)
+		}
+		if err := q.fail(ctx, listener, letter, errs); err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// fail settles a deferred message whose replay failed for another reason than
+// a budget, following the dead-letter policy of its listener.
+func (q *DeferralQueue) fail(ctx context.Context, listener *MessageListener, letter *DeadLetter, errs map[string]error) error {
+	letter.Replays++
+	letter.DeliveryAttempt++
+	policy := listener.DeadLetterPolicy()
+	if policy.enabled() && (letter.DeliveryAttempt >= policy.MaxDeliveryAttempts || permanent(errs)) {
+		if err := listener.sendDeadLetter(ctx, letter); err != nil {
+			log.Printf("failed to dead-letter deferred message %s: %v", letter.ID, err)
+		} else {
+			log.Printf("dead-lettered deferred message %s after %d attempts (permanent: %t)", letter.ID, letter.DeliveryAttempt, permanent(errs))
+			return q.store.Delete(ctx, letter.ID)
+		}
+	}
+	return q.store.Save(ctx, letter)
+}
+
+// deferrable reports whether a failure of the chain was a refusal by a spent
+// daily or monthly budget.
+func deferrable(errs map[string]error) bool {
+	for _, err := range errs {
+		var budgetErr *BudgetExceededError
+		if errors.As(err, &budgetErr) && budgetErr.Deferrable() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,393 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file implements `MessageSource` on a local directory: a file dropped
+// into the directory produces the same `GCSPubSubNotification` that a GCS
+// bucket publishes for a new object.
+//
+// Logic Flow:
+//  1. The directory is polled at a fixed interval. Files that exist when the
+//     source starts are delivered unless they were acknowledged before, in
+//     this generation; touching a file makes it new again.
+//  2. A new or changed file is delivered once its size and modification time
+//     have been stable for one interval, so that files still being copied
+//     are not picked up. Hidden files, including the temporary files of the
+//     local blob store, are ignored. Each delivery runs in its own goroutine,
+//     or, with `num_goroutines`, on a fixed pool of workers.
+//  3. The message is a JSON `GCSPubSubNotification` for the configured bucket
+//     with the file's path as the object name, its modification time as the
+//     generation and its content type, matching `LocalBlobStore`, plus the
+//     attributes of a GCS `OBJECT_FINALIZE` notification.
+//  4. `Ack` marks the file as done, and records its generation in a hidden
+//     marker file next to it, so that a restarted source does not deliver it
+//     again. `Nack`, or no answer within the acknowledgement deadline after
+//     the handler returned, delivers it again at the next poll.
+//     `ExtendDeadline` postpones the deadline.
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPollInterval is the poll interval used when none is configured.
+const defaultPollInterval = 2 * time.Second
+
+// sourceAckedPrefix marks the file recording the acknowledged generation of
+// the file of the same name.
+const sourceAckedPrefix = ".source-acked-"
+
+// File states of a DirectorySource.
+const (
+	fileSettling  = iota // Seen, but not yet stable for one interval.
+	fileDelivered        // Delivered and not yet settled.
+	fileDone             // Acknowledged.
+)
+
+// watchedFile is the state of a file of a DirectorySource.
+type watchedFile struct {
+	info     *BlobInfo // The file's metadata when it was last polled.
+	state    int       // One of the file states.
+	attempts int       // The number of deliveries of this generation.
+	expires  time.Time // The acknowledgement deadline of a delivered file; zero while the handler runs.
+}
+
+// DirectorySource delivers a storage notification for every new file of a directory.
+type DirectorySource struct {
+	dir      string        // The watched directory.
+	bucket   string        // The bucket name reported in the notifications.
+	interval time.Duration // The poll interval.
+	deadline time.Duration // The acknowledgement deadline of each delivery.
+	workers  int           // The number of handler workers; one goroutine per message if zero.
+
+	mu    sync.Mutex
+	files map[string]*watchedFile // The known files, keyed by object name.
+}
+
+// NewDirectorySource creates a source for a directory and records the files it
+// already contains; those acknowledged in their current generation are not
+// delivered.
+//
+// Inputs:
+//   - dir: The directory to watch; it is created if it does not exist.
+//   - bucket: The bucket name reported in the notifications.
+//   - interval: The poll interval; 2 seconds if zero.
+//   - deadline: The acknowledgement deadline; 60 seconds if zero.
+//
+// Outputs:
+//   - *DirectorySource: A pointer to the new source.
+//   - error: An error if the directory cannot be created or read.
+func NewDirectorySource(dir string, bucket string, interval time.Duration, deadline time.Duration) (*DirectorySource, error) {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	if deadline <= 0 {
+		deadline = defaultAckDeadline
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create watched directory %s: %w", dir, err)
+	}
+	s := &DirectorySource{dir: dir, bucket: bucket, interval: interval, deadline: deadline, files: make(map[string]*watchedFile)}
+	existing, err := s.scan()
+	if err != nil {
+		return nil, err
+	}
+	for name, info := range existing {
+		state := fileSettling
+		if s.acknowledged(info) {
+			state = fileDone
+		}
+		s.files[name] = &watchedFile{info: info, state: state}
+	}
+	return s, nil
+}
+
+// Name returns the watched directory.
+func (s *DirectorySource) Name() string {
+	return "directory:" + s.dir
+}
+
+// SetFlowControl sets the number of handler workers from `num_goroutines`.
+// The outstanding limits are enforced by the listener.
+func (s *DirectorySource) SetFlowControl(fc FlowControl) {
+	s.workers = fc.NumGoroutines
+}
+
+// Receive polls the directory until the context is canceled.
+func (s *DirectorySource) Receive(ctx context.Context, handler func(context.Context, *Message)) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// dispatch hands a message to a handler; it returns false if the context
+	// was canceled while all workers were busy.
+	dispatch := func(msg *Message) bool {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.deliver(ctx, msg, handler)
+		}()
+		return true
+	}
+	if s.workers > 0 {
+		work := make(chan *Message)
+		defer close(work)
+		for range s.workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for msg := range work {
+					s.deliver(ctx, msg, handler)
+				}
+			}()
+		}
+		dispatch = func(msg *Message) bool {
+			select {
+			case work <- msg:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			messages, err := s.poll()
+			if err != nil {
+				log.Printf("failed to poll %s: %v", s.dir, err)
+				continue
+			}
+			for i, msg := range messages {
+				if !dispatch(msg) {
+					// Release the files that were never handed out, so that
+					// they are delivered again if the source is restarted.
+					for _, pending := range messages[i:] {
+						s.Nack(pending)
+					}
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// deliver runs the handler of a delivered message.
+func (s *DirectorySource) deliver(ctx context.Context, msg *Message, handler func(context.Context, *Message)) {
+	handler(ctx, msg)
+	s.startDeadline(msg)
+}
+
+// scan lists the files of the directory, keyed by object name.
+func (s *DirectorySource) scan() (map[string]*BlobInfo, error) {
+	out := make(map[string]*BlobInfo)
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Removed while walking.
+				return nil
+			}
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != s.dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		out[name] = localBlobInfo(s.bucket, name, p, fi)
+		return nil
+	})
+	return out, err
+}
+
+// poll compares the directory with the known files and returns the messages
+// of the files that are ready for delivery.
+func (s *DirectorySource) poll() ([]*Message, error) {
+	current, err := s.scan()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	out := make([]*Message, 0)
+	for name, info := range current {
+		f, ok := s.files[name]
+		switch {
+		case !ok || f.info.Generation != info.Generation || f.info.Size != info.Size:
+			// A new or changed file; wait until it is stable.
+			s.files[name] = &watchedFile{info: info, state: fileSettling}
+		case f.state == fileSettling || (f.state == fileDelivered && !f.expires.IsZero() && now.After(f.expires)):
+			f.state = fileDelivered
+			f.expires = time.Time{}
+			f.attempts++
+			msg, err := s.message(info, f.attempts)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, msg)
+		}
+	}
+	for name := range s.files {
+		if _, ok := current[name]; !ok {
+			delete(s.files, name)
+			_ = os.Remove(s.ackedPath(name))
+		}
+	}
+	return out, nil
+}
+
+// message creates the storage notification of a file.
+func (s *DirectorySource) message(info *BlobInfo, attempt int) (*Message, error) {
+	generation := strconv.FormatInt(info.Generation, 10)
+	updated := info.Updated.UTC().Format(time.RFC3339Nano)
+	data, err := json.Marshal(&GCSPubSubNotification{
+		Kind:           "storage#object",
+		ID:             s.bucket + "/" + info.Name + "/" + generation,
+		Name:           info.Name,
+		Bucket:         s.bucket,
+		Generation:     generation,
+		MetaGeneration: "1",
+		ContentType:    info.ContentType,
+		TimeCreated:    updated,
+		Updated:        updated,
+		StorageClass:   "STANDARD",
+		Size:           strconv.FormatInt(info.Size, 10),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		ID:   s.bucket + "/" + info.Name + "/" + generation,
+		Data: data,
+		Attributes: map[string]string{
+			"eventType":        "OBJECT_FINALIZE",
+			"payloadFormat":    "JSON_API_V1",
+			"bucketId":         s.bucket,
+			"objectId":         info.Name,
+			"objectGeneration": generation,
+		},
+		DeliveryAttempt: attempt,
+		PublishTime:     time.Now(),
+		handle:          info,
+	}, nil
+}
+
+// leased returns the delivered file of the message, or nil if the file has
+// changed or the delivery was settled. The caller must hold the lock.
+func (s *DirectorySource) leased(msg *Message) *watchedFile {
+	info := msg.handle.(*BlobInfo)
+	f, ok := s.files[info.Name]
+	if !ok || f.state != fileDelivered || f.info.Generation != info.Generation || f.attempts != msg.DeliveryAttempt {
+		return nil
+	}
+	return f
+}
+
+// startDeadline starts the acknowledgement deadline of a delivery that is
+// still unsettled after its handler returned.
+func (s *DirectorySource) startDeadline(msg *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f := s.leased(msg); f != nil && f.expires.IsZero() {
+		f.expires = time.Now().Add(s.deadline)
+	}
+}
+
+// settle moves the delivered file of the message to a new state, and reports
+// whether the delivery was still unsettled.
+func (s *DirectorySource) settle(msg *Message, state int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f := s.leased(msg); f != nil {
+		f.state = state
+		return true
+	}
+	return false
+}
+
+// Ack marks the file as processed; it is delivered again only if it changes.
+func (s *DirectorySource) Ack(msg *Message) {
+	if !s.settle(msg, fileDone) {
+		return
+	}
+	info := msg.handle.(*BlobInfo)
+	generation := strconv.FormatInt(info.Generation, 10)
+	if err := os.WriteFile(s.ackedPath(info.Name), []byte(generation), 0o644); err != nil {
+		log.Printf("failed to record the acknowledgement of %s: %v", msg.ID, err)
+	}
+}
+
+// acknowledged reports whether the file was acknowledged in its current
+// generation, possibly by an earlier run of the source.
+func (s *DirectorySource) acknowledged(info *BlobInfo) bool {
+	saved, err := os.ReadFile(s.ackedPath(info.Name))
+	return err == nil && string(saved) == strconv.FormatInt(info.Generation, 10)
+}
+
+// ackedPath returns the marker file recording the acknowledged generation of
+// an object.
+func (s *DirectorySource) ackedPath(name string) string {
+	p := filepath.Join(s.dir, filepath.FromSlash(name))
+	return filepath.Join(filepath.Dir(p), sourceAckedPrefix+filepath.Base(p))
+}
+
+// Nack delivers the file again at the next poll.
+func (s *DirectorySource) Nack(msg *Message) {
+	_ = s.settle(msg, fileSettling)
+}
+
+// ExtendDeadline moves the acknowledgement deadline of the delivery. It has
+// no effect while the handler runs, since the file is held anyway.
+func (s *DirectorySource) ExtendDeadline(msg *Message, extension time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.leased(msg)
+	if f == nil {
+		return fmt.Errorf("message %s: %w", msg.ID, ErrMessageNotLeased)
+	}
+	if !f.expires.IsZero() {
+		f.expires = time.Now().Add(extension)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines the `Embedder` abstraction, which the embedding workflow
+// and the search service use to turn text into vectors without depending on a
+// particular provider.
+//
+// Logic Flow:
+//  1. Each `[embedding_models.<name>]` entry of the configuration selects a
+//     provider with `provider`: "vertex" (the default; Vertex AI text
+//     embeddings), "openai" (an OpenAI-compatible embeddings endpoint) or
+//     "hashing" (a local bag-of-words embedder, for tests and offline
+//     development).
+//  2. `NewEmbedder` creates the embedder and wraps it in a `QuotaAwareEmbedder`,
+//     which splits large batches, enforces `max_requests_per_minute` and checks
+//     the length of every returned vector.
+//  3. The vectors of one model must all have the same dimension, or they cannot
+//     be compared. A configured `dimension` is enforced from the first request;
+//     otherwise the dimension of the first embedding is, and any later mismatch
+//     is returned as `ErrDimensionMismatch`.
+//
+// Interfaces:
+//   - Embedder: Embeds batches of texts.
+//
+// Functions:
+//   - NewEmbedder: Creates the embedder selected by an embedding model's configuration.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/genai"
+)
+
+// EmbeddingProviderHashing selects the local `HashingEmbedder` with
+// `embedding_models.<name>.provider`. The "vertex" and "openai" providers are
+// shared with the agent models.
+const EmbeddingProviderHashing = "hashing"
+
+// maxEmbeddingBatch is the largest number of texts sent in one request.
+const maxEmbeddingBatch = 250
+
+// ErrDimensionMismatch is returned when a model returns a vector whose length
+// differs from the dimension of the model.
+var ErrDimensionMismatch = errors.New("embedding dimension mismatch")
+
+// Embedder turns texts into vectors.
+type Embedder interface {
+	// Name returns the ID of the model, which is stored with every embedding.
+	Name() string
+	// Dimension returns the length of the vectors, or 0 if it is not known yet.
+	Dimension() int
+	// Embed returns one vector per text, in the order of the texts.
+	Embed(ctx context.Context, texts []string) ([][]float64, error)
+}
+
+// NewEmbedder creates the embedder selected by an embedding model's configuration.
+//
+// Inputs:
+//   - name: The logical name of the embedding model (e.g., "multi-lingual").
+//   - values: The embedding model's configuration.
+//   - client: The GenAI client; only used by the Vertex provider.
+//
+// Outputs:
+//   - Embedder: The configured, rate-limited embedder.
+//   - error: An error if the provider is unknown or misconfigured.
+func NewEmbedder(name string, values VertexAiEmbeddingModel, client *genai.Client) (Embedder, error) {
+	var embedder Embedder
+	switch values.Provider {
+	case "", ModelProviderVertex:
+		embedder = NewVertexEmbedder(client.Models, values.Model, values.Dimension)
+	case ModelProviderOpenAI:
+		if len(values.Endpoint) == 0 {
+			return nil, fmt.Errorf("embedding model %s: the openai provider requires an endpoint", name)
+		}
+		apiKey := ""
+		if len(values.APIKeyEnv) > 0 {
+			apiKey = os.Getenv(values.APIKeyEnv)
+		}
+		embedder = NewOpenAIEmbedder(values.Endpoint, apiKey, values.Model, values.Dimension)
+	case EmbeddingProviderHashing:
+		embedder = NewHashingEmbedder(values.Model, values.Dimension)
+	default:
+		return nil, fmt.Errorf("embedding model %s: unknown provider %q", name, values.Provider)
+	}
+	return NewQuotaAwareEmbedder(embedder, values.MaxRequestsPerMinute), nil
+}
+
+// VertexEmbedder embeds texts with a Vertex AI text embedding model.
+type VertexEmbedder struct {
+	models    *genai.Models // The GenAI model service.
+	model     string        // The name of the model (e.g., "text-embedding-004").
+	dimension int           // The requested output dimensionality; the model's default if zero.
+}
+
+// NewVertexEmbedder creates an embedder on a Vertex AI model.
+//
+// Inputs:
+//   - models: The model service of the GenAI client.
+//   - model: The name of the embedding model.
+//   - dimension: The requested output dimensionality; the model's default if zero.
+//
+// Outputs:
+//   - *VertexEmbedder: A pointer to the new embedder.
+func NewVertexEmbedder(models *genai.Models, model string, dimension int) *VertexEmbedder {
+	return &VertexEmbedder{models: models, model: model, dimension: dimension}
+}
+
+// Name returns the name of the Vertex AI model.
+func (e *VertexEmbedder) Name() string {
+	return e.model
+}
+
+// Dimension returns the requested output dimensionality.
+func (e *VertexEmbedder) Dimension() int {
+	return e.dimension
+}
+
+// Embed sends the texts in a single EmbedContent request.
+func (e *VertexEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	contents := make([]*genai.Content, 0, len(texts))
+	for _, text := range texts {
+		contents = append(contents, genai.NewContentFromText(text, genai.RoleUser))
+	}
+	config := &genai.EmbedContentConfig{}
+	if e.dimension > 0 {
+		config.OutputDimensionality = genai.Ptr[int32](int32(e.dimension))
+	}
+	resp, err := e.models.EmbedContent(ctx, e.model, contents, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// The vector search compares float64 vectors, so the float32 values of
+	// the model are widened.
+	out := make([][]float64, 0, len(resp.Embeddings))
+	for _, embedding := range resp.Embeddings {
+		vector := make([]float64, 0, len(embedding.Values))
+		for _, f := range embedding.Values {
+			vector = append(vector, float64(f))
+		}
+		out = append(out, vector)
+	}
+	return out, nil
+}
+
+// QuotaAwareEmbedder is a decorator that adds batching, rate limiting and
+// dimension checks to an `Embedder`.
+type QuotaAwareEmbedder struct {
+	wrapped Embedder      // The embedder of the provider.
+	limiter *rate.Limiter // Limits the requests per minute; nil if unlimited.
+
+	mu        sync.Mutex
+	dimension int // The dimension of the model; 0 until known.
+}
+
+// NewQuotaAwareEmbedder wraps an embedder.
+//
+// Inputs:
+//   - wrapped: The embedder of the provider.
+//   - requestsPerMinute: The maximum number of requests per minute; unlimited if zero.
+//
+// Outputs:
+//   - *QuotaAwareEmbedder: A pointer to the new wrapper.
+func NewQuotaAwareEmbedder(wrapped Embedder, requestsPerMinute int) *QuotaAwareEmbedder {
+	out := &QuotaAwareEmbedder{wrapped: wrapped, dimension: wrapped.Dimension()}
+	if requestsPerMinute > 0 {
+		// A burst of one spreads the requests evenly over the minute.
+		out.limiter = rate.NewLimiter(rate.Limit(float64(requestsPerMinute)/60), 1)
+	}
+	return out
+}
+
+// Name returns the ID of the wrapped model.
+func (q *QuotaAwareEmbedder) Name() string {
+	return q.wrapped.Name()
+}
+
+// Dimension returns the configured or learned dimension of the model.
+func (q *QuotaAwareEmbedder) Dimension() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dimension
+}
+
+// Embed splits the texts into batches, waits for the rate limiter before
+// each request and checks that every vector has the dimension of the model.
+func (q *QuotaAwareEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	out := make([][]float64, 0, len(texts))
+	for start := 0; start < len(texts); start += maxEmbeddingBatch {
+		end := min(start+maxEmbeddingBatch, len(texts))
+		if q.limiter != nil {
+			if err := q.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		vectors, err := q.wrapped.Embed(ctx, texts[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("embedding model %s: %w", q.Name(), err)
+		}
+		if len(vectors) != end-start {
+			return nil, fmt.Errorf("embedding model %s: returned %d vectors for %d texts", q.Name(), len(vectors), end-start)
+		}
+		for _, vector := range vectors {
+			if err := q.checkDimension(len(vector)); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, vectors...)
+	}
+	return out, nil
+}
+
+// checkDimension compares the length of a vector with the dimension of the
+// model, which is set by the first vector if it is not configured.
+func (q *QuotaAwareEmbedder) checkDimension(length int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.dimension == 0 {
+		q.dimension = length
+	}
+	if length != q.dimension {
+		return fmt.Errorf("embedding model %s: %w: got %d, want %d", q.wrapped.Name(), ErrDimensionMismatch, length, q.dimension)
+	}
+	return nil
+}
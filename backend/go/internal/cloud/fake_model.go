@@ -0,0 +1,141 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file implements a deterministic `GenerativeModel` that answers from
+// fixture files, so that the workflows can be run in tests and offline.
+//
+// Logic Flow:
+//  1. At creation, every `*.json` file of the fixture directory is loaded, in
+//     file name order. A fixture has a `match` regular expression, a
+//     `response` and an optional `usage`:
+//     {"match": "Sequence: (\\d+)", "response": "{\"sequence\": $1}", "usage": {"input_tokens": 10}}
+//  2. A request is answered by the first fixture whose expression matches the
+//     prompt text; an empty expression matches every prompt. No match is an error.
+//  3. A string response is returned as is; any other JSON value is returned
+//     as its JSON text. `$1`, `${name}` and so on are replaced with the groups
+//     of the match, so one fixture can serve every scene of a video.
+//  4. Missing token counts are estimated as one token per four bytes.
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// fakeFixture is a canned response of a FakeModel.
+type fakeFixture struct {
+	match    *regexp.Regexp // The expression the prompt must match.
+	response string         // The response text, possibly with group references.
+	usage    *Usage         // The reported usage; estimated if nil.
+}
+
+// FakeModel answers prompts with canned responses.
+type FakeModel struct {
+	name     string         // The model name reported by Name.
+	fixtures []*fakeFixture // The fixtures, in file name order.
+}
+
+// NewFakeModel loads the fixtures of a directory.
+//
+// Inputs:
+//   - name: The model name reported by Name.
+//   - dir: The directory holding the `*.json` fixture files.
+//
+// Outputs:
+//   - *FakeModel: A pointer to the new model.
+//   - error: An error if a fixture cannot be read or parsed.
+func NewFakeModel(name string, dir string) (*FakeModel, error) {
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("fake model %s requires a fixture_dir", name)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	out := &FakeModel{name: name}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var decoded struct {
+			Match    string          `json:"match"`
+			Response json.RawMessage `json:"response"`
+			Usage    *struct {
+				InputTokens  int `json:"input_tokens"`
+				OutputTokens int `json:"output_tokens"`
+			} `json:"usage"`
+		}
+		if err := json.Unmarshal(content, &decoded); err != nil {
+			return nil, fmt.Errorf("failed to parse fixture %s: %w", file, err)
+		}
+		match, err := regexp.Compile(decoded.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match in fixture %s: %w", file, err)
+		}
+		fixture := &fakeFixture{match: match}
+		var text string
+		if err := json.Unmarshal(decoded.Response, &text); err == nil {
+			fixture.response = text
+		} else {
+			fixture.response = string(decoded.Response)
+		}
+		if decoded.Usage != nil {
+			fixture.usage = &Usage{InputTokens: decoded.Usage.InputTokens, OutputTokens: decoded.Usage.OutputTokens}
+		}
+		out.fixtures = append(out.fixtures, fixture)
+	}
+	if len(out.fixtures) == 0 {
+		return nil, fmt.Errorf("fake model %s: no fixtures in %s", name, dir)
+	}
+	return out, nil
+}
+
+// Name returns the configured model name.
+func (m *FakeModel) Name() string {
+	return m.name
+}
+
+// Generate answers with the first matching fixture.
+func (m *FakeModel) Generate(_ context.Context, request *GenerationRequest) (*GenerationResponse, error) {
+	for _, f := range m.fixtures {
+		groups := f.match.FindStringSubmatchIndex(request.Text)
+		if groups == nil {
+			continue
+		}
+		text := f.response
+		if f.match.NumSubexp() > 0 {
+			text = string(f.match.ExpandString(nil, f.response, request.Text, groups))
+		}
+		usage := Usage{InputTokens: estimateTokens(request.Text), OutputTokens: estimateTokens(text)}
+		if f.usage != nil {
+			usage = *f.usage
+		}
+		return &GenerationResponse{Text: text, Usage: usage}, nil
+	}
+	return nil, fmt.Errorf("fake model %s: no fixture matches the prompt", m.name)
+}
+
+// estimateTokens estimates the tokens of a text as one per four bytes.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines the flow control of a listener: how many messages, and how
+// many bytes of media, it processes at once.
+//
+// Logic Flow:
+//  1. Each `[topic_subscriptions.<name>]` entry sets `max_outstanding_messages`,
+//     `max_outstanding_bytes` and `num_goroutines`; zero keeps the default.
+//  2. `NewMessageSource` hands the settings to the source. The Pub/Sub source
+//     maps them onto the subscription's `ReceiveSettings`; the channel and
+//     directory sources run their handlers on `num_goroutines` workers.
+//  3. The `MessageListener` enforces the outstanding limits itself, whatever
+//     the source: a message waits before its workflow starts until it fits.
+//     The bytes of a storage notification are the size of the object it
+//     announces, so that the limit bounds the media downloaded at once.
+//
+// Structs:
+//   - FlowControl: The flow control settings of a listener.
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// FlowControl bounds the messages a listener processes at once.
+type FlowControl struct {
+	MaxOutstandingMessages int // The messages being processed at once; unlimited if zero or negative.
+	MaxOutstandingBytes    int // The bytes of the messages being processed at once; unlimited if zero or negative.
+	NumGoroutines          int // Pub/Sub: the streaming pulls; local sources: the handler workers. The source's default if zero.
+}
+
+// flowController enforces the outstanding limits of a FlowControl.
+type flowController struct {
+	messages *semaphore.Weighted // One unit per message; nil if unlimited.
+	bytes    *semaphore.Weighted // One unit per byte; nil if unlimited.
+	maxBytes int64               // The capacity of bytes.
+}
+
+// newFlowController creates the controller of the settings, or nil if they
+// set no limit.
+func newFlowController(fc FlowControl) *flowController {
+	if fc.MaxOutstandingMessages <= 0 && fc.MaxOutstandingBytes <= 0 {
+		return nil
+	}
+	f := &flowController{}
+	if fc.MaxOutstandingMessages > 0 {
+		f.messages = semaphore.NewWeighted(int64(fc.MaxOutstandingMessages))
+	}
+	if fc.MaxOutstandingBytes > 0 {
+		f.maxBytes = int64(fc.MaxOutstandingBytes)
+		f.bytes = semaphore.NewWeighted(f.maxBytes)
+	}
+	return f
+}
+
+// acquire waits until the message fits within the limits, or the context is
+// canceled. A message larger than the byte limit waits until it runs alone.
+func (f *flowController) acquire(ctx context.Context, msg *Message) error {
+	if f == nil {
+		return nil
+	}
+	if f.messages != nil {
+		if err := f.messages.Acquire(ctx, 1); err != nil {
+			return err
+		}
+	}
+	if f.bytes != nil {
+		if err := f.bytes.Acquire(ctx, f.weight(msg)); err != nil {
+			if f.messages != nil {
+				f.messages.Release(1)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// release gives back what acquire took for the message.
+func (f *flowController) release(msg *Message) {
+	if f == nil {
+		return
+	}
+	if f.bytes != nil {
+		f.bytes.Release(f.weight(msg))
+	}
+	if f.messages != nil {
+		f.messages.Release(1)
+	}
+}
+
+// weight returns the bytes of a message, capped at the byte limit.
+func (f *flowController) weight(msg *Message) int64 {
+	return min(MessageBytes(msg), f.maxBytes)
+}
+
+// MessageBytes returns the bytes a message stands for: the size of the object
+// announced by a storage notification, or else the size of the payload.
+//
+// Inputs:
+//   - msg: The message.
+//
+// Outputs:
+//   - int64: The bytes of the message.
+func MessageBytes(msg *Message) int64 {
+	var notification GCSPubSubNotification
+	if err := json.Unmarshal(msg.Data, &notification); err == nil && notification.Kind == "storage#object" {
+		if size, err := strconv.ParseInt(notification.Size, 10, 64); err == nil && size > 0 {
+			return size
+		}
+	}
+	return int64(len(msg.Data))
+}
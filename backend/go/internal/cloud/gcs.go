@@ -22,8 +22,13 @@
 //
 // Functions:
 //   - GetGCSObjectName: Returns a constant key used for storing GCS object data in a context.
+//
+// Variables:
+//   - GCSObjectKey: The typed context key for the GCS object being processed.
 package cloud
 
+import "github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+
 // GetGCSObjectName returns a constant string that is used as a key within the
 // Chain of Responsibility (CoR) context. This key allows different commands in a workflow
 // to consistently access the `GCSObject` data that is being processed.
@@ -34,6 +39,10 @@ func GetGCSObjectName() string {
 	return "__GCS__OBJ__"
 }
 
+// GCSObjectKey is the typed accessor for the `GCSObject` stored under
+// GetGCSObjectName. Commands should prefer it over asserting the raw value.
+var GCSObjectKey = cor.NewKey[*GCSObject](GetGCSObjectName())
+
 // GCSPubSubNotification is the structure that maps to the JSON message payload
 // received from a Google Cloud Storage (GCS) Pub/Sub notification. When an event
 // (like object creation or update) occurs in a monitored bucket, GCS sends a message
@@ -64,7 +73,8 @@ type GCSPubSubNotification struct {
 // GCSPubSubNotification into a lightweight struct that is easier to pass
 // between commands in a processing workflow.
 type GCSObject struct {
-	Bucket   string // The name of the GCS bucket.
-	Name     string // The name of the object.
-	MIMEType string // The MIME type of the object (e.g., "video/mp4").
+	Bucket     string // The name of the GCS bucket.
+	Name       string // The name of the object.
+	MIMEType   string // The MIME type of the object (e.g., "video/mp4").
+	Generation int64  // The generation of the object's content, when known; 0 otherwise.
 }
@@ -0,0 +1,167 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file classifies the errors of generative models, so that only the
+// failures worth retrying are retried, and the others reach the chain and the
+// dead-letter logic as typed errors.
+//
+// Logic Flow:
+//  1. The models report what only they can see as a `GenerationError`: a
+//     response blocked by safety filters, or an HTTP status of an
+//     OpenAI-compatible API. The other errors (e.g., the `genai.APIError` of
+//     Vertex AI, a `QuotaExceededError`, a network error) are classified by
+//     `ClassifyGenerationError`.
+//  2. `GenerateMultiModalResponse` retries the rate-limited and transient
+//     failures with an exponential, jittered backoff (`GenerationRetryPolicy`),
+//     waiting at least the delay a rate-limited response asks for.
+//  3. The other kinds are returned at once. They are not retryable
+//     (`cor.IsRetryable`), so a `RetryCommand` does not retry them. A blocked
+//     prompt, an invalid argument and a context too long are permanent: the
+//     listener dead-letters their message without waiting for its last
+//     delivery attempt. An unknown failure (e.g., a permission error being
+//     fixed) is redelivered like any other failure.
+//
+// Structs:
+//   - GenerationError: A classified failure of a generative model.
+//
+// Functions:
+//   - ClassifyGenerationError: Classifies the error of a generation.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"google.golang.org/genai"
+)
+
+// GenerationErrorKind is the class of a failed generation.
+type GenerationErrorKind string
+
+// The classes of failed generations.
+const (
+	GenerationRateLimited     GenerationErrorKind = "rate-limited"     // A quota was exceeded; retryable.
+	GenerationTransient       GenerationErrorKind = "transient"        // A server or network failure; retryable.
+	GenerationSafetyBlocked   GenerationErrorKind = "safety-blocked"   // The prompt or response was blocked by safety filters; permanent.
+	GenerationInvalidArgument GenerationErrorKind = "invalid-argument" // The request was rejected as malformed; permanent.
+	GenerationContextTooLong  GenerationErrorKind = "context-too-long" // The prompt exceeds the context window of the model; permanent.
+	GenerationUnknown         GenerationErrorKind = "unknown"          // Any other failure, such as a permission error.
+)
+
+// GenerationRetryPolicy is the backoff between the attempts of a retryable
+// generation: 2 seconds, doubling up to a minute, half of it jittered.
+var GenerationRetryPolicy = cor.RetryPolicy{
+	MaxAttempts:    MaxRetries + 1,
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     time.Minute,
+	Multiplier:     2,
+	Jitter:         0.5,
+}
+
+// GenerationError is a classified failure of a generative model.
+type GenerationError struct {
+	Kind       GenerationErrorKind // The class of the failure.
+	Model      string              // The name of the model.
+	RetryAfter time.Duration       // The delay asked for by a rate-limited response; zero if not reported.
+	Err        error               // The underlying error.
+}
+
+func (e *GenerationError) Error() string {
+	return fmt.Sprintf("model %s: %s: %v", e.Model, e.Kind, e.Err)
+}
+
+func (e *GenerationError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether the failure may succeed if the request is sent
+// again; it is consulted by `cor.IsRetryable`.
+func (e *GenerationError) Retryable() bool {
+	return e.Kind == GenerationRateLimited || e.Kind == GenerationTransient
+}
+
+// Permanent reports whether the failure would happen again on redelivery of
+// the message, which the listener then dead-letters at once. An unknown
+// failure is not: it is neither retried at once nor assumed permanent.
+func (e *GenerationError) Permanent() bool {
+	switch e.Kind {
+	case GenerationSafetyBlocked, GenerationInvalidArgument, GenerationContextTooLong:
+		return true
+	default:
+		return false
+	}
+}
+
+// ClassifyGenerationError classifies the error of a generation.
+//
+// Inputs:
+//   - model: The name of the model.
+//   - err: The error returned by the model.
+//
+// Outputs:
+//   - error: The error itself if it is nil, already classified, a
+//     cancellation of the caller or refused by an open circuit; otherwise a
+//     *GenerationError.
+func ClassifyGenerationError(model string, err error) error {
+	var genErr *GenerationError
+	if err == nil || errors.As(err, &genErr) || errors.Is(err, context.Canceled) || errors.Is(err, ErrCircuitOpen) {
+		return err
+	}
+	out := &GenerationError{Kind: GenerationUnknown, Model: model, Err: err}
+
+	var quotaErr *QuotaExceededError
+	var apiErr genai.APIError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &quotaErr):
+		out.Kind = GenerationRateLimited
+		out.RetryAfter = quotaErr.RetryAfter
+	case errors.As(err, &apiErr):
+		out.Kind = classifyStatus(apiErr.Code, apiErr.Message)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF):
+		out.Kind = GenerationTransient
+	}
+	return out
+}
+
+// classifyStatus classifies an HTTP status and message of a model's API.
+func classifyStatus(code int, message string) GenerationErrorKind {
+	switch code {
+	case http.StatusTooManyRequests:
+		return GenerationRateLimited
+	case http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return GenerationTransient
+	case http.StatusRequestEntityTooLarge:
+		return GenerationContextTooLong
+	case http.StatusBadRequest:
+		// e.g., "The input token count (1200000) exceeds the maximum number of
+		// tokens allowed (1048576)" or "maximum context length is 8192 tokens".
+		lower := strings.ToLower(message)
+		if strings.Contains(lower, "token") && (strings.Contains(lower, "exceed") || strings.Contains(lower, "context length")) {
+			return GenerationContextTooLong
+		}
+		return GenerationInvalidArgument
+	default:
+		return GenerationUnknown
+	}
+}
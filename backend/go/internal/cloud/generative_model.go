@@ -0,0 +1,127 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines the `GenerativeModel` abstraction, which the summary and
+// scene extraction commands use to prompt a large language model without
+// depending on a particular provider.
+//
+// Logic Flow:
+//  1. Each `[agent_models.<name>]` entry of the configuration selects a
+//     provider with `provider`: "vertex" (the default; Gemini on Vertex AI),
+//     "openai" (an OpenAI-compatible chat completions endpoint, such as a
+//     self-hosted or local server) or "fake" (canned responses from fixture
+//     files, for tests and offline development).
+//  2. `NewGenerativeModel` creates the model; `NewCloudServiceClients` stores
+//     it in `ServiceClients.AgentModels`.
+//  3. A request is a text prompt plus optional media parts referenced by URI;
+//     the response is the generated text plus the token usage, which feeds
+//     the token counters of the commands and the usage stored on the media.
+//
+// Interfaces:
+//   - GenerativeModel: Generates text from a multi-modal prompt.
+//
+// Functions:
+//   - NewGenerativeModel: Creates the model selected by an agent model's configuration.
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"google.golang.org/genai"
+)
+
+// Model providers that can be selected with `agent_models.<name>.provider`.
+const (
+	ModelProviderVertex = "vertex" // Gemini on Vertex AI; the default.
+	ModelProviderOpenAI = "openai" // An OpenAI-compatible chat completions API.
+	ModelProviderFake   = "fake"   // Canned responses from fixture files.
+)
+
+// MediaPart references a media file that is part of a prompt.
+type MediaPart struct {
+	URI      string // The URI of the file, as understood by the provider.
+	MIMEType string // The MIME type of the file (e.g., "video/mp4").
+}
+
+// GenerationRequest is a multi-modal prompt.
+type GenerationRequest struct {
+	Text  string      // The text of the prompt.
+	Media []MediaPart // The media files the prompt refers to, if any.
+}
+
+// Usage counts the tokens of a generation.
+type Usage struct {
+	InputTokens  int     // The tokens of the prompt, including media.
+	OutputTokens int     // The tokens of the generated text.
+	Cost         float64 // The estimated cost of the tokens, in USD; zero if the model has no pricing (see pricing.go).
+}
+
+// GenerationResponse is the result of a generation.
+type GenerationResponse struct {
+	Text  string // The generated text.
+	Usage Usage  // The token usage reported by the provider.
+}
+
+// GenerativeModel generates text from a multi-modal prompt.
+type GenerativeModel interface {
+	// Name returns the name of the underlying model (e.g., "gemini-2.5-pro").
+	Name() string
+	// Generate sends the request to the model and returns its response.
+	Generate(ctx context.Context, request *GenerationRequest) (*GenerationResponse, error)
+}
+
+// NewGenerativeModel creates the model selected by an agent model's configuration.
+//
+// Inputs:
+//   - name: The logical name of the agent model (e.g., "creative-flash").
+//   - values: The agent model's configuration.
+//   - client: The GenAI client; only used by the Vertex provider.
+//   - blobs: The blob store signing the URLs of the media sent to the OpenAI provider; may be nil.
+//
+// Outputs:
+//   - GenerativeModel: The configured model.
+//   - error: An error if the provider is unknown or misconfigured.
+func NewGenerativeModel(name string, values VertexAiLLMModel, client *genai.Client, blobs BlobStore) (GenerativeModel, error) {
+	switch values.Provider {
+	case "", ModelProviderVertex:
+		config := &genai.GenerateContentConfig{
+			Temperature:       genai.Ptr[float32](values.Temperature),
+			TopP:              genai.Ptr[float32](values.TopP),
+			TopK:              genai.Ptr[float32](values.TopK),
+			MaxOutputTokens:   values.MaxTokens,
+			SystemInstruction: &genai.Content{Parts: []*genai.Part{{Text: values.SystemInstructions}}},
+			SafetySettings:    DefaultSafetySettings,
+			ResponseMIMEType:  values.OutputFormat,
+			Tools:             []*genai.Tool{},
+		}
+		// Wrap the configured model with our retries.
+		return NewQuotaAwareModel(config, values.Model, client.Models), nil
+	case ModelProviderOpenAI:
+		if len(values.Endpoint) == 0 {
+			return nil, fmt.Errorf("agent model %s: the openai provider requires an endpoint", name)
+		}
+		apiKey := ""
+		if len(values.APIKeyEnv) > 0 {
+			apiKey = os.Getenv(values.APIKeyEnv)
+		}
+		return NewOpenAIModel(values.Endpoint, apiKey, values, blobs), nil
+	case ModelProviderFake:
+		return NewFakeModel(values.Model, values.FixtureDir)
+	default:
+		return nil, fmt.Errorf("agent model %s: unknown provider %q", name, values.Provider)
+	}
+}
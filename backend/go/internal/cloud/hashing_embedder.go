@@ -0,0 +1,113 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file implements a deterministic, pure-Go `Embedder`, so that embedding
+// and search can be run in tests and offline.
+//
+// Logic Flow:
+//  1. A text is split into lower-case words of letters and digits.
+//  2. Each word is hashed (FNV-1a) into one of `dimension` buckets; another bit
+//     of the hash decides whether it adds or subtracts one, which keeps
+//     colliding words from always reinforcing each other.
+//  3. The vector is normalized to unit length, so texts sharing more words are
+//     closer under both the Euclidean and the cosine distance.
+//
+// The vectors carry no meaning beyond shared words; they are meant for tests,
+// not for real searches.
+package cloud
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// defaultHashingDimension is the dimension of a HashingEmbedder when none is configured.
+const defaultHashingDimension = 256
+
+// HashingEmbedder is a bag-of-words embedder using the hashing trick.
+type HashingEmbedder struct {
+	name      string // The model ID stored with the embeddings.
+	dimension int    // The length of the vectors.
+}
+
+// NewHashingEmbedder creates a hashing embedder.
+//
+// Inputs:
+//   - name: The model ID stored with the embeddings; "hashing" if empty.
+//   - dimension: The length of the vectors; 256 if zero.
+//
+// Outputs:
+//   - *HashingEmbedder: A pointer to the new embedder.
+func NewHashingEmbedder(name string, dimension int) *HashingEmbedder {
+	if len(name) == 0 {
+		name = EmbeddingProviderHashing
+	}
+	if dimension <= 0 {
+		dimension = defaultHashingDimension
+	}
+	return &HashingEmbedder{name: name, dimension: dimension}
+}
+
+// Name returns the model ID.
+func (e *HashingEmbedder) Name() string {
+	return e.name
+}
+
+// Dimension returns the length of the vectors.
+func (e *HashingEmbedder) Dimension() int {
+	return e.dimension
+}
+
+// Embed hashes the words of every text into a vector.
+func (e *HashingEmbedder) Embed(_ context.Context, texts []string) ([][]float64, error) {
+	out := make([][]float64, 0, len(texts))
+	for _, text := range texts {
+		out = append(out, e.embed(text))
+	}
+	return out, nil
+}
+
+// embed hashes the words of a text into a unit vector.
+func (e *HashingEmbedder) embed(text string) []float64 {
+	vector := make([]float64, e.dimension)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(word))
+		sum := h.Sum64()
+		sign := 1.0
+		if sum>>63 == 1 {
+			sign = -1.0
+		}
+		vector[sum%uint64(e.dimension)] += sign
+	}
+
+	var norm float64
+	for _, v := range vector {
+		norm += v * v
+	}
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for i := range vector {
+			vector[i] /= norm
+		}
+	}
+	return vector
+}
@@ -0,0 +1,146 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines `Lifecycle`, which shuts the application down in order,
+// so that the work in flight when the process is asked to stop is finished,
+// or at least canceled cleanly and left for redelivery, rather than killed.
+//
+// Logic Flow:
+//  1. At startup, every background process registers a drain hook (the HTTP
+//     server, each message listener, the embedding timer) and every resource
+//     a close hook (the service clients, the telemetry providers).
+//  2. `Shutdown` runs all drain hooks at once, sharing one context that
+//     expires after `application.shutdown_timeout_seconds`. A drain hook stops
+//     accepting work and waits for the running work; when the context
+//     expires, it cancels that work.
+//  3. Once every drain hook has returned, the close hooks run one after
+//     another, in registration order, each with its own short timeout.
+//
+// Structs:
+//   - Lifecycle: The ordered shutdown hooks of the application.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultShutdownTimeout is the time given to running work to finish when
+// `shutdown_timeout_seconds` is not configured.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// closeTimeout bounds each close hook.
+const closeTimeout = 10 * time.Second
+
+// lifecycleHook is a named shutdown step.
+type lifecycleHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Lifecycle runs the shutdown hooks of the application.
+type Lifecycle struct {
+	drainTimeout time.Duration // The time given to the drain hooks.
+
+	mu     sync.Mutex
+	drains []lifecycleHook // Run concurrently, first.
+	closes []lifecycleHook // Run in order, after the drains.
+}
+
+// NewLifecycle creates a lifecycle without hooks.
+//
+// Inputs:
+//   - drainTimeout: The time given to running work to finish; DefaultShutdownTimeout if zero.
+//
+// Outputs:
+//   - *Lifecycle: A pointer to the new lifecycle.
+func NewLifecycle(drainTimeout time.Duration) *Lifecycle {
+	if drainTimeout <= 0 {
+		drainTimeout = DefaultShutdownTimeout
+	}
+	return &Lifecycle{drainTimeout: drainTimeout}
+}
+
+// OnDrain registers a hook that stops a background process and waits for its
+// running work until the context expires, then cancels it.
+//
+// Inputs:
+//   - name: The name of the process, for logs and errors.
+//   - fn: The hook.
+func (l *Lifecycle) OnDrain(name string, fn func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.drains = append(l.drains, lifecycleHook{name: name, fn: fn})
+}
+
+// OnClose registers a hook that releases a resource once all processes have drained.
+//
+// Inputs:
+//   - name: The name of the resource, for logs and errors.
+//   - fn: The hook.
+func (l *Lifecycle) OnClose(name string, fn func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closes = append(l.closes, lifecycleHook{name: name, fn: fn})
+}
+
+// Shutdown drains the background processes, then closes the resources.
+//
+// Inputs:
+//   - ctx: The parent context of the shutdown; canceling it cuts the drain short.
+//
+// Outputs:
+//   - error: The errors of the hooks, joined.
+func (l *Lifecycle) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	drains, closes := l.drains, l.closes
+	l.drains, l.closes = nil, nil
+	l.mu.Unlock()
+
+	drainCtx, cancel := context.WithTimeout(ctx, l.drainTimeout)
+	defer cancel()
+	errs := make([]error, len(drains))
+	var wg sync.WaitGroup
+	for i, hook := range drains {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = l.run(drainCtx, hook)
+		}()
+	}
+	wg.Wait()
+
+	for _, hook := range closes {
+		closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), closeTimeout)
+		errs = append(errs, l.run(closeCtx, hook))
+		cancel()
+	}
+	return errors.Join(errs...)
+}
+
+// run runs a hook and logs its outcome.
+func (l *Lifecycle) run(ctx context.Context, hook lifecycleHook) error {
+	start := time.Now()
+	if err := hook.fn(ctx); err != nil {
+		log.Printf("shutdown: %s failed after %s: %v", hook.name, time.Since(start).Round(time.Millisecond), err)
+		return fmt.Errorf("%s: %w", hook.name, err)
+	}
+	log.Printf("shutdown: %s done in %s", hook.name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines `Limiter`, a semaphore shared by every workflow that caps
+// how many heavy operations of one kind run at once in the process, whatever
+// the number of listeners and messages.
+//
+// Logic Flow:
+//  1. `NewCloudServiceClients` creates one limiter for FFmpeg processes
+//     (`application.max_concurrent_ffmpeg`) and one for Gemini ingestions
+//     (`application.max_concurrent_ingestions`), the requests that send a
+//     media file to a model.
+//  2. The FFmpeg command acquires a slot before it starts the process. The
+//     agent models are wrapped in a `LimitedModel`, which acquires a slot for
+//     every request with media parts.
+//  3. A nil limiter, created for a size of zero, never blocks.
+//
+// Structs:
+//   - Limiter: A named, context-aware semaphore.
+//   - LimitedModel: A GenerativeModel whose media requests hold a limiter slot.
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Limiter caps the number of operations of one kind running at once.
+type Limiter struct {
+	name  string              // The kind of operation, for errors and logs.
+	size  int                 // The number of slots.
+	sem   *semaphore.Weighted // One unit per slot.
+	inUse atomic.Int64        // The slots currently held.
+}
+
+// NewLimiter creates a limiter.
+//
+// Inputs:
+//   - name: The kind of operation (e.g., "ffmpeg").
+//   - size: The number of operations that may run at once.
+//
+// Outputs:
+//   - *Limiter: A pointer to the new limiter, or nil (unlimited) if size is zero or negative.
+func NewLimiter(name string, size int) *Limiter {
+	if size <= 0 {
+		return nil
+	}
+	return &Limiter{name: name, size: size, sem: semaphore.NewWeighted(int64(size))}
+}
+
+// Acquire waits for a free slot, until the context is canceled. Every
+// successful Acquire must be followed by a Release.
+//
+// Inputs:
+//   - ctx: The context bounding the wait.
+//
+// Outputs:
+//   - error: An error if the context was canceled first.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	if err := l.sem.Acquire(ctx, 1); err != nil {
+		return fmt.Errorf("waiting for a %s slot: %w", l.name, err)
+	}
+	l.inUse.Add(1)
+	return nil
+}
+
+// Release frees the slot taken by Acquire.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	l.inUse.Add(-1)
+	l.sem.Release(1)
+}
+
+// Size returns the number of slots; zero for a nil (unlimited) limiter.
+func (l *Limiter) Size() int {
+	if l == nil {
+		return 0
+	}
+	return l.size
+}
+
+// InUse returns the number of slots currently held.
+func (l *Limiter) InUse() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.inUse.Load())
+}
+
+// LimitedModel wraps a GenerativeModel so that its requests with media parts
+// hold a slot of a limiter. Text-only requests are not limited.
+type LimitedModel struct {
+	GenerativeModel          // The wrapped model.
+	limiter         *Limiter // The limiter of media requests.
+}
+
+// NewLimitedModel wraps a model with a limiter.
+//
+// Inputs:
+//   - model: The model to wrap.
+//   - limiter: The limiter of its media requests; nil returns the model itself.
+//
+// Outputs:
+//   - GenerativeModel: The wrapped model.
+func NewLimitedModel(model GenerativeModel, limiter *Limiter) GenerativeModel {
+	if limiter == nil {
+		return model
+	}
+	return &LimitedModel{GenerativeModel: model, limiter: limiter}
+}
+
+// Generate holds a slot of the limiter while a request with media runs.
+func (m *LimitedModel) Generate(ctx context.Context, request *GenerationRequest) (*GenerationResponse, error) {
+	if len(request.Media) > 0 {
+		if err := m.limiter.Acquire(ctx); err != nil {
+			return nil, err
+		}
+		defer m.limiter.Release()
+	}
+	return m.GenerativeModel.Generate(ctx, request)
+}
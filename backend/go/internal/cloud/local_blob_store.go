@@ -0,0 +1,409 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file implements `BlobStore` on a local directory tree, so that the
+// pipeline and the API can run on a laptop or in CI without GCP credentials.
+//
+// Logic Flow:
+//  1. Every bucket is a directory below the root, and every object a file in
+//     it. Object names may contain slashes, which become subdirectories. Names
+//     that would escape the bucket directory are rejected.
+//  2. Writes go to a hidden temporary file in the bucket directory, which is
+//     renamed into place by Close. Canceling the write's context discards it,
+//     mirroring the GCS writer.
+//  3. The generation of an object is its modification time in nanoseconds. The
+//     content type given to `Create` is kept in a hidden sidecar file next to
+//     the object; without one, it is derived from the name's extension, which
+//     knows the common video types even where the system has no MIME table.
+//  4. Signed URLs point back at the server (`LocalBlobPath`) and carry an
+//     expiry and an HMAC-SHA256 signature of the bucket, name and expiry. The
+//     server checks them with `Verify` before serving the file.
+package cloud
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalBlobPath is the server path under which signed local objects are
+// served, followed by "/<bucket>/<name>".
+const LocalBlobPath = "/api/v1/blobs"
+
+// localTempPrefix marks partially written objects, which are never listed.
+const localTempPrefix = ".blob-tmp-"
+
+// localMetaPrefix marks the sidecar file holding the content type of the
+// object whose base name follows it; sidecars are never listed.
+const localMetaPrefix = ".blob-meta-"
+
+// localContentTypes are the content types of the media extensions, which
+// `mime.TypeByExtension` only knows from the system's MIME tables.
+var localContentTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/x-m4v",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".avi":  "video/x-msvideo",
+	".mpeg": "video/mpeg",
+	".mpg":  "video/mpeg",
+}
+
+// ContentTypeByName returns the content type of an object from its name's
+// extension, knowing the common video types even where the system has no
+// MIME table.
+//
+// Inputs:
+//   - name: The object name.
+//
+// Outputs:
+//   - string: The content type; empty if the extension is unknown.
+func ContentTypeByName(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if contentType, ok := localContentTypes[ext]; ok {
+		return contentType
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// ErrInvalidSignature is returned by Verify for a missing, wrong or expired signature.
+var ErrInvalidSignature = errors.New("invalid or expired signature")
+
+// LocalBlobStore stores objects in a local directory tree.
+type LocalBlobStore struct {
+	root      string // The directory containing one directory per bucket.
+	publicURL string // The base URL of the server, used for signed URLs.
+	key       []byte // The key signed URLs are signed with.
+}
+
+// NewLocalBlobStore creates a store rooted in the directory, creating it if needed.
+//
+// Inputs:
+//   - root: The directory containing the buckets.
+//   - publicURL: The base URL of the server that serves signed URLs (e.g., "http://localhost:8080").
+//   - key: The HMAC key for signed URLs. If empty, a random key is generated,
+//     so that URLs signed before a restart stop working.
+//
+// Outputs:
+//   - *LocalBlobStore: A pointer to the new store.
+//   - error: An error if the root cannot be created or no key can be generated.
+func NewLocalBlobStore(root string, publicURL string, key []byte) (*LocalBlobStore, error) {
+	if len(root) == 0 {
+		return nil, errors.New("the local storage backend requires storage.local_root")
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create local storage root %s: %w", root, err)
+	}
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate signing key: %w", err)
+		}
+		log.Println("storage.signing_key is not set; signed URLs will not survive a restart")
+	}
+	return &LocalBlobStore{root: root, publicURL: strings.TrimSuffix(publicURL, "/"), key: key}, nil
+}
+
+// FilePath returns the local file that holds the object.
+//
+// Inputs:
+//   - bucket: The bucket name; it must be a single path element.
+//   - name: The object name; it must stay within the bucket.
+//
+// Outputs:
+//   - string: The path of the object's file.
+//   - error: An error if the bucket or name is not valid.
+func (s *LocalBlobStore) FilePath(bucket string, name string) (string, error) {
+	if err := validBucket(bucket); err != nil {
+		return "", err
+	}
+	local := filepath.FromSlash(name)
+	if len(name) == 0 || !filepath.IsLocal(local) || localInternal(filepath.Base(local)) {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	return filepath.Join(s.root, bucket, local), nil
+}
+
+// Open returns a reader for the object's file.
+func (s *LocalBlobStore) Open(_ context.Context, bucket string, name string) (io.ReadCloser, error) {
+	p, err := s.FilePath(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, localError(bucket, name, err)
+	}
+	return f, nil
+}
+
+// Create returns a writer for a temporary file that becomes the object on
+// Close. A non-empty content type is kept for Stat and List.
+func (s *LocalBlobStore) Create(ctx context.Context, bucket string, name string, contentType string) (BlobWriter, error) {
+	p, err := s.FilePath(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for %s/%s: %w", bucket, name, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), localTempPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s/%s: %w", bucket, name, err)
+	}
+	return &localBlobWriter{ctx: ctx, store: s, file: tmp, path: p, bucket: bucket, name: name, contentType: contentType}, nil
+}
+
+// Stat returns the metadata of the object's file.
+func (s *LocalBlobStore) Stat(_ context.Context, bucket string, name string) (*BlobInfo, error) {
+	p, err := s.FilePath(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if err == nil && fi.IsDir() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, localError(bucket, name, err)
+	}
+	return localBlobInfo(bucket, name, p, fi), nil
+}
+
+// Delete removes the object's file. A non-zero generation must match the
+// file's modification time.
+func (s *LocalBlobStore) Delete(ctx context.Context, bucket string, name string, generation int64) error {
+	info, err := s.Stat(ctx, bucket, name)
+	if err != nil {
+		return err
+	}
+	if generation != 0 && info.Generation != generation {
+		return fmt.Errorf("%s/%s generation %d: %w", bucket, name, generation, ErrBlobNotExist)
+	}
+	p, _ := s.FilePath(bucket, name)
+	if err := os.Remove(p); err != nil {
+		return localError(bucket, name, err)
+	}
+	_ = os.Remove(localMetaPath(p))
+	return nil
+}
+
+// List walks the bucket directory for files whose names start with the prefix.
+func (s *LocalBlobStore) List(_ context.Context, bucket string, prefix string) ([]*BlobInfo, error) {
+	out := make([]*BlobInfo, 0)
+	if err := validBucket(bucket); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(s.root, bucket)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == dir {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || localInternal(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		out = append(out, localBlobInfo(bucket, name, p, fi))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s/%s: %w", bucket, prefix, err)
+	}
+	return out, nil
+}
+
+// SignURL returns a link to the server's LocalBlobPath route, signed with the
+// store's key.
+func (s *LocalBlobStore) SignURL(_ context.Context, bucket string, name string, expires time.Duration) (string, error) {
+	if _, err := s.FilePath(bucket, name); err != nil {
+		return "", err
+	}
+	exp := strconv.FormatInt(time.Now().Add(expires).Unix(), 10)
+	query := url.Values{"expires": {exp}, "signature": {s.sign(bucket, name, exp)}}
+	return fmt.Sprintf("%s%s/%s/%s?%s", s.publicURL, LocalBlobPath, url.PathEscape(bucket),
+		(&url.URL{Path: name}).EscapedPath(), query.Encode()), nil
+}
+
+// Verify checks the expiry and signature of a URL created by SignURL.
+//
+// Inputs:
+//   - bucket, name: The object the URL points at.
+//   - expires: The "expires" query parameter, in Unix seconds.
+//   - signature: The "signature" query parameter.
+//
+// Outputs:
+//   - error: ErrInvalidSignature if the URL was not signed by this store or has expired.
+func (s *LocalBlobStore) Verify(bucket string, name string, expires string, signature string) error {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return ErrInvalidSignature
+	}
+	expected, err := hex.DecodeString(s.sign(bucket, name, expires))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	actual, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, actual) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// sign returns the hex encoded HMAC of the bucket, name and expiry.
+func (s *LocalBlobStore) sign(bucket string, name string, expires string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(bucket + "\n" + name + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// localBlobWriter writes to a temporary file that Close renames into place.
+type localBlobWriter struct {
+	ctx         context.Context
+	store       *LocalBlobStore
+	file        *os.File
+	path        string
+	bucket      string
+	name        string
+	contentType string
+	info        *BlobInfo
+}
+
+// Write appends to the temporary file, failing once the context is done.
+func (w *localBlobWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.file.Write(p)
+}
+
+// Close publishes the object, or discards it if the context is done.
+func (w *localBlobWriter) Close() error {
+	closeErr := w.file.Close()
+	if err := errors.Join(w.ctx.Err(), closeErr); err != nil {
+		_ = os.Remove(w.file.Name())
+		return fmt.Errorf("aborted write of %s/%s: %w", w.bucket, w.name, err)
+	}
+	// The sidecar is written first, so that the object is never seen
+	// without its content type.
+	meta := localMetaPath(w.path)
+	if len(w.contentType) > 0 {
+		if err := os.WriteFile(meta, []byte(w.contentType), 0o644); err != nil {
+			_ = os.Remove(w.file.Name())
+			return fmt.Errorf("failed to save the content type of %s/%s: %w", w.bucket, w.name, err)
+		}
+	} else {
+		_ = os.Remove(meta)
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		_ = os.Remove(w.file.Name())
+		return fmt.Errorf("failed to finalize %s/%s: %w", w.bucket, w.name, err)
+	}
+	info, err := w.store.Stat(w.ctx, w.bucket, w.name)
+	if err != nil {
+		return err
+	}
+	w.info = info
+	return nil
+}
+
+// Info returns the metadata of the written object.
+func (w *localBlobWriter) Info() *BlobInfo {
+	return w.info
+}
+
+// validBucket checks that the bucket name is a single path element.
+func validBucket(bucket string) error {
+	if len(bucket) == 0 || strings.ContainsAny(bucket, `/\`) || !filepath.IsLocal(bucket) {
+		return fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	return nil
+}
+
+// localInternal reports whether a file name is one of the store's own files:
+// a partially written object or a sidecar, or the acknowledgement marker of a
+// `DirectorySource` watching the bucket.
+func localInternal(base string) bool {
+	return strings.HasPrefix(base, localTempPrefix) || strings.HasPrefix(base, localMetaPrefix) ||
+		strings.HasPrefix(base, sourceAckedPrefix)
+}
+
+// localMetaPath returns the sidecar file of the object's file.
+func localMetaPath(p string) string {
+	return filepath.Join(filepath.Dir(p), localMetaPrefix+filepath.Base(p))
+}
+
+// localContentType returns the content type of an object: the one kept in its
+// sidecar, or else the one of its name's extension.
+func localContentType(name string, p string) string {
+	if saved, err := os.ReadFile(localMetaPath(p)); err == nil && len(saved) > 0 {
+		return string(saved)
+	}
+	if contentType := ContentTypeByName(name); len(contentType) > 0 {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// localBlobInfo converts the information of the object's file, at path p, to
+// a BlobInfo.
+func localBlobInfo(bucket string, name string, p string, fi fs.FileInfo) *BlobInfo {
+	return &BlobInfo{
+		Bucket:      bucket,
+		Name:        name,
+		ContentType: localContentType(name, p),
+		Size:        fi.Size(),
+		Generation:  fi.ModTime().UnixNano(),
+		Updated:     fi.ModTime(),
+	}
+}
+
+// localError adds the object to the error and makes a missing file match
+// ErrBlobNotExist.
+func localError(bucket string, name string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s/%s: %w", bucket, name, errors.Join(ErrBlobNotExist, err))
+	}
+	return fmt.Errorf("%s/%s: %w", bucket, name, err)
+}
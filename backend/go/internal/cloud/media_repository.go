@@ -0,0 +1,150 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines the `MediaRepository` abstraction, which stores the media
+// metadata and scene embeddings produced by the workflows and answers the
+// lookups and vector searches of the API.
+//
+// Logic Flow:
+//  1. At startup, `NewMediaRepository` reads the `[metadata_store]`
+//     configuration and creates either a `BigQueryMediaRepository` (the
+//     default) or a `SQLiteMediaRepository`, which keeps everything in a single
+//     local database file for running offline.
+//  2. The repository is shared through `ServiceClients.MediaRepository` and
+//     used by the persistence command, the embedding generator and the media
+//     and search services, so none of them build SQL themselves.
+//  3. A missing media object or scene is reported as `ErrMediaNotFound` by
+//     every implementation.
+//  4. The repository also keeps the usage ledger: a record of the tokens, and
+//     estimated cost, of every generation, summed by the budgets (see budget.go).
+//
+// Interfaces:
+//   - MediaRepository: Saves and reads media, scenes and embeddings, runs vector searches
+//     and keeps the usage ledger.
+//
+// Functions:
+//   - NewMediaRepository: Creates the repository selected by the configuration.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+)
+
+// Metadata backends that can be selected with `metadata_store.backend`.
+const (
+	MetadataBackendBigQuery = "bigquery" // BigQuery; the default.
+	MetadataBackendSQLite   = "sqlite"   // A local SQLite database file.
+)
+
+// Distance types for vector searches, selected with `metadata_store.distance_type`.
+const (
+	DistanceEuclidean = "EUCLIDEAN" // The straight-line distance; the default.
+	DistanceCosine    = "COSINE"    // One minus the cosine similarity.
+)
+
+// ErrMediaNotFound is matched by the errors returned for unknown media or scenes.
+var ErrMediaNotFound = errors.New("media not found")
+
+// MediaRepository stores media metadata and scene embeddings.
+type MediaRepository interface {
+	// SaveMedia stores the media object, including its cast and scenes.
+	SaveMedia(ctx context.Context, media *model.Media) error
+	// DeleteMedia removes the media object and its embeddings. Deleting a
+	// missing media object is not an error.
+	DeleteMedia(ctx context.Context, id string) error
+	// GetMedia returns the media object with the ID.
+	GetMedia(ctx context.Context, id string) (*model.Media, error)
+	// GetScene returns the scene of the media object with the sequence number.
+	GetScene(ctx context.Context, id string, sequence int) (*model.Scene, error)
+	// ListUnembeddedMedia returns the media objects that have no embeddings yet.
+	ListUnembeddedMedia(ctx context.Context) ([]*model.Media, error)
+	// SaveEmbeddings stores the scene embeddings.
+	SaveEmbeddings(ctx context.Context, embeddings []*model.SceneEmbedding) error
+	// FindScenes returns the scenes whose embeddings are nearest to the vector,
+	// nearest first.
+	FindScenes(ctx context.Context, vector []float64, limit int) ([]*model.SceneMatchResult, error)
+	// RecordUsage appends the usage of a generation to the usage ledger.
+	RecordUsage(ctx context.Context, record *model.UsageRecord) error
+	// SumUsage returns the total usage of the ledger since the time; its
+	// model is empty.
+	SumUsage(ctx context.Context, since time.Time) (*model.TokenUsage, error)
+}
+
+// NewMediaRepository creates the repository selected by the configuration.
+//
+// Inputs:
+//   - ctx: The context used to open the repository.
+//   - config: The application configuration.
+//   - client: The BigQuery client; only used by the BigQuery backend.
+//
+// Outputs:
+//   - MediaRepository: The configured repository.
+//   - error: An error if the backend is unknown or cannot be opened.
+func NewMediaRepository(ctx context.Context, config *Config, client *bigquery.Client) (MediaRepository, error) {
+	distance, err := distanceType(config.MetadataStore.DistanceType)
+	if err != nil {
+		return nil, err
+	}
+	switch config.MetadataStore.Backend {
+	case "", MetadataBackendBigQuery:
+		return NewBigQueryMediaRepository(client, config.BigQueryDataSource, distance), nil
+	case MetadataBackendSQLite:
+		return NewSQLiteMediaRepository(ctx, config.MetadataStore.SQLitePath, distance)
+	default:
+		return nil, fmt.Errorf("unknown metadata backend %q", config.MetadataStore.Backend)
+	}
+}
+
+// distanceType validates a configured distance type, defaulting to Euclidean.
+func distanceType(value string) (string, error) {
+	switch strings.ToUpper(value) {
+	case "", DistanceEuclidean:
+		return DistanceEuclidean, nil
+	case DistanceCosine:
+		return DistanceCosine, nil
+	default:
+		return "", fmt.Errorf("unknown distance type %q", value)
+	}
+}
+
+// vectorDistance computes the distance between two vectors of equal length.
+func vectorDistance(distance string, a []float64, b []float64) float64 {
+	if distance == DistanceCosine {
+		var dot, normA, normB float64
+		for i := range a {
+			dot += a[i] * b[i]
+			normA += a[i] * a[i]
+			normB += b[i] * b[i]
+		}
+		if normA == 0 || normB == 0 {
+			return 1
+		}
+		return 1 - dot/(math.Sqrt(normA)*math.Sqrt(normB))
+	}
+	var sum float64
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
@@ -0,0 +1,683 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines a generic, reusable message listener. The core idea
+// is to abstract the complexity of receiving messages from a `MessageSource`
+// (a Pub/Sub subscription, an in-process queue or a watched directory)
+// and to delegate the actual message processing to a "Command". This promotes
+// separation of concerns, making the code cleaner and more modular.
+//
+// Logic Flow:
+//  1. An instance of MessageListener is created with a message source.
+//  2. A "Command" (a piece of business logic) is attached to this listener.
+//  3. The `Listen` method is called, which starts an asynchronous background process (a goroutine).
+//  4. This goroutine continuously waits for new messages from the source.
+//  5. When a message arrives, it's passed to the attached Command for processing.
+//  6. The message is "acknowledged" (Ack'd) only if the Command completes successfully,
+//     ensuring reliable, at-least-once message processing. A failed message is
+//     Nack'd, so that it is redelivered following the subscription's retry
+//     policy rather than once the client library stops extending its lease.
+//  7. A panic in the Command is recovered, recorded on the message's span and
+//     counted, and the message is Nack'd so the listener keeps serving.
+//  8. With a `DeadLetterPolicy`, a message that still fails on its last delivery
+//     attempt is saved for replay and published to the dead-letter topic (see
+//     dead_letter.go), and then acknowledged instead of being redelivered forever.
+//     A failure that declares itself permanent (e.g., a `GenerationError` for a
+//     prompt blocked by safety filters) is dead-lettered on its first attempt.
+//     The workflow checkpoint of a dead-lettered message is deleted, since no
+//     redelivery will resume it. Deliveries the listener Nack'd without a
+//     failure (see 10 to 13) are left out of the attempts, even though a
+//     source such as Pub/Sub counts every delivery.
+//  9. With a `FlowControl`, a message waits before its command runs until it
+//     fits within the listener's outstanding message and byte limits (see
+//     flow_control.go), whatever the message source. Replays of dead letters
+//     and deferred messages wait the same way, and for the circuit breakers.
+//  10. With circuit breakers, a message waits before its command runs while
+//     a breaker is open, so the listener stops taking messages during an
+//     outage (see circuit_breaker.go). A chain that still hits an open
+//     circuit is Nack'd without counting as a failed attempt.
+//  11. With a deferral queue, a message whose chain is refused by a spent
+//     daily or monthly budget is moved to the queue and acknowledged, and
+//     replayed once the budget allows it (see deferral.go). Without one, it
+//     is Nack'd for redelivery. Either way, the refusal does not count as a
+//     failed attempt.
+//  12. In dry-run mode, the chain only plans the message. The listener then
+//     stops receiving, rather than planning the redelivered message over and
+//     over, and Nacks the message so that it is processed once dry-run mode
+//     is turned off.
+//  13. `Shutdown` stops receiving and waits for the running commands. Those
+//     still running when its context expires are canceled through their
+//     context, and their messages are Nack'd for redelivery.
+//  14. The entire process is instrumented with OpenTelemetry for tracing and monitoring.
+//
+// Structs:
+//   - MessageListener: Holds a message source and the command that will
+//     process incoming messages.
+//
+// Functions:
+//   - NewMessageListener: Constructor for creating a new MessageListener.
+//   - NewPubSubListener: Constructor for a listener on a Pub/Sub subscription.
+//   - SetCommand: Attaches a processing command to the listener.
+//   - SetDeadLetterPolicy: Sets when and where failing messages are dead-lettered.
+//   - SetFlowControl: Bounds the messages and bytes processed at once.
+//   - SetCircuitBreakers: Pauses the listener while a breaker is open.
+//   - SetDeferralQueue: Sets where messages refused by a spent budget wait.
+//   - Listen: Starts the background process to receive and handle messages.
+//   - Shutdown: Stops receiving and drains the running commands.
+//   - Replay: Runs the listener's command on the payload of a dead letter.
+//   - handle: Processes a single message, isolating panics.
+//   - admit: Waits for the circuit breakers and the flow control.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MessageListener is a struct that encapsulates the components needed to listen
+// to a message source. It acts as a wrapper that connects a source to a
+// processing command. Since listeners have a life-cycle independent of
+// individual API requests, they are considered a core "cloud" component.
+type MessageListener struct {
+	source     MessageSource     // The source this listener will receive messages from.
+	command    cor.Command       // The command to execute for each message received. This is part of the Chain of Responsibility (CoR) pattern.
+	deadLetter *DeadLetterPolicy // When and where failing messages are dead-lettered; nil to redeliver them forever.
+	flow       *flowController   // The outstanding limits of the listener; nil if unlimited.
+	breakers   []*CircuitBreaker // The breakers of the services the command calls; the listener pauses while one is open.
+	deferral   *DeferralQueue    // Where messages refused by a spent budget wait; nil to leave them for redelivery.
+	name       string            // The logical name of the listener, recorded with its deferred messages.
+
+	checkpoints cor.CheckpointStore // The checkpoints of the command's runs; nil if it does not checkpoint.
+	runID       cor.RunIDFunc       // Derives the checkpoint run ID of a message from its chain context.
+
+	mu         sync.Mutex         // Guards attempts, requeued and the fields set by Listen.
+	attempts   map[string]int     // The failed attempts of messages whose source does not count deliveries, keyed by message ID.
+	requeued   map[string]int     // The deliveries of messages Nack'd for another reason than a failure, keyed by message ID.
+	stop       context.CancelFunc // Stops receiving new messages; set by Listen.
+	cancelWork context.CancelFunc // Cancels the running commands; set by Listen.
+	done       chan struct{}      // Closed once Receive, and every handler, has returned; set by Listen.
+	inFlight   atomic.Int64       // The messages whose command is running.
+}
+
+// shutdownCancelGrace bounds the wait for canceled commands to return.
+const shutdownCancelGrace = 10 * time.Second
+
+// NewMessageListener is the constructor for creating a MessageListener. It
+// initializes the listener with the source to listen to and the command that
+// will process the messages.
+//
+// Inputs:
+//   - source: The MessageSource delivering the messages.
+//   - command: A cor.Command that defines the business logic to execute on each message; may be nil.
+//
+// Outputs:
+//   - *MessageListener: A pointer to the newly created and configured listener.
+func NewMessageListener(source MessageSource, command cor.Command) *MessageListener {
+	return &MessageListener{source: source, command: command, attempts: make(map[string]int), requeued: make(map[string]int)}
+}
+
+// NewPubSubListener creates a listener on a Pub/Sub subscription.
+//
+// Inputs:
+//   - pubsubClient: An authenticated *pubsub.Client for connecting to the service.
+//   - subscriptionID: The string ID of the subscription (e.g., "my-subscription").
+//   - command: A cor.Command that defines the business logic to execute on each message.
+//
+// Outputs:
+//   - *MessageListener: A pointer to the newly created and configured listener.
+//   - error: An error if the listener could not be created (though in this implementation, it always returns nil).
+func NewPubSubListener(
+	pubsubClient *pubsub.Client,
+	subscriptionID string,
+	command cor.Command,
+) (cmd *MessageListener, err error) {
+	return NewMessageListener(NewPubSubSource(pubsubClient, subscriptionID), command), nil
+}
+
+// Source returns the listener's message source, e.g. to publish to a
+// ChannelSource.
+func (m *MessageListener) Source() MessageSource {
+	return m.source
+}
+
+// SetCommand is a setter method that attaches a command to the listener.
+// This is useful for scenarios where the listener is created before the full
+// processing chain (the command) is assembled. It ensures that a command is not
+// accidentally overwritten.
+//
+// Inputs:
+//   - command: The cor.Command to be executed when a message is received.
+func (m *MessageListener) SetCommand(command cor.Command) {
+	// Only set the command if it hasn't been set already. This prevents
+	// accidental overwrites and ensures the initial configuration is respected.
+	if m.command == nil {
+		m.command = command
+	}
+}
+
+// SetDeadLetterPolicy sets when and where the listener dead-letters the
+// messages that keep failing.
+//
+// Inputs:
+//   - policy: The dead-letter policy; nil to redeliver failing messages forever.
+func (m *MessageListener) SetDeadLetterPolicy(policy *DeadLetterPolicy) {
+	m.deadLetter = policy
+}
+
+// DeadLetterPolicy returns the listener's dead-letter policy, or nil.
+func (m *MessageListener) DeadLetterPolicy() *DeadLetterPolicy {
+	return m.deadLetter
+}
+
+// SetFlowControl bounds the messages, and bytes, the listener processes at
+// once. It must be called before Listen.
+//
+// Inputs:
+//   - fc: The flow control settings; zero limits are unlimited.
+func (m *MessageListener) SetFlowControl(fc FlowControl) {
+	m.flow = newFlowController(fc)
+}
+
+// SetCircuitBreakers sets the breakers of the services the listener's command
+// calls. While one is open, messages wait before their command runs. It must
+// be called before Listen.
+//
+// Inputs:
+//   - breakers: The circuit breakers.
+func (m *MessageListener) SetCircuitBreakers(breakers ...*CircuitBreaker) {
+	m.breakers = breakers
+}
+
+// SetDeferralQueue sets where the listener moves the messages refused by a
+// spent budget. It must be called before Listen.
+//
+// Inputs:
+//   - name: The logical name of the listener, which replays the messages.
+//   - queue: The deferral queue; nil to leave the messages for redelivery.
+func (m *MessageListener) SetDeferralQueue(name string, queue *DeferralQueue) {
+	m.name, m.deferral = name, queue
+}
+
+// SetCheckpoints sets the store of the checkpoints of the listener's command,
+// so that the checkpoint of a message is deleted once the message is
+// dead-lettered. It must be called before Listen.
+//
+// Inputs:
+//   - store: The checkpoint store of the command; nil if it does not checkpoint.
+//   - runID: Derives the run ID of a message, as the command's chain does.
+func (m *MessageListener) SetCheckpoints(store cor.CheckpointStore, runID cor.RunIDFunc) {
+	m.checkpoints, m.runID = store, runID
+}
+
+// DropCheckpoint deletes the checkpoint of the run of a message's payload,
+// when the run will not be resumed. A failure is only logged, since the
+// checkpoint is then merely left behind.
+//
+// Inputs:
+//   - ctx: The context of the deletion.
+//   - data: The payload of the message.
+func (m *MessageListener) DropCheckpoint(ctx context.Context, data string) {
+	if m.checkpoints == nil || m.runID == nil {
+		return
+	}
+	chainCtx := cor.NewBaseContext()
+	defer chainCtx.Close()
+	chainCtx.SetContext(ctx)
+	chainCtx.Add(cor.CtxIn, data)
+	runID := m.runID(chainCtx)
+	if len(runID) == 0 {
+		return
+	}
+	if err := m.checkpoints.Delete(ctx, runID); err != nil {
+		log.Printf("failed to delete the checkpoint of %s: %v", runID, err)
+	}
+}
+
+// Listen starts the asynchronous message receiving process. It runs in a separate
+// goroutine so it doesn't block the main application thread. This allows the server
+// to continue handling other tasks (like API requests) while listening for messages
+// in the background.
+//
+// Inputs:
+//   - ctx: A context.Context that controls the lifecycle of the listener. If this
+//     context is canceled (e.g., during graceful shutdown), the message receiving will stop.
+func (m *MessageListener) Listen(ctx context.Context) {
+	log.Printf("listening: %s", m.source.Name())
+
+	// The commands run on `work`, which Shutdown cancels only once draining
+	// has timed out; the source receives on `receive`, which Shutdown cancels
+	// first so that no new message is accepted.
+	work, cancelWork := context.WithCancel(ctx)
+	receive, stop := context.WithCancel(work)
+	done := make(chan struct{})
+	m.mu.Lock()
+	m.stop, m.cancelWork, m.done = stop, cancelWork, done
+	m.mu.Unlock()
+
+	// Launch a new goroutine for the background work. This is the Go way of
+	// handling concurrent, non-blocking operations.
+	go func() {
+		defer close(done)
+		defer cancelWork()
+
+		// Create a tracer for this specific listener. The tracer is used to create "spans"
+		// which are units of work in a distributed trace, helping to monitor and debug.
+		tracer := otel.Tracer("message-listener")
+
+		// The source's Receive method blocks and waits for messages. It takes a
+		// callback function that will be executed for each message that arrives.
+		err := m.source.Receive(receive, func(_ context.Context, msg *Message) {
+			m.handle(receive, work, tracer, msg)
+		})
+
+		// If the Receive call exits (e.g., because the context was canceled),
+		// check if there was an error and log it.
+		if err != nil {
+			log.Printf("error receiving data: %v", err)
+		}
+	}()
+}
+
+// Shutdown stops receiving messages and waits for the running commands to
+// finish. If the context expires first, the commands are canceled through
+// their context and their messages Nack'd; their temporary files are removed
+// as usual when their chain context is closed.
+//
+// Inputs:
+//   - ctx: The context bounding the wait for the running commands.
+//
+// Outputs:
+//   - error: An error if commands had to be canceled, or did not return once canceled.
+func (m *MessageListener) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	stop, cancelWork, done := m.stop, m.cancelWork, m.done
+	m.mu.Unlock()
+	if done == nil {
+		// Listen was never called.
+		return nil
+	}
+
+	stop()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	running := m.inFlight.Load()
+	log.Printf("%s: canceling %d running messages", m.source.Name(), running)
+	cancelWork()
+	select {
+	case <-done:
+		return fmt.Errorf("%s: canceled %d running messages: %w", m.source.Name(), running, ctx.Err())
+	case <-time.After(shutdownCancelGrace):
+		return fmt.Errorf("%s: %d messages still running after being canceled", m.source.Name(), m.inFlight.Load())
+	}
+}
+
+// stopReceiving stops the source from delivering new messages; the running
+// commands go on.
+func (m *MessageListener) stopReceiving() {
+	m.mu.Lock()
+	stop := m.stop
+	m.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// handle processes a single message. A panic that escapes the command is
+// recovered here, so that one bad message cannot take down the listener (or
+// the server); the message is then Nack'd so that the source redelivers it
+// (for Pub/Sub, according to the subscription's retry and dead-letter policy).
+//
+// Inputs:
+//   - ctx: The receiving context, canceled when the listener stops accepting messages.
+//   - work: The context of the commands, canceled when the listener stops draining them.
+//   - tracer: The tracer used for the message's span.
+//   - msg: The received message.
+func (m *MessageListener) handle(ctx context.Context, work context.Context, tracer trace.Tracer, msg *Message) {
+	// A message delivered, or still waiting, once the listener stops is left
+	// to be redelivered.
+	if m.admit(ctx, msg) != nil {
+		m.requeue(msg)
+		return
+	}
+	defer m.flow.release(msg)
+	m.inFlight.Add(1)
+	defer m.inFlight.Add(-1)
+
+	// Start a new span for the processing of this specific message. This allows
+	// us to trace the journey of a single message through the system.
+	spanCtx, span := tracer.Start(work, "receive-message")
+	defer span.End()
+	// Attach the message data as an attribute to the span for better traceability.
+	span.SetAttributes(attribute.String("msg", string(msg.Data)))
+	log.Println("received message")
+
+	// Create a new context for the Chain of Responsibility (CoR). This context
+	// will carry data through the different steps of the processing command.
+	// Closing it removes any temporary files, even after a panic.
+	chainCtx := cor.NewBaseContext()
+	defer chainCtx.Close()
+	chainCtx.SetContext(spanCtx)              // Pass the tracing span's context into the chain.
+	chainCtx.Add(cor.CtxIn, string(msg.Data)) // Add the message data as the initial input.
+
+	defer func() {
+		if r := recover(); r != nil {
+			err := cor.RecordPanic(spanCtx, m.command.GetName(), r)
+			if work.Err() != nil {
+				m.requeue(msg)
+				return
+			}
+			m.fail(spanCtx, msg, map[string]error{m.command.GetName(): err})
+		}
+	}()
+
+	// Execute the command attached to the listener, passing the chain's context.
+	m.command.Execute(chainCtx)
+
+	switch {
+	case work.Err() != nil:
+		// The listener canceled the command while shutting down. The failure
+		// is not the message's fault, so it is redelivered without counting
+		// toward its dead-letter attempts.
+		span.SetStatus(codes.Error, "canceled")
+		log.Printf("canceled message %s on shutdown", msg.ID)
+		m.requeue(msg)
+
+	case chainCtx.Get(cor.CtxPlan) != nil:
+		// A dry run did not process the message, so it is Nack'd, and
+		// redelivered rather than lost once dry-run mode is turned off. The
+		// listener stops receiving first, so that it does not plan the
+		// redelivered message again and again.
+		span.SetStatus(codes.Ok, "dry run")
+		log.Printf("dry run; planned message %s, no longer receiving from %s", msg.ID, m.source.Name())
+		m.stopReceiving()
+		m.requeue(msg)
+
+	case circuitOpen(chainCtx.GetErrors()):
+		// A service was down. The message is redelivered without counting
+		// toward its dead-letter attempts, once the circuit lets calls through.
+		span.SetStatus(codes.Error, "circuit open")
+		log.Printf("circuit open; redelivering message %s", msg.ID)
+		m.requeue(msg)
+
+	case deferrable(chainCtx.GetErrors()):
+		// A budget is spent. The message waits for it without counting toward
+		// its dead-letter attempts.
+		span.SetStatus(codes.Error, "budget exceeded")
+		m.deferMessage(spanCtx, msg, chainCtx.GetErrors())
+
+	case !chainCtx.HasErrors():
+		// If successful, set the span's status to Ok and acknowledge the message.
+		// This tells the source that the message has been successfully processed and
+		// must not be delivered again.
+		span.SetStatus(codes.Ok, "success")
+		m.forget(msg)
+		m.source.Ack(msg)
+
+	default:
+		// If there were errors, set the span's status to Error and log each error
+		// that occurred during the chain's execution.
+		span.SetStatus(codes.Error, "failed")
+		errs := chainCtx.GetErrors()
+		for _, e := range errs {
+			log.Printf("error executing chain: %v", e)
+		}
+		m.fail(spanCtx, msg, errs)
+	}
+}
+
+// fail settles a message whose command failed. On the last delivery attempt of
+// a dead-letter policy, or at once if a failure is permanent (see `permanent`),
+// the message is dead-lettered and acknowledged. Otherwise it is Nack'd, and
+// redelivered with the backoff of the subscription's retry policy. Leaving it
+// unsettled would not do: the Pub/Sub client keeps extending the lease of an
+// unsettled message up to `ReceiveSettings.MaxExtension`, an hour by default.
+//
+// Inputs:
+//   - ctx: The context of the message's span.
+//   - msg: The failed message.
+//   - errs: The errors of the chain, keyed by command name.
+func (m *MessageListener) fail(ctx context.Context, msg *Message, errs map[string]error) {
+	if m.deadLetter.enabled() {
+		attempt := m.attempt(msg)
+		if attempt >= m.deadLetter.MaxDeliveryAttempts || permanent(errs) {
+			letter := NewDeadLetter(m.deadLetter.Listener, msg, errs)
+			letter.DeliveryAttempt = attempt
+			if err := m.sendDeadLetter(ctx, letter); err != nil {
+				// The message stays with its source and is dead-lettered again
+				// on its next delivery.
+				log.Printf("failed to dead-letter message %s: %v", msg.ID, err)
+			} else {
+				log.Printf("dead-lettered message %s after %d attempts (permanent: %t)", msg.ID, attempt, permanent(errs))
+				m.forget(msg)
+				m.source.Ack(msg)
+				return
+			}
+		}
+	}
+	m.source.Nack(msg)
+}
+
+// deferMessage moves a message refused by a spent budget to the deferral
+// queue and acknowledges it. Without a queue, or if it cannot be saved, the
+// message is Nack'd, and redelivered following the subscription's retry policy.
+//
+// Inputs:
+//   - ctx: The context of the message's span.
+//   - msg: The refused message.
+//   - errs: The errors of the chain, keyed by command name.
+func (m *MessageListener) deferMessage(ctx context.Context, msg *Message, errs map[string]error) {
+	if m.deferral == nil {
+		log.Printf("budget exceeded; redelivering message %s", msg.ID)
+		m.requeue(msg)
+		return
+	}
+	letter := NewDeadLetter(m.name, msg, errs)
+	letter.DeliveryAttempt = m.failedAttempts(msg)
+	if err := m.deferral.Defer(ctx, letter); err != nil {
+		log.Printf("failed to defer message %s: %v", msg.ID, err)
+		m.requeue(msg)
+		return
+	}
+	log.Printf("budget exceeded; deferred message %s", msg.ID)
+	m.forget(msg)
+	m.source.Ack(msg)
+}
+
+// failedAttempts returns the failed delivery attempts of a message before the
+// current one.
+func (m *MessageListener) failedAttempts(msg *Message) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg.DeliveryAttempt > 0 {
+		return msg.DeliveryAttempt - 1 - m.requeued[msg.ID]
+	}
+	return m.attempts[msg.ID]
+}
+
+// circuitOpen reports whether a failure of the chain was a call refused by an
+// open circuit breaker.
+func circuitOpen(errs map[string]error) bool {
+	for _, err := range errs {
+		if errors.Is(err, ErrCircuitOpen) {
+			return true
+		}
+	}
+	return false
+}
+
+// permanent reports whether a failure of the chain would happen again on
+// redelivery: an error with a `Permanent() bool` method that returns true or,
+// for an error without one, a `Retryable() bool` method that returns false.
+// An open circuit is not: the dependency is expected back once it cools down.
+func permanent(errs map[string]error) bool {
+	for _, err := range errs {
+		if errors.Is(err, ErrCircuitOpen) {
+			continue
+		}
+		var declared interface{ Permanent() bool }
+		if errors.As(err, &declared) {
+			if declared.Permanent() {
+				return true
+			}
+			continue
+		}
+		var classified interface{ Retryable() bool }
+		if errors.As(err, &classified) && !classified.Retryable() {
+			return true
+		}
+	}
+	return false
+}
+
+// attempt returns the delivery attempt of a failed message: the source's
+// count, less the deliveries the listener Nack'd without a failure, if it has
+// one, or else the failures counted by the listener.
+func (m *MessageListener) attempt(msg *Message) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg.DeliveryAttempt > 0 {
+		return msg.DeliveryAttempt - m.requeued[msg.ID]
+	}
+	m.attempts[msg.ID]++
+	return m.attempts[msg.ID]
+}
+
+// requeue Nacks a message that did not fail (e.g., one refused by an open
+// circuit, or canceled on shutdown). The source counts the redelivery as a
+// delivery attempt all the same, so the listener remembers it, and `attempt`
+// leaves it out. The count is kept in memory: a message redelivered to
+// another instance counts these deliveries again.
+func (m *MessageListener) requeue(msg *Message) {
+	if msg.DeliveryAttempt > 0 {
+		m.mu.Lock()
+		m.requeued[msg.ID]++
+		m.mu.Unlock()
+	}
+	m.source.Nack(msg)
+}
+
+// forget drops the attempts counted for a settled message.
+func (m *MessageListener) forget(msg *Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, msg.ID)
+	delete(m.requeued, msg.ID)
+}
+
+// admit waits until a message may run: while a service the command calls is
+// down, rather than running the message into its open circuit, and until the
+// message fits within the flow control limits. Once it returns nil, the
+// caller must release the message from the flow control.
+//
+// Inputs:
+//   - ctx: The context bounding the wait.
+//   - msg: The message to run.
+//
+// Outputs:
+//   - error: The context's error if it ended the wait.
+func (m *MessageListener) admit(ctx context.Context, msg *Message) error {
+	for _, breaker := range m.breakers {
+		if !breaker.refusing() {
+			continue
+		}
+		log.Printf("%s: paused while circuit breaker %s is open", m.source.Name(), breaker.Name())
+		if err := breaker.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.flow.acquire(ctx, msg)
+}
+
+// sendDeadLetter saves a dead letter to the policy's store and publishes it
+// to the policy's topic. The save comes first: it is keyed by the letter's ID,
+// so repeating it when the message is dead-lettered again is harmless, while
+// a publish followed by a failed save would be published again.
+func (m *MessageListener) sendDeadLetter(ctx context.Context, letter *DeadLetter) error {
+	if store := m.deadLetter.Store; store != nil {
+		if err := store.Save(ctx, letter); err != nil {
+			return fmt.Errorf("failed to save dead letter: %w", err)
+		}
+	}
+	if topic := m.deadLetter.Topic; topic != nil {
+		if _, err := topic.Publish(ctx, letter.PubSubMessage()).Get(ctx); err != nil {
+			return fmt.Errorf("failed to publish to %s: %w", topic.ID(), err)
+		}
+	}
+	// A replay of the dead letter starts over.
+	m.DropCheckpoint(ctx, letter.Data)
+	return nil
+}
+
+// Replay runs the listener's command on the payload of a dead letter, as if
+// its message had been delivered again: it waits for the circuit breakers and
+// the flow control like a delivered message, so that replays cannot exceed
+// the listener's limits.
+//
+// Inputs:
+//   - ctx: The context of the replay.
+//   - letter: The dead letter to replay.
+//
+// Outputs:
+//   - map[string]error: The errors of the chain, keyed by command name; empty
+//     on success. If the context ends while the replay waits to run, it holds
+//     the context's error.
+func (m *MessageListener) Replay(ctx context.Context, letter *DeadLetter) (errs map[string]error) {
+	msg := &Message{ID: letter.MessageID, Data: []byte(letter.Data), Attributes: letter.Attributes}
+	if err := m.admit(ctx, msg); err != nil {
+		return map[string]error{m.command.GetName(): err}
+	}
+	defer m.flow.release(msg)
+
+	ctx, span := otel.Tracer("message-listener").Start(ctx, "replay-message")
+	defer span.End()
+	span.SetAttributes(attribute.String("msg", letter.Data), attribute.String("dead_letter", letter.ID))
+
+	chainCtx := cor.NewBaseContext()
+	defer chainCtx.Close()
+	chainCtx.SetContext(ctx)
+	chainCtx.Add(cor.CtxIn, letter.Data)
+
+	defer func() {
+		if r := recover(); r != nil {
+			errs = map[string]error{m.command.GetName(): cor.RecordPanic(ctx, m.command.GetName(), r)}
+		}
+	}()
+	m.command.Execute(chainCtx)
+	if chainCtx.HasErrors() {
+		span.SetStatus(codes.Error, "failed")
+	} else {
+		span.SetStatus(codes.Ok, "success")
+	}
+	return chainCtx.GetErrors()
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines the `MessageSource` abstraction, which delivers the events
+// that trigger the workflows. It decouples `MessageListener` from Pub/Sub, so
+// that the same workflows are driven the same way in local development as in
+// production.
+//
+// Logic Flow:
+//  1. Each `[topic_subscriptions.<name>]` entry of the configuration selects a
+//     source with `source`: "pubsub" (the default), "channel" for an
+//     in-process queue, or "directory" for a watched local directory.
+//  2. `NewMessageSource` creates the source; `NewCloudServiceClients` wraps
+//     each one in a `MessageListener`.
+//  3. The listener calls `Receive`, which blocks and invokes the handler for
+//     every delivered message until the context is canceled.
+//  4. The handler settles each message with `Ack` (processed) or `Nack`
+//     (redeliver now). A message that is neither is redelivered by sources
+//     with an acknowledgement deadline once the deadline passes;
+//     `ExtendDeadline` postpones it for long-running work.
+//  5. Every source takes the subscription's flow control (see flow_control.go)
+//     with `SetFlowControl`.
+//
+// Interfaces:
+//   - MessageSource: Receives and settles messages.
+//
+// Functions:
+//   - NewMessageSource: Creates the source selected by a subscription's configuration.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Message sources that can be selected with `topic_subscriptions.<name>.source`.
+const (
+	MessageSourcePubSub    = "pubsub"    // A Pub/Sub subscription; the default.
+	MessageSourceChannel   = "channel"   // An in-process queue, fed with ChannelSource.Publish.
+	MessageSourceDirectory = "directory" // New files in a local directory.
+)
+
+// ErrMessageNotLeased is returned when settling a message that has already
+// been settled or whose deadline has expired.
+var ErrMessageNotLeased = errors.New("message is no longer leased")
+
+// Message is a single delivery of a source. The same message is delivered
+// again, with the same ID and a higher DeliveryAttempt, after a Nack or an
+// expired deadline.
+type Message struct {
+	ID              string            // The ID assigned by the source.
+	Data            []byte            // The payload; a `GCSPubSubNotification` for storage events.
+	Attributes      map[string]string // The attributes of the message, if any.
+	DeliveryAttempt int               // The delivery attempt, starting at 1; 0 if the source does not count.
+	PublishTime     time.Time         // The time the message was published.
+
+	handle interface{} // The source's own representation of the delivery.
+}
+
+// MessageSource delivers messages to a handler and settles them.
+type MessageSource interface {
+	// Name returns a description of the source for logs.
+	Name() string
+	// Receive calls the handler for every message, possibly concurrently, and
+	// blocks until the context is canceled and all handlers have returned.
+	Receive(ctx context.Context, handler func(context.Context, *Message)) error
+	// Ack marks the message as processed.
+	Ack(msg *Message)
+	// Nack asks for the message to be redelivered.
+	Nack(msg *Message)
+	// ExtendDeadline postpones the redelivery of an unsettled message.
+	ExtendDeadline(msg *Message, extension time.Duration) error
+	// SetFlowControl applies the flow control settings the source can
+	// enforce; it must be called before Receive.
+	SetFlowControl(fc FlowControl)
+}
+
+// NewMessageSource creates the source selected by a subscription's configuration.
+//
+// Inputs:
+//   - name: The logical name of the subscription (e.g., "HiResTopic").
+//   - subscription: The subscription's configuration.
+//   - client: The Pub/Sub client; only used by Pub/Sub sources.
+//   - storage: The storage configuration, which locates the directory of a
+//     directory source that does not set `watch_dir`.
+//
+// Outputs:
+//   - MessageSource: The configured source.
+//   - error: An error if the source is unknown or misconfigured.
+func NewMessageSource(name string, subscription TopicSubscription, client *pubsub.Client, storage Storage) (MessageSource, error) {
+	source, err := newMessageSource(name, subscription, client, storage)
+	if err != nil {
+		return nil, err
+	}
+	source.SetFlowControl(subscription.FlowControl())
+	return source, nil
+}
+
+// newMessageSource creates the source of NewMessageSource, before its flow control is set.
+func newMessageSource(name string, subscription TopicSubscription, client *pubsub.Client, storage Storage) (MessageSource, error) {
+	deadline := time.Duration(subscription.TimeoutInSeconds) * time.Second
+	switch subscription.Source {
+	case "", MessageSourcePubSub:
+		source := NewPubSubSource(client, subscription.Name)
+		source.SetAckDeadline(deadline)
+		return source, nil
+	case MessageSourceChannel:
+		return NewChannelSource(name, 100, deadline), nil
+	case MessageSourceDirectory:
+		if len(subscription.Bucket) == 0 {
+			return nil, fmt.Errorf("directory source %s requires a bucket", name)
+		}
+		dir := subscription.WatchDir
+		if len(dir) == 0 {
+			if len(storage.LocalRoot) == 0 {
+				return nil, fmt.Errorf("directory source %s requires watch_dir or storage.local_root", name)
+			}
+			dir = filepath.Join(storage.LocalRoot, subscription.Bucket)
+		}
+		interval := time.Duration(subscription.PollIntervalSeconds) * time.Second
+		return NewDirectorySource(dir, subscription.Bucket, interval, deadline)
+	default:
+		return nil, fmt.Errorf("unknown message source %q for %s", subscription.Source, name)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file implements `Embedder` on an OpenAI-compatible embeddings endpoint,
+// such as a self-hosted text-embeddings server or a local Ollama server.
+//
+// Logic Flow:
+//  1. The texts are POSTed as the `input` list of `<endpoint>/embeddings`,
+//     with the configured dimension as `dimensions` and the API key as a
+//     bearer token, if they are set.
+//  2. The returned vectors are put back in the order of the texts using their
+//     `index`, since servers are not required to keep the order.
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// OpenAIEmbedder embeds texts with an OpenAI-compatible embeddings API.
+type OpenAIEmbedder struct {
+	endpoint   string       // The base URL of the API (e.g., "http://localhost:8000/v1").
+	apiKey     string       // The bearer token; empty for servers without authentication.
+	model      string       // The name of the served model.
+	dimension  int          // The requested dimension; the model's default if zero.
+	httpClient *http.Client // The client used for requests.
+}
+
+// NewOpenAIEmbedder creates an embedder on an OpenAI-compatible endpoint.
+//
+// Inputs:
+//   - endpoint: The base URL of the API, without "/embeddings".
+//   - apiKey: The API key; may be empty.
+//   - model: The name of the served model.
+//   - dimension: The requested dimension; the model's default if zero.
+//
+// Outputs:
+//   - *OpenAIEmbedder: A pointer to the new embedder.
+func NewOpenAIEmbedder(endpoint string, apiKey string, model string, dimension int) *OpenAIEmbedder {
+	return &OpenAIEmbedder{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		apiKey:     apiKey,
+		model:      model,
+		dimension:  dimension,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// openAIEmbeddingRequest is the body of an embeddings request.
+type openAIEmbeddingRequest struct {
+	Model      string   `json:"model"`
+	Input      []string `json:"input"`
+	Dimensions int      `json:"dimensions,omitempty"`
+}
+
+// openAIEmbeddingResponse is the part of an embeddings response that is read.
+type openAIEmbeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+}
+
+// Name returns the name of the served model.
+func (e *OpenAIEmbedder) Name() string {
+	return e.model
+}
+
+// Dimension returns the requested dimension.
+func (e *OpenAIEmbedder) Dimension() int {
+	return e.dimension
+}
+
+// Embed sends the texts in a single embeddings request.
+func (e *OpenAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float64, error) {
+	payload, err := json.Marshal(openAIEmbeddingRequest{Model: e.model, Input: texts, Dimensions: e.dimension})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+"/embeddings", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(e.apiKey) > 0 {
+		req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	}
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+
+	var decoded openAIEmbeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	out := make([][]float64, len(texts))
+	for _, d := range decoded.Data {
+		if d.Index < 0 || d.Index >= len(out) || out[d.Index] != nil {
+			return nil, fmt.Errorf("unexpected embedding index %d", d.Index)
+		}
+		out[d.Index] = d.Embedding
+	}
+	for i, vector := range out {
+		if vector == nil {
+			return nil, fmt.Errorf("no embedding for input %d", i)
+		}
+	}
+	return out, nil
+}
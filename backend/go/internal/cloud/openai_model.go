@@ -0,0 +1,262 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file implements `GenerativeModel` on an OpenAI-compatible chat
+// completions endpoint, such as a self-hosted vLLM or a local Ollama server.
+//
+// Logic Flow:
+//  1. The request becomes a single user message whose content is the prompt
+//     text followed by one part per media file: `image_url` for images and
+//     `video_url` (a common extension for video models) for videos. A `gs://`
+//     URI, which only Google services can read, is replaced by a signed URL of
+//     the blob store (valid for `openAIMediaURLExpiry`); other URIs must be
+//     reachable by the server as they are.
+//  2. The configured system instructions, sampling parameters and, for a JSON
+//     `output_format`, a JSON response format are added.
+//  3. The body is POSTed to `<endpoint>/chat/completions` with the API key as
+//     a bearer token, if one is configured.
+//  4. The text of the first choice and the reported usage are returned. A 429
+//     is returned as a `QuotaExceededError`, with the delay and the remaining
+//     quota of its `retry-after` and `x-ratelimit-*` headers; other statuses,
+//     and a choice stopped by a content filter, as a `GenerationError`.
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAIMediaURLExpiry is how long the signed URL of a media file sent to an
+// OpenAI-compatible API stays valid; long enough for queued requests.
+const openAIMediaURLExpiry = time.Hour
+
+// OpenAIModel generates text with an OpenAI-compatible chat completions API.
+type OpenAIModel struct {
+	endpoint   string           // The base URL of the API (e.g., "http://localhost:8000/v1").
+	apiKey     string           // The bearer token; empty for servers without authentication.
+	config     VertexAiLLMModel // The model name, system instructions and sampling parameters.
+	blobs      BlobStore        // The store signing the URLs of `gs://` media; nil if there is none.
+	httpClient *http.Client     // The client used for requests.
+}
+
+// NewOpenAIModel creates a model on an OpenAI-compatible endpoint.
+//
+// Inputs:
+//   - endpoint: The base URL of the API, without "/chat/completions".
+//   - apiKey: The API key; may be empty.
+//   - config: The agent model's configuration.
+//   - blobs: The store signing the URLs of `gs://` media; nil to refuse such media.
+//
+// Outputs:
+//   - *OpenAIModel: A pointer to the new model.
+func NewOpenAIModel(endpoint string, apiKey string, config VertexAiLLMModel, blobs BlobStore) *OpenAIModel {
+	return &OpenAIModel{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		apiKey:     apiKey,
+		config:     config,
+		blobs:      blobs,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// openAIContentPart is a part of a multi-modal chat message.
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIMediaURL `json:"image_url,omitempty"`
+	VideoURL *openAIMediaURL `json:"video_url,omitempty"`
+}
+
+// openAIMediaURL references a media file of a chat message.
+type openAIMediaURL struct {
+	URL string `json:"url"`
+}
+
+// openAIMessage is a chat message; Content is a string or a list of parts.
+type openAIMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+// openAIRequest is the body of a chat completions request.
+type openAIRequest struct {
+	Model          string            `json:"model"`
+	Messages       []openAIMessage   `json:"messages"`
+	Temperature    float32           `json:"temperature"`
+	TopP           float32           `json:"top_p,omitempty"`
+	MaxTokens      int32             `json:"max_tokens,omitempty"`
+	ResponseFormat map[string]string `json:"response_format,omitempty"`
+}
+
+// openAIResponse is the part of a chat completions response that is read.
+type openAIResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// Name returns the name of the served model.
+func (m *OpenAIModel) Name() string {
+	return m.config.Model
+}
+
+// Generate sends the request as a chat completion.
+func (m *OpenAIModel) Generate(ctx context.Context, request *GenerationRequest) (*GenerationResponse, error) {
+	parts := []openAIContentPart{{Type: "text", Text: request.Text}}
+	for _, media := range request.Media {
+		var mediaURL string
+		if strings.HasPrefix(media.MIMEType, "image/") || strings.HasPrefix(media.MIMEType, "video/") {
+			var err error
+			if mediaURL, err = m.mediaURL(ctx, media.URI); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case strings.HasPrefix(media.MIMEType, "image/"):
+			parts = append(parts, openAIContentPart{Type: "image_url", ImageURL: &openAIMediaURL{URL: mediaURL}})
+		case strings.HasPrefix(media.MIMEType, "video/"):
+			parts = append(parts, openAIContentPart{Type: "video_url", VideoURL: &openAIMediaURL{URL: mediaURL}})
+		default:
+			return nil, fmt.Errorf("model %s: unsupported media type %q", m.config.Model, media.MIMEType)
+		}
+	}
+
+	body := openAIRequest{
+		Model:       m.config.Model,
+		Temperature: m.config.Temperature,
+		TopP:        m.config.TopP,
+		MaxTokens:   m.config.MaxTokens,
+	}
+	if len(m.config.SystemInstructions) > 0 {
+		body.Messages = append(body.Messages, openAIMessage{Role: "system", Content: m.config.SystemInstructions})
+	}
+	body.Messages = append(body.Messages, openAIMessage{Role: "user", Content: parts})
+	if m.config.OutputFormat == "application/json" {
+		body.ResponseFormat = map[string]string{"type": "json_object"}
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.endpoint+"/chat/completions", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(m.apiKey) > 0 {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("model %s: %w", m.config.Model, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("model %s: status %d: %s", m.config.Model, resp.StatusCode, strings.TrimSpace(string(detail)))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, newOpenAIQuotaError(m.config.Model, resp.Header, err)
+		}
+		return nil, &GenerationError{Kind: classifyStatus(resp.StatusCode, string(detail)), Model: m.config.Model, Err: err}
+	}
+
+	var decoded openAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("model %s: failed to decode response: %w", m.config.Model, err)
+	}
+	if len(decoded.Choices) == 0 {
+		return nil, fmt.Errorf("model %s: the response has no choices", m.config.Model)
+	}
+	if decoded.Choices[0].FinishReason == "content_filter" {
+		return nil, &GenerationError{Kind: GenerationSafetyBlocked, Model: m.config.Model, Err: errors.New("response blocked by the content filter")}
+	}
+	return &GenerationResponse{
+		Text: decoded.Choices[0].Message.Content,
+		Usage: Usage{
+			InputTokens:  decoded.Usage.PromptTokens,
+			OutputTokens: decoded.Usage.CompletionTokens,
+		},
+	}, nil
+}
+
+// mediaURL returns the URL the server reads a media file from: a signed URL
+// for a `gs://` URI, or else the URI itself.
+func (m *OpenAIModel) mediaURL(ctx context.Context, uri string) (string, error) {
+	object, ok := strings.CutPrefix(uri, "gs://")
+	if !ok {
+		return uri, nil
+	}
+	bucket, name, ok := strings.Cut(object, "/")
+	if !ok || len(name) == 0 {
+		return "", fmt.Errorf("model %s: invalid media URI %q", m.config.Model, uri)
+	}
+	if m.blobs == nil {
+		return "", fmt.Errorf("model %s: no blob store to sign the media URI %q", m.config.Model, uri)
+	}
+	signed, err := m.blobs.SignURL(ctx, bucket, name, openAIMediaURLExpiry)
+	if err != nil {
+		return "", fmt.Errorf("model %s: failed to sign the media URI %q: %w", m.config.Model, uri, err)
+	}
+	return signed, nil
+}
+
+// newOpenAIQuotaError reads the delay and the remaining quota of a 429 from
+// the `retry-after` and `x-ratelimit-*` headers of an OpenAI-compatible API.
+//
+// Inputs:
+//   - model: The name of the model.
+//   - header: The headers of the response.
+//   - err: The error of the response.
+//
+// Outputs:
+//   - *QuotaExceededError: The quota error.
+func newOpenAIQuotaError(model string, header http.Header, err error) *QuotaExceededError {
+	out := &QuotaExceededError{Model: model, RemainingRequests: -1, RemainingTokens: -1, Err: err}
+	if remaining, err := strconv.Atoi(header.Get("x-ratelimit-remaining-requests")); err == nil {
+		out.RemainingRequests = remaining
+	}
+	if remaining, err := strconv.Atoi(header.Get("x-ratelimit-remaining-tokens")); err == nil {
+		out.RemainingTokens = remaining
+	}
+	// retry-after is in seconds; otherwise, wait for the reset of the exhausted limit.
+	if seconds, err := strconv.Atoi(header.Get("retry-after")); err == nil {
+		out.RetryAfter = time.Duration(seconds) * time.Second
+		return out
+	}
+	if out.RemainingRequests == 0 {
+		out.RetryAfter, _ = time.ParseDuration(header.Get("x-ratelimit-reset-requests"))
+	}
+	if reset, err := time.ParseDuration(header.Get("x-ratelimit-reset-tokens")); err == nil && out.RemainingTokens == 0 {
+		out.RetryAfter = max(out.RetryAfter, reset)
+	}
+	return out
+}
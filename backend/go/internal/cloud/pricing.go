@@ -0,0 +1,76 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file converts the token usage of a generation into an estimated cost,
+// so that what each media file cost to index can be stored with it.
+//
+// Logic Flow:
+//  1. `[model_pricing."<model>"]` sets the price of a million prompt and
+//     candidate tokens of a model, keyed by model name like its quotas.
+//  2. `NewCloudServiceClients` wraps every agent model whose underlying model
+//     has a price with a `PricedModel`, which sets the `Cost` of the usage of
+//     each response.
+//  3. The summary and scene commands store that usage on the context, and
+//     `MediaAssembly` stores it on the scenes and the media object, where
+//     `GET /api/v1/media/:id/usage` reads it.
+//
+// Structs:
+//   - PricedModel: A GenerativeModel estimating the cost of its responses.
+package cloud
+
+import "context"
+
+// Cost returns the estimated cost of a generation's tokens, in USD.
+//
+// Inputs:
+//   - usage: The token usage of the generation.
+//
+// Outputs:
+//   - float64: The cost of the input and output tokens.
+func (p ModelPricing) Cost(usage Usage) float64 {
+	return (float64(usage.InputTokens)*p.InputPerMillionTokens + float64(usage.OutputTokens)*p.OutputPerMillionTokens) / 1e6
+}
+
+// PricedModel is a GenerativeModel estimating the cost of its responses.
+type PricedModel struct {
+	GenerativeModel
+	pricing ModelPricing
+}
+
+// NewPricedModel wraps a model with the price of its tokens.
+//
+// Inputs:
+//   - model: The model to wrap.
+//   - pricing: The prices of the models, keyed by model name.
+//
+// Outputs:
+//   - GenerativeModel: The wrapped model, or the model itself if it has no price.
+func NewPricedModel(model GenerativeModel, pricing map[string]ModelPricing) GenerativeModel {
+	price, ok := pricing[model.Name()]
+	if !ok {
+		return model
+	}
+	return &PricedModel{GenerativeModel: model, pricing: price}
+}
+
+// Generate sends the request and sets the cost of its usage.
+func (m *PricedModel) Generate(ctx context.Context, request *GenerationRequest) (*GenerationResponse, error) {
+	resp, err := m.GenerativeModel.Generate(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp.Usage.Cost = m.pricing.Cost(resp.Usage)
+	return resp, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file implements `MessageSource` on a Pub/Sub subscription.
+//
+// Logic Flow:
+//  1. `Receive` delegates to `pubsub.Subscription.Receive` and wraps every
+//     `pubsub.Message` in a `Message`.
+//  2. `Ack` and `Nack` are forwarded to the wrapped message.
+//  3. The client library extends the lease of unsettled messages on its own,
+//     up to the subscription's `ReceiveSettings.MaxExtension` (60 minutes by
+//     default), so `ExtendDeadline` has nothing to do. `SetAckDeadline` bounds
+//     each extension, so that the message of a crashed worker is redelivered
+//     soon. A message left unsettled by a running worker is held until
+//     MaxExtension, which is why the listener Nacks the messages that fail.
+//  4. `SetFlowControl` maps the subscription's flow control onto the client
+//     library's `ReceiveSettings`, so that no more messages are pulled than
+//     the listener is allowed to process.
+package cloud
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// PubSubSource delivers the messages of a Pub/Sub subscription.
+type PubSubSource struct {
+	subscription *pubsub.Subscription // The subscription to pull messages from.
+}
+
+// NewPubSubSource creates a source for a subscription.
+//
+// Inputs:
+//   - client: An authenticated *pubsub.Client.
+//   - subscriptionID: The ID of the subscription (e.g., "my-subscription").
+//
+// Outputs:
+//   - *PubSubSource: A pointer to the new source.
+func NewPubSubSource(client *pubsub.Client, subscriptionID string) *PubSubSource {
+	return &PubSubSource{subscription: client.Subscription(subscriptionID)}
+}
+
+// SetAckDeadline sets the lease extension period of the received messages,
+// from the subscription's `timeout_in_seconds`. Pub/Sub accepts periods from
+// 10 seconds to 10 minutes; zero keeps the client library's default.
+//
+// Inputs:
+//   - deadline: The acknowledgement deadline of a message.
+func (s *PubSubSource) SetAckDeadline(deadline time.Duration) {
+	if deadline <= 0 {
+		return
+	}
+	deadline = min(max(deadline, 10*time.Second), 10*time.Minute)
+	s.subscription.ReceiveSettings.MinExtensionPeriod = deadline
+	s.subscription.ReceiveSettings.MaxExtensionPeriod = deadline
+}
+
+// SetFlowControl sets the receive settings of the subscription. Zero values
+// keep the client library's defaults.
+//
+// Inputs:
+//   - fc: The flow control settings of the subscription.
+func (s *PubSubSource) SetFlowControl(fc FlowControl) {
+	settings := &s.subscription.ReceiveSettings
+	if fc.MaxOutstandingMessages > 0 {
+		settings.MaxOutstandingMessages = fc.MaxOutstandingMessages
+	}
+	if fc.MaxOutstandingBytes > 0 {
+		settings.MaxOutstandingBytes = fc.MaxOutstandingBytes
+	}
+	if fc.NumGoroutines > 0 {
+		settings.NumGoroutines = fc.NumGoroutines
+	}
+}
+
+// Name returns the fully qualified name of the subscription.
+func (s *PubSubSource) Name() string {
+	return s.subscription.String()
+}
+
+// Receive pulls messages until the context is canceled.
+func (s *PubSubSource) Receive(ctx context.Context, handler func(context.Context, *Message)) error {
+	return s.subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		m := &Message{
+			ID:          msg.ID,
+			Data:        msg.Data,
+			Attributes:  msg.Attributes,
+			PublishTime: msg.PublishTime,
+			handle:      msg,
+		}
+		if msg.DeliveryAttempt != nil {
+			// Only set when the subscription has a dead-letter policy.
+			m.DeliveryAttempt = *msg.DeliveryAttempt
+		}
+		handler(ctx, m)
+	})
+}
+
+// Ack acknowledges the message.
+func (s *PubSubSource) Ack(msg *Message) {
+	msg.handle.(*pubsub.Message).Ack()
+}
+
+// Nack negatively acknowledges the message, so that it is redelivered
+// according to the subscription's retry policy.
+func (s *PubSubSource) Nack(msg *Message) {
+	msg.handle.(*pubsub.Message).Nack()
+}
+
+// ExtendDeadline is a no-op: the client library keeps extending the lease of
+// unsettled messages up to the subscription's MaxExtension, whether or not
+// their handler has returned.
+func (s *PubSubSource) ExtendDeadline(_ *Message, _ time.Duration) error {
+	return nil
+}
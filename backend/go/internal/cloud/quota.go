@@ -0,0 +1,432 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file defines `QuotaManager`, which keeps the agent models within the
+// per-minute quotas of their provider: requests, input tokens and output
+// tokens per minute, per model.
+//
+// Logic Flow:
+//  1. Each `[model_quotas.<model>]` entry sets the quotas of a model (e.g.,
+//     "gemini-2.5-pro"), whichever agent models use it; zero is unlimited.
+//  2. `NewCloudServiceClients` creates one manager, and wraps every agent
+//     model in a `QuotaModel` sharing it.
+//  3. Before each request, `QuotaModel` waits, through `QuotaManager.Wait`,
+//     until the requests and tokens of the last minute leave room for it. The
+//     input tokens are estimated up front, from the prompt text and the input
+//     tokens of the model's last request with media. Output tokens cannot be
+//     known in advance: a request waits while the last minute's output tokens
+//     are at the limit.
+//  4. Once the request returns, its reservation is corrected with the usage
+//     reported by the provider.
+//  5. A request rejected for exceeding a quota (HTTP 429) pauses the model for
+//     the delay the provider asks for (Vertex AI's `RetryInfo`, or the
+//     `retry-after` and `x-ratelimit-*` headers of an OpenAI-compatible API),
+//     and the remaining quota it reports is kept for the statistics.
+//  6. `Snapshot` returns the state of every model, for the `/admin/quotas`
+//     endpoint; the same state is exported as OpenTelemetry gauges.
+//
+// Structs:
+//   - QuotaManager: The quota state of every model, shared by all agent models.
+//   - QuotaReservation: The share of the quota taken by a request.
+//   - QuotaState: A snapshot of the quota state of a model.
+//   - QuotaExceededError: A request rejected by the provider for exceeding a quota.
+//   - QuotaModel: A GenerativeModel whose requests wait for the quota.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/genai"
+)
+
+// quotaWindow is the period the quotas are counted over.
+const quotaWindow = time.Minute
+
+// defaultQuotaBackoff is the pause of a model after a 429 that does not say
+// when to retry.
+const defaultQuotaBackoff = 10 * time.Second
+
+// QuotaExceededError is returned for a request the provider rejected because a
+// quota was exceeded (HTTP 429).
+type QuotaExceededError struct {
+	Model             string        // The name of the model.
+	RetryAfter        time.Duration // The delay the provider asks for; zero if not reported.
+	RemainingRequests int           // The requests left, as reported by the provider; -1 if not reported.
+	RemainingTokens   int           // The tokens left, as reported by the provider; -1 if not reported.
+	Err               error         // The error of the provider.
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("model %s: quota exceeded: %v", e.Model, e.Err)
+}
+
+func (e *QuotaExceededError) Unwrap() error {
+	return e.Err
+}
+
+// asQuotaExceeded returns the quota error of a failed request, recognizing
+// the 429 errors of the GenAI SDK; nil if the request did not exceed a quota.
+func asQuotaExceeded(model string, err error) *QuotaExceededError {
+	var quotaErr *QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return quotaErr
+	}
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != 429 {
+		return nil
+	}
+	quotaErr = &QuotaExceededError{Model: model, RemainingRequests: -1, RemainingTokens: -1, Err: err}
+	for _, detail := range apiErr.Details {
+		if detail["@type"] != "type.googleapis.com/google.rpc.RetryInfo" {
+			continue
+		}
+		if delay, ok := detail["retryDelay"].(string); ok {
+			quotaErr.RetryAfter, _ = time.ParseDuration(delay)
+		}
+	}
+	return quotaErr
+}
+
+// quotaEvent is a request counted in the window.
+type quotaEvent struct {
+	at     time.Time // When the request was sent.
+	input  int       // Its input tokens: estimated until it returns, then reported.
+	output int       // Its output tokens, once it returns.
+}
+
+// modelQuota is the quota state of a model.
+type modelQuota struct {
+	mu                sync.Mutex
+	limits            ModelQuota
+	events            []*quotaEvent // The requests of the window, oldest first.
+	waiting           int           // The requests waiting for the quota.
+	pausedUntil       time.Time     // When the model may be called again after a 429.
+	throttles         int           // The 429s received.
+	remainingRequests int           // Reported by the last 429; -1 if not reported.
+	remainingTokens   int           // Reported by the last 429; -1 if not reported.
+}
+
+// prune drops the requests that left the window.
+func (m *modelQuota) prune(now time.Time) {
+	keep := 0
+	for keep < len(m.events) && now.Sub(m.events[keep].at) >= quotaWindow {
+		keep++
+	}
+	m.events = m.events[keep:]
+}
+
+// totals returns the tokens of the window.
+func (m *modelQuota) totals() (input int, output int) {
+	for _, event := range m.events {
+		input += event.input
+		output += event.output
+	}
+	return input, output
+}
+
+// delay returns how long a request of the given input tokens must wait; zero
+// if it may be sent now. A request over a token limit on its own is sent once
+// the window is empty.
+func (m *modelQuota) delay(now time.Time, inputTokens int) time.Duration {
+	if now.Before(m.pausedUntil) {
+		return m.pausedUntil.Sub(now)
+	}
+	m.prune(now)
+	if len(m.events) == 0 {
+		return 0
+	}
+	input, output := m.totals()
+	full := (m.limits.RequestsPerMinute > 0 && len(m.events) >= m.limits.RequestsPerMinute) ||
+		(m.limits.InputTokensPerMinute > 0 && input+inputTokens > m.limits.InputTokensPerMinute) ||
+		(m.limits.OutputTokensPerMinute > 0 && output >= m.limits.OutputTokensPerMinute)
+	if !full {
+		return 0
+	}
+	// Wait until the oldest request leaves the window, then check again.
+	return max(m.events[0].at.Add(quotaWindow).Sub(now), time.Millisecond)
+}
+
+// QuotaManager enforces the per-minute quotas of the models.
+type QuotaManager struct {
+	quotas map[string]ModelQuota // The configured quotas, keyed by model.
+
+	mu     sync.Mutex
+	models map[string]*modelQuota // The state of every model used so far.
+}
+
+// NewQuotaManager creates a quota manager and registers its gauges.
+//
+// Inputs:
+//   - quotas: The quotas, keyed by model name; models without an entry are unlimited.
+//
+// Outputs:
+//   - *QuotaManager: A pointer to the new manager.
+func NewQuotaManager(quotas map[string]ModelQuota) *QuotaManager {
+	q := &QuotaManager{quotas: quotas, models: make(map[string]*modelQuota)}
+	q.registerMetrics()
+	return q
+}
+
+// model returns the state of a model, creating it on first use.
+func (q *QuotaManager) model(name string) *modelQuota {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m, ok := q.models[name]
+	if !ok {
+		m = &modelQuota{limits: q.quotas[name], remainingRequests: -1, remainingTokens: -1}
+		q.models[name] = m
+	}
+	return m
+}
+
+// Wait blocks until a request to the model fits within its quotas, or the
+// context is canceled, and counts the request.
+//
+// Inputs:
+//   - ctx: The context bounding the wait.
+//   - model: The name of the model.
+//   - inputTokens: The estimated input tokens of the request.
+//
+// Outputs:
+//   - *QuotaReservation: The reservation, to complete with the reported usage.
+//   - error: An error if the context was canceled first.
+func (q *QuotaManager) Wait(ctx context.Context, model string, inputTokens int) (*QuotaReservation, error) {
+	m := q.model(model)
+	m.mu.Lock()
+	m.waiting++
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.waiting--
+		m.mu.Unlock()
+	}()
+
+	for {
+		m.mu.Lock()
+		now := time.Now()
+		delay := m.delay(now, inputTokens)
+		if delay == 0 {
+			event := &quotaEvent{at: now, input: inputTokens}
+			m.events = append(m.events, event)
+			m.mu.Unlock()
+			return &QuotaReservation{model: m, event: event}, nil
+		}
+		m.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("waiting for the quota of model %s: %w", model, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// Throttle pauses a model after the provider rejected a request for exceeding
+// a quota, for the delay it asked for, and records the quota it reports left.
+//
+// Inputs:
+//   - model: The name of the model.
+//   - err: The quota error of the provider.
+func (q *QuotaManager) Throttle(model string, err *QuotaExceededError) {
+	m := q.model(model)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delay := err.RetryAfter
+	if delay <= 0 {
+		delay = defaultQuotaBackoff
+	}
+	if until := time.Now().Add(delay); until.After(m.pausedUntil) {
+		m.pausedUntil = until
+	}
+	m.throttles++
+	m.remainingRequests = err.RemainingRequests
+	m.remainingTokens = err.RemainingTokens
+	log.Printf("model %s: quota exceeded, pausing for %s", model, delay)
+}
+
+// Snapshot returns the quota state of every model used so far, by model name.
+//
+// Outputs:
+//   - []QuotaState: The state of each model.
+func (q *QuotaManager) Snapshot() []QuotaState {
+	q.mu.Lock()
+	names := make([]string, 0, len(q.models))
+	for name := range q.models {
+		names = append(names, name)
+	}
+	q.mu.Unlock()
+	sort.Strings(names)
+
+	out := make([]QuotaState, 0, len(names))
+	now := time.Now()
+	for _, name := range names {
+		m := q.model(name)
+		m.mu.Lock()
+		m.prune(now)
+		input, output := m.totals()
+		state := QuotaState{
+			Model:        name,
+			Limits:       m.limits,
+			Requests:     len(m.events),
+			InputTokens:  input,
+			OutputTokens: output,
+			Waiting:      m.waiting,
+			Throttles:    m.throttles,
+		}
+		if now.Before(m.pausedUntil) {
+			until := m.pausedUntil
+			state.PausedUntil = &until
+		}
+		if remaining := m.remainingRequests; remaining >= 0 {
+			state.RemainingRequests = &remaining
+		}
+		if remaining := m.remainingTokens; remaining >= 0 {
+			state.RemainingTokens = &remaining
+		}
+		m.mu.Unlock()
+		out = append(out, state)
+	}
+	return out
+}
+
+// registerMetrics exports the snapshot as gauges, with a "model" attribute.
+func (q *QuotaManager) registerMetrics() {
+	meter := otel.Meter("github.com/GoogleCloudPlatform/solutions/media")
+	requests, err1 := meter.Int64ObservableGauge("quota.requests",
+		metric.WithDescription("The requests sent to a model in the last minute."))
+	inputTokens, err2 := meter.Int64ObservableGauge("quota.input_tokens",
+		metric.WithDescription("The input tokens sent to a model in the last minute."))
+	outputTokens, err3 := meter.Int64ObservableGauge("quota.output_tokens",
+		metric.WithDescription("The output tokens generated by a model in the last minute."))
+	waiting, err4 := meter.Int64ObservableGauge("quota.waiting",
+		metric.WithDescription("The requests waiting for the quota of a model."))
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		log.Printf("error creating quota gauges: %v\n", err)
+		return
+	}
+	_, err := meter.RegisterCallback(func(_ context.Context, observer metric.Observer) error {
+		for _, state := range q.Snapshot() {
+			model := metric.WithAttributes(attribute.String("model", state.Model))
+			observer.ObserveInt64(requests, int64(state.Requests), model)
+			observer.ObserveInt64(inputTokens, int64(state.InputTokens), model)
+			observer.ObserveInt64(outputTokens, int64(state.OutputTokens), model)
+			observer.ObserveInt64(waiting, int64(state.Waiting), model)
+		}
+		return nil
+	}, requests, inputTokens, outputTokens, waiting)
+	if err != nil {
+		log.Printf("error registering quota gauges: %v\n", err)
+	}
+}
+
+// QuotaReservation is the share of a model's quota taken by a request.
+type QuotaReservation struct {
+	model *modelQuota
+	event *quotaEvent
+}
+
+// Done replaces the estimated tokens of the request with those reported by
+// the provider; a failed request keeps its place in the request count only.
+//
+// Inputs:
+//   - usage: The reported usage; zero for a failed request.
+func (r *QuotaReservation) Done(usage Usage) {
+	r.model.mu.Lock()
+	defer r.model.mu.Unlock()
+	r.event.input = usage.InputTokens
+	r.event.output = usage.OutputTokens
+}
+
+// QuotaState is a snapshot of the quota state of a model.
+type QuotaState struct {
+	Model             string     `json:"model"`
+	Limits            ModelQuota `json:"limits"`
+	Requests          int        `json:"requests"`      // In the last minute.
+	InputTokens       int        `json:"input_tokens"`  // In the last minute.
+	OutputTokens      int        `json:"output_tokens"` // In the last minute.
+	Waiting           int        `json:"waiting"`
+	Throttles         int        `json:"throttles"`                    // The 429s received since startup.
+	PausedUntil       *time.Time `json:"paused_until,omitempty"`       // Set while the model is paused after a 429.
+	RemainingRequests *int       `json:"remaining_requests,omitempty"` // As reported by the last 429.
+	RemainingTokens   *int       `json:"remaining_tokens,omitempty"`   // As reported by the last 429.
+}
+
+// QuotaModel wraps a GenerativeModel so that its requests wait for the quota
+// of the model.
+type QuotaModel struct {
+	GenerativeModel               // The wrapped model.
+	quotas          *QuotaManager // The manager shared by all models.
+	mediaTokens     atomic.Int64  // The input tokens of the last request with media.
+}
+
+// NewQuotaModel wraps a model with a quota manager.
+//
+// Inputs:
+//   - model: The model to wrap.
+//   - quotas: The shared quota manager; nil returns the model itself.
+//
+// Outputs:
+//   - GenerativeModel: The wrapped model.
+func NewQuotaModel(model GenerativeModel, quotas *QuotaManager) GenerativeModel {
+	if quotas == nil {
+		return model
+	}
+	return &QuotaModel{GenerativeModel: model, quotas: quotas}
+}
+
+// Generate waits for the quota, sends the request and accounts for its usage.
+func (m *QuotaModel) Generate(ctx context.Context, request *GenerationRequest) (*GenerationResponse, error) {
+	reservation, err := m.quotas.Wait(ctx, m.Name(), m.estimate(request))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.GenerativeModel.Generate(ctx, request)
+	if err != nil {
+		reservation.Done(Usage{})
+		if quotaErr := asQuotaExceeded(m.Name(), err); quotaErr != nil {
+			m.quotas.Throttle(m.Name(), quotaErr)
+			return nil, quotaErr
+		}
+		return nil, err
+	}
+	reservation.Done(resp.Usage)
+	if len(request.Media) > 0 && resp.Usage.InputTokens > 0 {
+		m.mediaTokens.Store(int64(resp.Usage.InputTokens))
+	}
+	return resp, nil
+}
+
+// estimate returns the expected input tokens of a request: about four
+// characters per token of text, plus, with media, the input tokens of the
+// last request with media.
+func (m *QuotaModel) estimate(request *GenerationRequest) int {
+	tokens := len(request.Text) / 4
+	if len(request.Media) > 0 {
+		tokens += int(m.mediaTokens.Load())
+	}
+	return tokens
+}
@@ -0,0 +1,296 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloud provides components for interacting with Google Cloud services.
+// This file implements `MediaRepository` on an embedded SQLite database, so
+// that the server and the tests can run without BigQuery.
+//
+// Logic Flow:
+//  1. Opening the repository creates the `media`, `scene_embeddings` and
+//     `usage_records` tables if they do not exist yet.
+//  2. A media object is stored as its JSON document, keyed by ID; saving the
+//     same ID again replaces it. Scenes are read from the document.
+//  3. Embeddings are stored as little-endian float64 blobs.
+//  4. Vector searches are brute force: every embedding is compared with the
+//     query vector in Go, and the nearest are returned. This is fine for the
+//     thousands of scenes of a development data set. An embedding of another
+//     dimension, written by another model, fails the search with
+//     `ErrDimensionMismatch` rather than being left out of the results.
+//  5. Usage records are appended to `usage_records` and summed with SQL.
+package cloud
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+	_ "github.com/mattn/go-sqlite3" // Registers the "sqlite3" database/sql driver.
+)
+
+// sqliteSchema creates the tables of the repository.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS media (
+	id          TEXT PRIMARY KEY,
+	create_date TIMESTAMP NOT NULL,
+	document    TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS scene_embeddings (
+	media_id        TEXT NOT NULL,
+	sequence_number INTEGER NOT NULL,
+	model_name      TEXT NOT NULL,
+	embeddings      BLOB NOT NULL,
+	PRIMARY KEY (media_id, sequence_number)
+);
+CREATE TABLE IF NOT EXISTS usage_records (
+	recorded_at   TIMESTAMP NOT NULL,
+	model         TEXT NOT NULL,
+	input_tokens  INTEGER NOT NULL,
+	output_tokens INTEGER NOT NULL,
+	cost          REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS usage_records_recorded_at ON usage_records (recorded_at);`
+
+// SQLiteMediaRepository stores media and embeddings in a SQLite database.
+type SQLiteMediaRepository struct {
+	db       *sql.DB // The database handle.
+	distance string  // The distance type for vector searches.
+}
+
+// NewSQLiteMediaRepository opens (or creates) the database file.
+//
+// Inputs:
+//   - ctx: The context used to create the schema.
+//   - path: The database file; ":memory:" creates a private in-memory database.
+//   - distance: The distance type for vector searches.
+//
+// Outputs:
+//   - *SQLiteMediaRepository: A pointer to the new repository.
+//   - error: An error if the database cannot be opened or initialized.
+func NewSQLiteMediaRepository(ctx context.Context, path string, distance string) (*SQLiteMediaRepository, error) {
+	if len(path) == 0 {
+		return nil, errors.New("the sqlite metadata backend requires metadata_store.sqlite_path")
+	}
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection also keeps ":memory:"
+	// databases from being private to each connection.
+	db.SetMaxOpenConns(1)
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create schema in %s: %w", path, err)
+	}
+	return &SQLiteMediaRepository{db: db, distance: distance}, nil
+}
+
+// Close closes the database.
+func (r *SQLiteMediaRepository) Close() error {
+	return r.db.Close()
+}
+
+// SaveMedia stores the media document, replacing any with the same ID.
+func (r *SQLiteMediaRepository) SaveMedia(ctx context.Context, media *model.Media) error {
+	document, err := json.Marshal(media)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx,
+		`INSERT INTO media (id, create_date, document) VALUES (?, ?, ?)
+		 ON CONFLICT (id) DO UPDATE SET create_date = excluded.create_date, document = excluded.document`,
+		media.Id, media.CreateDate, string(document))
+	if err != nil {
+		return fmt.Errorf("sqlite insert failed for title '%s': %w", media.Title, err)
+	}
+	return nil
+}
+
+// DeleteMedia deletes the media document and its embeddings.
+func (r *SQLiteMediaRepository) DeleteMedia(ctx context.Context, id string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM scene_embeddings WHERE media_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete embeddings of media %s: %w", id, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM media WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete media %s: %w", id, err)
+	}
+	return tx.Commit()
+}
+
+// GetMedia decodes the media document with the ID.
+func (r *SQLiteMediaRepository) GetMedia(ctx context.Context, id string) (*model.Media, error) {
+	var document string
+	err := r.db.QueryRowContext(ctx, `SELECT document FROM media WHERE id = ?`, id).Scan(&document)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("media %s: %w", id, ErrMediaNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	media := &model.Media{}
+	if err := json.Unmarshal([]byte(document), media); err != nil {
+		return nil, fmt.Errorf("failed to decode media %s: %w", id, err)
+	}
+	return media, nil
+}
+
+// GetScene returns the scene with the sequence number from the media document.
+func (r *SQLiteMediaRepository) GetScene(ctx context.Context, id string, sequence int) (*model.Scene, error) {
+	media, err := r.GetMedia(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, scene := range media.Scenes {
+		if scene.SequenceNumber == sequence {
+			return scene, nil
+		}
+	}
+	return nil, fmt.Errorf("scene %d of media %s: %w", sequence, id, ErrMediaNotFound)
+}
+
+// ListUnembeddedMedia returns the media documents without embeddings, oldest first.
+func (r *SQLiteMediaRepository) ListUnembeddedMedia(ctx context.Context) ([]*model.Media, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT document FROM media WHERE id NOT IN (SELECT media_id FROM scene_embeddings) ORDER BY create_date`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]*model.Media, 0)
+	for rows.Next() {
+		var document string
+		if err := rows.Scan(&document); err != nil {
+			return nil, err
+		}
+		media := &model.Media{}
+		if err := json.Unmarshal([]byte(document), media); err != nil {
+			return nil, err
+		}
+		out = append(out, media)
+	}
+	return out, rows.Err()
+}
+
+// SaveEmbeddings stores the embeddings in a single transaction.
+func (r *SQLiteMediaRepository) SaveEmbeddings(ctx context.Context, embeddings []*model.SceneEmbedding) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range embeddings {
+		_, err := tx.ExecContext(ctx,
+			`INSERT OR REPLACE INTO scene_embeddings (media_id, sequence_number, model_name, embeddings) VALUES (?, ?, ?, ?)`,
+			e.Id, e.SequenceNumber, e.ModelName, encodeVector(e.Embeddings))
+		if err != nil {
+			return fmt.Errorf("failed to save embedding %d of media %s: %w", e.SequenceNumber, e.Id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// FindScenes compares the vector with every stored embedding and returns the
+// nearest scenes. It fails with ErrDimensionMismatch if an embedding has
+// another dimension than the vector.
+func (r *SQLiteMediaRepository) FindScenes(ctx context.Context, vector []float64, limit int) ([]*model.SceneMatchResult, error) {
+	type match struct {
+		result   *model.SceneMatchResult
+		distance float64
+	}
+	rows, err := r.db.QueryContext(ctx, `SELECT media_id, sequence_number, embeddings FROM scene_embeddings`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := make([]match, 0)
+	for rows.Next() {
+		result := &model.SceneMatchResult{}
+		var blob []byte
+		if err := rows.Scan(&result.MediaId, &result.SequenceNumber, &blob); err != nil {
+			return nil, err
+		}
+		embedding := decodeVector(blob)
+		if len(embedding) != len(vector) {
+			// Embeddings of another model cannot be compared; the stored
+			// embeddings must be generated again with the query's model.
+			return nil, fmt.Errorf("scene %d of media %s: %w: stored %d, query %d",
+				result.SequenceNumber, result.MediaId, ErrDimensionMismatch, len(embedding), len(vector))
+		}
+		matches = append(matches, match{result: result, distance: vectorDistance(r.distance, vector, embedding)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].distance < matches[j].distance })
+	out := make([]*model.SceneMatchResult, 0, limit)
+	for i := 0; i < len(matches) && i < limit; i++ {
+		out = append(out, matches[i].result)
+	}
+	return out, nil
+}
+
+// RecordUsage appends the usage record to the ledger.
+func (r *SQLiteMediaRepository) RecordUsage(ctx context.Context, record *model.UsageRecord) error {
+	_, err := r.db.ExecContext(ctx,
+		`INSERT INTO usage_records (recorded_at, model, input_tokens, output_tokens, cost) VALUES (?, ?, ?, ?, ?)`,
+		record.RecordedAt.UTC(), record.Model, record.InputTokens, record.OutputTokens, record.Cost)
+	if err != nil {
+		return fmt.Errorf("failed to record usage of %s: %w", record.Model, err)
+	}
+	return nil
+}
+
+// SumUsage sums the usage records since the time.
+func (r *SQLiteMediaRepository) SumUsage(ctx context.Context, since time.Time) (*model.TokenUsage, error) {
+	usage := &model.TokenUsage{}
+	err := r.db.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0), COALESCE(SUM(cost), 0)
+		 FROM usage_records WHERE recorded_at >= ?`, since.UTC()).
+		Scan(&usage.InputTokens, &usage.OutputTokens, &usage.Cost)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// encodeVector encodes the vector as little-endian float64 values.
+func encodeVector(vector []float64) []byte {
+	out := make([]byte, 8*len(vector))
+	for i, f := range vector {
+		binary.LittleEndian.PutUint64(out[8*i:], math.Float64bits(f))
+	}
+	return out
+}
+
+// decodeVector decodes a vector written by encodeVector.
+func decodeVector(blob []byte) []float64 {
+	out := make([]float64, len(blob)/8)
+	for i := range out {
+		out[i] = math.Float64frombits(binary.LittleEndian.Uint64(blob[8*i:]))
+	}
+	return out
+}
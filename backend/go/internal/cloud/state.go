@@ -22,11 +22,30 @@
 // Logic Flow:
 //  1. The `NewCloudServiceClients` function is called at application startup.
 //  2. It takes the application's configuration (`Config`) and a `context.Context`.
-//  3. It iteratively initializes clients for Storage, Pub/Sub, GenAI, and BigQuery.
+//  3. It iteratively initializes the blob store (GCS or local, see blob_store.go),
+//     the clients for Pub/Sub, GenAI, and BigQuery, and the media repository
+//     (BigQuery or SQLite, see media_repository.go). Each client is only created
+//     when the configuration uses it, so a configuration of local stand-ins
+//     (local blobs, SQLite, channel or directory sources, fake models) runs
+//     without credentials or network access.
 //  4. It then reads the configuration to create and configure specific service wrappers,
-//     like Pub/Sub listeners and AI models, storing them in maps.
-//  5. All initialized clients and services are bundled into a single `ServiceClients` struct.
-//  6. This struct is then used by other parts of the application (like API handlers and workflows)
+//     like message listeners (on Pub/Sub, an in-process queue or a directory, see
+//     message_source.go) and AI models, storing them in maps. Each listener is
+//     given the dead-letter policy and the flow control of its subscription
+//     (see dead_letter.go and flow_control.go).
+//  5. It creates the limiters of FFmpeg processes and media ingestions shared
+//     by every workflow (see limiter.go), and the quota manager shared by every
+//     agent model (see quota.go).
+//  6. It creates the circuit breakers of Vertex AI, the OpenAI-compatible API
+//     and the media repository, wraps the models, embedders and repository
+//     calling them, and hands the breakers to every listener, which pauses
+//     while one is open (see circuit_breaker.go).
+//  7. It creates the budgets of ingestion, whose spend every agent model
+//     records in the usage ledger of the repository, and the queue where the
+//     listeners defer the messages refused by a spent budget (see budget.go
+//     and deferral.go).
+//  8. All initialized clients and services are bundled into a single `ServiceClients` struct.
+//  9. This struct is then used by other parts of the application (like API handlers and workflows)
 //     to perform their tasks.
 //
 // Structs:
@@ -41,13 +60,14 @@ package cloud
 
 import (
 	"context"
-	"fmt"
+	"io"
 	"log"
+	"sort"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 	credentials "cloud.google.com/go/iam/credentials/apiv1"
 	"cloud.google.com/go/pubsub"
-	"cloud.google.com/go/storage"
 	"google.golang.org/genai"
 )
 
@@ -56,27 +76,55 @@ import (
 // dependency injection, making it easy to manage and share these client connections
 // across the entire application.
 type ServiceClients struct {
-	StorageClient   *storage.Client                   // Client for Google Cloud Storage (GCS).
-	PubsubClient    *pubsub.Client                    // Client for Google Cloud Pub/Sub.
-	GenAIClient     *genai.Client                     // Client for Google's Generative AI services (Vertex AI).
-	BiqQueryClient  *bigquery.Client                  // Client for Google Cloud BigQuery.
-	IAMClient       *credentials.IamCredentialsClient // Client for IAM to sign things like GCS URLs.
-	PubSubListeners map[string]*PubSubListener        // A map of active Pub/Sub listeners, keyed by a logical name from the config.
-	//TODO: Do this later when we do step 2 embedding
-	EmbeddingModels map[string]*genai.Models                // A map of configured GenAI embedding models, keyed by a logical name.
-	AgentModels     map[string]*QuotaAwareGenerativeAIModel // A map of configured GenAI agent (LLM) models, keyed by a logical name.
+	BlobStore        BlobStore                         // The store for media objects, backed by GCS or a local directory.
+	PubsubClient     *pubsub.Client                    // Client for Google Cloud Pub/Sub; nil unless a listener uses it.
+	GenAIClient      *genai.Client                     // Client for Google's Generative AI services (Vertex AI); nil unless a model uses it.
+	BiqQueryClient   *bigquery.Client                  // Client for Google Cloud BigQuery; nil unless it is the metadata backend.
+	MediaRepository  MediaRepository                   // The store for media metadata and embeddings, backed by BigQuery or SQLite.
+	IAMClient        *credentials.IamCredentialsClient // Client for IAM to sign things like GCS URLs.
+	Listeners        map[string]*MessageListener       // A map of message listeners, keyed by a logical name from the config.
+	DeadLetters      DeadLetterStore                   // The store of dead-lettered messages; nil unless `dead_letter_dir` is set.
+	EmbeddingModels  map[string]Embedder               // A map of configured embedding models, keyed by a logical name.
+	AgentModels      map[string]GenerativeModel        // A map of configured agent (LLM) models, keyed by a logical name.
+	FFmpegLimiter    *Limiter                          // Caps the FFmpeg processes running at once; nil if unlimited.
+	IngestionLimiter *Limiter                          // Caps the model requests with media running at once; nil if unlimited.
+	Quotas           *QuotaManager                     // Keeps the agent models within their per-minute quotas.
+	Breakers         []*CircuitBreaker                 // The circuit breakers of the external services, sorted by name; empty if disabled.
+	Budgets          *BudgetManager                    // Keeps ingestion within its spend budgets; nil if unlimited.
+	Deferrals        *DeferralQueue                    // The messages refused by a spent budget; nil unless `budget.deferred_dir` is set.
 }
 
 // Close is a utility method to gracefully shut down all the active client connections.
 // While client connections are typically managed by the application's root context,
 // this method provides an explicit way to release resources, which is especially
-// useful in tests or for controlled shutdowns.
+// useful in tests or for controlled shutdowns. It does nothing on nil clients.
 func (c *ServiceClients) Close() {
-	_ = c.StorageClient.Close()
-	_ = c.PubsubClient.Close()
+	if c == nil {
+		return
+	}
+	if closer, ok := c.BlobStore.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	for _, listener := range c.Listeners {
+		if closer, ok := listener.Source().(io.Closer); ok {
+			_ = closer.Close()
+		}
+		if policy := listener.DeadLetterPolicy(); policy != nil && policy.Topic != nil {
+			// Flush the dead letters still being published.
+			policy.Topic.Stop()
+		}
+	}
+	if c.PubsubClient != nil {
+		_ = c.PubsubClient.Close()
+	}
 	//TODO: New library does not have a client close function
 	//TODO _ = c.GenAIClient.Close()
-	_ = c.BiqQueryClient.Close()
+	if c.BiqQueryClient != nil {
+		_ = c.BiqQueryClient.Close()
+	}
+	if closer, ok := c.MediaRepository.(io.Closer); ok {
+		_ = closer.Close()
+	}
 }
 
 // NewCloudServiceClients is a factory function that initializes all required Google Cloud
@@ -91,104 +139,282 @@ func (c *ServiceClients) Close() {
 //   - *ServiceClients: A pointer to the fully initialized ServiceClients struct.
 //   - error: An error if any of the clients fail to initialize.
 func NewCloudServiceClients(ctx context.Context, config *Config) (cloud *ServiceClients, err error) {
-	// Create a new Google Cloud Storage client.
-	sc, err := storage.NewClient(ctx)
+	// Create the blob store for the configured backend (GCS by default).
+	bs, err := NewBlobStore(ctx, config.Storage)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create a new Google Cloud Pub/Sub client for the specified project.
-	pc, err := pubsub.NewClient(ctx, config.Application.GoogleProjectId)
-	if err != nil {
-		return nil, err
+	// Create a new Google Cloud Pub/Sub client for the specified project, if a
+	// listener reads a Pub/Sub subscription. The client honors
+	// PUBSUB_EMULATOR_HOST, which points it at the Pub/Sub emulator.
+	var pc *pubsub.Client
+	if usesPubSub(config) {
+		pc, err = pubsub.NewClient(ctx, config.Application.GoogleProjectId)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Create a new Generative AI client using an API key for authentication.
-	fmt.Print("The project ID is:", config.Application.GoogleProjectId)
-	fmt.Print("The project location is", config.Application.GoogleLocation)
-	gc, err := genai.NewClient(ctx, &genai.ClientConfig{
-		Project:  config.Application.GoogleProjectId,
-		Location: config.Application.GoogleLocation,
-		Backend:  genai.BackendVertexAI,
-	})
-	if err != nil {
-		fmt.Print("Error creating genai client:", err)
-		log.Printf("error creating genai client: %v", err)
-		return nil, err
+	// Create a new Generative AI client on Vertex AI, if a model uses it.
+	var gc *genai.Client
+	if usesVertexAI(config) {
+		genaiConfig := &genai.ClientConfig{
+			Project:  config.Application.GoogleProjectId,
+			Location: config.Application.GoogleLocation,
+			Backend:  genai.BackendVertexAI,
+		}
+		// In tests, GCP_TEST_MODE may record or replay the GenAI calls.
+		if err := applyTestMode(genaiConfig); err != nil {
+			return nil, err
+		}
+		gc, err = genai.NewClient(ctx, genaiConfig)
+		if err != nil {
+			log.Printf("error creating genai client: %v", err)
+			return nil, err
+		}
 	}
 
-	// Create a new Google Cloud BigQuery client.
-	bc, err := bigquery.NewClient(ctx, config.Application.GoogleProjectId)
+	// Create a new Google Cloud BigQuery client, unless another metadata backend is configured.
+	var bc *bigquery.Client
+	if backend := config.MetadataStore.Backend; backend == "" || backend == MetadataBackendBigQuery {
+		bc, err = bigquery.NewClient(ctx, config.Application.GoogleProjectId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The circuit breakers of the external services are created as they are
+	// used. A breaker is nil, and its calls are not wrapped, if breakers are
+	// disabled or the provider has none (e.g., fake models).
+	breakers := newCircuitBreakers(config.CircuitBreaker)
+
+	// Create the media repository for the configured metadata backend.
+	repo, err := NewMediaRepository(ctx, config, bc)
 	if err != nil {
 		return nil, err
 	}
+	repo = NewBreakerRepository(repo, breakers.get(breakerRepository))
 
-	// Iterate through the subscription configurations and create a PubSubListener for each one.
-	// The command is initially set to `nil` because it will be attached later when the workflows are built.
-	subscriptions := make(map[string]*PubSubListener)
-	for subKey := range config.TopicSubscriptions {
-		values := config.TopicSubscriptions[subKey]
-		actual, err := NewPubSubListener(pc, values.Name, nil)
+	// Create the store of dead-lettered messages, if a directory is configured.
+	var deadLetters DeadLetterStore
+	if len(config.Application.DeadLetterDir) > 0 {
+		deadLetters, err = NewFileDeadLetterStore(config.Application.DeadLetterDir)
 		if err != nil {
 			return nil, err
 		}
-		subscriptions[subKey] = actual
 	}
 
-	// Iterate through the embedding model configurations and create a reference to each model.
-	embeddingModels := make(map[string]*genai.Models)
+	// Iterate through the subscription configurations and create a MessageListener on the
+	// configured message source for each one. The command is initially set to `nil` because
+	// it will be attached later when the workflows are built.
+	listeners := make(map[string]*MessageListener)
+	for subKey, subscription := range config.TopicSubscriptions {
+		source, err := NewMessageSource(subKey, subscription, pc, config.Storage)
+		if err != nil {
+			return nil, err
+		}
+		listener := NewMessageListener(source, nil)
+		listener.SetDeadLetterPolicy(newDeadLetterPolicy(subKey, subscription, pc, deadLetters))
+		listener.SetFlowControl(subscription.FlowControl())
+		listeners[subKey] = listener
+	}
+
+	// Iterate through the embedding model configurations and create the
+	// rate-limited embedder of each one's provider.
+	embeddingModels := make(map[string]Embedder)
 	for embKey := range config.EmbeddingModels {
-		//	embeddingModels[embKey] = gc.GenerativeModel(config.EmbeddingModels[embKey].Model)
-		embeddingModels[embKey] = gc.Models
-		fmt.Print("looping through embeddingmodels, this one is: \n", config.EmbeddingModels[embKey].Model)
+		embedder, err := NewEmbedder(embKey, config.EmbeddingModels[embKey], gc)
+		if err != nil {
+			return nil, err
+		}
+		embeddingModels[embKey] = NewBreakerEmbedder(embedder, breakers.get(providerBreaker(config.EmbeddingModels[embKey].Provider)))
+	}
+
+	// Create the limiters shared by every workflow: FFmpeg processes, and the
+	// model requests that ingest a media file.
+	ffmpegLimiter := NewLimiter("ffmpeg", config.Application.MaxConcurrentFFmpeg)
+	ingestionLimiter := NewLimiter("ingestion", config.Application.MaxConcurrentIngestions)
+
+	// The budgets sum the usage records of the repository, and the messages
+	// they refuse wait in the deferral queue until they allow them.
+	budgets := NewBudgetManager(config.Budget, repo)
+	deferrals, err := NewDeferralQueue(config.Budget, budgets, listeners)
+	if err != nil {
+		return nil, err
+	}
+	for name, listener := range listeners {
+		listener.SetDeferralQueue(name, deferrals)
 	}
 
-	// Iterate through the agent model configurations, create a generative model for each,
-	// apply its specific settings (temperature, TopK, etc.), and wrap it in our
-	// custom rate-limiting (`QuotaAware`) model.
-	agentModels := make(map[string]*QuotaAwareGenerativeAIModel)
+	// Iterate through the agent model configurations and create the model of
+	// each one's provider, which estimates the cost of its responses if its
+	// underlying model has a price (see pricing.go), and records their usage
+	// with the budgets. Every model waits for the quotas of its underlying
+	// model, shared with the other agent models using it, and the ingestion
+	// limiter; a request waits for its slot before it waits for the quota, and
+	// an open circuit refuses it before either.
+	quotas := NewQuotaManager(config.ModelQuotas)
+	agentModels := make(map[string]GenerativeModel)
 	for amKey := range config.AgentModels {
-		values := config.AgentModels[amKey]
-		fmt.Print("The value of amkey is: \n", amKey)
-		fmt.Print("The content in Agnentmodel is \n", values)
-
-		model := &genai.GenerateContentConfig{
-			Temperature:       genai.Ptr[float32](values.Temperature),
-			TopP:              genai.Ptr[float32](values.TopP),
-			TopK:              genai.Ptr[float32](values.TopK),
-			MaxOutputTokens:   values.MaxTokens,
-			SystemInstruction: &genai.Content{Parts: []*genai.Part{{Text: values.SystemInstructions}}},
-			SafetySettings:    DefaultSafetySettings,
-			ResponseMIMEType:  values.OutputFormat,
-			Tools:             []*genai.Tool{},
+		model, err := NewGenerativeModel(amKey, config.AgentModels[amKey], gc, bs)
+		if err != nil {
+			return nil, err
 		}
-		// 	model.SetTemperature(values.Temperature)
-		// 	model.SetTopK(values.TopK)
-		// 	model.SetTopP(values.TopP)
-		// 	model.SetMaxOutputTokens(values.MaxTokens)
-		// 	model.SystemInstruction = &genai.Content{
-		// 		Parts: []genai.Part{genai.Text(values.SystemInstructions)},
-		// 	}
-		// 	// Apply the default safety settings and desired output format.
-		// 	model.SafetySettings = DefaultSafetySettings
-		// 	model.ResponseMIMEType = values.OutputFormat
-		// 	model.Tools = []*genai.Tool{} // Initialize with no tools by default.
-
-		// 	// Wrap the configured model with our rate limiter.
-		wrappedAgent := NewQuotaAwareModel(model, values.Model, gc.Models, values.RateLimit)
-		agentModels[amKey] = wrappedAgent
+		breaker := breakers.get(providerBreaker(config.AgentModels[amKey].Provider))
+		model = NewQuotaModel(NewBudgetModel(NewPricedModel(model, config.ModelPricing), budgets), quotas)
+		agentModels[amKey] = NewLimitedModel(NewBreakerModel(model, breaker), ingestionLimiter)
+	}
+
+	// Every listener pauses while a breaker is open, rather than running its
+	// messages into it.
+	breakerList := breakers.list()
+	for _, listener := range listeners {
+		listener.SetCircuitBreakers(breakerList...)
 	}
 
 	// Assemble the final ServiceClients struct with all the initialized clients and models.
 	cloud = &ServiceClients{
-		StorageClient:   sc,
-		PubsubClient:    pc,
-		GenAIClient:     gc,
-		BiqQueryClient:  bc,
-		PubSubListeners: subscriptions,
-		EmbeddingModels: embeddingModels,
-		AgentModels:     agentModels,
+		BlobStore:        bs,
+		PubsubClient:     pc,
+		GenAIClient:      gc,
+		BiqQueryClient:   bc,
+		MediaRepository:  repo,
+		Listeners:        listeners,
+		DeadLetters:      deadLetters,
+		EmbeddingModels:  embeddingModels,
+		AgentModels:      agentModels,
+		FFmpegLimiter:    ffmpegLimiter,
+		IngestionLimiter: ingestionLimiter,
+		Quotas:           quotas,
+		Breakers:         breakerList,
+		Budgets:          budgets,
+		Deferrals:        deferrals,
 	}
 
 	return cloud, err
 }
+
+// The names of the circuit breakers.
+const (
+	breakerVertexAI   = "vertex-ai"
+	breakerOpenAI     = "openai"
+	breakerRepository = "repository"
+)
+
+// defaultOpenTimeout is the time an open circuit waits before a probe if
+// `open_timeout_seconds` is zero.
+const defaultOpenTimeout = 30 * time.Second
+
+// circuitBreakers creates the circuit breakers of the external services on
+// first use, so that only the services in use have one.
+type circuitBreakers struct {
+	config   CircuitBreakerConfig
+	breakers map[string]*CircuitBreaker
+}
+
+func newCircuitBreakers(config CircuitBreakerConfig) *circuitBreakers {
+	return &circuitBreakers{config: config, breakers: make(map[string]*CircuitBreaker)}
+}
+
+// get returns the breaker of a service, creating it on first use. It is nil
+// if the name is empty or the configuration disables breakers.
+func (c *circuitBreakers) get(name string) *CircuitBreaker {
+	if len(name) == 0 {
+		return nil
+	}
+	if breaker, ok := c.breakers[name]; ok {
+		return breaker
+	}
+	openTimeout := time.Duration(c.config.OpenTimeoutSeconds) * time.Second
+	if openTimeout <= 0 {
+		openTimeout = defaultOpenTimeout
+	}
+	isFailure := IsServiceOutage
+	if name == breakerRepository {
+		isFailure = IsRepositoryOutage
+	}
+	breaker := NewCircuitBreaker(name, c.config.FailureThreshold, openTimeout, isFailure)
+	c.breakers[name] = breaker
+	return breaker
+}
+
+// list returns the breakers created so far, sorted by name.
+func (c *circuitBreakers) list() []*CircuitBreaker {
+	var out []*CircuitBreaker
+	for _, breaker := range c.breakers {
+		if breaker != nil {
+			out = append(out, breaker)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out
+}
+
+// providerBreaker returns the name of the breaker of a model provider, or ""
+// if its calls do not leave the process.
+func providerBreaker(provider string) string {
+	switch provider {
+	case "", ModelProviderVertex:
+		return breakerVertexAI
+	case ModelProviderOpenAI:
+		return breakerOpenAI
+	default:
+		return ""
+	}
+}
+
+// usesPubSub reports whether a listener of the configuration reads a Pub/Sub
+// subscription or publishes to a dead-letter topic.
+func usesPubSub(config *Config) bool {
+	for _, subscription := range config.TopicSubscriptions {
+		if subscription.Source == "" || subscription.Source == MessageSourcePubSub || len(subscription.DeadLetterTopic) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// newDeadLetterPolicy creates the dead-letter policy of a listener.
+//
+// Inputs:
+//   - name: The logical name of the listener.
+//   - subscription: The listener's configuration.
+//   - client: The Pub/Sub client; nil if no listener uses Pub/Sub.
+//   - store: The store of dead letters; may be nil.
+//
+// Outputs:
+//   - *DeadLetterPolicy: The policy, or nil if the listener never dead-letters.
+func newDeadLetterPolicy(name string, subscription TopicSubscription, client *pubsub.Client, store DeadLetterStore) *DeadLetterPolicy {
+	attempts := subscription.MaxDeliveryAttempts
+	if attempts == 0 {
+		attempts = DefaultMaxDeliveryAttempts
+	}
+	if attempts < 0 {
+		return nil
+	}
+	policy := &DeadLetterPolicy{Listener: name, MaxDeliveryAttempts: attempts, Store: store}
+	if len(subscription.DeadLetterTopic) > 0 && client != nil {
+		policy.Topic = client.Topic(subscription.DeadLetterTopic)
+	}
+	if policy.Topic == nil && policy.Store == nil {
+		return nil
+	}
+	return policy
+}
+
+// usesVertexAI reports whether an agent or embedding model of the configuration
+// is served by Vertex AI.
+func usesVertexAI(config *Config) bool {
+	for _, model := range config.AgentModels {
+		if model.Provider == "" || model.Provider == ModelProviderVertex {
+			return true
+		}
+	}
+	for _, model := range config.EmbeddingModels {
+		if model.Provider == "" || model.Provider == ModelProviderVertex {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+)
+
+// mediaWithoutUsage is the response of BigQuery to a lookup of a media row
+// written before usage was recorded: its usage record, and the usage columns
+// of its scene, are NULL.
+const mediaWithoutUsage = `{
+  "kind": "bigquery#queryResponse",
+  "jobComplete": true,
+  "jobReference": {"projectId": "test-project", "jobId": "job-1"},
+  "totalRows": "1",
+  "schema": {"fields": [
+    {"name": "id", "type": "STRING"},
+    {"name": "title", "type": "STRING"},
+    {"name": "scenes", "type": "RECORD", "mode": "REPEATED", "fields": [
+      {"name": "sequence", "type": "INTEGER"},
+      {"name": "tokens_to_generate", "type": "INTEGER"},
+      {"name": "tokens_generated", "type": "INTEGER"},
+      {"name": "cost", "type": "FLOAT"},
+      {"name": "script", "type": "STRING"}
+    ]},
+    {"name": "usage", "type": "RECORD", "fields": [
+      {"name": "total", "type": "RECORD", "fields": [
+        {"name": "model", "type": "STRING"},
+        {"name": "input_tokens", "type": "INTEGER"},
+        {"name": "output_tokens", "type": "INTEGER"},
+        {"name": "cost", "type": "FLOAT"}
+      ]}
+    ]}
+  ]},
+  "rows": [{"f": [
+    {"v": "media-1"},
+    {"v": "Trailer"},
+    {"v": [{"v": {"f": [{"v": "1"}, {"v": null}, {"v": null}, {"v": null}, {"v": "the opening shot"}]}}]},
+    {"v": null}
+  ]}]
+}`
+
+// TestBigQueryMediaRepositoryReadsMediaWithoutUsage verifies that media rows
+// written before usage was recorded are still read, with no usage.
+func TestBigQueryMediaRepositoryReadsMediaWithoutUsage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasSuffix(r.URL.Path, "/queries"), r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(mediaWithoutUsage))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client, err := bigquery.NewClient(ctx, "test-project", option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	assert.Nil(t, err)
+	defer client.Close()
+	repo := cloud.NewBigQueryMediaRepository(client, cloud.BigQueryDataSource{DatasetName: "media_ds", MediaTable: "media"}, cloud.DistanceEuclidean)
+
+	media, err := repo.GetMedia(ctx, "media-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Trailer", media.Title)
+	assert.Nil(t, media.Usage)
+	if assert.Len(t, media.Scenes, 1) {
+		assert.Equal(t, "the opening shot", media.Scenes[0].Script)
+		assert.False(t, media.Scenes[0].TokensToGenerate.Valid)
+		assert.False(t, media.Scenes[0].Cost.Valid)
+	}
+}
+
+// TestBigQueryMediaRepositorySavesWithInsertID verifies that media rows are
+// streamed with an insert ID, so that a retried insert is de-duplicated, that
+// differs for a media object indexed again.
+func TestBigQueryMediaRepositorySavesWithInsertID(t *testing.T) {
+	var insertIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasSuffix(r.URL.Path, "/tables/media/insertAll"), r.URL.Path)
+		var body struct {
+			Rows []struct {
+				InsertID string `json:"insertId"`
+			} `json:"rows"`
+		}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		for _, row := range body.Rows {
+			insertIDs = append(insertIDs, row.InsertID)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"kind": "bigquery#tableDataInsertAllResponse"}`))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client, err := bigquery.NewClient(ctx, "test-project", option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	assert.Nil(t, err)
+	defer client.Close()
+	repo := cloud.NewBigQueryMediaRepository(client, cloud.BigQueryDataSource{DatasetName: "media_ds", MediaTable: "media"}, cloud.DistanceEuclidean)
+
+	media := model.NewMedia("trailer.mp4")
+	assert.Nil(t, repo.SaveMedia(ctx, media))
+	assert.Nil(t, repo.SaveMedia(ctx, media))
+	again := model.NewMedia("trailer.mp4")
+	again.CreateDate = media.CreateDate.Add(time.Second)
+	assert.Nil(t, repo.SaveMedia(ctx, again))
+	if assert.Len(t, insertIDs, 3) {
+		assert.True(t, strings.HasPrefix(insertIDs[0], media.Id))
+		assert.Equal(t, insertIDs[0], insertIDs[1])
+		assert.NotEqual(t, insertIDs[0], insertIDs[2])
+	}
+}
+
+// TestBigQueryMediaRepositoryDeletesWithTombstone verifies that a deletion is
+// recorded as a tombstone, which the lookups filter on, and succeeds even
+// when BigQuery refuses to delete rows still in the streaming buffer.
+func TestBigQueryMediaRepositoryDeletesWithTombstone(t *testing.T) {
+	var tombstones []string
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/tables/media_tombstones/insertAll"):
+			var body struct {
+				Rows []struct {
+					JSON map[string]interface{} `json:"json"`
+				} `json:"rows"`
+			}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			for _, row := range body.Rows {
+				tombstones = append(tombstones, row.JSON["media_id"].(string))
+			}
+			_, _ = w.Write([]byte(`{"kind": "bigquery#tableDataInsertAllResponse"}`))
+		case strings.HasSuffix(r.URL.Path, "/jobs"):
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": {"code": 400, "message": "UPDATE or DELETE statement over table would affect rows in the streaming buffer, which is not supported"}}`))
+		case strings.Contains(r.URL.Path, "/queries"):
+			if r.Method == http.MethodPost {
+				var body struct {
+					Query string `json:"query"`
+				}
+				assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+				queries = append(queries, body.Query)
+			}
+			_, _ = w.Write([]byte(`{"kind": "bigquery#queryResponse", "jobComplete": true, "totalRows": "0",
+				"jobReference": {"projectId": "test-project", "jobId": "job-1"}, "schema": {"fields": [{"name": "id", "type": "STRING"}]}}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client, err := bigquery.NewClient(ctx, "test-project", option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	assert.Nil(t, err)
+	defer client.Close()
+	repo := cloud.NewBigQueryMediaRepository(client, cloud.BigQueryDataSource{DatasetName: "media_ds", MediaTable: "media",
+		EmbeddingTable: "scene_embeddings", TombstoneTable: "media_tombstones"}, cloud.DistanceEuclidean)
+
+	assert.Nil(t, repo.DeleteMedia(ctx, "media-1"))
+	assert.Nil(t, repo.DeleteMedia(ctx, "media-1"))
+	assert.Equal(t, []string{"media-1", "media-1"}, tombstones)
+
+	_, err = repo.GetMedia(ctx, "media-1")
+	assert.ErrorIs(t, err, cloud.ErrMediaNotFound)
+	if assert.Len(t, queries, 1) {
+		assert.Contains(t, queries[0], "media_tombstones")
+	}
+}
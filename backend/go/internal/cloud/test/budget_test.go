@@ -0,0 +1,272 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLogs sends the structured logs of the test to a buffer.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	logger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(logger) })
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	return &buf
+}
+
+// TestBudgetManager verifies that a spent daily budget refuses further work
+// until the next day, that the spend is read from the ledger shared by every
+// instance, and that an estimate over the per-media budget fails for good.
+func TestBudgetManager(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t, cloud.DistanceEuclidean)
+	config := cloud.BudgetConfig{DailyMaxCost: 1, MonthlyMaxTokens: 1_000_000, PerMediaMaxCost: 0.5}
+	budgets := cloud.NewBudgetManager(config, repo)
+	assert.Nil(t, cloud.NewBudgetManager(cloud.BudgetConfig{AlertThresholds: []float64{0.5}}, repo))
+
+	assert.Nil(t, budgets.Check(ctx, model.TokenUsage{}))
+	assert.Nil(t, budgets.Record(ctx, "gemini", cloud.Usage{InputTokens: 400_000, OutputTokens: 10_000, Cost: 0.6}))
+	assert.Nil(t, budgets.Check(ctx, model.TokenUsage{Cost: 0.4}))
+	assert.Nil(t, budgets.Record(ctx, "gemini", cloud.Usage{InputTokens: 300_000, OutputTokens: 10_000, Cost: 0.45}))
+
+	err := budgets.Check(ctx, model.TokenUsage{})
+	assert.ErrorIs(t, err, cloud.ErrBudgetExceeded)
+	var budgetErr *cloud.BudgetExceededError
+	assert.True(t, errors.As(err, &budgetErr))
+	assert.Equal(t, cloud.BudgetDaily, budgetErr.Budget)
+	assert.Equal(t, cloud.BudgetUnitCost, budgetErr.Unit)
+	assert.InDelta(t, 1.05, budgetErr.Spent, 1e-9)
+	assert.True(t, budgetErr.Deferrable())
+	assert.False(t, cor.IsRetryable(err))
+	now := time.Now().UTC()
+	assert.Equal(t, time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC), budgetErr.ResetAt)
+
+	// Another instance reads the spend from the ledger.
+	assert.ErrorIs(t, cloud.NewBudgetManager(config, repo).Check(ctx, model.TokenUsage{}), cloud.ErrBudgetExceeded)
+
+	// A media file over the per-media budget would be refused on any day.
+	err = budgets.Check(ctx, model.TokenUsage{Cost: 0.6})
+	assert.True(t, errors.As(err, &budgetErr))
+	assert.Equal(t, cloud.BudgetPerMedia, budgetErr.Budget)
+	assert.False(t, budgetErr.Deferrable())
+	assert.Equal(t, "per-media cost budget exceeded: $0.60 of $0.50", err.Error())
+
+	states := budgets.Snapshot()
+	assert.Len(t, states, 2)
+	assert.Equal(t, cloud.BudgetMonthly, states[1].Budget)
+	assert.Equal(t, 720_000, states[1].Tokens)
+	assert.Equal(t, 1_000_000, states[1].MaxTokens)
+	assert.Empty(t, (*cloud.BudgetManager)(nil).Snapshot())
+}
+
+// TestBudgetManagerAlerts verifies that an alert is logged once for the
+// highest threshold crossed by each spend.
+func TestBudgetManagerAlerts(t *testing.T) {
+	logs := captureLogs(t)
+	ctx := context.Background()
+	budgets := cloud.NewBudgetManager(cloud.BudgetConfig{DailyMaxTokens: 1000, AlertThresholds: []float64{0.8, 0.5}}, newTestRepository(t, cloud.DistanceEuclidean))
+
+	assert.Nil(t, budgets.Record(ctx, "gemini", cloud.Usage{InputTokens: 400}))
+	assert.Empty(t, logs.String())
+	assert.Nil(t, budgets.Record(ctx, "gemini", cloud.Usage{InputTokens: 150}))
+	assert.Nil(t, budgets.Record(ctx, "gemini", cloud.Usage{InputTokens: 10}))
+	assert.Nil(t, budgets.Record(ctx, "gemini", cloud.Usage{InputTokens: 500}))
+
+	alerts := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assert.Len(t, alerts, 2)
+	assert.Contains(t, alerts[0], `"msg":"budget threshold crossed","budget":"daily","unit":"tokens","threshold":0.5,"spent":550,"limit":1000`)
+	assert.Contains(t, alerts[1], `"threshold":0.8,"spent":1060`)
+}
+
+// TestBudgetModel verifies that the usage, and estimated cost, of each
+// response is recorded with the budgets.
+func TestBudgetModel(t *testing.T) {
+	budgets := cloud.NewBudgetManager(cloud.BudgetConfig{DailyMaxCost: 1}, newTestRepository(t, cloud.DistanceEuclidean))
+	throttled := &throttledModel{}
+	throttled.calls.Store(1) // Past its rejected request.
+	priced := cloud.NewPricedModel(throttled, map[string]cloud.ModelPricing{"gemini": {InputPerMillionTokens: 1.25, OutputPerMillionTokens: 10}})
+	model := cloud.NewBudgetModel(priced, budgets)
+	assert.Same(t, priced, cloud.NewBudgetModel(priced, nil))
+
+	for range 2 {
+		_, err := model.Generate(context.Background(), &cloud.GenerationRequest{Text: "describe"})
+		assert.Nil(t, err)
+	}
+	daily := budgets.Snapshot()[0]
+	assert.Equal(t, 2460, daily.Tokens)
+	assert.InDelta(t, 0.0036, daily.Cost, 1e-9)
+}
+
+// budgetCommand fails with the errors it is given, one per run, then succeeds.
+type budgetCommand struct {
+	cor.BaseCommand
+	mu    sync.Mutex
+	errs  []error
+	calls atomic.Int32
+}
+
+func (c *budgetCommand) Execute(context cor.Context) {
+	c.calls.Add(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.errs) > 0 {
+		context.AddError(c.GetName(), c.errs[0])
+		c.errs = c.errs[1:]
+	}
+}
+
+// spent is a refusal by the spent daily budget.
+var spent = &cloud.BudgetExceededError{Budget: cloud.BudgetDaily, Unit: cloud.BudgetUnitCost, Limit: 1, Spent: 1}
+
+// TestMessageListenerDefersOverBudget verifies that a message refused by a
+// spent budget is acknowledged into the deferral queue, and replayed from it
+// once the budgets allow it.
+func TestMessageListenerDefersOverBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := &answeringSource{ChannelSource: cloud.NewChannelSource("test", 10, 20*time.Millisecond), answers: map[string]string{}}
+	defer source.Close()
+	deadLetters, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.Nil(t, err)
+
+	// The budgets only limit media files, so the queue is always allowed to replay.
+	repo := newTestRepository(t, cloud.DistanceEuclidean)
+	config := cloud.BudgetConfig{PerMediaMaxTokens: 1000, DeferredDir: t.TempDir()}
+	command := &budgetCommand{BaseCommand: *cor.NewBaseCommand("check-summary-budget"), errs: []error{spent, spent}}
+	listener := cloud.NewMessageListener(source, command)
+	listener.SetDeadLetterPolicy(&cloud.DeadLetterPolicy{Listener: "LowResTopic", MaxDeliveryAttempts: 1, Store: deadLetters})
+	listeners := map[string]*cloud.MessageListener{"LowResTopic": listener}
+	queue, err := cloud.NewDeferralQueue(config, cloud.NewBudgetManager(config, repo), listeners)
+	assert.Nil(t, err)
+	listener.SetDeferralQueue("LowResTopic", queue)
+	listener.Listen(ctx)
+
+	_, err = source.Publish(ctx, []byte("trailer.mp4"), nil)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return source.answerTo("trailer.mp4") == "ack" }, 5*time.Second, 10*time.Millisecond)
+	deferred, err := queue.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, deferred, 1)
+	assert.Equal(t, "LowResTopic", deferred[0].Listener)
+	assert.Contains(t, deferred[0].Errors["check-summary-budget"], "daily cost budget exceeded")
+
+	// Refused again: the message stays deferred, and is not dead-lettered.
+	replayed, err := queue.ReplayDeferred(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, replayed)
+	deferred, _ = queue.List(ctx)
+	assert.Len(t, deferred, 1)
+
+	replayed, err = queue.ReplayDeferred(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, replayed)
+	deferred, _ = queue.List(ctx)
+	assert.Empty(t, deferred)
+	letters, _ := deadLetters.List(ctx)
+	assert.Empty(t, letters)
+	assert.Equal(t, int32(3), command.calls.Load())
+
+	// A spent budget holds the deferred messages back without replaying them.
+	exhausted := cloud.BudgetConfig{DailyMaxTokens: 1, DeferredDir: config.DeferredDir}
+	budgets := cloud.NewBudgetManager(exhausted, repo)
+	assert.Nil(t, budgets.Record(ctx, "gemini", cloud.Usage{InputTokens: 10}))
+	held, err := cloud.NewDeferralQueue(exhausted, budgets, listeners)
+	assert.Nil(t, err)
+	assert.Nil(t, held.Defer(ctx, &cloud.DeadLetter{ID: "held", Listener: "LowResTopic", Data: "teaser.mp4"}))
+	replayed, err = held.ReplayDeferred(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, replayed)
+	assert.Equal(t, int32(3), command.calls.Load())
+}
+
+// TestDeferralQueueDeadLettersFailedReplays verifies that a deferred message
+// whose replay fails for another reason follows the listener's dead-letter
+// policy.
+func TestDeferralQueueDeadLettersFailedReplays(t *testing.T) {
+	ctx := context.Background()
+	deadLetters, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.Nil(t, err)
+	config := cloud.BudgetConfig{PerMediaMaxTokens: 1000, DeferredDir: t.TempDir()}
+	command := &budgetCommand{BaseCommand: *cor.NewBaseCommand("generate-media-summary"), errs: []error{errors.New("unavailable"), errors.New("unavailable")}}
+	listener := cloud.NewMessageListener(cloud.NewChannelSource("test", 1, time.Second), command)
+	listener.SetDeadLetterPolicy(&cloud.DeadLetterPolicy{Listener: "LowResTopic", MaxDeliveryAttempts: 2, Store: deadLetters})
+	queue, err := cloud.NewDeferralQueue(config, cloud.NewBudgetManager(config, newTestRepository(t, cloud.DistanceEuclidean)),
+		map[string]*cloud.MessageListener{"LowResTopic": listener})
+	assert.Nil(t, err)
+	assert.Nil(t, queue.Defer(ctx, &cloud.DeadLetter{ID: "deferred", Listener: "LowResTopic", Data: "trailer.mp4"}))
+
+	// The first failure is kept for the next round, the second is the last attempt.
+	for range 2 {
+		replayed, err := queue.ReplayDeferred(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, replayed)
+	}
+	deferred, _ := queue.List(ctx)
+	assert.Empty(t, deferred)
+	letters, _ := deadLetters.List(ctx)
+	assert.Len(t, letters, 1)
+	assert.Equal(t, 2, letters[0].DeliveryAttempt)
+	assert.Equal(t, "unavailable", letters[0].Errors["generate-media-summary"])
+}
+
+// TestDeferralQueueKeepsMessagesRefusedByOpenCircuit verifies that a replay
+// refused by an open circuit breaker keeps the message deferred, without
+// counting an attempt, and ends the round.
+func TestDeferralQueueKeepsMessagesRefusedByOpenCircuit(t *testing.T) {
+	ctx := context.Background()
+	deadLetters, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.Nil(t, err)
+	config := cloud.BudgetConfig{PerMediaMaxTokens: 1000, DeferredDir: t.TempDir()}
+	command := &budgetCommand{BaseCommand: *cor.NewBaseCommand("generate-media-summary"),
+		errs: []error{&cloud.CircuitOpenError{Breaker: "model", RetryAfter: time.Minute}}}
+	listener := cloud.NewMessageListener(cloud.NewChannelSource("test", 1, time.Second), command)
+	listener.SetDeadLetterPolicy(&cloud.DeadLetterPolicy{Listener: "LowResTopic", MaxDeliveryAttempts: 1, Store: deadLetters})
+	queue, err := cloud.NewDeferralQueue(config, cloud.NewBudgetManager(config, newTestRepository(t, cloud.DistanceEuclidean)),
+		map[string]*cloud.MessageListener{"LowResTopic": listener})
+	assert.Nil(t, err)
+	assert.Nil(t, queue.Defer(ctx, &cloud.DeadLetter{ID: "first", Listener: "LowResTopic", Data: "first.mp4"}))
+	assert.Nil(t, queue.Defer(ctx, &cloud.DeadLetter{ID: "second", Listener: "LowResTopic", Data: "second.mp4"}))
+
+	replayed, err := queue.ReplayDeferred(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, replayed)
+	assert.Equal(t, int32(1), command.calls.Load())
+	deferred, _ := queue.List(ctx)
+	assert.Len(t, deferred, 2)
+	for _, letter := range deferred {
+		assert.Equal(t, 0, letter.DeliveryAttempt)
+	}
+	letters, _ := deadLetters.List(ctx)
+	assert.Empty(t, letters)
+
+	// Once the circuit closes, both are replayed.
+	replayed, err = queue.ReplayDeferred(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, replayed)
+}
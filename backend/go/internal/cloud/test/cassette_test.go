@@ -0,0 +1,134 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"cloud.google.com/go/auth"
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genai"
+)
+
+// staticToken provides a fixed token to the GenAI client under test.
+type staticToken struct{}
+
+func (staticToken) Token(context.Context) (*auth.Token, error) {
+	return &auth.Token{Value: "test", Type: "Bearer"}, nil
+}
+
+// newCassetteClient creates a Vertex AI GenAI client whose requests go through
+// a cassette transport to the given base URL.
+func newCassetteClient(t *testing.T, transport http.RoundTripper, baseURL string) *genai.Client {
+	client, err := genai.NewClient(context.Background(), &genai.ClientConfig{
+		Project:     "test-project",
+		Location:    "us-central1",
+		Backend:     genai.BackendVertexAI,
+		Credentials: auth.NewCredentials(&auth.CredentialsOptions{TokenProvider: staticToken{}}),
+		HTTPClient:  &http.Client{Transport: transport},
+		HTTPOptions: genai.HTTPOptions{BaseURL: baseURL},
+	})
+	assert.Nil(t, err)
+	return client
+}
+
+// TestCassetteRecordAndReplay verifies that a Gemini call recorded against a
+// server is replayed, usage included, after the server is gone.
+func TestCassetteRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		assert.True(t, strings.HasSuffix(r.URL.Path, "/models/gemini-2.5-pro:generateContent"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{
+			"candidates": [{"content": {"role": "model", "parts": [{"text": "{\"title\": \"Up\"}"}]}}],
+			"usageMetadata": {"promptTokenCount": 1200, "candidatesTokenCount": 30}
+		}`))
+	}))
+	config := cloud.VertexAiLLMModel{Model: "gemini-2.5-pro", OutputFormat: "application/json"}
+	request := &cloud.GenerationRequest{
+		Text:  "Summarize the trailer.",
+		Media: []cloud.MediaPart{{URI: "gs://media-low-res/trailer.mp4", MIMEType: "video/mp4"}},
+	}
+
+	recorder, err := cloud.NewCassetteTransport(cloud.TestModeRecord, dir, nil)
+	assert.Nil(t, err)
+	model, err := cloud.NewGenerativeModel("creative-flash", config, newCassetteClient(t, recorder, server.URL), nil)
+	assert.Nil(t, err)
+	recorded, err := model.Generate(context.Background(), request)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), hits.Load())
+	server.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Equal(t, 1, len(files))
+	content, _ := os.ReadFile(files[0])
+	assert.Contains(t, string(content), `"promptTokenCount": 1200`)
+	assert.NotContains(t, string(content), "Bearer")
+
+	// The replay client points at another host, which is not part of the key.
+	player, err := cloud.NewCassetteTransport(cloud.TestModeReplay, dir, nil)
+	assert.Nil(t, err)
+	model, err = cloud.NewGenerativeModel("creative-flash", config, newCassetteClient(t, player, "https://europe-west1-aiplatform.googleapis.com/"), nil)
+	assert.Nil(t, err)
+	replayed, err := model.Generate(context.Background(), request)
+	assert.Nil(t, err)
+	assert.Equal(t, recorded, replayed)
+	assert.Equal(t, `{"title": "Up"}`, replayed.Text)
+	assert.Equal(t, cloud.Usage{InputTokens: 1200, OutputTokens: 30}, replayed.Usage)
+}
+
+// TestCassetteKeyIgnoresFieldOrder verifies that JSON bodies with the same
+// content replay the same cassette whatever the order of their fields, and
+// that other requests are not answered.
+func TestCassetteKeyIgnoresFieldOrder(t *testing.T) {
+	dir := t.TempDir()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("plain text"))
+	}))
+	defer server.Close()
+
+	recorder, err := cloud.NewCassetteTransport(cloud.TestModeRecord, dir, nil)
+	assert.Nil(t, err)
+	resp, err := (&http.Client{Transport: recorder}).Post(server.URL+"/v1/embed", "application/json", strings.NewReader(`{"a": 1, "b": [2, 3]}`))
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	player, err := cloud.NewCassetteTransport(cloud.TestModeReplay, dir, nil)
+	assert.Nil(t, err)
+	client := &http.Client{Transport: player}
+	resp, err = client.Post("http://elsewhere/v1/embed", "application/json", strings.NewReader(`{"b":[2,3],"a":1}`))
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "plain text", string(body))
+
+	_, err = client.Post("http://elsewhere/v1/embed", "application/json", strings.NewReader(`{"a": 2}`))
+	assert.ErrorIs(t, err, cloud.ErrCassetteNotFound)
+
+	_, err = cloud.NewCassetteTransport(cloud.TestModeReplay, "", nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genai"
+)
+
+// unavailable is an outage of Vertex AI.
+var unavailable = genai.APIError{Code: 503, Status: "UNAVAILABLE"}
+
+// trip records failures of the service until the breaker opens.
+func trip(t *testing.T, breaker *cloud.CircuitBreaker, failures int) {
+	for range failures {
+		assert.Nil(t, breaker.Allow())
+		breaker.Record(unavailable)
+	}
+	assert.Equal(t, "open", breaker.Status().State)
+}
+
+// TestCircuitBreakerStates verifies that consecutive outages open the
+// circuit, and that a single probe closes or reopens it.
+func TestCircuitBreakerStates(t *testing.T) {
+	breaker := cloud.NewCircuitBreaker("vertex-ai", 2, 50*time.Millisecond, cloud.IsServiceOutage)
+
+	// Rejected requests and exceeded quotas do not count as outages.
+	for range 3 {
+		assert.Nil(t, breaker.Allow())
+		breaker.Record(genai.APIError{Code: 400, Message: "Invalid argument"})
+		breaker.Record(genai.APIError{Code: 429, Status: "RESOURCE_EXHAUSTED"})
+	}
+	assert.Equal(t, "closed", breaker.Status().State)
+	assert.Nil(t, breaker.Status().OpenedAt)
+
+	trip(t, breaker, 2)
+	err := breaker.Allow()
+	assert.ErrorIs(t, err, cloud.ErrCircuitOpen)
+	var openErr *cloud.CircuitOpenError
+	assert.True(t, errors.As(err, &openErr))
+	assert.Equal(t, "vertex-ai", openErr.Breaker)
+	assert.Greater(t, openErr.RetryAfter, time.Duration(0))
+	assert.NotNil(t, breaker.Status().OpenedAt)
+
+	// A failed probe opens the circuit again.
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, "half-open", breaker.Status().State)
+	assert.Nil(t, breaker.Allow())
+	assert.ErrorIs(t, breaker.Allow(), cloud.ErrCircuitOpen)
+	breaker.Record(unavailable)
+	assert.Equal(t, "open", breaker.Status().State)
+
+	// A successful probe closes it.
+	time.Sleep(60 * time.Millisecond)
+	assert.Nil(t, breaker.Allow())
+	breaker.Record(nil)
+	assert.Equal(t, "closed", breaker.Status().State)
+	assert.Equal(t, 0, breaker.Status().Failures)
+	assert.Nil(t, breaker.Allow())
+
+	// Breakers are disabled by a zero threshold.
+	assert.Nil(t, cloud.NewCircuitBreaker("vertex-ai", 0, time.Second, cloud.IsServiceOutage))
+}
+
+// TestCircuitBreakerWait verifies that Wait blocks until the open circuit
+// lets a probe through, and honors cancellation.
+func TestCircuitBreakerWait(t *testing.T) {
+	breaker := cloud.NewCircuitBreaker("vertex-ai", 1, 100*time.Millisecond, cloud.IsServiceOutage)
+	trip(t, breaker, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, breaker.Wait(ctx), context.DeadlineExceeded)
+
+	start := time.Now()
+	assert.Nil(t, breaker.Wait(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, "half-open", breaker.Status().State)
+}
+
+// TestBreakerModel verifies that an open circuit refuses the requests of a
+// model without sending them, and that the refusal is neither classified as a
+// failure of the model nor retried.
+func TestBreakerModel(t *testing.T) {
+	model := &flakyModel{errs: []error{unavailable, unavailable, unavailable}}
+	breaker := cloud.NewCircuitBreaker("vertex-ai", 2, time.Minute, cloud.IsServiceOutage)
+	wrapped := cloud.NewBreakerModel(model, breaker)
+	assert.Same(t, model, cloud.NewBreakerModel(model, nil))
+
+	for range 2 {
+		_, err := wrapped.Generate(context.Background(), &cloud.GenerationRequest{Text: "describe"})
+		assert.Equal(t, unavailable, err)
+	}
+	_, err := generate(t, wrapped)
+	assert.ErrorIs(t, err, cloud.ErrCircuitOpen)
+	assert.Equal(t, int32(2), model.calls.Load())
+	assert.Equal(t, err, cloud.ClassifyGenerationError("gemini", err))
+	assert.False(t, cor.IsRetryable(err))
+
+	// A missing media object is not an outage of the repository.
+	assert.False(t, cloud.IsRepositoryOutage(fmt.Errorf("media a.mp4: %w", cloud.ErrMediaNotFound)))
+	assert.True(t, cloud.IsRepositoryOutage(errors.New("database is locked")))
+}
+
+// modelCommand sends a request to a model.
+type modelCommand struct {
+	cor.BaseCommand
+	model cloud.GenerativeModel
+}
+
+func (c *modelCommand) Execute(context cor.Context) {
+	if _, err := c.model.Generate(context.GetContext(), &cloud.GenerationRequest{Text: "describe"}); err != nil {
+		context.AddError(c.GetName(), err)
+	}
+}
+
+// listenThrough starts a listener, which dead-letters a message on its first
+// failure, on a command calling the model through the breaker.
+func listenThrough(t *testing.T, model cloud.GenerativeModel, breaker *cloud.CircuitBreaker, pause bool) (*answeringSource, cloud.DeadLetterStore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	source := &answeringSource{ChannelSource: cloud.NewChannelSource("test", 10, 20*time.Millisecond), answers: map[string]string{}}
+	t.Cleanup(func() { source.Close() })
+	store, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.Nil(t, err)
+
+	command := &modelCommand{BaseCommand: *cor.NewBaseCommand("generate-media-summary"), model: cloud.NewBreakerModel(model, breaker)}
+	listener := cloud.NewMessageListener(source, command)
+	listener.SetDeadLetterPolicy(&cloud.DeadLetterPolicy{Listener: "LowResTopic", MaxDeliveryAttempts: 1, Store: store})
+	if pause {
+		listener.SetCircuitBreakers(breaker)
+	}
+	listener.Listen(ctx)
+	return source, store
+}
+
+// TestMessageListenerPausesWhileCircuitOpen verifies that a listener does not
+// run its messages while a breaker is open.
+func TestMessageListenerPausesWhileCircuitOpen(t *testing.T) {
+	model := &flakyModel{}
+	breaker := cloud.NewCircuitBreaker("vertex-ai", 1, 150*time.Millisecond, cloud.IsServiceOutage)
+	trip(t, breaker, 1)
+	source, store := listenThrough(t, model, breaker, true)
+
+	start := time.Now()
+	_, err := source.Publish(context.Background(), []byte("trailer.mp4"), nil)
+	assert.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), model.calls.Load())
+
+	assert.Eventually(t, func() bool { return source.answerTo("trailer.mp4") == "ack" }, 5*time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, int32(1), model.calls.Load())
+	assert.Equal(t, "closed", breaker.Status().State)
+	letters, _ := store.List(context.Background())
+	assert.Empty(t, letters)
+}
+
+// TestMessageListenerNacksOnOpenCircuit verifies that a chain refused by an
+// open circuit is redelivered without counting as a failed attempt.
+func TestMessageListenerNacksOnOpenCircuit(t *testing.T) {
+	model := &flakyModel{}
+	breaker := cloud.NewCircuitBreaker("vertex-ai", 1, 100*time.Millisecond, cloud.IsServiceOutage)
+	trip(t, breaker, 1)
+	source, store := listenThrough(t, model, breaker, false)
+
+	_, err := source.Publish(context.Background(), []byte("trailer.mp4"), nil)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return source.answerTo("trailer.mp4") == "nack" }, time.Second, 5*time.Millisecond)
+
+	assert.Eventually(t, func() bool { return source.answerTo("trailer.mp4") == "ack" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), model.calls.Load())
+	letters, _ := store.List(context.Background())
+	assert.Empty(t, letters)
+}
+
+// TestMessageListenerReplayWaitsWhileCircuitOpen verifies that a replay waits
+// for an open breaker like a delivered message, rather than running into it.
+func TestMessageListenerReplayWaitsWhileCircuitOpen(t *testing.T) {
+	model := &flakyModel{}
+	breaker := cloud.NewCircuitBreaker("vertex-ai", 1, time.Minute, cloud.IsServiceOutage)
+	trip(t, breaker, 1)
+	command := &modelCommand{BaseCommand: *cor.NewBaseCommand("generate-media-summary"), model: cloud.NewBreakerModel(model, breaker)}
+	listener := cloud.NewMessageListener(cloud.NewChannelSource("test", 1, time.Second), command)
+	listener.SetCircuitBreakers(breaker)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	errs := listener.Replay(ctx, &cloud.DeadLetter{ID: "letter", Listener: "LowResTopic", Data: "trailer.mp4"})
+	assert.ErrorIs(t, errs["generate-media-summary"], context.DeadlineExceeded)
+	assert.Equal(t, int32(0), model.calls.Load())
+}
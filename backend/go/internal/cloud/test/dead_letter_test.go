@@ -0,0 +1,334 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// failingCommand fails until it is told to succeed.
+type failingCommand struct {
+	cor.BaseCommand
+	mu      sync.Mutex
+	calls   int
+	succeed bool
+	inputs  []string
+}
+
+func (c *failingCommand) Execute(context cor.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	c.inputs = append(c.inputs, context.Get(cor.CtxIn).(string))
+	if !c.succeed {
+		context.AddError(c.GetName(), errors.New("transcode failed"))
+	}
+}
+
+func (c *failingCommand) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+// uncountedSource hides the delivery attempts of a channel source, like a
+// Pub/Sub subscription without a dead-letter policy.
+type uncountedSource struct {
+	*cloud.ChannelSource
+}
+
+func (s uncountedSource) Receive(ctx context.Context, handler func(context.Context, *cloud.Message)) error {
+	return s.ChannelSource.Receive(ctx, func(ctx context.Context, msg *cloud.Message) {
+		msg.DeliveryAttempt = 0
+		handler(ctx, msg)
+	})
+}
+
+// TestMessageListenerDeadLetters verifies that a message failing its last
+// delivery attempt is saved with its errors and acknowledged, and that it can
+// be replayed into the listener's command.
+func TestMessageListenerDeadLetters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := cloud.NewChannelSource("test", 10, 20*time.Millisecond)
+	defer source.Close()
+	store, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.Nil(t, err)
+
+	command := &failingCommand{BaseCommand: *cor.NewBaseCommand("video-resize")}
+	listener := cloud.NewMessageListener(source, command)
+	listener.SetDeadLetterPolicy(&cloud.DeadLetterPolicy{Listener: "HiResTopic", MaxDeliveryAttempts: 3, Store: store})
+	listener.Listen(ctx)
+
+	id, err := source.Publish(ctx, []byte(`{"name":"trailer.mp4"}`), map[string]string{"eventType": "OBJECT_FINALIZE"})
+	assert.Nil(t, err)
+	var letters []*cloud.DeadLetter
+	assert.Eventually(t, func() bool {
+		letters, _ = store.List(ctx)
+		return len(letters) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	letter := letters[0]
+	assert.Equal(t, "HiResTopic", letter.Listener)
+	assert.Equal(t, id, letter.MessageID)
+	assert.Equal(t, `{"name":"trailer.mp4"}`, letter.Data)
+	assert.Equal(t, "OBJECT_FINALIZE", letter.Attributes["eventType"])
+	assert.Equal(t, 3, letter.DeliveryAttempt)
+	assert.Equal(t, map[string]string{"video-resize": "transcode failed"}, letter.Errors)
+
+	// The message was acknowledged, so it is not delivered again.
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 3, command.count())
+
+	got, err := store.Get(ctx, letter.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, letter.Data, got.Data)
+
+	command.mu.Lock()
+	command.succeed = true
+	command.mu.Unlock()
+	assert.Empty(t, listener.Replay(ctx, letter))
+	assert.Equal(t, `{"name":"trailer.mp4"}`, command.inputs[3])
+
+	assert.Nil(t, store.Delete(ctx, letter.ID))
+	assert.ErrorIs(t, store.Delete(ctx, letter.ID), cloud.ErrDeadLetterNotFound)
+	_, err = store.Get(ctx, "../"+letter.ID)
+	assert.ErrorIs(t, err, cloud.ErrDeadLetterNotFound)
+}
+
+// TestMessageListenerNacksFailedMessages verifies that a failed message is
+// Nack'd for redelivery rather than left to wait for its acknowledgement
+// deadline, so that its attempts are used up without the deadline passing.
+func TestMessageListenerNacksFailedMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := cloud.NewChannelSource("test", 10, time.Hour)
+	defer source.Close()
+	store, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.Nil(t, err)
+
+	command := &failingCommand{BaseCommand: *cor.NewBaseCommand("video-resize")}
+	listener := cloud.NewMessageListener(source, command)
+	listener.SetDeadLetterPolicy(&cloud.DeadLetterPolicy{Listener: "HiResTopic", MaxDeliveryAttempts: 3, Store: store})
+	listener.Listen(ctx)
+
+	_, err = source.Publish(ctx, []byte(`{"name":"trailer.mp4"}`), nil)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		letters, _ := store.List(ctx)
+		return len(letters) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, command.count())
+}
+
+// circuitThenFailCommand is refused by an open circuit on its first calls, and
+// then fails.
+type circuitThenFailCommand struct {
+	cor.BaseCommand
+	refusals int
+	calls    atomic.Int32
+}
+
+func (c *circuitThenFailCommand) Execute(context cor.Context) {
+	if int(c.calls.Add(1)) <= c.refusals {
+		context.AddError(c.GetName(), fmt.Errorf("vertex: %w", cloud.ErrCircuitOpen))
+		return
+	}
+	context.AddError(c.GetName(), errors.New("transcode failed"))
+}
+
+// TestMessageListenerDoesNotCountRequeuedDeliveries verifies that the
+// deliveries Nack'd because of an open circuit are left out of the attempts of
+// a source that counts every delivery, so that they do not bring the message
+// closer to being dead-lettered.
+func TestMessageListenerDoesNotCountRequeuedDeliveries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := cloud.NewChannelSource("test", 10, 20*time.Millisecond)
+	defer source.Close()
+	store, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.Nil(t, err)
+
+	command := &circuitThenFailCommand{BaseCommand: *cor.NewBaseCommand("video-resize"), refusals: 3}
+	listener := cloud.NewMessageListener(source, command)
+	listener.SetDeadLetterPolicy(&cloud.DeadLetterPolicy{Listener: "HiResTopic", MaxDeliveryAttempts: 2, Store: store})
+	listener.Listen(ctx)
+
+	_, err = source.Publish(ctx, []byte(`{"name":"trailer.mp4"}`), nil)
+	assert.Nil(t, err)
+	var letters []*cloud.DeadLetter
+	assert.Eventually(t, func() bool {
+		letters, _ = store.List(ctx)
+		return len(letters) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(5), command.calls.Load())
+	assert.Equal(t, 2, letters[0].DeliveryAttempt)
+}
+
+// TestMessageListenerDropsCheckpointsOfDeadLetters verifies that the workflow
+// checkpoint of a dead-lettered message is deleted, so that it is not left
+// behind in the checkpoint directory.
+func TestMessageListenerDropsCheckpointsOfDeadLetters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := cloud.NewChannelSource("test", 10, 20*time.Millisecond)
+	defer source.Close()
+	store, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.Nil(t, err)
+	checkpoints := cor.NewFileCheckpointStore(t.TempDir())
+	assert.Nil(t, checkpoints.Save(ctx, &cor.Checkpoint{RunID: "trailer.mp4#1", Steps: map[string]*cor.CheckpointStep{}}))
+	assert.Nil(t, checkpoints.Save(ctx, &cor.Checkpoint{RunID: "other.mp4#1", Steps: map[string]*cor.CheckpointStep{}}))
+
+	command := &failingCommand{BaseCommand: *cor.NewBaseCommand("video-resize")}
+	listener := cloud.NewMessageListener(source, command)
+	listener.SetDeadLetterPolicy(&cloud.DeadLetterPolicy{Listener: "HiResTopic", MaxDeliveryAttempts: 2, Store: store})
+	listener.SetCheckpoints(checkpoints, func(context cor.Context) string {
+		var notification struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal([]byte(context.Get(cor.CtxIn).(string)), &notification); err != nil {
+			return ""
+		}
+		return notification.Name + "#1"
+	})
+	listener.Listen(ctx)
+
+	_, err = source.Publish(ctx, []byte(`{"name":"trailer.mp4"}`), nil)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		letters, _ := store.List(ctx)
+		checkpoint, _ := checkpoints.Load(ctx, "trailer.mp4#1")
+		return len(letters) == 1 && checkpoint == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	checkpoint, err := checkpoints.Load(ctx, "other.mp4#1")
+	assert.Nil(t, err)
+	assert.NotNil(t, checkpoint)
+}
+
+// TestMessageListenerPublishesDeadLetters verifies that a dead letter is
+// published to the dead-letter topic with the failing commands and errors as
+// attributes, counting the attempts of a source that does not.
+func TestMessageListenerPublishesDeadLetters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := pstest.NewServer()
+	defer server.Close()
+	conn, err := grpc.NewClient(server.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	defer conn.Close()
+	client, err := pubsub.NewClient(ctx, "test-project", option.WithGRPCConn(conn))
+	assert.Nil(t, err)
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, "media_high_res_events_dead_letter")
+	assert.Nil(t, err)
+	defer topic.Stop()
+
+	source := cloud.NewChannelSource("test", 10, 20*time.Millisecond)
+	defer source.Close()
+	command := &failingCommand{BaseCommand: *cor.NewBaseCommand("video-resize")}
+	listener := cloud.NewMessageListener(uncountedSource{source}, command)
+	listener.SetDeadLetterPolicy(&cloud.DeadLetterPolicy{Listener: "HiResTopic", MaxDeliveryAttempts: 2, Topic: topic})
+	listener.Listen(ctx)
+
+	id, err := source.Publish(ctx, []byte(`{"name":"trailer.mp4"}`), map[string]string{"eventType": "OBJECT_FINALIZE"})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return len(server.Messages()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	published := server.Messages()[0]
+	assert.Equal(t, `{"name":"trailer.mp4"}`, string(published.Data))
+	assert.Equal(t, "OBJECT_FINALIZE", published.Attributes["eventType"])
+	assert.Equal(t, "HiResTopic", published.Attributes[cloud.DeadLetterAttrListener])
+	assert.Equal(t, id, published.Attributes[cloud.DeadLetterAttrMessageID])
+	assert.Equal(t, "2", published.Attributes[cloud.DeadLetterAttrDeliveryAttempt])
+	assert.Equal(t, "video-resize", published.Attributes[cloud.DeadLetterAttrCommands])
+	var errs map[string]string
+	assert.Nil(t, json.Unmarshal([]byte(published.Attributes[cloud.DeadLetterAttrErrors]), &errs))
+	assert.Equal(t, map[string]string{"video-resize": "transcode failed"}, errs)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 2, command.count())
+}
+
+// unreliableStore fails its first save.
+type unreliableStore struct {
+	*cloud.FileDeadLetterStore
+	saves atomic.Int32
+}
+
+func (s *unreliableStore) Save(ctx context.Context, letter *cloud.DeadLetter) error {
+	if s.saves.Add(1) == 1 {
+		return errors.New("disk full")
+	}
+	return s.FileDeadLetterStore.Save(ctx, letter)
+}
+
+// TestMessageListenerSavesDeadLettersBeforePublishing verifies that a dead
+// letter whose save fails is not published, so that the redelivered message
+// is published to the dead-letter topic only once.
+func TestMessageListenerSavesDeadLettersBeforePublishing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := pstest.NewServer()
+	defer server.Close()
+	conn, err := grpc.NewClient(server.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	defer conn.Close()
+	client, err := pubsub.NewClient(ctx, "test-project", option.WithGRPCConn(conn))
+	assert.Nil(t, err)
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, "media_high_res_events_dead_letter")
+	assert.Nil(t, err)
+	defer topic.Stop()
+	files, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.Nil(t, err)
+	store := &unreliableStore{FileDeadLetterStore: files}
+
+	source := cloud.NewChannelSource("test", 10, 20*time.Millisecond)
+	defer source.Close()
+	command := &failingCommand{BaseCommand: *cor.NewBaseCommand("video-resize")}
+	listener := cloud.NewMessageListener(source, command)
+	listener.SetDeadLetterPolicy(&cloud.DeadLetterPolicy{Listener: "HiResTopic", MaxDeliveryAttempts: 2, Topic: topic, Store: store})
+	listener.Listen(ctx)
+
+	_, err = source.Publish(ctx, []byte(`{"name":"trailer.mp4"}`), nil)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		letters, _ := store.List(ctx)
+		return len(letters) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 3, command.count())
+	assert.Len(t, server.Messages(), 1)
+}
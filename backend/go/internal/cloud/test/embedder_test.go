@@ -0,0 +1,139 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestOpenAIEmbedderEmbed verifies the embeddings request and that the
+// vectors are returned in the order of the texts.
+func TestOpenAIEmbedderEmbed(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/embeddings", r.URL.Path)
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		_, _ = w.Write([]byte(`{"data":[{"index":1,"embedding":[0,1,0]},{"index":0,"embedding":[1,0,0]}]}`))
+	}))
+	defer server.Close()
+
+	embedder, err := cloud.NewEmbedder("local", cloud.VertexAiEmbeddingModel{
+		Provider:  cloud.ModelProviderOpenAI,
+		Endpoint:  server.URL + "/v1",
+		Model:     "nomic-embed-text",
+		Dimension: 3,
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "nomic-embed-text", embedder.Name())
+	assert.Equal(t, 3, embedder.Dimension())
+
+	vectors, err := embedder.Embed(context.Background(), []string{"first", "second"})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]float64{{1, 0, 0}, {0, 1, 0}}, vectors)
+	assert.Equal(t, "nomic-embed-text", body["model"])
+	assert.Equal(t, []interface{}{"first", "second"}, body["input"])
+	assert.Equal(t, float64(3), body["dimensions"])
+}
+
+// TestEmbedderDimensionMismatch verifies that a vector whose length differs
+// from the configured or first-seen dimension is an error.
+func TestEmbedderDimensionMismatch(t *testing.T) {
+	length := 3
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vector := make([]float64, length)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": []interface{}{map[string]interface{}{"index": 0, "embedding": vector}},
+		})
+	}))
+	defer server.Close()
+
+	configured, err := cloud.NewEmbedder("local", cloud.VertexAiEmbeddingModel{
+		Provider: cloud.ModelProviderOpenAI, Endpoint: server.URL, Dimension: 768,
+	}, nil)
+	assert.Nil(t, err)
+	_, err = configured.Embed(context.Background(), []string{"text"})
+	assert.ErrorIs(t, err, cloud.ErrDimensionMismatch)
+
+	learned, err := cloud.NewEmbedder("local", cloud.VertexAiEmbeddingModel{
+		Provider: cloud.ModelProviderOpenAI, Endpoint: server.URL,
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, learned.Dimension())
+	_, err = learned.Embed(context.Background(), []string{"text"})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, learned.Dimension())
+	length = 4
+	_, err = learned.Embed(context.Background(), []string{"text"})
+	assert.ErrorIs(t, err, cloud.ErrDimensionMismatch)
+}
+
+// TestHashingEmbedder verifies that the hashing embedder is deterministic and
+// that texts sharing words are closer than unrelated texts.
+func TestHashingEmbedder(t *testing.T) {
+	embedder, err := cloud.NewEmbedder("offline", cloud.VertexAiEmbeddingModel{Provider: cloud.EmbeddingProviderHashing}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "hashing", embedder.Name())
+	assert.Equal(t, 256, embedder.Dimension())
+
+	// More texts than fit in one request are split into batches.
+	texts := make([]string, 300)
+	for i := range texts {
+		texts[i] = "filler"
+	}
+	texts[0] = "a red car in the desert"
+	texts[1] = "the red car at night"
+	texts[2] = "two friends eat dinner"
+	vectors, err := embedder.Embed(context.Background(), texts)
+	assert.Nil(t, err)
+	assert.Equal(t, 300, len(vectors))
+
+	again, err := embedder.Embed(context.Background(), texts[:1])
+	assert.Nil(t, err)
+	assert.Equal(t, vectors[0], again[0])
+
+	dot := func(a, b []float64) (out float64) {
+		for i := range a {
+			out += a[i] * b[i]
+		}
+		return out
+	}
+	assert.InDelta(t, 1.0, dot(vectors[0], vectors[0]), 1e-9)
+	assert.Greater(t, dot(vectors[0], vectors[1]), dot(vectors[0], vectors[2]))
+}
+
+// TestEmbedderRateLimit verifies that `max_requests_per_minute` spaces the
+// requests out.
+func TestEmbedderRateLimit(t *testing.T) {
+	embedder, err := cloud.NewEmbedder("offline", cloud.VertexAiEmbeddingModel{
+		Provider: cloud.EmbeddingProviderHashing, MaxRequestsPerMinute: 600,
+	}, nil)
+	assert.Nil(t, err)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := embedder.Embed(context.Background(), []string{"text"})
+		assert.Nil(t, err)
+	}
+	// 600 requests per minute allow one request every 100ms after the first.
+	assert.GreaterOrEqual(t, time.Since(start), 180*time.Millisecond)
+}
@@ -0,0 +1,184 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+)
+
+// concurrency records how many calls run at once.
+type concurrency struct {
+	mu      sync.Mutex
+	running int
+	peak    int
+	calls   int
+}
+
+// run records a call that lasts for the given duration.
+func (c *concurrency) run(d time.Duration) {
+	c.mu.Lock()
+	c.running++
+	c.peak = max(c.peak, c.running)
+	c.mu.Unlock()
+	time.Sleep(d)
+	c.mu.Lock()
+	c.running--
+	c.calls++
+	c.mu.Unlock()
+}
+
+func (c *concurrency) stats() (peak int, calls int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peak, c.calls
+}
+
+// slowCommand takes a while to process each message.
+type slowCommand struct {
+	cor.BaseCommand
+	concurrency
+}
+
+func (c *slowCommand) Execute(_ cor.Context) {
+	c.run(50 * time.Millisecond)
+}
+
+// notification returns a storage notification for an object of the given size.
+func notification(t *testing.T, name string, size int) []byte {
+	data, err := json.Marshal(&cloud.GCSPubSubNotification{Kind: "storage#object", Name: name, Size: strconv.Itoa(size)})
+	assert.Nil(t, err)
+	return data
+}
+
+// listen starts a listener with the flow control on a channel source and publishes the payloads.
+func listen(t *testing.T, fc cloud.FlowControl, payloads ...[]byte) *slowCommand {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	source := cloud.NewChannelSource("test", 10, time.Minute)
+	t.Cleanup(func() { source.Close() })
+	source.SetFlowControl(fc)
+
+	command := &slowCommand{BaseCommand: *cor.NewBaseCommand("slow")}
+	listener := cloud.NewMessageListener(source, command)
+	listener.SetFlowControl(fc)
+	listener.Listen(ctx)
+	for _, payload := range payloads {
+		_, err := source.Publish(ctx, payload, nil)
+		assert.Nil(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		_, calls := command.stats()
+		return calls == len(payloads)
+	}, 5*time.Second, 10*time.Millisecond)
+	return command
+}
+
+// TestListenerMaxOutstandingMessages verifies that a listener processes at
+// most max_outstanding_messages messages at once.
+func TestListenerMaxOutstandingMessages(t *testing.T) {
+	payloads := [][]byte{[]byte("1"), []byte("2"), []byte("3"), []byte("4"), []byte("5")}
+	command := listen(t, cloud.FlowControl{MaxOutstandingMessages: 2}, payloads...)
+	peak, _ := command.stats()
+	assert.Equal(t, 2, peak)
+}
+
+// TestListenerMaxOutstandingBytes verifies that the bytes of a storage
+// notification are those of its object, and that a message larger than the
+// limit still runs, alone.
+func TestListenerMaxOutstandingBytes(t *testing.T) {
+	assert.Equal(t, int64(600), cloud.MessageBytes(&cloud.Message{Data: notification(t, "a.mp4", 600)}))
+	assert.Equal(t, int64(7), cloud.MessageBytes(&cloud.Message{Data: []byte("payload")}))
+
+	command := listen(t, cloud.FlowControl{MaxOutstandingBytes: 1000},
+		notification(t, "a.mp4", 600), notification(t, "b.mp4", 600), notification(t, "c.mp4", 5000))
+	peak, _ := command.stats()
+	assert.Equal(t, 1, peak)
+
+	command = listen(t, cloud.FlowControl{MaxOutstandingBytes: 1000},
+		notification(t, "a.mp4", 400), notification(t, "b.mp4", 400), notification(t, "c.mp4", 400))
+	peak, _ = command.stats()
+	assert.Equal(t, 2, peak)
+}
+
+// TestChannelSourceNumGoroutines verifies that a local source runs its
+// handlers on num_goroutines workers.
+func TestChannelSourceNumGoroutines(t *testing.T) {
+	command := listen(t, cloud.FlowControl{NumGoroutines: 1}, []byte("1"), []byte("2"), []byte("3"))
+	peak, _ := command.stats()
+	assert.Equal(t, 1, peak)
+}
+
+// mediaModel records the concurrency of its requests.
+type mediaModel struct {
+	concurrency
+}
+
+func (m *mediaModel) Name() string { return "media" }
+
+func (m *mediaModel) Generate(_ context.Context, _ *cloud.GenerationRequest) (*cloud.GenerationResponse, error) {
+	m.run(30 * time.Millisecond)
+	return &cloud.GenerationResponse{Text: "ok"}, nil
+}
+
+// TestLimitedModel verifies that the requests with media of a limited model
+// hold a slot of its limiter, and that text-only requests do not.
+func TestLimitedModel(t *testing.T) {
+	assert.Nil(t, cloud.NewLimiter("ingestion", 0))
+	inner := &mediaModel{}
+	assert.Same(t, inner, cloud.NewLimitedModel(inner, nil))
+
+	limiter := cloud.NewLimiter("ingestion", 2)
+	model := cloud.NewLimitedModel(inner, limiter)
+	generate := func(request *cloud.GenerationRequest) {
+		var wg sync.WaitGroup
+		for range 6 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := model.Generate(context.Background(), request)
+				assert.Nil(t, err)
+			}()
+		}
+		wg.Wait()
+	}
+
+	generate(&cloud.GenerationRequest{Text: "describe", Media: []cloud.MediaPart{{URI: "gs://b/a.mp4"}}})
+	peak, _ := inner.stats()
+	assert.Equal(t, 2, peak)
+	assert.Equal(t, 0, limiter.InUse())
+
+	generate(&cloud.GenerationRequest{Text: "describe"})
+	peak, _ = inner.stats()
+	assert.Equal(t, 6, peak)
+
+	// A canceled wait gives up without taking a slot.
+	assert.Nil(t, limiter.Acquire(context.Background()))
+	assert.Nil(t, limiter.Acquire(context.Background()))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, limiter.Acquire(ctx), context.Canceled)
+	assert.Equal(t, 2, limiter.InUse())
+	limiter.Release()
+	limiter.Release()
+}
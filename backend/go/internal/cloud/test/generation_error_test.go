@@ -0,0 +1,213 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/metric/noop"
+	"google.golang.org/genai"
+)
+
+// kindOf returns the kind of a classified error, or "" if it is not one.
+func kindOf(err error) cloud.GenerationErrorKind {
+	var genErr *cloud.GenerationError
+	if errors.As(err, &genErr) {
+		return genErr.Kind
+	}
+	return ""
+}
+
+// TestClassifyGenerationError verifies the class of the errors of the
+// providers, that only rate-limited and transient failures are retryable, and
+// that only blocked, invalid and too long prompts are permanent.
+func TestClassifyGenerationError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want cloud.GenerationErrorKind
+	}{
+		{genai.APIError{Code: 429, Status: "RESOURCE_EXHAUSTED"}, cloud.GenerationRateLimited},
+		{&cloud.QuotaExceededError{Model: "gemini", RetryAfter: time.Second}, cloud.GenerationRateLimited},
+		{genai.APIError{Code: 503, Status: "UNAVAILABLE"}, cloud.GenerationTransient},
+		{fmt.Errorf("post: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), cloud.GenerationTransient},
+		{genai.APIError{Code: 400, Message: "The input token count (1200000) exceeds the maximum number of tokens allowed (1048576)."}, cloud.GenerationContextTooLong},
+		{genai.APIError{Code: 400, Message: "Unsupported MIME type: video/x-unknown"}, cloud.GenerationInvalidArgument},
+		{genai.APIError{Code: 403, Message: "Permission denied"}, cloud.GenerationUnknown},
+		{errors.New("unexpected"), cloud.GenerationUnknown},
+	}
+	for _, test := range tests {
+		err := cloud.ClassifyGenerationError("gemini", test.err)
+		assert.Equal(t, test.want, kindOf(err), test.err.Error())
+		assert.Equal(t, test.err, errors.Unwrap(err))
+		retryable := test.want == cloud.GenerationRateLimited || test.want == cloud.GenerationTransient
+		assert.Equal(t, retryable, cor.IsRetryable(err), test.err.Error())
+		permanent := test.want == cloud.GenerationSafetyBlocked || test.want == cloud.GenerationInvalidArgument ||
+			test.want == cloud.GenerationContextTooLong
+		assert.Equal(t, permanent, err.(*cloud.GenerationError).Permanent(), test.err.Error())
+	}
+
+	// Cancellations and classified errors are returned as is.
+	assert.Equal(t, context.Canceled, cloud.ClassifyGenerationError("gemini", context.Canceled))
+	blocked := &cloud.GenerationError{Kind: cloud.GenerationSafetyBlocked, Model: "gemini", Err: errors.New("blocked")}
+	assert.Same(t, blocked, cloud.ClassifyGenerationError("gemini", blocked))
+	assert.Equal(t, time.Second, cloud.ClassifyGenerationError("gemini", tests[1].err).(*cloud.GenerationError).RetryAfter)
+}
+
+// flakyModel fails with the given errors, then succeeds.
+type flakyModel struct {
+	errs  []error
+	calls atomic.Int32
+}
+
+func (m *flakyModel) Name() string { return "gemini" }
+
+func (m *flakyModel) Generate(_ context.Context, _ *cloud.GenerationRequest) (*cloud.GenerationResponse, error) {
+	call := int(m.calls.Add(1))
+	if call <= len(m.errs) {
+		return nil, m.errs[call-1]
+	}
+	return &cloud.GenerationResponse{Text: "```json{\"title\": \"Up\"}```"}, nil
+}
+
+// generate calls GenerateMultiModalResponse with no-op counters and a short backoff.
+func generate(t *testing.T, model cloud.GenerativeModel) (string, error) {
+	policy := cloud.GenerationRetryPolicy
+	t.Cleanup(func() { cloud.GenerationRetryPolicy = policy })
+	cloud.GenerationRetryPolicy.InitialBackoff = time.Millisecond
+	cloud.GenerationRetryPolicy.MaxBackoff = 10 * time.Millisecond
+
+	counter, _ := noop.NewMeterProvider().Meter("test").Int64Counter("test")
+	out, _, err := cloud.GenerateMultiModalResponse(context.Background(), counter, counter, counter, 0, model, &cloud.GenerationRequest{Text: "describe"})
+	return out, err
+}
+
+// TestGenerateMultiModalResponseRetries verifies that only retryable failures
+// are retried, up to the attempts of the policy.
+func TestGenerateMultiModalResponseRetries(t *testing.T) {
+	unavailable := genai.APIError{Code: 503, Status: "UNAVAILABLE"}
+	model := &flakyModel{errs: []error{unavailable, genai.APIError{Code: 429}}}
+	out, err := generate(t, model)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"title": "Up"}`, out)
+	assert.Equal(t, int32(3), model.calls.Load())
+
+	model = &flakyModel{errs: []error{genai.APIError{Code: 400, Message: "Invalid argument"}}}
+	_, err = generate(t, model)
+	assert.Equal(t, cloud.GenerationInvalidArgument, kindOf(err))
+	assert.Equal(t, int32(1), model.calls.Load())
+
+	model = &flakyModel{errs: []error{unavailable, unavailable, unavailable, unavailable, unavailable}}
+	_, err = generate(t, model)
+	assert.Equal(t, cloud.GenerationTransient, kindOf(err))
+	assert.Equal(t, int32(cloud.GenerationRetryPolicy.MaxAttempts), model.calls.Load())
+}
+
+// TestVertexModelSafetyBlocked verifies that a prompt blocked by the safety
+// filters of Vertex AI is reported as a safety-blocked failure.
+func TestVertexModelSafetyBlocked(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"promptFeedback": {"blockReason": "PROHIBITED_CONTENT"}}`))
+	}))
+	defer server.Close()
+
+	model, err := cloud.NewGenerativeModel("creative-flash", cloud.VertexAiLLMModel{Model: "gemini-2.5-pro"},
+		newCassetteClient(t, http.DefaultTransport, server.URL), nil)
+	assert.Nil(t, err)
+	_, err = model.Generate(context.Background(), &cloud.GenerationRequest{Text: "describe"})
+	assert.Equal(t, cloud.GenerationSafetyBlocked, kindOf(err))
+	assert.False(t, cor.IsRetryable(err))
+}
+
+// TestMessageListenerDeadLettersPermanentFailures verifies that a message
+// failing for a reason that would not change on redelivery is dead-lettered
+// on its first attempt.
+func TestMessageListenerDeadLettersPermanentFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := cloud.NewChannelSource("test", 10, 20*time.Millisecond)
+	defer source.Close()
+	store, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.Nil(t, err)
+
+	command := &blockedCommand{BaseCommand: *cor.NewBaseCommand("generate-media-summary"), kind: cloud.GenerationSafetyBlocked}
+	listener := cloud.NewMessageListener(source, command)
+	listener.SetDeadLetterPolicy(&cloud.DeadLetterPolicy{Listener: "LowResTopic", MaxDeliveryAttempts: 5, Store: store})
+	listener.Listen(ctx)
+
+	_, err = source.Publish(ctx, []byte(`{"name":"trailer.mp4"}`), nil)
+	assert.Nil(t, err)
+	var letters []*cloud.DeadLetter
+	assert.Eventually(t, func() bool {
+		letters, _ = store.List(ctx)
+		return len(letters) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, letters[0].DeliveryAttempt)
+	assert.Contains(t, letters[0].Errors["generate-media-summary"], "safety-blocked")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), command.calls.Load())
+}
+
+// TestMessageListenerRedeliversUnknownFailures verifies that a message
+// failing for an unknown reason uses up its delivery attempts before it is
+// dead-lettered.
+func TestMessageListenerRedeliversUnknownFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := cloud.NewChannelSource("test", 10, 20*time.Millisecond)
+	defer source.Close()
+	store, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.Nil(t, err)
+
+	command := &blockedCommand{BaseCommand: *cor.NewBaseCommand("generate-media-summary"), kind: cloud.GenerationUnknown}
+	listener := cloud.NewMessageListener(source, command)
+	listener.SetDeadLetterPolicy(&cloud.DeadLetterPolicy{Listener: "LowResTopic", MaxDeliveryAttempts: 3, Store: store})
+	listener.Listen(ctx)
+
+	_, err = source.Publish(ctx, []byte(`{"name":"trailer.mp4"}`), nil)
+	assert.Nil(t, err)
+	var letters []*cloud.DeadLetter
+	assert.Eventually(t, func() bool {
+		letters, _ = store.List(ctx)
+		return len(letters) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, letters[0].DeliveryAttempt)
+	assert.Equal(t, int32(3), command.calls.Load())
+}
+
+// blockedCommand fails with a generation error of its kind (e.g., a prompt
+// blocked by safety filters).
+type blockedCommand struct {
+	cor.BaseCommand
+	kind  cloud.GenerationErrorKind
+	calls atomic.Int32
+}
+
+func (c *blockedCommand) Execute(context cor.Context) {
+	c.calls.Add(1)
+	context.AddError(c.GetName(), fmt.Errorf("gemini request failed: %w",
+		&cloud.GenerationError{Kind: c.kind, Model: "gemini", Err: errors.New("request refused")}))
+}
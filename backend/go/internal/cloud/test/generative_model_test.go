@@ -0,0 +1,162 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestOpenAIModelGenerate verifies the chat completions request built from a
+// multi-modal prompt and the parsing of the response.
+func TestOpenAIModelGenerate(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"content":"{\"title\":\"Up\"}"}}],"usage":{"prompt_tokens":12,"completion_tokens":5}}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("TEST_OPENAI_KEY", "secret")
+	model, err := cloud.NewGenerativeModel("local", cloud.VertexAiLLMModel{
+		Provider:           cloud.ModelProviderOpenAI,
+		Endpoint:           server.URL + "/v1/",
+		APIKeyEnv:          "TEST_OPENAI_KEY",
+		Model:              "qwen2.5-vl",
+		SystemInstructions: "You describe trailers.",
+		OutputFormat:       "application/json",
+	}, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "qwen2.5-vl", model.Name())
+
+	resp, err := model.Generate(context.Background(), &cloud.GenerationRequest{
+		Text:  "Summarize the trailer.",
+		Media: []cloud.MediaPart{{URI: "http://localhost/trailer.mp4", MIMEType: "video/mp4"}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"title":"Up"}`, resp.Text)
+	assert.Equal(t, cloud.Usage{InputTokens: 12, OutputTokens: 5}, resp.Usage)
+
+	assert.Equal(t, "qwen2.5-vl", body["model"])
+	assert.Equal(t, map[string]interface{}{"type": "json_object"}, body["response_format"])
+	messages := body["messages"].([]interface{})
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, map[string]interface{}{"role": "system", "content": "You describe trailers."}, messages[0])
+	parts := messages[1].(map[string]interface{})["content"].([]interface{})
+	assert.Equal(t, map[string]interface{}{"type": "text", "text": "Summarize the trailer."}, parts[0])
+	assert.Equal(t, map[string]interface{}{"type": "video_url", "video_url": map[string]interface{}{"url": "http://localhost/trailer.mp4"}}, parts[1])
+
+	_, err = model.Generate(context.Background(), &cloud.GenerationRequest{
+		Text:  "Read this.",
+		Media: []cloud.MediaPart{{URI: "http://localhost/script.pdf", MIMEType: "application/pdf"}},
+	})
+	assert.NotNil(t, err)
+}
+
+// TestOpenAIModelSignsGCSMedia verifies that a `gs://` media URI, which the
+// server cannot read, is sent as a signed URL of the blob store.
+func TestOpenAIModelSignsGCSMedia(t *testing.T) {
+	var body struct {
+		Messages []struct {
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"content":"{}"}}]}`))
+	}))
+	defer server.Close()
+	store, err := cloud.NewLocalBlobStore(t.TempDir(), "http://localhost:8080", []byte("key"))
+	assert.Nil(t, err)
+	w, err := store.Create(context.Background(), "low-res", "trailer.mp4", "video/mp4")
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	request := &cloud.GenerationRequest{
+		Text:  "Summarize the trailer.",
+		Media: []cloud.MediaPart{{URI: "gs://low-res/trailer.mp4", MIMEType: "video/mp4"}},
+	}
+	model := cloud.NewOpenAIModel(server.URL, "", cloud.VertexAiLLMModel{Model: "qwen2.5-vl"}, store)
+	_, err = model.Generate(context.Background(), request)
+	assert.Nil(t, err)
+	var parts []struct {
+		VideoURL struct {
+			URL string `json:"url"`
+		} `json:"video_url"`
+	}
+	if assert.Len(t, body.Messages, 1) {
+		assert.Nil(t, json.Unmarshal(body.Messages[0].Content, &parts))
+	}
+	if assert.Len(t, parts, 2) {
+		videoURL := parts[1].VideoURL.URL
+		assert.True(t, strings.HasPrefix(videoURL, "http://localhost:8080"+cloud.LocalBlobPath+"/low-res/trailer.mp4?"), videoURL)
+		assert.Contains(t, videoURL, "signature=")
+	}
+
+	// Without a blob store, the model refuses the URI rather than sending it.
+	_, err = cloud.NewOpenAIModel(server.URL, "", cloud.VertexAiLLMModel{Model: "qwen2.5-vl"}, nil).Generate(context.Background(), request)
+	assert.NotNil(t, err)
+}
+
+// TestFakeModelGenerate verifies that the fake model answers with the first
+// matching fixture, expands the groups of the match and estimates missing usage.
+func TestFakeModelGenerate(t *testing.T) {
+	dir := t.TempDir()
+	fixtures := map[string]string{
+		"10-scene.json":   `{"match": "Sequence: (\\d+)", "response": {"sequence": "$1"}, "usage": {"input_tokens": 100, "output_tokens": 20}}`,
+		"20-summary.json": `{"match": "Summarize", "response": "{\"title\": \"Up\"}"}`,
+		"99-default.json": `{"match": "", "response": "{}"}`,
+	}
+	for name, content := range fixtures {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+	model, err := cloud.NewGenerativeModel("offline", cloud.VertexAiLLMModel{
+		Provider:   cloud.ModelProviderFake,
+		Model:      "fake-pro",
+		FixtureDir: dir,
+	}, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "fake-pro", model.Name())
+
+	resp, err := model.Generate(context.Background(), &cloud.GenerationRequest{Text: "Summarize. Sequence: 7"})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"sequence": "7"}`, resp.Text)
+	assert.Equal(t, cloud.Usage{InputTokens: 100, OutputTokens: 20}, resp.Usage)
+
+	resp, err = model.Generate(context.Background(), &cloud.GenerationRequest{Text: "Summarize the trailer."})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"title": "Up"}`, resp.Text)
+	assert.Equal(t, cloud.Usage{InputTokens: 6, OutputTokens: 4}, resp.Usage)
+
+	resp, err = model.Generate(context.Background(), &cloud.GenerationRequest{Text: "Anything else"})
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", resp.Text)
+
+	_, err = cloud.NewGenerativeModel("offline", cloud.VertexAiLLMModel{Provider: cloud.ModelProviderFake}, nil, nil)
+	assert.NotNil(t, err)
+	_, err = cloud.NewGenerativeModel("offline", cloud.VertexAiLLMModel{Provider: "bedrock"}, nil, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,184 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+)
+
+// answeringSource records the answers given to the messages of a channel source.
+type answeringSource struct {
+	*cloud.ChannelSource
+	mu      sync.Mutex
+	answers map[string]string
+}
+
+func (s *answeringSource) Ack(msg *cloud.Message) {
+	s.answer(msg, "ack")
+	s.ChannelSource.Ack(msg)
+}
+
+func (s *answeringSource) Nack(msg *cloud.Message) {
+	s.answer(msg, "nack")
+	s.ChannelSource.Nack(msg)
+}
+
+func (s *answeringSource) answer(msg *cloud.Message, answer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.answers[string(msg.Data)] = answer
+}
+
+func (s *answeringSource) answerTo(data string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.answers[data]
+}
+
+// blockingCommand writes a temporary file, then runs until it is released or
+// its context is canceled.
+type blockingCommand struct {
+	cor.BaseCommand
+	dir     string
+	started chan string
+	release chan struct{}
+}
+
+func (c *blockingCommand) Execute(context cor.Context) {
+	file := filepath.Join(c.dir, context.Get(cor.CtxIn).(string))
+	if err := os.WriteFile(file, []byte("frame"), 0o600); err != nil {
+		context.AddError(c.GetName(), err)
+		return
+	}
+	context.AddTempFile(file)
+	c.started <- file
+	select {
+	case <-c.release:
+	case <-context.GetContext().Done():
+		context.AddError(c.GetName(), context.GetContext().Err())
+	}
+}
+
+// startBlocking starts a listener whose command blocks, and publishes a message to it.
+func startBlocking(t *testing.T) (*cloud.MessageListener, *answeringSource, *blockingCommand, string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	source := &answeringSource{ChannelSource: cloud.NewChannelSource("test", 10, time.Minute), answers: map[string]string{}}
+	t.Cleanup(func() { source.Close() })
+	command := &blockingCommand{
+		BaseCommand: *cor.NewBaseCommand("blocking"),
+		dir:         t.TempDir(),
+		started:     make(chan string, 1),
+		release:     make(chan struct{}),
+	}
+	listener := cloud.NewMessageListener(source, command)
+	assert.Nil(t, listener.Shutdown(ctx))
+
+	listener.Listen(ctx)
+	_, err := source.Publish(ctx, []byte("clip.mp4"), nil)
+	assert.Nil(t, err)
+	return listener, source, command, <-command.started
+}
+
+// TestMessageListenerShutdownDrains verifies that Shutdown waits for a
+// running command to finish, and that its message is then acknowledged.
+func TestMessageListenerShutdownDrains(t *testing.T) {
+	listener, source, command, file := startBlocking(t)
+
+	stopped := make(chan error)
+	go func() { stopped <- listener.Shutdown(context.Background()) }()
+	select {
+	case <-stopped:
+		t.Fatal("Shutdown returned while a command was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(command.release)
+
+	assert.Nil(t, <-stopped)
+	assert.Equal(t, "ack", source.answerTo("clip.mp4"))
+	assert.NoFileExists(t, file)
+}
+
+// TestMessageListenerShutdownCancels verifies that a command still running
+// when the shutdown times out is canceled, its message Nack'd without being
+// dead-lettered, and its temporary files removed.
+func TestMessageListenerShutdownCancels(t *testing.T) {
+	listener, source, _, file := startBlocking(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := listener.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, "nack", source.answerTo("clip.mp4"))
+	assert.NoFileExists(t, file)
+}
+
+// TestLifecycleShutdown verifies that the drain hooks run at once and share
+// the shutdown timeout, that the close hooks run after them in order, and
+// that the errors of all hooks are returned.
+func TestLifecycleShutdown(t *testing.T) {
+	lifecycle := cloud.NewLifecycle(100 * time.Millisecond)
+	var mu sync.Mutex
+	var order []string
+	record := func(step string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, step)
+	}
+
+	// Each drain waits for the other to start, so they only finish if they run at once.
+	var started sync.WaitGroup
+	started.Add(2)
+	for _, name := range []string{"listener", "server"} {
+		lifecycle.OnDrain(name, func(ctx context.Context) error {
+			started.Done()
+			started.Wait()
+			record("drain " + name)
+			return nil
+		})
+	}
+	lifecycle.OnDrain("timer", func(ctx context.Context) error {
+		<-ctx.Done()
+		record("drain timer")
+		return ctx.Err()
+	})
+	lifecycle.OnClose("clients", func(ctx context.Context) error {
+		assert.Nil(t, ctx.Err())
+		record("close clients")
+		return nil
+	})
+	lifecycle.OnClose("telemetry", func(context.Context) error {
+		record("close telemetry")
+		return errors.New("exporter unavailable")
+	})
+
+	err := lifecycle.Shutdown(context.Background())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "timer")
+	assert.ErrorContains(t, err, "telemetry: exporter unavailable")
+	assert.Len(t, order, 5)
+	assert.ElementsMatch(t, []string{"drain listener", "drain server", "drain timer"}, order[:3])
+	assert.Equal(t, []string{"close clients", "close telemetry"}, order[3:])
+}
@@ -0,0 +1,156 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeBlob writes the content to a new object of the store.
+func writeBlob(t *testing.T, store cloud.BlobStore, bucket string, name string, content string) *cloud.BlobInfo {
+	w, err := store.Create(context.Background(), bucket, name, "video/mp4")
+	assert.Nil(t, err)
+	_, err = io.WriteString(w, content)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return w.Info()
+}
+
+// TestLocalBlobStoreRoundTrip verifies that objects can be written, read,
+// listed and deleted, and that missing objects match ErrBlobNotExist.
+func TestLocalBlobStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store, err := cloud.NewLocalBlobStore(t.TempDir(), "http://localhost:8080", []byte("key"))
+	assert.Nil(t, err)
+
+	info := writeBlob(t, store, "hi-res", "trailers/movie.mp4", "frames")
+	assert.Equal(t, int64(6), info.Size)
+	assert.Equal(t, "video/mp4", info.ContentType)
+
+	r, err := store.Open(ctx, "hi-res", "trailers/movie.mp4")
+	assert.Nil(t, err)
+	content, _ := io.ReadAll(r)
+	_ = r.Close()
+	assert.Equal(t, "frames", string(content))
+
+	writeBlob(t, store, "hi-res", "other.mp4", "x")
+	listed, err := store.List(ctx, "hi-res", "trailers/")
+	assert.Nil(t, err)
+	assert.Len(t, listed, 1)
+	assert.Equal(t, "trailers/movie.mp4", listed[0].Name)
+
+	assert.True(t, errors.Is(store.Delete(ctx, "hi-res", "trailers/movie.mp4", info.Generation+1), cloud.ErrBlobNotExist))
+	assert.Nil(t, store.Delete(ctx, "hi-res", "trailers/movie.mp4", info.Generation))
+	_, err = store.Stat(ctx, "hi-res", "trailers/movie.mp4")
+	assert.True(t, errors.Is(err, cloud.ErrBlobNotExist))
+}
+
+// TestLocalBlobStoreAbortedWrite verifies that canceling the context of a
+// write discards the object.
+func TestLocalBlobStoreAbortedWrite(t *testing.T) {
+	store, err := cloud.NewLocalBlobStore(t.TempDir(), "http://localhost:8080", []byte("key"))
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := store.Create(ctx, "bucket", "partial.mp4", "")
+	assert.Nil(t, err)
+	_, _ = io.WriteString(w, "half")
+	cancel()
+	assert.NotNil(t, w.Close())
+
+	listed, err := store.List(context.Background(), "bucket", "")
+	assert.Nil(t, err)
+	assert.Empty(t, listed)
+}
+
+// TestLocalBlobStoreContentType verifies that the content type given to
+// Create is kept, that the common video extensions are known without it, and
+// that the files keeping it are neither listed nor left behind.
+func TestLocalBlobStoreContentType(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	store, err := cloud.NewLocalBlobStore(root, "http://localhost:8080", []byte("key"))
+	assert.Nil(t, err)
+
+	info := writeBlob(t, store, "hi-res", "trailers/clip", "frames")
+	assert.Equal(t, "video/mp4", info.ContentType)
+	w, err := store.Create(ctx, "hi-res", "trailers/movie.MOV", "")
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	assert.Equal(t, "video/quicktime", w.Info().ContentType)
+
+	listed, err := store.List(ctx, "hi-res", "")
+	assert.Nil(t, err)
+	types := make(map[string]string)
+	for _, listedInfo := range listed {
+		types[listedInfo.Name] = listedInfo.ContentType
+	}
+	assert.Equal(t, map[string]string{"trailers/clip": "video/mp4", "trailers/movie.MOV": "video/quicktime"}, types)
+
+	assert.Nil(t, store.Delete(ctx, "hi-res", "trailers/clip", 0))
+	entries, err := os.ReadDir(filepath.Join(root, "hi-res", "trailers"))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
+
+// TestLocalBlobStoreRejectsEscapingNames verifies that object and bucket
+// names cannot point outside the store's root.
+func TestLocalBlobStoreRejectsEscapingNames(t *testing.T) {
+	store, err := cloud.NewLocalBlobStore(t.TempDir(), "http://localhost:8080", []byte("key"))
+	assert.Nil(t, err)
+
+	_, err = store.FilePath("bucket", "../../etc/passwd")
+	assert.NotNil(t, err)
+	_, err = store.FilePath("..", "passwd")
+	assert.NotNil(t, err)
+	_, err = store.FilePath("bucket", "/etc/passwd")
+	assert.NotNil(t, err)
+}
+
+// TestLocalBlobStoreSignedURL verifies that signed URLs point at the server's
+// blob route and are only accepted with their own signature before expiry.
+func TestLocalBlobStoreSignedURL(t *testing.T) {
+	store, err := cloud.NewLocalBlobStore(t.TempDir(), "http://localhost:8080/", []byte("key"))
+	assert.Nil(t, err)
+
+	signed, err := store.SignURL(context.Background(), "low-res", "dir/movie one.mp4", time.Minute)
+	assert.Nil(t, err)
+	u, err := url.Parse(signed)
+	assert.Nil(t, err)
+	assert.Equal(t, cloud.LocalBlobPath+"/low-res/dir/movie one.mp4", u.Path)
+	assert.True(t, strings.HasPrefix(signed, "http://localhost:8080"+cloud.LocalBlobPath))
+
+	expires, signature := u.Query().Get("expires"), u.Query().Get("signature")
+	assert.Nil(t, store.Verify("low-res", "dir/movie one.mp4", expires, signature))
+	assert.ErrorIs(t, store.Verify("low-res", "dir/other.mp4", expires, signature), cloud.ErrInvalidSignature)
+
+	other, _ := cloud.NewLocalBlobStore(t.TempDir(), "http://localhost:8080", []byte("other-key"))
+	assert.ErrorIs(t, other.Verify("low-res", "dir/movie one.mp4", expires, signature), cloud.ErrInvalidSignature)
+
+	expired, _ := store.SignURL(context.Background(), "low-res", "dir/movie one.mp4", -time.Minute)
+	u, _ = url.Parse(expired)
+	assert.ErrorIs(t, store.Verify("low-res", "dir/movie one.mp4", u.Query().Get("expires"), u.Query().Get("signature")), cloud.ErrInvalidSignature)
+}
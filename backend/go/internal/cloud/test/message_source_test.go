@@ -0,0 +1,270 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+)
+
+// receive runs the source's Receive in the background and returns a channel
+// of the delivered messages and a function that stops it.
+func receive(t *testing.T, source cloud.MessageSource, handler func(*cloud.Message)) (<-chan *cloud.Message, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	delivered := make(chan *cloud.Message, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.Nil(t, source.Receive(ctx, func(_ context.Context, msg *cloud.Message) {
+			delivered <- msg
+			handler(msg)
+		}))
+	}()
+	return delivered, func() { cancel(); <-done }
+}
+
+// next waits for the next delivered message.
+func next(t *testing.T, delivered <-chan *cloud.Message) *cloud.Message {
+	select {
+	case msg := <-delivered:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message delivered")
+		return nil
+	}
+}
+
+// TestChannelSourceRedelivers verifies that a Nack'd message and a message
+// left unsettled past its deadline are delivered again, and that an Ack'd
+// message is not.
+func TestChannelSourceRedelivers(t *testing.T) {
+	source := cloud.NewChannelSource("test", 10, 50*time.Millisecond)
+	defer source.Close()
+
+	delivered, stop := receive(t, source, func(msg *cloud.Message) {
+		switch msg.DeliveryAttempt {
+		case 1:
+			source.Nack(msg)
+		case 2:
+			// Left unsettled; expires after the deadline.
+		default:
+			source.Ack(msg)
+		}
+	})
+	defer stop()
+
+	id, err := source.Publish(context.Background(), []byte("payload"), map[string]string{"k": "v"})
+	assert.Nil(t, err)
+	for attempt := 1; attempt <= 3; attempt++ {
+		msg := next(t, delivered)
+		assert.Equal(t, id, msg.ID)
+		assert.Equal(t, attempt, msg.DeliveryAttempt)
+		assert.Equal(t, "payload", string(msg.Data))
+		assert.Equal(t, "v", msg.Attributes["k"])
+	}
+	select {
+	case msg := <-delivered:
+		t.Fatalf("acknowledged message delivered again: attempt %d", msg.DeliveryAttempt)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestChannelSourceExtendDeadline verifies that the lease of a settled
+// message cannot be extended.
+func TestChannelSourceExtendDeadline(t *testing.T) {
+	source := cloud.NewChannelSource("test", 10, time.Minute)
+	defer source.Close()
+	delivered, stop := receive(t, source, func(*cloud.Message) {})
+	defer stop()
+
+	_, err := source.Publish(context.Background(), []byte("payload"), nil)
+	assert.Nil(t, err)
+	msg := next(t, delivered)
+	assert.Nil(t, source.ExtendDeadline(msg, time.Minute))
+	source.Ack(msg)
+	assert.ErrorIs(t, source.ExtendDeadline(msg, time.Minute), cloud.ErrMessageNotLeased)
+}
+
+// TestDirectorySourceNotifiesNewFiles verifies that a file dropped into the
+// directory produces a GCS notification, that hidden files are ignored, and
+// that a Nack'd file is delivered again.
+func TestDirectorySourceNotifiesNewFiles(t *testing.T) {
+	dir := t.TempDir()
+	source, err := cloud.NewDirectorySource(dir, "hi-res", 20*time.Millisecond, time.Minute)
+	assert.Nil(t, err)
+
+	var mu sync.Mutex
+	nacked := false
+	delivered, stop := receive(t, source, func(msg *cloud.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !nacked {
+			nacked = true
+			source.Nack(msg)
+			return
+		}
+		source.Ack(msg)
+	})
+	defer stop()
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "trailers"), 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "trailers", ".partial"), []byte("x"), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "trailers", "new.mp4"), []byte("frames"), 0o644))
+
+	msg := next(t, delivered)
+	var notification cloud.GCSPubSubNotification
+	assert.Nil(t, json.Unmarshal(msg.Data, &notification))
+	assert.Equal(t, "storage#object", notification.Kind)
+	assert.Equal(t, "hi-res", notification.Bucket)
+	assert.Equal(t, "trailers/new.mp4", notification.Name)
+	assert.Equal(t, "video/mp4", notification.ContentType)
+	assert.Equal(t, "6", notification.Size)
+	assert.Equal(t, "OBJECT_FINALIZE", msg.Attributes["eventType"])
+	assert.Equal(t, 1, msg.DeliveryAttempt)
+
+	again := next(t, delivered)
+	assert.Equal(t, msg.ID, again.ID)
+	assert.Equal(t, 2, again.DeliveryAttempt)
+
+	select {
+	case msg := <-delivered:
+		t.Fatalf("unexpected delivery of %s", msg.ID)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestDirectorySourceRemembersAcknowledgements verifies that a restarted
+// source delivers the files present at start-up that were not acknowledged,
+// and those changed since, but not those acknowledged before.
+func TestDirectorySourceRemembersAcknowledgements(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"acked.mp4", "changed.mp4", "pending.mp4"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644))
+	}
+	source, err := cloud.NewDirectorySource(dir, "hi-res", 20*time.Millisecond, time.Minute)
+	assert.Nil(t, err)
+	delivered, stop := receive(t, source, func(msg *cloud.Message) {
+		if msg.Attributes["objectId"] != "pending.mp4" {
+			source.Ack(msg)
+		}
+	})
+	received := make(map[string]bool)
+	for range 3 {
+		received[next(t, delivered).Attributes["objectId"]] = true
+	}
+	stop()
+	assert.Equal(t, map[string]bool{"acked.mp4": true, "changed.mp4": true, "pending.mp4": true}, received)
+
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "changed.mp4"), later, later))
+	restarted, err := cloud.NewDirectorySource(dir, "hi-res", 20*time.Millisecond, time.Minute)
+	assert.Nil(t, err)
+	delivered, stop = receive(t, restarted, restarted.Ack)
+	defer stop()
+	received = make(map[string]bool)
+	for range 2 {
+		received[next(t, delivered).Attributes["objectId"]] = true
+	}
+	assert.Equal(t, map[string]bool{"changed.mp4": true, "pending.mp4": true}, received)
+	select {
+	case msg := <-delivered:
+		t.Fatalf("unexpected delivery of %s", msg.ID)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// countingCommand counts its executions.
+type countingCommand struct {
+	cor.BaseCommand
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *countingCommand) Execute(_ cor.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+}
+
+func (c *countingCommand) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+// TestMessageListenerAcknowledges verifies that the listener acknowledges
+// messages whose command succeeds, whatever the source.
+func TestMessageListenerAcknowledges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := cloud.NewChannelSource("test", 10, 50*time.Millisecond)
+	defer source.Close()
+
+	command := &countingCommand{BaseCommand: *cor.NewBaseCommand("count")}
+	cloud.NewMessageListener(source, command).Listen(ctx)
+
+	_, err := source.Publish(ctx, []byte(`{"kind":"storage#object"}`), nil)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return command.count() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// An unacknowledged message would be delivered again after 50ms.
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, command.count())
+}
+
+// planningCommand plans its messages, as a chain in dry-run mode does.
+type planningCommand struct {
+	countingCommand
+}
+
+func (c *planningCommand) Execute(context cor.Context) {
+	c.countingCommand.Execute(context)
+	context.Add(cor.CtxPlan, &cor.ExecutionPlan{})
+}
+
+// TestMessageListenerStopsAfterDryRun verifies that a listener in dry-run
+// mode stops receiving once it has planned a message, and leaves the message
+// to be processed later.
+func TestMessageListenerStopsAfterDryRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := cloud.NewChannelSource("test", 10, 20*time.Millisecond)
+	defer source.Close()
+
+	planner := &planningCommand{countingCommand{BaseCommand: *cor.NewBaseCommand("plan")}}
+	dryRun := cloud.NewMessageListener(source, planner)
+	dryRun.Listen(ctx)
+	_, err := source.Publish(ctx, []byte(`{"kind":"storage#object"}`), nil)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return planner.count() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// The message is not planned again, although it was not acknowledged.
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, planner.count())
+	assert.Nil(t, dryRun.Shutdown(ctx))
+
+	command := &countingCommand{BaseCommand: *cor.NewBaseCommand("count")}
+	cloud.NewMessageListener(source, command).Listen(ctx)
+	assert.Eventually(t, func() bool { return command.count() == 1 }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,45 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// TestPricedModel verifies that the cost of a response is estimated from the
+// price of its model's tokens, and returned with its usage.
+func TestPricedModel(t *testing.T) {
+	pricing := map[string]cloud.ModelPricing{"gemini": {InputPerMillionTokens: 1.25, OutputPerMillionTokens: 10}}
+	throttled := &throttledModel{}
+	throttled.calls.Store(1) // Past its rejected request.
+	model := cloud.NewPricedModel(throttled, pricing)
+
+	counter, _ := noop.NewMeterProvider().Meter("test").Int64Counter("test")
+	out, usage, err := cloud.GenerateMultiModalResponse(context.Background(), counter, counter, counter, 0, model, &cloud.GenerationRequest{Text: "describe"})
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", out)
+	assert.Equal(t, 1200, usage.InputTokens)
+	assert.Equal(t, 30, usage.OutputTokens)
+	assert.InDelta(t, 0.0018, usage.Cost, 1e-9)
+
+	// Models without a price are not wrapped.
+	unpriced := &flakyModel{}
+	assert.Same(t, unpriced, cloud.NewPricedModel(unpriced, map[string]cloud.ModelPricing{"other": {InputPerMillionTokens: 1}}))
+}
@@ -42,18 +42,23 @@ func (c *MediaMessageCommand) Execute(context cor.Context) {
 }
 
 func TestMessageHandler(t *testing.T) {
+	test.SkipWithoutCredentials(t)
 	ctx, cancel := context.WithCancel(context.Background())
 	config := test.GetConfig()
 
 	cloudClients, err := cloud.NewCloudServiceClients(ctx, config)
 	test.HandleErr(err, t)
+	if err != nil {
+		cancel()
+		return
+	}
 	defer cloudClients.Close()
 
 	// Create the external controller group.
 	var wg sync.WaitGroup
 	wg.Add(1)
 
-	pubsubListener := cloudClients.PubSubListeners["HiResTopic"]
+	pubsubListener := cloudClients.Listeners["HiResTopic"]
 	pubsubListener.SetCommand(&MediaMessageCommand{})
 
 	assert.NotNil(t, pubsubListener)
@@ -0,0 +1,163 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genai"
+)
+
+// blocked verifies that a request of the given input tokens has to wait for the quota.
+func blocked(t *testing.T, quotas *cloud.QuotaManager, model string, inputTokens int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := quotas.Wait(ctx, model, inputTokens)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// TestQuotaManagerRequestsPerMinute verifies that requests over the
+// requests per minute wait, and that the wait honors cancellation.
+func TestQuotaManagerRequestsPerMinute(t *testing.T) {
+	quotas := cloud.NewQuotaManager(map[string]cloud.ModelQuota{"gemini": {RequestsPerMinute: 2}})
+	ctx := context.Background()
+	for range 2 {
+		_, err := quotas.Wait(ctx, "gemini", 10)
+		assert.Nil(t, err)
+	}
+
+	waitCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		_, err := quotas.Wait(waitCtx, "gemini", 10)
+		done <- err
+	}()
+	assert.Eventually(t, func() bool { return quotas.Snapshot()[0].Waiting == 1 }, time.Second, 5*time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	// Other models have their own quotas; models without one are unlimited.
+	_, err := quotas.Wait(ctx, "other", 10)
+	assert.Nil(t, err)
+	snapshot := quotas.Snapshot()
+	assert.Equal(t, 2, len(snapshot))
+	assert.Equal(t, "gemini", snapshot[0].Model)
+	assert.Equal(t, 2, snapshot[0].Requests)
+	assert.Equal(t, 20, snapshot[0].InputTokens)
+	assert.Equal(t, 0, snapshot[0].Waiting)
+}
+
+// TestQuotaManagerTokensPerMinute verifies that the estimated input tokens
+// are replaced with the reported usage, and that both token quotas are
+// enforced.
+func TestQuotaManagerTokensPerMinute(t *testing.T) {
+	quotas := cloud.NewQuotaManager(map[string]cloud.ModelQuota{
+		"input":  {InputTokensPerMinute: 1000},
+		"output": {OutputTokensPerMinute: 100},
+	})
+	ctx := context.Background()
+
+	reservation, err := quotas.Wait(ctx, "input", 600)
+	assert.Nil(t, err)
+	_, err = quotas.Wait(ctx, "input", 300)
+	assert.Nil(t, err)
+	reservation.Done(cloud.Usage{InputTokens: 100})
+	_, err = quotas.Wait(ctx, "input", 500)
+	assert.Nil(t, err)
+	blocked(t, quotas, "input", 200)
+
+	reservation, err = quotas.Wait(ctx, "output", 10)
+	assert.Nil(t, err)
+	reservation.Done(cloud.Usage{InputTokens: 12, OutputTokens: 150})
+	blocked(t, quotas, "output", 10)
+	assert.Equal(t, 150, quotas.Snapshot()[1].OutputTokens)
+
+	// A request larger than the quota is sent once the window is empty.
+	quotas = cloud.NewQuotaManager(map[string]cloud.ModelQuota{"input": {InputTokensPerMinute: 1000}})
+	_, err = quotas.Wait(ctx, "input", 5000)
+	assert.Nil(t, err)
+}
+
+// throttledModel rejects its first request for exceeding a quota.
+type throttledModel struct {
+	calls atomic.Int32
+}
+
+func (m *throttledModel) Name() string { return "gemini" }
+
+func (m *throttledModel) Generate(_ context.Context, _ *cloud.GenerationRequest) (*cloud.GenerationResponse, error) {
+	if m.calls.Add(1) == 1 {
+		return nil, genai.APIError{Code: 429, Status: "RESOURCE_EXHAUSTED", Details: []map[string]any{
+			{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "0.2s"},
+		}}
+	}
+	return &cloud.GenerationResponse{Text: "ok", Usage: cloud.Usage{InputTokens: 1200, OutputTokens: 30}}, nil
+}
+
+// TestQuotaModelThrottle verifies that a 429 of Vertex AI pauses the model
+// for the delay of its RetryInfo, and that the usage is accounted for.
+func TestQuotaModelThrottle(t *testing.T) {
+	quotas := cloud.NewQuotaManager(nil)
+	model := cloud.NewQuotaModel(&throttledModel{}, quotas)
+	request := &cloud.GenerationRequest{Text: "describe", Media: []cloud.MediaPart{{URI: "gs://b/a.mp4"}}}
+
+	_, err := model.Generate(context.Background(), request)
+	var quotaErr *cloud.QuotaExceededError
+	assert.True(t, errors.As(err, &quotaErr))
+	assert.Equal(t, 200*time.Millisecond, quotaErr.RetryAfter)
+	snapshot := quotas.Snapshot()[0]
+	assert.Equal(t, 1, snapshot.Throttles)
+	assert.NotNil(t, snapshot.PausedUntil)
+
+	start := time.Now()
+	resp, err := model.Generate(context.Background(), request)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", resp.Text)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	snapshot = quotas.Snapshot()[0]
+	assert.Equal(t, 2, snapshot.Requests)
+	assert.Equal(t, 1200, snapshot.InputTokens)
+	assert.Equal(t, 30, snapshot.OutputTokens)
+}
+
+// TestOpenAIModelQuotaExceeded verifies that a 429 of an OpenAI-compatible
+// API reports the delay and the remaining quota of its headers.
+func TestOpenAIModelQuotaExceeded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ratelimit-remaining-requests", "12")
+		w.Header().Set("x-ratelimit-remaining-tokens", "0")
+		w.Header().Set("x-ratelimit-reset-tokens", "6m0s")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error": "rate limited"}`))
+	}))
+	defer server.Close()
+
+	model := cloud.NewOpenAIModel(server.URL, "", cloud.VertexAiLLMModel{Model: "llava"}, nil)
+	_, err := model.Generate(context.Background(), &cloud.GenerationRequest{Text: "describe"})
+	var quotaErr *cloud.QuotaExceededError
+	assert.True(t, errors.As(err, &quotaErr))
+	assert.Equal(t, "llava", quotaErr.Model)
+	assert.Equal(t, 12, quotaErr.RemainingRequests)
+	assert.Equal(t, 0, quotaErr.RemainingTokens)
+	assert.Equal(t, 6*time.Minute, quotaErr.RetryAfter)
+}
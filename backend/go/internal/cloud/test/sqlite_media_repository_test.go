@@ -0,0 +1,162 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloud_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestMedia creates a media object with one scene per script.
+func newTestMedia(name string, scripts ...string) *model.Media {
+	media := model.NewMedia(name)
+	media.Title = name
+	for i, script := range scripts {
+		media.Scenes = append(media.Scenes, &model.Scene{SequenceNumber: i + 1, Start: "00:00:00", End: "00:00:10", Script: script})
+	}
+	return media
+}
+
+// newTestRepository opens a repository in a temporary database file.
+func newTestRepository(t *testing.T, distance string) *cloud.SQLiteMediaRepository {
+	repo, err := cloud.NewSQLiteMediaRepository(context.Background(), filepath.Join(t.TempDir(), "media.db"), distance)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = repo.Close() })
+	return repo
+}
+
+// TestSQLiteMediaRepositoryStoresMedia verifies that media and scenes can be
+// saved, read back and deleted, and that unknown IDs match ErrMediaNotFound.
+func TestSQLiteMediaRepositoryStoresMedia(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t, cloud.DistanceEuclidean)
+
+	media := newTestMedia("trailer.mp4", "a car chase", "a quiet dinner")
+	media.Cast = append(media.Cast, &model.CastMember{CharacterName: "Mal", ActorName: "Nathan Fillion"})
+	assert.Nil(t, repo.SaveMedia(ctx, media))
+	media.Title = "Renamed"
+	assert.Nil(t, repo.SaveMedia(ctx, media))
+
+	got, err := repo.GetMedia(ctx, media.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "Renamed", got.Title)
+	assert.Equal(t, "Nathan Fillion", got.Cast[0].ActorName)
+
+	scene, err := repo.GetScene(ctx, media.Id, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "a quiet dinner", scene.Script)
+
+	_, err = repo.GetScene(ctx, media.Id, 3)
+	assert.True(t, errors.Is(err, cloud.ErrMediaNotFound))
+
+	assert.Nil(t, repo.DeleteMedia(ctx, media.Id))
+	_, err = repo.GetMedia(ctx, media.Id)
+	assert.True(t, errors.Is(err, cloud.ErrMediaNotFound))
+}
+
+// TestSQLiteMediaRepositoryListsUnembeddedMedia verifies that media drops off
+// the unembedded list once its embeddings are saved.
+func TestSQLiteMediaRepositoryListsUnembeddedMedia(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t, cloud.DistanceEuclidean)
+	first, second := newTestMedia("first.mp4", "one"), newTestMedia("second.mp4", "two")
+	assert.Nil(t, repo.SaveMedia(ctx, first))
+	assert.Nil(t, repo.SaveMedia(ctx, second))
+
+	embedding := model.NewSceneEmbedding(first.Id, 1, "test-model")
+	embedding.Embeddings = []float64{1, 0}
+	assert.Nil(t, repo.SaveEmbeddings(ctx, []*model.SceneEmbedding{embedding}))
+
+	unembedded, err := repo.ListUnembeddedMedia(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, unembedded, 1)
+	assert.Equal(t, second.Id, unembedded[0].Id)
+}
+
+// TestSQLiteMediaRepositoryFindsNearestScenes verifies the brute-force vector
+// search for both distance types.
+func TestSQLiteMediaRepositoryFindsNearestScenes(t *testing.T) {
+	ctx := context.Background()
+	vectors := map[int][]float64{1: {1, 0}, 2: {0, 1}, 3: {10, 1}}
+
+	for distance, expected := range map[string][]int{
+		// (10, 1) is far away from (1, 0.2) but points in almost the same direction.
+		cloud.DistanceEuclidean: {1, 2, 3},
+		cloud.DistanceCosine:    {3, 1, 2},
+	} {
+		repo := newTestRepository(t, distance)
+		embeddings := make([]*model.SceneEmbedding, 0)
+		for sequence, vector := range vectors {
+			embedding := model.NewSceneEmbedding("media", sequence, "test-model")
+			embedding.Embeddings = vector
+			embeddings = append(embeddings, embedding)
+		}
+		assert.Nil(t, repo.SaveEmbeddings(ctx, embeddings))
+
+		results, err := repo.FindScenes(ctx, []float64{1, 0.2}, 3)
+		assert.Nil(t, err)
+		sequences := make([]int, 0, len(results))
+		for _, r := range results {
+			sequences = append(sequences, r.SequenceNumber)
+		}
+		assert.Equal(t, expected, sequences, distance)
+	}
+}
+
+// TestSQLiteMediaRepositoryRejectsOtherDimensions verifies that a search
+// fails when a stored embedding has another dimension than the query.
+func TestSQLiteMediaRepositoryRejectsOtherDimensions(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t, cloud.DistanceCosine)
+	embedding := model.NewSceneEmbedding("media", 1, "other-model")
+	embedding.Embeddings = []float64{0.9, 0.1, 0}
+	assert.Nil(t, repo.SaveEmbeddings(ctx, []*model.SceneEmbedding{embedding}))
+
+	_, err := repo.FindScenes(ctx, []float64{1, 0.2}, 3)
+	assert.ErrorIs(t, err, cloud.ErrDimensionMismatch)
+}
+
+// TestSQLiteMediaRepositorySumsUsage verifies that the usage records are
+// summed from the given time.
+func TestSQLiteMediaRepositorySumsUsage(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepository(t, cloud.DistanceEuclidean)
+	now := time.Now()
+
+	usage, err := repo.SumUsage(ctx, now.Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, model.TokenUsage{}, *usage)
+
+	assert.Nil(t, repo.RecordUsage(ctx, &model.UsageRecord{RecordedAt: now.Add(-48 * time.Hour), Model: "gemini", InputTokens: 5000, OutputTokens: 500, Cost: 1}))
+	assert.Nil(t, repo.RecordUsage(ctx, &model.UsageRecord{RecordedAt: now, Model: "gemini", InputTokens: 1200, OutputTokens: 30, Cost: 0.0018}))
+	assert.Nil(t, repo.RecordUsage(ctx, &model.UsageRecord{RecordedAt: now, Model: "other", InputTokens: 100, OutputTokens: 10}))
+
+	usage, err = repo.SumUsage(ctx, now.Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1300, usage.InputTokens)
+	assert.Equal(t, 40, usage.OutputTokens)
+	assert.InDelta(t, 0.0018, usage.Cost, 1e-9)
+
+	usage, err = repo.SumUsage(ctx, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, 6300, usage.InputTokens)
+}
@@ -23,9 +23,10 @@
 //     configuration file and then overwrites values with a second, environment-specific
 //     file (e.g., .env.local.toml, .env.test.toml). The environment is determined by
 //     an environment variable.
-//   - GenerateMultiModalResponse: A wrapper for making calls to the GenAI model. It includes
-//     a retry mechanism to handle transient errors and integrates with OpenTelemetry to
-//     record metrics for token usage and retries.
+//   - GenerateMultiModalResponse: A wrapper for making calls to the GenAI model. It classifies
+//     failures (see generation_error.go), retries the rate-limited and transient ones with
+//     an exponential, jittered backoff, and integrates with OpenTelemetry to record metrics
+//     for token usage and retries.
 //   - NewTextPart, NewFileData: Simple factory functions for creating genai.Part objects,
 //     improving code readability when constructing multi-modal prompts.
 package cloud
@@ -37,6 +38,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"go.opentelemetry.io/otel/metric"
 
@@ -52,6 +54,8 @@ const (
 	ConfigSeparator     = "."                 // The separator used in config file names (e.g., ".env.local.toml").
 	EnvConfigFilePrefix = "GCP_CONFIG_PREFIX" // The environment variable for specifying the config directory.
 	EnvConfigRuntime    = "GCP_RUNTIME"       // The environment variable for specifying the runtime context (e.g., "local", "test", "prod").
+	EnvTestMode         = "GCP_TEST_MODE"     // The environment variable for recording or replaying GenAI calls ("live", "record", "replay").
+	EnvCassetteDir      = "GCP_CASSETTE_DIR"  // The environment variable for the directory of recorded GenAI calls.
 	MaxRetries          = 3                   // The maximum number of times to retry a failed API call.
 )
 
@@ -128,59 +132,66 @@ func LoadConfig(baseConfig interface{}) {
 // GenerateMultiModalResponse is a helper function for executing multi-modal requests
 // against a Generative AI model. It includes logic for retries and telemetry.
 //
+// Logic Flow:
+//  1. Send the request to the model.
+//  2. If it fails, classify the error with `ClassifyGenerationError`.
+//  3. If the failure is retryable (rate-limited or transient) and attempts are
+//     left, wait for the backoff of `GenerationRetryPolicy`, or the delay a
+//     rate-limited response asked for if longer, and try again.
+//  4. Otherwise, return the classified error; a canceled context ends the wait.
+//
 // Inputs:
 //   - ctx: The context for the request, which controls cancellation and tracing.
 //   - inputTokenCounter: An OpenTelemetry counter for prompt tokens used.
 //   - outputTokenCounter: An OpenTelemetry counter for response tokens generated.
 //   - retryCounter: An OpenTelemetry counter for tracking the number of retries.
-//   - tryCount: The current attempt number for this request (starts at 0).
-//   - model: The rate-limited, quota-aware generative model to use.
-//   - parts: A variadic slice of `genai.Part` (e.g., text, images, video) that form the prompt.
+//   - tryCount: The number of attempts already made for this request (usually 0).
+//   - model: The generative model to use, of any provider.
+//   - request: The text and media that form the prompt.
 //
 // Outputs:
-//   - string: The concatenated text content from the model's response.
-//   - error: An error if the request fails after all retries.
+//   - string: The text of the model's response, without a Markdown JSON fence.
+//   - Usage: The token usage, and estimated cost, of the successful attempt.
+//   - error: A *GenerationError if the request fails after all retries, or the
+//     error of the context if it is canceled.
 func GenerateMultiModalResponse(
 	ctx context.Context,
 	inputTokenCounter metric.Int64Counter,
 	outputTokenCounter metric.Int64Counter,
 	retryCounter metric.Int64Counter,
 	tryCount int,
-	model *QuotaAwareGenerativeAIModel,
-	content []*genai.Content) (value string, err error) {
-	// Make the request to the generative model.
-	resp, err := model.GenerateContent(ctx, content)
-
-	// If there's an error, check if we can retry.
-	if err != nil {
-		if tryCount < MaxRetries {
-			// If we haven't reached the max retry count, increment the retry counter
-			// and recursively call this function to try again.
-			retryCounter.Add(ctx, 1)
-			return GenerateMultiModalResponse(ctx, inputTokenCounter, outputTokenCounter, retryCounter, tryCount+1, model, content)
-		} else {
-			// If max retries have been reached, return the error.
-			return "", err
+	model GenerativeModel,
+	request *GenerationRequest) (value string, usage Usage, err error) {
+	var resp *GenerationResponse
+	for attempt := tryCount + 1; ; attempt++ {
+		// Make the request to the generative model.
+		resp, err = model.Generate(ctx, request)
+		if err == nil {
+			break
 		}
-	}
-	// Record the token counts for both the prompt and the generated candidates.
-	inputTokenCounter.Add(ctx, int64(resp.UsageMetadata.PromptTokenCount))
-	outputTokenCounter.Add(ctx, int64(resp.UsageMetadata.CandidatesTokenCount))
-
-	// If the request was successful, process the response.
-	value = ""
-	// The response can have multiple candidates; iterate through them.
-	for _, candidate := range resp.Candidates {
-		if candidate.Content != nil {
-			// Each candidate's content can have multiple parts; iterate and concatenate them.
-			for _, part := range candidate.Content.Parts {
-				value += fmt.Sprint(part.Text)
-			}
+
+		// If there's an error, check if it is worth retrying.
+		err = ClassifyGenerationError(model.Name(), err)
+		var genErr *GenerationError
+		if !errors.As(err, &genErr) || !genErr.Retryable() || attempt >= GenerationRetryPolicy.MaxAttempts {
+			return "", Usage{}, err
+		}
+		wait := max(GenerationRetryPolicy.Backoff(attempt), genErr.RetryAfter)
+		log.Printf("generation failed on attempt %d/%d, retrying in %s: %v", attempt, GenerationRetryPolicy.MaxAttempts, wait, err)
+		retryCounter.Add(ctx, 1)
+		select {
+		case <-ctx.Done():
+			return "", Usage{}, ctx.Err()
+		case <-time.After(wait):
 		}
 	}
-	value = strings.TrimPrefix(value, "```json")
+	// Record the token counts for both the prompt and the generated candidates.
+	inputTokenCounter.Add(ctx, int64(resp.Usage.InputTokens))
+	outputTokenCounter.Add(ctx, int64(resp.Usage.OutputTokens))
+
+	value = strings.TrimPrefix(resp.Text, "```json")
 	value = strings.TrimSuffix(value, "```")
-	return value, nil
+	return value, resp.Usage, nil
 }
 
 // NewTextPart is a simple factory function (delegate) for creating a text part.
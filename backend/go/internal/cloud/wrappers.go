@@ -15,120 +15,148 @@
 // Package cloud provides components for interacting with Google Cloud services.
 // This file implements a wrapper around the standard Generative AI client.
 // This wrapper uses the Decorator design pattern to add extra functionality
-// to an existing object without altering its code. Specifically, it adds
-// rate limiting and a retry mechanism to the Generative AI model.
+// to an existing object without altering its code. Specifically, it reports
+// the responses blocked by safety filters as errors.
 //
-// Why this is important:
-//   - Rate Limiting: Services like Vertex AI have quotas on how many requests
-//     you can make per minute. This wrapper prevents the application from
-//     exceeding those limits, which would otherwise result in errors.
-//   - Retry Logic: Network requests can sometimes fail for transient reasons.
-//     The wrapper automatically retries a failed request, making the application
-//     more resilient and reliable.
+// The quotas of the model (requests and tokens per minute) are enforced by
+// the `QuotaManager` shared by all agent models (see quota.go), and failed
+// requests are classified and retried by `GenerateMultiModalResponse` (see
+// generation_error.go).
+//
+// The wrapped model is the Vertex AI (Gemini) implementation of `GenerativeModel`.
 //
 // Structs:
-//   - QuotaAwareGenerativeAIModel: A struct that wraps the base `genai.GenerativeModel`
-//     and adds a rate limiter.
+//   - QuotaAwareGenerativeAIModel: A struct that wraps the base `genai.GenerativeModel`.
 //
 // Functions:
 //   - NewQuotaAwareModel: A constructor to create a new instance of the wrapped model.
 //   - GenerateContent: An overridden method that intercepts calls to the AI model
-//     to enforce rate limiting and retries.
+//     to detect blocked responses.
+//   - Generate: Implements `GenerativeModel` on top of GenerateContent.
 package cloud
 
 import (
 	"context"
-	"errors"
-	"time"
+	"fmt"
 
-	"golang.org/x/time/rate"
 	"google.golang.org/genai"
 )
 
 // QuotaAwareGenerativeAIModel is a decorator struct that wraps the standard
-// `genai.GenerativeModel` to add rate-limiting capabilities. By embedding
-// the original model, it inherits all its methods, but we can override specific
-// ones, like `GenerateContent`, to add our custom logic.
+// `genai.GenerativeModel`. By embedding the original model, it
+// inherits all its methods, but we can override specific ones, like
+// `GenerateContent`, to add our custom logic.
 type QuotaAwareGenerativeAIModel struct {
 	GenerativeContentConfig *genai.GenerateContentConfig // The embedded base Vertex AI LLM. All its fields and methods are available here.
 	ModelName               string
 	ModelHandle             *genai.Models
-	RateLimit               rate.Limiter // A rate limiter from Go's standard library to control request frequency.
 }
 
 // NewQuotaAwareModel is a constructor function that creates a new
-// QuotaAwareGenerativeAIModel. It takes the base model and a rate limit
-// (in requests per second) and returns our enhanced, quota-aware model.
+// QuotaAwareGenerativeAIModel. Its quotas are enforced by the `QuotaModel`
+// that `NewCloudServiceClients` wraps it in.
 //
 // Inputs:
-//   - wrapped: The original *genai.GenerativeModel to be wrapped.
-//   - requestsPerSecond: An integer specifying the maximum number of API calls allowed per second.
+//   - wrapped: The generation settings of the model.
+//   - name: The name of the Vertex AI model (e.g., "gemini-2.5-pro").
+//   - ModelHand: The models service of the GenAI client.
 //
 // Outputs:
 //   - *QuotaAwareGenerativeAIModel: A pointer to the newly created wrapper.
-func NewQuotaAwareModel(wrapped *genai.GenerateContentConfig, name string, ModelHand *genai.Models, requestsPerSecond int) *QuotaAwareGenerativeAIModel {
+func NewQuotaAwareModel(wrapped *genai.GenerateContentConfig, name string, ModelHand *genai.Models) *QuotaAwareGenerativeAIModel {
 	return &QuotaAwareGenerativeAIModel{
 		GenerativeContentConfig: wrapped,
 		ModelName:               name,
 		ModelHandle:             ModelHand,
-		// Creates a new rate limiter that allows a burst of `requestsPerSecond` events
-		// and replenishes the "token bucket" at a rate of 1 token per second.
-		RateLimit: *rate.NewLimiter(rate.Every(time.Second/1), requestsPerSecond),
 	}
 }
 
 // GenerateContent overrides the original `GenerateContent` method of the embedded
-// `genai.GenerativeModel`. This is where the rate-limiting and retry logic is implemented.
+// `genai.GenerativeModel`, to report a blocked prompt or response as an error.
 //
 // Logic Flow:
-//  1. Check the rate limiter.
-//  2. If a request is allowed:
-//     a. Call the original `GenerateContent` method.
-//     b. If it fails, check the retry count.
-//     c. If retries are available, wait and recursively call itself to try again.
-//     d. If no retries are left, return the error.
-//  3. If a request is NOT allowed (rate-limited):
-//     a. Wait for a short period.
-//     b. Recursively call itself to re-queue the request.
+//  1. Call the original `GenerateContent` method; its errors are returned as is.
+//  2. If the prompt was blocked, or every candidate was stopped by a safety
+//     filter, return a `GenerationError` of kind `GenerationSafetyBlocked`.
 //
 // Inputs:
-//   - ctx: The context for the request. It's used here to manage retry state.
-//   - parts: The parts of the multi-modal prompt (text, images, etc.).
+//   - ctx: The context for the request.
+//   - content: The multi-modal prompt (text, images, etc.).
 //
 // Outputs:
 //   - *genai.GenerateContentResponse: The response from the AI model if successful.
-//   - error: An error if the request fails after all retries or if another issue occurs.
-func (q *QuotaAwareGenerativeAIModel) GenerateContent(ctx context.Context, content []*genai.Content) (resp *genai.GenerateContentResponse, err error) {
-	// The `Allow()` method checks if an event can happen now. It's a non-blocking check.
-	if q.RateLimit.Allow() {
-		// If allowed, proceed to call the actual Generative AI model.
-		resp, err = q.ModelHandle.GenerateContent(ctx, q.ModelName, content, q.GenerativeContentConfig)
-		if err != nil {
-			// If an error occurred during the API call, start the retry logic.
-			// Get the current retry count from the context. `Value()` returns an interface{},
-			// so we must type-assert it to an `int`.
-			var retryCount int
-			if ctx.Value("retry") != nil {
-				retryCount = ctx.Value("retry").(int)
+//   - error: An error if the request fails or was blocked.
+func (q *QuotaAwareGenerativeAIModel) GenerateContent(ctx context.Context, content []*genai.Content) (*genai.GenerateContentResponse, error) {
+	resp, err := q.ModelHandle.GenerateContent(ctx, q.ModelName, content, q.GenerativeContentConfig)
+	if err != nil {
+		return nil, err
+	}
+	if feedback := resp.PromptFeedback; feedback != nil && feedback.BlockReason != "" {
+		return nil, &GenerationError{Kind: GenerationSafetyBlocked, Model: q.ModelName,
+			Err: fmt.Errorf("prompt blocked: %s %s", feedback.BlockReason, feedback.BlockReasonMessage)}
+	}
+	if len(resp.Candidates) > 0 {
+		for _, candidate := range resp.Candidates {
+			if !safetyFinishReasons[candidate.FinishReason] {
+				return resp, nil
 			}
-			if retryCount > 3 {
-				// If we have exceeded the maximum number of retries, give up and return an error.
-				return nil, errors.New("failed generation on max retries")
+		}
+		return nil, &GenerationError{Kind: GenerationSafetyBlocked, Model: q.ModelName,
+			Err: fmt.Errorf("response blocked: %s", resp.Candidates[0].FinishReason)}
+	}
+	return resp, nil
+}
+
+// safetyFinishReasons are the finish reasons of a candidate stopped by a safety filter.
+var safetyFinishReasons = map[genai.FinishReason]bool{
+	genai.FinishReasonSafety:            true,
+	genai.FinishReasonBlocklist:         true,
+	genai.FinishReasonProhibitedContent: true,
+	genai.FinishReasonSPII:              true,
+	genai.FinishReasonImageSafety:       true,
+}
+
+// Name returns the name of the Vertex AI model.
+func (q *QuotaAwareGenerativeAIModel) Name() string {
+	return q.ModelName
+}
+
+// Generate implements GenerativeModel. The prompt text is followed by the
+// media parts, which must be URIs the Vertex AI API can read (e.g., files of
+// the GenAI File Service or GCS objects).
+//
+// Inputs:
+//   - ctx: The context for the request.
+//   - request: The prompt text and media.
+//
+// Outputs:
+//   - *GenerationResponse: The concatenated text of all candidates and the token usage.
+//   - error: An error if the request fails.
+func (q *QuotaAwareGenerativeAIModel) Generate(ctx context.Context, request *GenerationRequest) (*GenerationResponse, error) {
+	parts := []*genai.Part{{Text: request.Text}}
+	for _, media := range request.Media {
+		parts = append(parts, &genai.Part{FileData: &genai.FileData{FileURI: media.URI, MIMEType: media.MIMEType}})
+	}
+	resp, err := q.GenerateContent(ctx, []*genai.Content{{Parts: parts, Role: genai.RoleUser}})
+	if err != nil {
+		return nil, err
+	}
+
+	out := &GenerationResponse{}
+	if resp.UsageMetadata != nil {
+		out.Usage = Usage{
+			InputTokens:  int(resp.UsageMetadata.PromptTokenCount),
+			OutputTokens: int(resp.UsageMetadata.CandidatesTokenCount),
+		}
+	}
+	// The response can have multiple candidates; iterate through them.
+	for _, candidate := range resp.Candidates {
+		if candidate.Content != nil {
+			// Each candidate's content can have multiple parts; iterate and concatenate them.
+			for _, part := range candidate.Content.Parts {
+				out.Text += part.Text
 			}
-			// If more retries are allowed, create a new context with an incremented retry count.
-			errCtx := context.WithValue(ctx, "retry", retryCount+1)
-			// Wait for one minute before retrying to give the service time to recover.
-			time.Sleep(time.Minute * 1)
-			// Recursively call this function to try again.
-			return q.ModelHandle.GenerateContent(errCtx, q.ModelName, content, q.GenerativeContentConfig)
 		}
-		// If the API call was successful, return the response and a nil error.
-		return resp, err
-	} else {
-		// If the rate limiter did not allow the request, wait for 5 seconds.
-		// This pauses the execution of this specific request, effectively "queueing" it.
-		time.Sleep(time.Second * 5)
-		// After waiting, recursively call this function to try obtaining a token from the rate limiter again.
-		return q.ModelHandle.GenerateContent(ctx, q.ModelName, content, q.GenerativeContentConfig)
 	}
+	return out, nil
 }
@@ -0,0 +1,97 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package commands provides the concrete implementations of the Chain of
+// Responsibility (COR) pattern's Command interface. This file defines the
+// command that stops a workflow before it spends more than the budgets of
+// ingestion allow (see `cloud.BudgetManager`).
+//
+// Logic Flow:
+// The media reader workflow runs this command before `MediaSummaryCreator`
+// and before `SceneExtractor`, the two steps sending the media to the model.
+//
+//  1. Before the summary, nothing is known about the media file: the command
+//     only checks that the daily and monthly budgets are not spent.
+//  2. Before the scenes, it also estimates the usage of the whole media file
+//     from the usage of its summary (`SummaryUsageKey`): each scene request
+//     sends the same media, so the summary's usage is counted once more for
+//     each scene of the summary. The estimate is checked against the
+//     per-media budget.
+//  3. A refusal is recorded on the context as a `cloud.BudgetExceededError`,
+//     which stops the chain; the listener defers the message, or dead-letters
+//     it if it is over the per-media budget.
+//  4. Otherwise, the piped input is passed on unchanged to the next command.
+package commands
+
+import (
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+)
+
+// BudgetCheck is a command that fails when the budgets of ingestion do not
+// allow the next steps of the workflow.
+type BudgetCheck struct {
+	cor.BaseCommand
+	budgets      *cloud.BudgetManager // The budgets of ingestion.
+	summaryParam string               // The context key of the `model.MediaSummary`; empty before the summary exists.
+}
+
+// NewBudgetCheck is the constructor for the BudgetCheck command.
+//
+// Inputs:
+//   - name: A string name for this command instance.
+//   - budgets: The budgets of ingestion.
+//   - summaryParam: The name of the context parameter holding the `model.MediaSummary`
+//     whose scenes estimate the usage of the media file; empty to check only the
+//     daily and monthly budgets.
+//
+// Outputs:
+//   - *BudgetCheck: A pointer to the newly instantiated command.
+func NewBudgetCheck(name string, budgets *cloud.BudgetManager, summaryParam string) *BudgetCheck {
+	return &BudgetCheck{BaseCommand: *cor.NewBaseCommand(name), budgets: budgets, summaryParam: summaryParam}
+}
+
+// Execute checks the budgets and passes the piped input on.
+//
+// Inputs:
+//   - context: The shared `cor.Context` for this workflow execution.
+func (c *BudgetCheck) Execute(context cor.Context) {
+	if err := c.budgets.Check(context.GetContext(), c.estimate(context)); err != nil {
+		context.AddError(c.GetName(), err)
+		return
+	}
+	context.Add(cor.CtxOut, context.Get(c.GetInputParam()))
+}
+
+// estimate returns the estimated usage of the media file: the usage of its
+// summary, once for the summary and once for each scene. It is zero before
+// the summary exists.
+func (c *BudgetCheck) estimate(context cor.Context) model.TokenUsage {
+	if len(c.summaryParam) == 0 {
+		return model.TokenUsage{}
+	}
+	summary, _ := cor.NewKey[*model.MediaSummary](c.summaryParam).Get(context)
+	usage, _ := SummaryUsageKey.Get(context)
+	if summary == nil || usage == nil {
+		return model.TokenUsage{}
+	}
+	requests := 1 + len(summary.SceneTimeStamps)
+	return model.TokenUsage{
+		Model:        usage.Model,
+		InputTokens:  usage.InputTokens * requests,
+		OutputTokens: usage.OutputTokens * requests,
+		Cost:         usage.Cost * float64(requests),
+	}
+}
@@ -34,7 +34,9 @@
 //  3. Create a new temporary input file with the correct extension (e.g., input.mp4).
 //  4. Copy the contents from the original file to this new, correctly-named temp file.
 //  5. Create a temporary output file.
-//  6. Build and execute the `ffmpeg` command-line instruction.
+//  6. Build and execute the `ffmpeg` command-line instruction, once a slot of
+//     the shared FFmpeg limiter is free (see `cloud.Limiter`), so that the
+//     number of transcodes running at once is bounded across all workflows.
 //  7. If successful, add the path of the newly created (resized) video file to
 //     the context so it can be used by the next command in the chain.
 //  8. Track all created temporary files in the context for later cleanup.
@@ -43,6 +45,7 @@ package commands
 import (
 	"fmt"
 	"io"
+	"log/slog"
 
 	"github.com/h2non/filetype"
 
@@ -50,6 +53,7 @@ import (
 	"os/exec"
 	"strings"
 
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
 )
 
@@ -74,9 +78,10 @@ const (
 // It is used to download a media file, resize it to a specific width while maintaining
 // the aspect ratio, and prepare the resized version for the next step in a workflow.
 type FFMpegCommand struct {
-	cor.BaseCommand        // Embeds the BaseCommand for common functionality like naming and metrics.
-	commandPath     string // The path to the FFmpeg executable (e.g., "/usr/bin/ffmpeg").
-	targetWidth     string // The desired output width for the video in pixels (e.g., "240").
+	cor.BaseCommand                // Embeds the BaseCommand for common functionality like naming and metrics.
+	commandPath     string         // The path to the FFmpeg executable (e.g., "/usr/bin/ffmpeg").
+	targetWidth     string         // The desired output width for the video in pixels (e.g., "240").
+	limiter         *cloud.Limiter // Caps the FFmpeg processes running at once; nil if unlimited.
 }
 
 // NewFFMpegCommand is the constructor for creating a new FFMpegCommand.
@@ -95,6 +100,20 @@ func NewFFMpegCommand(name string, commandPath string, targetWidth string) *FFMp
 		targetWidth: targetWidth}
 }
 
+// SetLimiter sets the limiter that FFmpeg processes must hold a slot of.
+//
+// Inputs:
+//   - limiter: The shared FFmpeg limiter; nil if unlimited.
+func (c *FFMpegCommand) SetLimiter(limiter *cloud.Limiter) {
+	c.limiter = limiter
+}
+
+// OutputKeys declares the keys written by Execute (see `cor.KeyDeclarer`).
+// The resized file is always written to `cor.CtxOut`.
+func (c *FFMpegCommand) OutputKeys() []string {
+	return []string{cor.CtxOut}
+}
+
 // Execute contains the core logic for the command. It handles file operations,
 // command building, and execution of FFmpeg.
 //
@@ -103,12 +122,14 @@ func NewFFMpegCommand(name string, commandPath string, targetWidth string) *FFMp
 func (c *FFMpegCommand) Execute(context cor.Context) {
 	// Retrieve the input file path from the context. This is expected to have been
 	// placed here by a previous command in the chain.
-	originalInputPath := context.Get(c.GetInputParam()).(string)
+	originalInputPath, ok := cor.NewKey[string](c.GetInputParam()).MustGet(context, c.GetName())
+	if !ok {
+		return
+	}
 
 	// --- Step 1: Open the original input file ---
 	originalFile, err := os.Open(originalInputPath)
 	if err != nil {
-		c.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(c.GetName(), fmt.Errorf("failed to open original input file: %w", err))
 		return
 	}
@@ -119,7 +140,6 @@ func (c *FFMpegCommand) Execute(context cor.Context) {
 	// to identify most common file formats by their magic numbers.
 	header := make([]byte, 261)
 	if _, err := originalFile.Read(header); err != nil && err != io.EOF {
-		c.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(c.GetName(), fmt.Errorf("failed to read header from input file: %w", err))
 		return
 	}
@@ -131,7 +151,7 @@ func (c *FFMpegCommand) Execute(context cor.Context) {
 	if kind == filetype.Unknown {
 		// If the file type can't be determined, we log a warning but proceed.
 		// FFmpeg is often smart enough to figure it out anyway, but this is less reliable.
-		fmt.Println("Warning: Could not determine file type. FFmpeg might fail.")
+		slog.WarnContext(context.GetContext(), "could not determine file type; ffmpeg might fail", "file", originalInputPath)
 	}
 
 	// --- Step 3: Create a new temp input file WITH the correct extension ---
@@ -141,7 +161,6 @@ func (c *FFMpegCommand) Execute(context cor.Context) {
 	// especially in restricted environments like Snap packages.
 	newInputFile, err := os.CreateTemp(".", "ffmpeg-input-*."+kind.Extension)
 	if err != nil {
-		c.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(c.GetName(), fmt.Errorf("failed to create new temp input file: %w", err))
 		return
 	}
@@ -150,17 +169,14 @@ func (c *FFMpegCommand) Execute(context cor.Context) {
 
 	// Copy the original file's content to the new, correctly named temp file.
 	if _, err := io.Copy(newInputFile, originalFile); err != nil {
-		c.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(c.GetName(), fmt.Errorf("failed to copy content to new temp input: %w", err))
 		return
 	}
-	fmt.Printf("Created new temporary input with correct extension: %s\n", newInputFile.Name())
 
 	// --- Step 4: Create the temporary output file ---
 	// Create a placeholder file where FFmpeg will write the resized video.
 	outputFile, err := os.CreateTemp(".", "ffmpeg-output-*.mp4")
 	if err != nil {
-		c.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(c.GetName(), fmt.Errorf("could not create a temp output file: %w", err))
 		return
 	}
@@ -170,22 +186,26 @@ func (c *FFMpegCommand) Execute(context cor.Context) {
 	// Populate the format string with the new temp input file, target width, and temp output file.
 	args := fmt.Sprintf(DefaultFfmpegArgs, newInputFile.Name(), c.targetWidth, outputFile.Name())
 	// Create the command object with the executable path and the formatted arguments.
-	cmd := exec.Command(c.commandPath, strings.Split(args, CommandSeparator)...)
+	// The process is killed if the workflow is canceled, e.g. on shutdown.
+	cmd := exec.CommandContext(context.GetContext(), c.commandPath, strings.Split(args, CommandSeparator)...)
 
-	fmt.Printf("Executing FFmpeg command: %s\n", cmd.String())
+	slog.DebugContext(context.GetContext(), "executing ffmpeg", "command", cmd.String())
 	cmd.Stderr = os.Stderr // Pipe FFmpeg's error output to the main application's stderr for visibility.
 
-	// Run the command and wait for it to complete.
-	if err := cmd.Run(); err != nil {
+	// Wait for a free FFmpeg slot, then run the command and wait for it to complete.
+	if err := c.limiter.Acquire(context.GetContext()); err != nil {
+		os.Remove(outputFile.Name())
+		context.AddError(c.GetName(), err)
+		return
+	}
+	err = cmd.Run()
+	c.limiter.Release()
+	if err != nil {
 		os.Remove(outputFile.Name()) // Clean up the failed output file if the command fails.
-		c.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(c.GetName(), fmt.Errorf("error running ffmpeg: %w", err))
 		return
 	}
 
-	// If successful, log the output path and update metrics.
-	fmt.Printf("FFmpeg processing successful. Output is at: %s\n", outputFile.Name())
-	c.GetSuccessCounter().Add(context.GetContext(), 1)
 	// Add the output file to the context's list of temp files for later cleanup by the chain executor.
 	context.AddTempFile(outputFile.Name())
 	// Add the output file path as the primary output of this command, making it available
@@ -0,0 +1,100 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package commands provides the concrete implementations of the Chain of
+// Responsibility (COR) pattern's Command interface. This file defines the
+// command for probing a local video file's width with FFprobe.
+//
+// Logic Flow:
+// The `FFProbeWidthCommand` lets a workflow decide whether a video needs to be
+// transcoded at all. It does not change the file; it only measures it.
+//
+//  1. Get the path of the input file from the COR context.
+//  2. Run `ffprobe` to read the width of the first video stream.
+//  3. Store the width (in pixels) under the command's output parameter. If the
+//     probe fails, the width is stored as 0 ("unknown") and the workflow is
+//     expected to fall back to its default behavior.
+//  4. Pass the input path through as `CtxOut` so the next command sees the same file.
+package commands
+
+import (
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+)
+
+// DefaultFfprobeArgs prints only the width of the first video stream, without
+// any headers, e.g. "1920".
+const DefaultFfprobeArgs = "-v error -select_streams v:0 -show_entries stream=width -of csv=p=0"
+
+// FFProbeWidthCommand measures the width of a local video file using FFprobe.
+type FFProbeWidthCommand struct {
+	cor.BaseCommand        // Embeds the BaseCommand for common functionality like naming and metrics.
+	commandPath     string // The path to the FFprobe executable (e.g., "/usr/bin/ffprobe").
+}
+
+// NewFFProbeWidthCommand is the constructor for FFProbeWidthCommand.
+//
+// Inputs:
+//   - name: A string name for this command instance, used for logging and telemetry.
+//   - commandPath: The file system path to the FFprobe executable.
+//   - outputParamName: The context key under which the width (an int) is stored.
+//
+// Outputs:
+//   - *FFProbeWidthCommand: A pointer to the newly instantiated command.
+func NewFFProbeWidthCommand(name string, commandPath string, outputParamName string) *FFProbeWidthCommand {
+	out := &FFProbeWidthCommand{BaseCommand: *cor.NewBaseCommand(name), commandPath: commandPath}
+	out.OutputParamName = outputParamName
+	return out
+}
+
+// OutputKeys declares the keys written by Execute (see `cor.KeyDeclarer`).
+// The probed file is passed through in `cor.CtxOut` and its width is written to the output parameter.
+func (c *FFProbeWidthCommand) OutputKeys() []string {
+	return []string{cor.CtxOut, c.GetOutputParam()}
+}
+
+// Execute runs FFprobe on the input file and records its width.
+//
+// Inputs:
+//   - context: The shared `cor.Context` for this workflow execution.
+func (c *FFProbeWidthCommand) Execute(context cor.Context) {
+	path, ok := cor.NewKey[string](c.GetInputParam()).MustGet(context, c.GetName())
+	if !ok {
+		return
+	}
+
+	// Always pass the file through, whatever the outcome of the probe.
+	context.Add(cor.CtxOut, path)
+
+	args := append(strings.Split(DefaultFfprobeArgs, CommandSeparator), path)
+	out, err := exec.CommandContext(context.GetContext(), c.commandPath, args...).Output()
+	if err != nil {
+		log.Printf("ffprobe failed for %s, width unknown: %v\n", path, err)
+		context.Add(c.GetOutputParam(), 0)
+		return
+	}
+
+	width, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		log.Printf("unexpected ffprobe output for %s, width unknown: %q\n", path, out)
+		context.Add(c.GetOutputParam(), 0)
+		return
+	}
+
+	context.Add(c.GetOutputParam(), width)
+}
@@ -14,7 +14,8 @@
 
 // Package commands provides the concrete implementations of the Chain of
 // Responsibility (COR) pattern's Command interface. This file defines a
-// command for uploading a local file to a specified Google Cloud Storage (GCS) bucket.
+// command for uploading a local file to a specified Google Cloud Storage (GCS)
+// bucket, or a bucket of any other `cloud.BlobStore`.
 //
 // Logic Flow:
 // This command is a step in a larger workflow, typically following a command
@@ -27,22 +28,24 @@
 //     triggered the workflow. If this metadata is not present, it falls back
 //     to using the local file's name.
 //  3. Open the local file for reading.
-//  4. Schedule the local temporary file for deletion after the function completes.
-//  5. Get a handle to the destination GCS bucket and create a writer object for
-//     the destination object name.
-//  6. Use `io.Copy` to efficiently stream the file's contents from the local disk
-//     directly to the GCS bucket.
-//  7. Handle any errors and perform cleanup.
+//  4. Create a blob store writer for the destination bucket and object name.
+//  5. Use `io.Copy` to efficiently stream the file's contents from the local disk
+//     directly to the bucket, then close the writer to finalize the upload.
+//  6. Only once the upload has succeeded, delete the local file. On failure the
+//     file is kept so that the command can be retried (see `cor.RetryCommand`).
+//  7. Record the written object as an undo record, so that `Compensate` can
+//     delete it if a later step of the workflow fails.
 package commands
 
 import (
+	goctx "context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 
-	"cloud.google.com/go/storage"
 	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
 )
@@ -51,91 +54,125 @@ import (
 // from the local filesystem to a Google Cloud Storage bucket.
 type GCSFileUpload struct {
 	cor.BaseCommand                 // Embeds the BaseCommand for common functionality like naming and metrics.
-	client          *storage.Client // The GCS client for interacting with the storage service.
-	bucket          string          // The name of the destination GCS bucket.
+	store           cloud.BlobStore // The blob store the file is uploaded to.
+	bucket          string          // The name of the destination bucket.
 }
 
 // NewGCSFileUpload is the constructor for creating a new GCSFileUpload command.
 //
 // Inputs:
 //   - name: A string name for this command instance, used for logging and telemetry.
-//   - client: An initialized *storage.Client for communicating with GCS.
-//   - bucket: The name of the target GCS bucket for the upload.
+//   - store: The blob store to upload to (GCS or local).
+//   - bucket: The name of the target bucket for the upload.
 //
 // Outputs:
 //   - *GCSFileUpload: A pointer to the newly instantiated command.
-func NewGCSFileUpload(name string, client *storage.Client, bucket string) *GCSFileUpload {
-	return &GCSFileUpload{BaseCommand: *cor.NewBaseCommand(name), client: client, bucket: bucket}
+func NewGCSFileUpload(name string, store cloud.BlobStore, bucket string) *GCSFileUpload {
+	return &GCSFileUpload{BaseCommand: *cor.NewBaseCommand(name), store: store, bucket: bucket}
+}
+
+// OutputKeys declares the keys written by Execute (see `cor.KeyDeclarer`).
+// The upload has no output in the context.
+func (c *GCSFileUpload) OutputKeys() []string {
+	return nil
 }
 
 // Execute contains the core logic for the command. It reads a local file
-// and streams its content to a GCS bucket.
+// and streams its content to a bucket of the blob store.
 //
 // Inputs:
 //   - context: The shared `cor.Context` for this workflow execution.
 func (c *GCSFileUpload) Execute(context cor.Context) {
 	// Retrieve the local file path from the context, which was put there by a previous command.
-	path := context.Get(c.GetInputParam()).(string)
+	path, ok := cor.NewKey[string](c.GetInputParam()).MustGet(context, c.GetName())
+	if !ok {
+		return
+	}
 	// Extract just the filename from the full path.
 	name := filepath.Base(path)
 
 	// Retrieve the metadata of the original GCS object that started the workflow.
 	// This ensures that if the input was "video.mov", the output is also named "video.mov"
 	// in the destination bucket, even if the local temp file had a different name.
-	original := context.Get(cloud.GetGCSObjectName()).(*cloud.GCSObject)
+	// The original object is optional, so a missing value is not an error here.
+	original, _ := cloud.GCSObjectKey.Get(context)
 
 	// Open the local file for reading.
 	dat, err := os.Open(path)
 	if err != nil {
-		c.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(c.GetName(), fmt.Errorf("failed to open file %s: %w", path, err))
 		return
 	}
 
-	// Defer the removal of the local temporary file. This function will be executed
-	// when the Execute function returns, ensuring cleanup.
-	defer func(name string) {
-		err := os.Remove(name)
-		if err != nil {
-			log.Printf("failed to remove file from OS: %v\n", err)
-		}
-	}(path)
+	defer dat.Close()
 
-	// Get a handle for the destination bucket.
-	writerBucket := c.client.Bucket(c.bucket)
-	var obj *storage.ObjectHandle
-
-	// Determine the name of the object to be created in GCS.
+	// Determine the name of the object to be created. If we have the original
+	// object's metadata, use its name; otherwise, fall back to the local file's name.
+	objectName := name
 	if original != nil {
-		// If we have the original object's metadata, use its name.
-		obj = writerBucket.Object(original.Name)
-	} else {
-		// Otherwise, fall back to using the name of the local file.
-		obj = writerBucket.Object(name)
+		objectName = original.Name
 	}
 
-	// Create a new writer for the GCS object. This opens a stream to GCS.
-	writer := obj.NewWriter(context.GetContext())
-
-	// Defer closing the writer. This is critical to finalize the upload.
-	// If the writer is not closed, the object may not be created or may be incomplete.
-	defer func(writer *storage.Writer) {
-		err := writer.Close()
-		if err != nil {
-			log.Printf("failed to close GCS writer: %v\n", err)
-		}
-	}(writer)
+	// Create a new writer for the object. Canceling the writer's context aborts
+	// the upload, so a failed copy never creates a partial object.
+	writeCtx, cancel := goctx.WithCancel(context.GetContext())
+	defer cancel()
+	writer, err := c.store.Create(writeCtx, c.bucket, objectName, "")
+	if err != nil {
+		context.AddError(c.GetName(), fmt.Errorf("failed to create %s/%s: %w", c.bucket, objectName, err))
+		return
+	}
 
-	// Use io.Copy to stream the file content from the local reader (`dat`) to the GCS writer.
+	// Use io.Copy to stream the file content from the local reader (`dat`) to the blob writer.
 	// This is memory-efficient as it doesn't load the entire file into memory.
 	if written, err := io.Copy(writer, dat); err != nil {
-		log.Printf("failed to copy to GCS or partial write: %d total bytes, %v\n", written, err)
-		c.GetErrorCounter().Add(context.GetContext(), 1)
-		context.AddError(c.GetName(), err)
+		cancel()
+		_ = writer.Close()
+		context.AddError(c.GetName(), fmt.Errorf("failed to copy to bucket or partial write: %d total bytes: %w", written, err))
+		return
+	}
+
+	// Closing the writer finalizes the upload; errors from the store usually surface here.
+	if err := writer.Close(); err != nil {
+		context.AddError(c.GetName(), fmt.Errorf("failed to finalize upload to %s/%s: %w", c.bucket, objectName, err))
 		return
 	}
 
-	// If the copy is successful, increment the success counter.
-	c.GetSuccessCounter().Add(context.GetContext(), 1)
-	log.Printf("Successfully uploaded %s to gs://%s/%s", name, c.bucket, obj.ObjectName())
+	// The local file is only removed once the upload succeeded, so that a retry
+	// of this command can read it again.
+	if err := os.Remove(path); err != nil {
+		log.Printf("failed to remove file from OS: %v\n", err)
+	}
+
+	// Remember exactly which object generation was written, so that a failure
+	// later in the workflow can remove it again (see Compensate).
+	written := &cloud.GCSObject{Bucket: c.bucket, Name: objectName}
+	if info := writer.Info(); info != nil {
+		written.Generation = info.Generation
+	}
+	cor.SetUndo(context, c.GetName(), written)
+
+}
+
+// Compensate deletes the object written by Execute. The delete is conditioned
+// on the generation that was written, so a newer upload of the same name by
+// another run is never removed.
+//
+// Inputs:
+//   - context: The shared `cor.Context` for this workflow execution.
+//
+// Outputs:
+//   - bool: True if Execute had written an object, even if its deletion failed.
+func (c *GCSFileUpload) Compensate(context cor.Context) bool {
+	written, ok := cor.TakeUndo[*cloud.GCSObject](context, c.GetName())
+	if !ok {
+		return false
+	}
+	err := c.store.Delete(context.GetContext(), written.Bucket, written.Name, written.Generation)
+	if err != nil && !errors.Is(err, cloud.ErrBlobNotExist) {
+		context.AddError(c.GetName()+"-compensate", fmt.Errorf("failed to delete %s/%s: %w", written.Bucket, written.Name, err))
+		return true
+	}
+	log.Printf("Compensated upload by deleting %s/%s", written.Bucket, written.Name)
+	return true
 }
@@ -14,8 +14,8 @@
 
 // Package commands provides the concrete implementations of the Chain of
 // Responsibility (COR) pattern's Command interface. This file defines a
-// command for downloading an object from Google Cloud Storage (GCS) to a
-// local temporary file.
+// command for downloading an object from Google Cloud Storage (GCS), or any
+// other `cloud.BlobStore`, to a local temporary file.
 //
 // Logic Flow:
 // This command serves as a bridge between a GCS-based workflow and a
@@ -25,9 +25,9 @@
 //
 //  1. Receives a `cloud.GCSObject` struct from the context, which contains the
 //     bucket and object name.
-//  2. Creates a reader for the specified GCS object.
+//  2. Opens a reader for the object from the blob store.
 //  3. Creates a new empty temporary file on the local disk.
-//  4. Efficiently streams the content from the GCS reader directly into the
+//  4. Efficiently streams the content from the blob reader directly into the
 //     local temporary file using `io.Copy`.
 //  5. Adds the path of the newly created temporary file to the context for two
 //     purposes:
@@ -41,16 +41,15 @@ import (
 	"log"
 	"os"
 
-	"cloud.google.com/go/storage"
 	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
 )
 
-// GCSToTempFile is a command implementation that downloads an object from GCS
+// GCSToTempFile is a command implementation that downloads an object from a blob store
 // and saves it as a temporary file on the local filesystem.
 type GCSToTempFile struct {
 	cor.BaseCommand                 // Embeds the BaseCommand for common functionality like naming and metrics.
-	client          *storage.Client // The GCS client for interacting with the storage service.
+	store           cloud.BlobStore // The blob store the object is read from.
 	tempFilePrefix  string          // A prefix to use when naming the temporary file (e.g., "ffmpeg-").
 }
 
@@ -58,44 +57,42 @@ type GCSToTempFile struct {
 //
 // Inputs:
 //   - name: A string name for this command instance, used for logging and telemetry.
-//   - client: An initialized *storage.Client for communicating with GCS.
+//   - store: The blob store holding the objects (GCS or local).
 //   - tempFilePrefix: A string prefix for the temporary file's name.
 //
 // Outputs:
 //   - *GCSToTempFile: A pointer to the newly instantiated command.
-func NewGCSToTempFile(name string, client *storage.Client, tempFilePrefix string) *GCSToTempFile {
+func NewGCSToTempFile(name string, store cloud.BlobStore, tempFilePrefix string) *GCSToTempFile {
 	return &GCSToTempFile{
 		BaseCommand:    *cor.NewBaseCommand(name),
-		client:         client,
+		store:          store,
 		tempFilePrefix: tempFilePrefix,
 	}
 }
 
-// Execute contains the core logic for downloading the GCS object.
+// Execute contains the core logic for downloading the object.
 //
 // Inputs:
 //   - context: The shared `cor.Context` for this workflow execution.
 func (c *GCSToTempFile) Execute(context cor.Context) {
 	// Retrieve the GCS object metadata from the context's input parameter.
-	msg := context.Get(c.GetInputParam()).(*cloud.GCSObject)
-
-	// Get a client handle for the specified bucket and object.
-	readerBucket := c.client.Bucket(msg.Bucket)
-	obj := readerBucket.Object(msg.Name)
+	msg, ok := cor.NewKey[*cloud.GCSObject](c.GetInputParam()).MustGet(context, c.GetName())
+	if !ok {
+		return
+	}
 
-	// Create a new reader to stream the object's data from GCS.
-	reader, err := obj.NewReader(context.GetContext())
+	// Open a reader to stream the object's data from the blob store.
+	reader, err := c.store.Open(context.GetContext(), msg.Bucket, msg.Name)
 	if err != nil {
-		c.GetErrorCounter().Add(context.GetContext(), 1)
-		context.AddError(c.GetName(), fmt.Errorf("failed to create GCS reader for gs://%s/%s: %w", msg.Bucket, msg.Name, err))
+		context.AddError(c.GetName(), fmt.Errorf("failed to create reader for %s/%s: %w", msg.Bucket, msg.Name, err))
 		return
 	}
 	// Defer closing the reader. This is important to release resources.
-	defer func(reader *storage.Reader) {
+	defer func(reader io.ReadCloser) {
 		err := reader.Close()
 		if err != nil {
 			// Log the error but don't stop the workflow, as the data might have been read successfully.
-			log.Printf("failed to close GCS reader: %v\n", err)
+			log.Printf("failed to close blob reader: %v\n", err)
 		}
 	}(reader)
 
@@ -103,19 +100,19 @@ func (c *GCSToTempFile) Execute(context cor.Context) {
 	// means it will be created in the default temporary directory for the OS.
 	tempFile, err := os.CreateTemp("", c.tempFilePrefix)
 	if err != nil {
-		c.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(c.GetName(), fmt.Errorf("could not create temp file: %w", err))
 		return
 	}
+	// Track the temp file straight away so that it is cleaned up even if the
+	// download below fails (e.g. when the command is retried).
+	context.AddTempFile(tempFile.Name())
 
-	// Use io.Copy to stream the content from the GCS reader to the local temp file.
+	// Use io.Copy to stream the content from the blob reader to the local temp file.
 	// This is memory-efficient because it streams the data in chunks rather than
 	// loading the entire file into memory at once.
 	written, err := io.Copy(tempFile, reader)
 	if err != nil {
-		c.GetErrorCounter().Add(context.GetContext(), 1)
-		log.Printf("failed to copy GCS object to local file, %d bytes written: %v\n", written, err)
-		context.AddError(c.GetName(), err)
+		context.AddError(c.GetName(), fmt.Errorf("failed to copy object to local file, %d bytes written: %w", written, err))
 		// It's good practice to close the temp file handle here before returning.
 		_ = tempFile.Close()
 		return
@@ -123,11 +120,6 @@ func (c *GCSToTempFile) Execute(context cor.Context) {
 	// The copy is complete, so we close the file handle to ensure data is flushed to disk.
 	_ = tempFile.Close()
 
-	c.GetSuccessCounter().Add(context.GetContext(), 1)
-	log.Printf("Successfully downloaded gs://%s/%s to local file %s (%d bytes)", msg.Bucket, msg.Name, tempFile.Name(), written)
-	// Add the path of the new temp file to the context's list of tracked temp files.
-	// This allows the main workflow manager to clean them up automatically at the end.
-	context.AddTempFile(tempFile.Name())
 	// Place the temp file's path into the context's output parameter, making it
 	// the default input for the next command in the chain.
 	context.Add(c.GetOutputParam(), tempFile.Name())
@@ -27,13 +27,15 @@
 //     a) A `model.MediaSummary` struct.
 //     b) A slice of strings, where each string is a JSON representation of a `model.Scene`.
 //  2. Joins the scene JSON strings into a single valid JSON array string.
-//  3. Unmarshals (parses) this JSON array into a slice of `model.Scene` structs.
+//  3. Unmarshals (parses) this JSON array into a slice of `model.Scene` structs,
+//     and sets the token usage and cost of each scene from `SceneUsageKey`.
 //  4. Sorts the scenes chronologically based on their start time. This is
 //     important because scene extraction may have happened in parallel and out of order.
 //  5. Re-sequences the scenes by assigning a new sequence number after sorting.
 //  6. Creates a new `model.Media` object (which also generates a UUID for the ID).
 //  7. Populates the `model.Media` object with all the data from the summary
-//     and the newly sorted and sequenced scenes.
+//     and the newly sorted and sequenced scenes, and with the usage of the
+//     summary (`SummaryUsageKey`) and of the scenes, if they were recorded.
 //  8. Places the final, assembled `model.Media` object back into the context
 //     for the next command (likely persistence) to use.
 package commands
@@ -45,6 +47,7 @@ import (
 	"strings"
 	"time"
 
+	"cloud.google.com/go/bigquery"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
 )
@@ -95,14 +98,30 @@ func (m *MediaAssembly) IsExecutable(context cor.Context) bool {
 		context.Get(m.sceneParam) != nil
 }
 
+// InputKeys declares the keys read by Execute (see `cor.KeyDeclarer`).
+func (m *MediaAssembly) InputKeys() []string {
+	return []string{m.summaryParam, m.sceneParam}
+}
+
+// OutputKeys declares the keys written by Execute (see `cor.KeyDeclarer`).
+func (m *MediaAssembly) OutputKeys() []string {
+	return []string{m.mediaObjectParam, cor.CtxOut}
+}
+
 // Execute performs the assembly logic.
 //
 // Inputs:
 //   - context: The shared `cor.Context` for this workflow execution.
 func (m *MediaAssembly) Execute(context cor.Context) {
 	// Retrieve the inputs from the context.
-	summary := context.Get(m.summaryParam).(*model.MediaSummary)
-	jsonScenes := context.Get(m.sceneParam).([]string)
+	summary, ok := cor.NewKey[*model.MediaSummary](m.summaryParam).MustGet(context, m.GetName())
+	if !ok {
+		return
+	}
+	jsonScenes, ok := cor.NewKey[[]string](m.sceneParam).MustGet(context, m.GetName())
+	if !ok {
+		return
+	}
 
 	// The scene data comes in as a slice of JSON strings: `["{...}", "{...}"]`.
 	// We join them with a comma and wrap them in brackets to create a valid JSON array string: `"[ {...} , {...} ]"`.
@@ -112,11 +131,21 @@ func (m *MediaAssembly) Execute(context cor.Context) {
 	scenes := make([]*model.Scene, 0)
 	sceneErr := json.Unmarshal([]byte(sceneValues), &scenes)
 	if sceneErr != nil {
-		m.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(m.GetName(), sceneErr)
 		return
 	}
 
+	// Record what generating each scene cost. The usage is in the order of
+	// the scene strings, so it is applied before sorting.
+	sceneUsage, _ := SceneUsageKey(m.sceneParam).Get(context)
+	if len(sceneUsage) == len(scenes) {
+		for i, usage := range sceneUsage {
+			scenes[i].TokensToGenerate = bigquery.NullInt64{Int64: int64(usage.InputTokens), Valid: true}
+			scenes[i].TokensGenerated = bigquery.NullInt64{Int64: int64(usage.OutputTokens), Valid: true}
+			scenes[i].Cost = bigquery.NullFloat64{Float64: usage.Cost, Valid: true}
+		}
+	}
+
 	// Sort the scenes chronologically. This is crucial because scene extraction
 	// may have happened in parallel, so the results are not guaranteed to be in order.
 	sort.Slice(scenes, func(i, j int) bool {
@@ -146,8 +175,19 @@ func (m *MediaAssembly) Execute(context cor.Context) {
 	media.Rating = summary.Rating
 	media.Cast = append(media.Cast, summary.Cast...)
 	media.Scenes = append(media.Scenes, scenes...)
-
-	m.GetSuccessCounter().Add(context.GetContext(), 1)
+	if usage, ok := SummaryUsageKey.Get(context); ok && usage != nil {
+		media.Usage = &model.MediaUsage{Summary: *usage}
+		media.Usage.Total.Add(*usage)
+	}
+	if len(sceneUsage) > 0 && len(sceneUsage) == len(scenes) {
+		if media.Usage == nil {
+			media.Usage = &model.MediaUsage{}
+		}
+		for _, usage := range sceneUsage {
+			media.Usage.Scenes.Add(*usage)
+		}
+		media.Usage.Total.Add(media.Usage.Scenes)
+	}
 
 	// Place the fully assembled Media object into the specified output parameter in the context.
 	context.Add(m.mediaObjectParam, media)
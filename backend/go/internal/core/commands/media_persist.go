@@ -0,0 +1,132 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package commands provides the concrete implementations of the Chain of
+// Responsibility (COR) pattern's Command interface. This file defines the
+// command responsible for persisting the final media object to the media
+// repository (BigQuery or SQLite, see `cloud.MediaRepository`).
+//
+// Logic Flow:
+// This command is a crucial persistence step in the workflow. It takes the
+// fully assembled `model.Media` struct, which contains all the extracted
+// metadata (summary, cast, scenes, etc.), and saves it in the media
+// repository. This makes the data available for later querying and for the
+// asynchronous embedding generation process.
+//
+//  1. It retrieves the complete `model.Media` object from the context.
+//  2. It saves the object with `MediaRepository.SaveMedia`. The BigQuery
+//     repository streams it into the media table with an `Inserter`; the SQLite
+//     repository stores it as a document.
+//  3. It records any error on the context; metrics and logging are applied by
+//     the chain's interceptors (see `cor.DefaultInterceptors`).
+//  4. It records the saved media's ID as an undo record, so that `Compensate`
+//     can delete it if a later step of the workflow fails.
+package commands
+
+import (
+	"log"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+)
+
+// MediaPersist is a command that saves a Media object to the media repository.
+type MediaPersist struct {
+	cor.BaseCommand
+	repository cloud.MediaRepository // The repository the media is saved to.
+	mediaParam string                // The context key for the input `model.Media` object.
+}
+
+// NewMediaPersist is the constructor for the MediaPersist command.
+//
+// Inputs:
+//   - name: A string name for this command instance.
+//   - repository: The media repository.
+//   - mediaParam: The name of the context parameter holding the `model.Media` object to be saved.
+//
+// Outputs:
+//   - *MediaPersist: A pointer to the newly instantiated command.
+func NewMediaPersist(name string, repository cloud.MediaRepository, mediaParam string) *MediaPersist {
+	return &MediaPersist{BaseCommand: *cor.NewBaseCommand(name), repository: repository, mediaParam: mediaParam}
+}
+
+// IsExecutable overrides the default behavior to ensure that the Media object
+// to be persisted exists in the context before execution.
+//
+// Inputs:
+//   - context: The shared `cor.Context` for this workflow execution.
+//
+// Outputs:
+//   - bool: True if the Media object exists in the context, otherwise false.
+func (s *MediaPersist) IsExecutable(context cor.Context) bool {
+	return context != nil && context.Get(s.mediaParam) != nil
+}
+
+// InputKeys declares the keys read by Execute (see `cor.KeyDeclarer`).
+func (s *MediaPersist) InputKeys() []string {
+	return []string{s.mediaParam}
+}
+
+// OutputKeys declares the keys written by Execute (see `cor.KeyDeclarer`).
+func (s *MediaPersist) OutputKeys() []string {
+	return []string{cor.CtxOut}
+}
+
+// Execute saves the media object in the repository.
+//
+// Inputs:
+//   - context: The shared `cor.Context` for this workflow execution.
+func (s *MediaPersist) Execute(context cor.Context) {
+	// Retrieve the fully assembled Media object from the context.
+	media, ok := cor.NewKey[*model.Media](s.mediaParam).MustGet(context, s.GetName())
+	if !ok {
+		return
+	}
+
+	if err := s.repository.SaveMedia(context.GetContext(), media); err != nil {
+		context.AddError(s.GetName(), err)
+		return
+	}
+
+	// Remember the saved media so that a failure later in the workflow can remove it.
+	cor.SetUndo(context, s.GetName(), media.Id)
+
+	// On success, pass the media object to the next command.
+	context.Add(cor.CtxOut, media)
+}
+
+// Compensate deletes the media saved by Execute. BigQuery rejects DML on rows
+// that are still in the streaming buffer (roughly the first few minutes after
+// insertion); with a tombstone table, the repository hides such rows behind a
+// tombstone instead. Without one, the failure is recorded on the context so
+// the leftover row can be found and cleaned up.
+//
+// Inputs:
+//   - context: The shared `cor.Context` for this workflow execution.
+//
+// Outputs:
+//   - bool: True if Execute had saved media, even if its deletion failed.
+func (s *MediaPersist) Compensate(context cor.Context) bool {
+	id, ok := cor.TakeUndo[string](context, s.GetName())
+	if !ok {
+		return false
+	}
+	if err := s.repository.DeleteMedia(context.GetContext(), id); err != nil {
+		context.AddError(s.GetName()+"-compensate", err)
+		return true
+	}
+	log.Printf("Compensated insert by deleting media %s", id)
+	return true
+}
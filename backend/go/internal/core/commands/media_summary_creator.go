@@ -36,13 +36,15 @@
 //     model in a multi-modal request.
 //  5. It receives the raw JSON string response from the model.
 //  6. It places this JSON string into the context for the next command in the
-//     chain (`MediaSummaryJsonToStruct`) to parse and process.
+//     chain (`MediaSummaryJsonToStruct`) to parse and process, and the token
+//     usage of the request under `SummaryUsageKey` for `MediaAssembly`.
 package commands
 
 import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"text/template"
 
 	"go.opentelemetry.io/otel/metric"
@@ -53,16 +55,25 @@ import (
 	"google.golang.org/genai"
 )
 
+// SummaryUsageKey holds the token usage, and estimated cost, of the request
+// that generated the summary.
+var SummaryUsageKey = cor.NewKey[*model.TokenUsage]("__SUMMARY_USAGE__")
+
+// newTokenUsage converts the usage of a generation to its stored form.
+func newTokenUsage(modelName string, usage cloud.Usage) *model.TokenUsage {
+	return &model.TokenUsage{Model: modelName, InputTokens: usage.InputTokens, OutputTokens: usage.OutputTokens, Cost: usage.Cost}
+}
+
 // MediaSummaryCreator is a command that uses a generative model to create a
 // summary and extract metadata from a video file.
 type MediaSummaryCreator struct {
 	cor.BaseCommand
-	config                   *cloud.Config                      // Application configuration, used for prompt templating.
-	generativeAIModel        *cloud.QuotaAwareGenerativeAIModel // The rate-limited generative model client.
-	template                 *template.Template                 // The Go template for building the prompt.
-	geminiInputTokenCounter  metric.Int64Counter                // OTel counter for input tokens.
-	geminiOutputTokenCounter metric.Int64Counter                // OTel counter for output tokens.
-	geminiRetryCounter       metric.Int64Counter                // OTel counter for retries.
+	config                   *cloud.Config         // Application configuration, used for prompt templating.
+	generativeAIModel        cloud.GenerativeModel // The generative model, of any provider.
+	template                 *template.Template    // The Go template for building the prompt.
+	geminiInputTokenCounter  metric.Int64Counter   // OTel counter for input tokens.
+	geminiOutputTokenCounter metric.Int64Counter   // OTel counter for output tokens.
+	geminiRetryCounter       metric.Int64Counter   // OTel counter for retries.
 }
 
 // NewMediaSummaryCreator is the constructor for the MediaSummaryCreator command.
@@ -70,7 +81,7 @@ type MediaSummaryCreator struct {
 // Inputs:
 //   - name: A string name for this command instance.
 //   - config: The application's configuration object.
-//   - generativeAIModel: The rate-limited wrapper for the generative model client.
+//   - generativeAIModel: The generative model (e.g., the rate-limited Vertex model).
 //   - template: A parsed Go template for the prompt.
 //
 // Outputs:
@@ -78,7 +89,7 @@ type MediaSummaryCreator struct {
 func NewMediaSummaryCreator(
 	name string,
 	config *cloud.Config,
-	generativeAIModel *cloud.QuotaAwareGenerativeAIModel,
+	generativeAIModel cloud.GenerativeModel,
 	template *template.Template) *MediaSummaryCreator {
 
 	out := &MediaSummaryCreator{
@@ -106,10 +117,16 @@ func (t *MediaSummaryCreator) GenerateParams(_ cor.Context) map[string]interface
 	params := make(map[string]interface{})
 
 	// Create a string representation of the media categories from the config
-	// to help the model choose a valid category. Example: "trailer - A short...; movie - A feature..."
+	// to help the model choose a valid category. Example: "movie - A feature...; trailer - A short..."
+	// The categories are sorted, so that the same media always gets the same prompt.
+	keys := make([]string, 0, len(t.config.Categories))
+	for key := range t.config.Categories {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 	catStr := ""
-	for key, cat := range t.config.Categories {
-		catStr += fmt.Sprintf("%s - %s; ", key, cat.Definition)
+	for _, key := range keys {
+		catStr += fmt.Sprintf("%s - %s; ", key, t.config.Categories[key].Definition)
 	}
 	params["CATEGORIES"] = catStr
 
@@ -120,57 +137,47 @@ func (t *MediaSummaryCreator) GenerateParams(_ cor.Context) map[string]interface
 	return params
 }
 
+// OutputKeys declares the keys written by Execute (see `cor.KeyDeclarer`).
+func (t *MediaSummaryCreator) OutputKeys() []string {
+	return []string{t.GetOutputParam(), SummaryUsageKey.Name()}
+}
+
 // Execute contains the core logic for prompting the generative model.
 //
 // Inputs:
 //   - context: The shared `cor.Context` for this workflow execution.
 func (t *MediaSummaryCreator) Execute(context cor.Context) {
 	// Retrieve the `genai.File` object (the handle to the media file in the File Service) from the context.
-	mediaFile := context.Get(t.GetInputParam()).(*genai.FileData)
+	mediaFile, ok := cor.NewKey[*genai.FileData](t.GetInputParam()).MustGet(context, t.GetName())
+	if !ok {
+		return
+	}
 
 	// Use a buffer to execute the Go template, substituting the dynamic params.
 	var buffer bytes.Buffer
 	err := t.template.Execute(&buffer, t.GenerateParams(context))
 	if err != nil {
-		t.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(t.GetName(), fmt.Errorf("failed to execute prompt template: %w", err))
 		return
 	}
 
-	// Muziris Change
-	// // Prepare the parts for the multi-modal request to Gemini.
-	// parts := make([]genai.Part, 0)
-	// // Part 1: The media file itself, referenced by its URI.
-	// parts = append(parts, cloud.NewFileData(mediaFile.URI, mediaFile.MIMEType))
-	// // Part 2: The text prompt generated from the template.
-	// parts = append(parts, cloud.NewTextPart(buffer.String()))
-
-	//Muziris Change
-	// Prepare the parts for the multi-modal request to Gemini.
-	contents := []*genai.Content{
-		{Parts: []*genai.Part{
-			{Text: buffer.String()},
-			{FileData: &genai.FileData{
-				FileURI:  mediaFile.FileURI,
-				MIMEType: mediaFile.MIMEType,
-			}},
-		},
-			Role: "user"},
+	// Prepare the multi-modal request: the text prompt generated from the
+	// template, followed by the media file referenced by its URI.
+	request := &cloud.GenerationRequest{
+		Text:  buffer.String(),
+		Media: []cloud.MediaPart{{URI: mediaFile.FileURI, MIMEType: mediaFile.MIMEType}},
 	}
 
 	// Call the helper function to send the request to the model. This helper
 	// encapsulates retry logic and telemetry updates.
-	// Muziris Change
-	out, err := cloud.GenerateMultiModalResponse(context.GetContext(), t.geminiInputTokenCounter, t.geminiOutputTokenCounter, t.geminiRetryCounter, 0, t.generativeAIModel, contents)
-	fmt.Print("\nThe output of the GnerateMultiModalResponse function is:", out)
+	out, usage, err := cloud.GenerateMultiModalResponse(context.GetContext(), t.geminiInputTokenCounter, t.geminiOutputTokenCounter, t.geminiRetryCounter, 0, t.generativeAIModel, request)
 	if err != nil {
-		t.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(t.GetName(), fmt.Errorf("gemini request failed: %w", err))
 		return
 	}
 
-	// On success, update the success counter and place the raw JSON string
+	// On success, place the raw JSON string
 	// response into the context for the next command.
-	t.GetSuccessCounter().Add(context.GetContext(), 1)
 	context.Add(t.GetOutputParam(), out)
+	SummaryUsageKey.Set(context, newTokenUsage(t.generativeAIModel.Name(), usage))
 }
@@ -66,23 +66,38 @@ func NewMediaSummaryJsonToStruct(name string, outputParamName string) *MediaSumm
 	return &out
 }
 
+// InputKeys declares the keys read by Execute (see `cor.KeyDeclarer`).
+func (s *MediaSummaryJsonToStruct) InputKeys() []string {
+	return []string{s.GetInputParam(), cloud.GCSObjectKey.Name()}
+}
+
+// OutputKeys declares the keys written by Execute (see `cor.KeyDeclarer`).
+func (s *MediaSummaryJsonToStruct) OutputKeys() []string {
+	return []string{s.GetOutputParam(), cor.CtxOut}
+}
+
 // Execute contains the core logic for parsing the JSON and enriching the data.
 //
 // Inputs:
 //   - context: The shared `cor.Context` for this workflow execution.
 func (s *MediaSummaryJsonToStruct) Execute(context cor.Context) {
 	// Retrieve the raw JSON string from the context, which was the output of the previous command.
-	in := context.Get(s.GetInputParam()).(string)
+	in, ok := cor.NewKey[string](s.GetInputParam()).MustGet(context, s.GetName())
+	if !ok {
+		return
+	}
 
 	// Retrieve the GCSObject which contains details about the original file location.
-	gcsFile := context.Get(cloud.GetGCSObjectName()).(*cloud.GCSObject)
+	gcsFile, ok := cloud.GCSObjectKey.MustGet(context, s.GetName())
+	if !ok {
+		return
+	}
 	// Muziris Change: In some cases where the model cannot find the release date, the release date field is populated
 	// with a string "Not Specified" or "N/A". However the MediaSummary Json structure expecs an int and so does BQ.
 	// Easy fix is to deterministically take the field and if its a string set it to int 0.
 	// Step 1: Unmarshal into a generic map to inspect the data.
 	var rawData map[string]interface{}
 	if err := json.Unmarshal([]byte(in), &rawData); err != nil {
-		s.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(s.GetName(), fmt.Errorf("failed to pre-parse media summary JSON: %w", err))
 		return
 	}
@@ -97,7 +112,6 @@ func (s *MediaSummaryJsonToStruct) Execute(context cor.Context) {
 	// Step 3: Marshal the corrected map back into a JSON byte slice.
 	correctedJSON, err := json.Marshal(rawData)
 	if err != nil {
-		s.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(s.GetName(), fmt.Errorf("failed to re-marshal corrected data: %w", err))
 		return
 	}
@@ -110,14 +124,10 @@ func (s *MediaSummaryJsonToStruct) Execute(context cor.Context) {
 	err = json.Unmarshal(correctedJSON, &doc)
 	if err != nil {
 		// If parsing fails, it's a critical error. Record it and stop.
-		s.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(s.GetName(), fmt.Errorf("failed to unmarshal media summary JSON: %w", err))
 		return
 	}
 
-	// If parsing is successful, increment the success counter.
-	s.GetSuccessCounter().Add(context.GetContext(), 1)
-
 	// Enrich the data: construct the full, direct-access URL to the media file in GCS.
 	// The model doesn't know this URL, so we construct it here using the bucket and object name.
 	doc.MediaUrl = fmt.Sprintf("https://storage.mtls.cloud.google.com/%s/%s", gcsFile.Bucket, gcsFile.Name)
@@ -60,6 +60,12 @@ func NewMediaTriggerToGCSObject(name string) *MediaTriggerToGCSObject {
 	return &MediaTriggerToGCSObject{BaseCommand: *cor.NewBaseCommand(name)}
 }
 
+// OutputKeys declares the keys written by Execute (see `cor.KeyDeclarer`).
+// The parsed object is also stored under `cloud.GCSObjectKey` for later commands.
+func (c *MediaTriggerToGCSObject) OutputKeys() []string {
+	return []string{cloud.GCSObjectKey.Name(), c.GetOutputParam()}
+}
+
 // Execute contains the core logic for parsing the GCS notification message.
 //
 // Inputs:
@@ -67,7 +73,10 @@ func NewMediaTriggerToGCSObject(name string) *MediaTriggerToGCSObject {
 //     the raw message data in the input parameter.
 func (c *MediaTriggerToGCSObject) Execute(context cor.Context) {
 	// Retrieve the raw JSON message string from the context.
-	in := context.Get(c.GetInputParam()).(string)
+	in, ok := cor.NewKey[string](c.GetInputParam()).MustGet(context, c.GetName())
+	if !ok {
+		return
+	}
 
 	// Declare a variable of the target type to hold the unmarshaled data.
 	var out cloud.GCSPubSubNotification
@@ -76,14 +85,10 @@ func (c *MediaTriggerToGCSObject) Execute(context cor.Context) {
 	err := json.Unmarshal([]byte(in), &out)
 	if err != nil {
 		// If parsing fails, it's a critical error for the workflow.
-		c.GetErrorCounter().Add(context.GetContext(), 1)
 		context.AddError(c.GetName(), fmt.Errorf("failed to unmarshal GCS notification: %w", err))
 		return
 	}
 
-	// If successful, increment the success counter for telemetry.
-	c.GetSuccessCounter().Add(context.GetContext(), 1)
-
 	// Create a new, simplified GCSObject containing only the essential information
 	// needed by downstream commands.
 	msg := &cloud.GCSObject{Bucket: out.Bucket, Name: out.Name, MIMEType: out.ContentType}
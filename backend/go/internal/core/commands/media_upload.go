@@ -85,6 +85,21 @@ func GetVideoUploadFileParameterName() string {
 	return "__VIDEO_UPLOAD_FILE__"
 }
 
+// VideoUploadFileKey is the typed accessor for the `genai.FileData` stored
+// under GetVideoUploadFileParameterName.
+var VideoUploadFileKey = cor.NewKey[*genai.FileData](GetVideoUploadFileParameterName())
+
+// InputKeys declares the keys read by Execute (see `cor.KeyDeclarer`).
+func (v *MediaUpload) InputKeys() []string {
+	return []string{cloud.GCSObjectKey.Name()}
+}
+
+// OutputKeys declares the keys written by Execute (see `cor.KeyDeclarer`).
+// The file handle is also stored under `VideoUploadFileKey` for later commands.
+func (v *MediaUpload) OutputKeys() []string {
+	return []string{VideoUploadFileKey.Name(), v.GetOutputParam()}
+}
+
 // Execute contains the core logic for uploading the file and polling for its status.
 //
 // Inputs:
@@ -96,9 +111,11 @@ func GetVideoUploadFileParameterName() string {
 // this function will be a shell that returns the GCS object name and Mime type.
 func (v *MediaUpload) Execute(context cor.Context) {
 	// Retrieve the original GCS object details from the context to get metadata.
-	gcsFile := context.Get(cloud.GetGCSObjectName()).(*cloud.GCSObject)
+	gcsFile, ok := cloud.GCSObjectKey.MustGet(context, v.GetName())
+	if !ok {
+		return
+	}
 	GCSFileLink := fmt.Sprintf("gs://%s/%s", gcsFile.Bucket, gcsFile.Name)
-	fmt.Print("\nThe GCS filename for media upload is: ", GCSFileLink)
 	var GCSFileStruct genai.FileData
 	GCSFileStruct.FileURI = GCSFileLink
 	GCSFileStruct.MIMEType = gcsFile.MIMEType
@@ -136,9 +153,6 @@ func (v *MediaUpload) Execute(context cor.Context) {
 	// 	return
 	// }
 
-	// Once the loop completes and the file is active, record the success.
-	v.GetSuccessCounter().Add(context.GetContext(), 1)
-
 	// Store the `genai.File` handle in the context using the canonical key.
 	context.Add(GetVideoUploadFileParameterName(), &GCSFileStruct)
 	// Also place it in the default output parameter for the next command in the chain.
@@ -43,7 +43,8 @@
 //     finish (using a `sync.WaitGroup`) and then collects all the generated scene
 //     scripts from the `results` channel into a single slice.
 //  6. This slice of scene scripts is then placed back into the context for the
-//     final `MediaAssembly` command to use.
+//     final `MediaAssembly` command to use, along with the token usage of each
+//     script, in the same order, under `SceneUsageKey`.
 package commands
 
 import (
@@ -66,22 +67,28 @@ import (
 	"google.golang.org/genai"
 )
 
+// SceneUsageKey returns the key holding the token usage, and estimated cost,
+// of the scene scripts stored under sceneParam, in the same order.
+func SceneUsageKey(sceneParam string) cor.Key[[]*model.TokenUsage] {
+	return cor.NewKey[[]*model.TokenUsage](sceneParam + "__USAGE__")
+}
+
 // SceneExtractor is a command that processes scene timestamps in parallel to generate detailed descriptions.
 type SceneExtractor struct {
 	cor.BaseCommand
-	generativeAIModel        *cloud.QuotaAwareGenerativeAIModel // The rate-limited generative model client.
-	promptTemplate           *template.Template                 // The Go template for generating the scene-specific prompt.
-	numberOfWorkers          int                                // The number of concurrent workers to spawn.
-	geminiInputTokenCounter  metric.Int64Counter                // OTel counter for input tokens.
-	geminiOutputTokenCounter metric.Int64Counter                // OTel counter for output tokens.
-	geminiRetryCounter       metric.Int64Counter                // OTel counter for retries.
+	generativeAIModel        cloud.GenerativeModel // The generative model, of any provider.
+	promptTemplate           *template.Template    // The Go template for generating the scene-specific prompt.
+	numberOfWorkers          int                   // The number of concurrent workers to spawn.
+	geminiInputTokenCounter  metric.Int64Counter   // OTel counter for input tokens.
+	geminiOutputTokenCounter metric.Int64Counter   // OTel counter for output tokens.
+	geminiRetryCounter       metric.Int64Counter   // OTel counter for retries.
 }
 
 // NewSceneExtractor is the constructor for the SceneExtractor command.
 //
 // Inputs:
 //   - name: A string name for this command instance.
-//   - model: The client for the generative AI model.
+//   - model: The generative model (e.g., the rate-limited Vertex model).
 //   - prompt: The parsed Go template for the prompt.
 //   - numberOfWorkers: The size of the worker pool for concurrent processing.
 //
@@ -89,7 +96,7 @@ type SceneExtractor struct {
 //   - *SceneExtractor: A pointer to the newly instantiated command.
 func NewSceneExtractor(
 	name string,
-	model *cloud.QuotaAwareGenerativeAIModel,
+	model cloud.GenerativeModel,
 	prompt *template.Template,
 	numberOfWorkers int) *SceneExtractor {
 	out := &SceneExtractor{
@@ -113,14 +120,30 @@ func (s *SceneExtractor) IsExecutable(context cor.Context) bool {
 		context.Get(GetVideoUploadFileParameterName()) != nil
 }
 
+// InputKeys declares the keys read by Execute (see `cor.KeyDeclarer`).
+func (s *SceneExtractor) InputKeys() []string {
+	return []string{s.GetInputParam(), VideoUploadFileKey.Name()}
+}
+
+// OutputKeys declares the keys written by Execute (see `cor.KeyDeclarer`).
+func (s *SceneExtractor) OutputKeys() []string {
+	return []string{s.GetOutputParam(), SceneUsageKey(s.GetOutputParam()).Name(), cor.CtxOut}
+}
+
 // Execute orchestrates the parallel processing of scene extractions.
 //
 // Inputs:
 //   - context: The shared `cor.Context` for this workflow execution.
 func (s *SceneExtractor) Execute(context cor.Context) {
 	// Retrieve necessary data from the context.
-	summary := context.Get(s.GetInputParam()).(*model.MediaSummary)
-	videoFile := context.Get(GetVideoUploadFileParameterName()).(*genai.FileData)
+	summary, ok := cor.NewKey[*model.MediaSummary](s.GetInputParam()).MustGet(context, s.GetName())
+	if !ok {
+		return
+	}
+	videoFile, ok := VideoUploadFileKey.MustGet(context, s.GetName())
+	if !ok {
+		return
+	}
 
 	// --- Prepare data for the prompt template ---
 	exampleScene := model.GetExampleScene()
@@ -172,29 +195,28 @@ func (s *SceneExtractor) Execute(context cor.Context) {
 
 	// --- Aggregate Results ---
 	sceneData := make([]string, 0, len(summary.SceneTimeStamps))
+	sceneUsage := make([]*model.TokenUsage, 0, len(summary.SceneTimeStamps))
 	// Range over the results channel to collect all the responses.
 	for r := range results {
 		if r.err != nil {
-			s.GetErrorCounter().Add(context.GetContext(), 1)
 			context.AddError(s.GetName(), r.err)
 		} else {
-			// Append the successful scene data to the list.
+			// Append the successful scene data, and its usage, to the lists.
 			sceneData = append(sceneData, r.value)
+			sceneUsage = append(sceneUsage, newTokenUsage(s.generativeAIModel.Name(), r.usage))
 		}
 	}
 
-	if !context.HasErrors() {
-		s.GetSuccessCounter().Add(context.GetContext(), 1)
-	}
-
-	// Place the final list of scene strings into the context.
+	// Place the final list of scene strings, and their usage, into the context.
 	context.Add(s.GetOutputParam(), sceneData)
+	SceneUsageKey(s.GetOutputParam()).Set(context, sceneUsage)
 	context.Add(cor.CtxOut, sceneData)
 }
 
 // SceneResponse is a simple struct to pass results or errors back from a worker.
 type SceneResponse struct {
 	value string
+	usage cloud.Usage // The token usage of the request that generated the value.
 	err   error
 }
 
@@ -207,8 +229,8 @@ type SceneJob struct {
 	geminiRetryCounter       metric.Int64Counter
 	timeSpan                 *model.TimeSpan
 	span                     trace.Span
-	contents                 []*genai.Content
-	model                    *cloud.QuotaAwareGenerativeAIModel
+	request                  *cloud.GenerationRequest
+	model                    cloud.GenerativeModel
 	err                      error
 }
 
@@ -231,7 +253,7 @@ func CreateJob(
 	exampleText string,
 	template template.Template,
 	videoFile *genai.FileData,
-	model *cloud.QuotaAwareGenerativeAIModel,
+	model cloud.GenerativeModel,
 	timeSpan *model.TimeSpan,
 ) *SceneJob {
 	// Start a new OTel span for this specific scene processing task.
@@ -258,25 +280,10 @@ func CreateJob(
 	}
 	tsPrompt := doc.String()
 
-	//Muziris Change: To accomodate how the new genai golan libaries work
-
-	// // Assemble the multimodal parts for the Gemini API call.
-	// parts := []*genai.Part {
-	// 	cloud.NewFileData(videoFile.URI, videoFile.MIMEType),
-	// 	cloud.NewTextPart(tsPrompt),
-	// }
-
-	//Muziris Change
-	// Prepare the parts for the multi-modal request to Gemini.
-	contents := []*genai.Content{
-		{Parts: []*genai.Part{
-			{Text: tsPrompt},
-			{FileData: &genai.FileData{
-				FileURI:  videoFile.FileURI,
-				MIMEType: videoFile.MIMEType,
-			}},
-		},
-			Role: "user"},
+	// Prepare the multi-modal request: the scene prompt followed by the video.
+	request := &cloud.GenerationRequest{
+		Text:  tsPrompt,
+		Media: []cloud.MediaPart{{URI: videoFile.FileURI, MIMEType: videoFile.MIMEType}},
 	}
 
 	return &SceneJob{
@@ -287,7 +294,7 @@ func CreateJob(
 		geminiRetryCounter:       geminiRetryCounter,
 		timeSpan:                 timeSpan,
 		span:                     sceneSpan,
-		contents:                 contents,
+		request:                  request,
 		model:                    model,
 	}
 }
@@ -312,7 +319,7 @@ func sceneWorker(jobs <-chan *SceneJob, results chan<- *SceneResponse, wg *sync.
 		}
 
 		// Call the generative model to get the scene description.
-		out, err := cloud.GenerateMultiModalResponse(j.ctx, j.geminiInputTokenCounter, j.geminiOutputTokenCounter, j.geminiRetryCounter, 0, j.model, j.contents)
+		out, usage, err := cloud.GenerateMultiModalResponse(j.ctx, j.geminiInputTokenCounter, j.geminiOutputTokenCounter, j.geminiRetryCounter, 0, j.model, j.request)
 		if err != nil {
 			j.Close(codes.Error, "scene extract failed")
 			results <- &SceneResponse{err: err}
@@ -321,7 +328,7 @@ func sceneWorker(jobs <-chan *SceneJob, results chan<- *SceneResponse, wg *sync.
 
 		// Only add the result if the model returned non-empty content.
 		if len(strings.TrimSpace(out)) > 0 && out != "{}" {
-			results <- &SceneResponse{value: out, err: nil}
+			results <- &SceneResponse{value: out, usage: usage, err: nil}
 		}
 
 		j.Close(codes.Ok, "completed scene")
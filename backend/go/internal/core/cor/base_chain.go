@@ -41,20 +41,53 @@
 //  7. **Completion**: Once all commands are run (or the chain is stopped by an error),
 //     the main OpenTelemetry span for the chain is closed and its status is set to
 //     success or failure based on the final state of the context.
+//
+// Compensation:
+// When the chain fails and `continueOnFailure` is false, commands implementing
+// `Compensator` are asked to undo their side effects, in reverse order. See
+// compensation.go.
+//
+// Checkpoints:
+// When configured with `WithCheckpoints`, the chain saves the writes of every
+// successful command to a `CheckpointStore` and, on a later run with the same
+// run ID, replays them instead of executing the command again. See checkpoint.go.
+//
+// Interceptors:
+// Commands are executed through the interceptors registered with `Use`, which
+// add metrics, logging, timing and panic recovery around every command. Nested
+// chains inherit them. See interceptor.go.
+//
+// Dry run:
+// When configured with `DryRun(true)`, the chain executes none of its commands.
+// Instead it stores an `ExecutionPlan` under `CtxPlan` describing what it would
+// do. `Plan` produces the same report on demand. See plan.go.
 package cor
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// RunIDFunc derives the checkpoint run ID from the context at the start of a
+// chain. An empty run ID disables checkpointing for that run.
+type RunIDFunc func(context Context) string
+
 // BaseChain is the default implementation of the Chain interface. It holds a slice
 // of commands to be executed sequentially.
 type BaseChain struct {
 	BaseCommand
-	continueOnFailure bool      // A flag that determines if the chain should continue executing subsequent commands after one fails.
-	commands          []Command // The ordered list of commands that this chain will execute.
+	continueOnFailure bool            // A flag that determines if the chain should continue executing subsequent commands after one fails.
+	commands          []Command       // The ordered list of commands that this chain will execute.
+	checkpoints       CheckpointStore // Where progress is saved; nil disables checkpointing.
+	runID             RunIDFunc       // Derives the checkpoint run ID for an execution.
+	dryRun            bool            // If true, Execute only plans the run.
+	interceptors      []Interceptor   // Wrap the execution of every command, outermost first.
 }
 
 // NewBaseChain is the constructor for BaseChain.
@@ -94,6 +127,64 @@ func (c *BaseChain) AddCommand(command Command) Chain {
 	return c
 }
 
+// WithCheckpoints is a builder method that makes the chain resumable. After each
+// successful command its writes are saved to the store under the run ID, and a
+// later execution with the same run ID skips the commands that already completed.
+//
+// Inputs:
+//   - store: The store in which to keep checkpoints.
+//   - runID: A function that derives the run ID from the initial context.
+//
+// Outputs:
+//   - *BaseChain: The chain instance, allowing for fluent method chaining.
+func (c *BaseChain) WithCheckpoints(store CheckpointStore, runID RunIDFunc) *BaseChain {
+	c.checkpoints = store
+	c.runID = runID
+	return c
+}
+
+// Use is a builder method that registers interceptors, which wrap the execution
+// of every command in this chain and in the chains nested in it.
+//
+// Inputs:
+//   - interceptors: The interceptors to add, outermost first.
+//
+// Outputs:
+//   - *BaseChain: The chain instance, allowing for fluent method chaining.
+func (c *BaseChain) Use(interceptors ...Interceptor) *BaseChain {
+	c.interceptors = append(c.interceptors, interceptors...)
+	return c
+}
+
+// DryRun is a builder method that switches the chain to plan-only mode. A dry
+// run calls no command's Execute; it stores the chain's `ExecutionPlan` under
+// `CtxPlan` and logs it.
+//
+// Inputs:
+//   - dryRun: True to plan instead of executing.
+//
+// Outputs:
+//   - *BaseChain: The chain instance, allowing for fluent method chaining.
+func (c *BaseChain) DryRun(dryRun bool) *BaseChain {
+	c.dryRun = dryRun
+	return c
+}
+
+// Plan walks the chain against a simulated copy of the context and reports the
+// commands that would run, the keys they would read and write, which of them
+// would be skipped and which keys are read without being produced. The given
+// context is not modified.
+//
+// Inputs:
+//   - chCtx: The context the chain would be executed with, usually holding the
+//     initial `CtxIn`.
+//
+// Outputs:
+//   - *ExecutionPlan: The plan, including diagnostics.
+func (c *BaseChain) Plan(chCtx Context) *ExecutionPlan {
+	return newPlan(c, chCtx)
+}
+
 // IsExecutable checks if the chain can be executed. For a chain, this simply means
 // that a valid Go context exists.
 func (c *BaseChain) IsExecutable(context Context) bool {
@@ -112,6 +203,24 @@ func (c *BaseChain) Execute(chCtx Context) {
 	outerCtx, chainSpan := c.Tracer.Start(parentCtx, fmt.Sprintf("%s_execute", c.GetName()))
 	defer chainSpan.End() // Ensure the span is closed when the function returns.
 
+	// Combine the interceptors inherited from an enclosing chain with this chain's
+	// own, and hand them on to any chain nested in this one.
+	interceptors := append(append([]Interceptor{}, interceptorsFrom(parentCtx)...), c.interceptors...)
+	outerCtx = withInterceptors(outerCtx, interceptors)
+
+	// In a dry run, report what would happen instead of doing it.
+	if c.dryRun {
+		plan := c.Plan(chCtx)
+		chCtx.Add(CtxPlan, plan)
+		log.Printf("dry run of %s\n%s", c.GetName(), plan)
+		chainSpan.AddEvent("dry_run", trace.WithAttributes(attribute.Int("cor.plan.diagnostics", len(plan.Diagnostics))))
+		chainSpan.SetStatus(codes.Ok, "chain planned")
+		return
+	}
+
+	// Load the progress of a previous attempt at this run, if checkpointing is enabled.
+	checkpoint := c.loadCheckpoint(chCtx)
+
 	// Loop through each command in the chain's list.
 	for _, command := range c.commands {
 		// Start a new child span for the individual command. This allows us to trace
@@ -127,14 +236,26 @@ func (c *BaseChain) Execute(chCtx Context) {
 			break // Exit the loop.
 		}
 
-		// Check if the current command is able to run with the current context.
-		if command.IsExecutable(chCtx) {
+		// Check if the current command already completed in a previous attempt at this run.
+		if c.restoreStep(chCtx, checkpoint, command) {
+			// The restored writes stand in for the command's execution.
+			commandSpan.AddEvent("checkpoint.restored", trace.WithAttributes(attribute.String("cor.run_id", checkpoint.RunID)))
+		} else if isExecutable(command, chCtx) {
 			// Set the Go context for the command to the new child span's context.
 			// This ensures that any operations within the command are traced as children of this command's span.
 			chCtx.SetContext(commandContext)
 
-			// Execute the command's core logic.
-			command.Execute(chCtx)
+			// Execute the command's core logic. With checkpoints enabled, the writes
+			// are recorded so they can be saved once the command succeeds.
+			if checkpoint != nil {
+				recorder := newRecordingContext(chCtx)
+				invoke(interceptors, command, recorder)
+				if !chCtx.HasErrors() {
+					c.saveStep(outerCtx, checkpoint, command, recorder)
+				}
+			} else {
+				invoke(interceptors, command, chCtx)
+			}
 
 			// **Important**: Reset the shared context's Go context back to the chain's main
 			// context. This prevents the next command's span from being a grandchild of
@@ -155,21 +276,133 @@ func (c *BaseChain) Execute(chCtx Context) {
 		commandSpan.End() // End the span for the individual command.
 
 		// --- Data Piping Logic ---
-		// "Flip-flop" the input and output to create a pipeline effect.
-		// The value placed in CtxOut by the command that just ran...
-		outputValue := chCtx.Get(CtxOut)
-		// ...is now placed in CtxIn for the next command in the loop.
-		chCtx.Remove(CtxIn) // Clean up old input
-		if outputValue != nil {
-			chCtx.Add(CtxIn, outputValue)
-		}
-		chCtx.Remove(CtxOut) // Clean up the output to prepare for the next command.
+		pipe(chCtx)
 	}
 
 	// After the loop finishes, set the final status for the entire chain's span.
 	if !chCtx.HasErrors() {
+		// A completed run has nothing left to resume.
+		if checkpoint != nil {
+			if err := c.checkpoints.Delete(outerCtx, checkpoint.RunID); err != nil {
+				log.Printf("failed to delete checkpoint for run %s: %v\n", checkpoint.RunID, err)
+			}
+		}
 		chainSpan.SetStatus(codes.Ok, "chain completed successfully")
 	} else {
+		// Undo the side effects of the commands that already ran, so that a failed
+		// run does not leave half-written state behind.
+		if !c.continueOnFailure {
+			c.forgetCompensated(outerCtx, checkpoint, compensateAll(c.Tracer, chCtx, c.commands))
+		}
 		chainSpan.SetStatus(codes.Error, "chain failed to execute")
 	}
 }
+
+// pipe "flip-flops" the input and output to create a pipeline effect: the
+// value placed in CtxOut by the command that just ran becomes the CtxIn of the
+// next command, and CtxOut is cleared.
+func pipe(chCtx Context) {
+	outputValue := chCtx.Get(CtxOut)
+	chCtx.Remove(CtxIn) // Clean up old input
+	if outputValue != nil {
+		chCtx.Add(CtxIn, outputValue)
+	}
+	chCtx.Remove(CtxOut) // Clean up the output to prepare for the next command.
+}
+
+// Compensate undoes the side effects of this chain's commands in reverse order.
+// The chain undoes them the same way when it fails; Compensate is called by an
+// enclosing chain when a later step of that chain fails.
+func (c *BaseChain) Compensate(context Context) bool {
+	return len(compensateAll(c.Tracer, context, c.commands)) > 0
+}
+
+// forgetCompensated removes compensated commands from the checkpoint, since
+// their side effects have been undone and they must run again on resume.
+// Commands that had nothing to undo (e.g. a router whose branch has no side
+// effect) keep their step, so a resumed run does not repeat them.
+func (c *BaseChain) forgetCompensated(ctx context.Context, checkpoint *Checkpoint, compensated map[string]bool) {
+	if checkpoint == nil {
+		return
+	}
+	changed := false
+	for _, command := range c.commands {
+		if !compensated[command.GetName()] {
+			continue
+		}
+		if _, ok := checkpoint.Steps[command.GetName()]; ok {
+			delete(checkpoint.Steps, command.GetName())
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := c.checkpoints.Save(ctx, checkpoint); err != nil {
+		log.Printf("failed to save checkpoint for run %s: %v\n", checkpoint.RunID, err)
+	}
+}
+
+// loadCheckpoint returns the checkpoint for this run, a new empty checkpoint if
+// there is none, or nil if checkpointing is disabled.
+func (c *BaseChain) loadCheckpoint(chCtx Context) *Checkpoint {
+	if c.checkpoints == nil || c.runID == nil {
+		return nil
+	}
+	runID := c.runID(chCtx)
+	if len(runID) == 0 {
+		return nil
+	}
+	checkpoint, err := c.checkpoints.Load(chCtx.GetContext(), runID)
+	if err != nil {
+		// A broken checkpoint must not block the run; start over instead.
+		log.Printf("failed to load checkpoint for run %s, starting over: %v\n", runID, err)
+	}
+	if checkpoint == nil {
+		checkpoint = &Checkpoint{RunID: runID}
+	}
+	if checkpoint.Steps == nil {
+		checkpoint.Steps = make(map[string]*CheckpointStep)
+	}
+	return checkpoint
+}
+
+// restoreStep replays the saved writes of a command that completed in a
+// previous attempt. It returns false if the command has to be executed.
+func (c *BaseChain) restoreStep(chCtx Context, checkpoint *Checkpoint, command Command) bool {
+	if checkpoint == nil {
+		return false
+	}
+	step, ok := checkpoint.Steps[command.GetName()]
+	if !ok {
+		return false
+	}
+	values, err := step.restore()
+	if err != nil {
+		log.Printf("failed to restore checkpoint step %s, executing it again: %v\n", command.GetName(), err)
+		delete(checkpoint.Steps, command.GetName())
+		return false
+	}
+	for _, k := range step.Removed {
+		chCtx.Remove(k)
+	}
+	for k, v := range values {
+		chCtx.Add(k, v)
+	}
+	return true
+}
+
+// saveStep persists the writes recorded for a successful command.
+func (c *BaseChain) saveStep(ctx context.Context, checkpoint *Checkpoint, command Command, recorder *recordingContext) {
+	step, err := recorder.step()
+	if err != nil {
+		// The command is simply executed again on resume.
+		log.Printf("not checkpointing %s: %v\n", command.GetName(), err)
+		return
+	}
+	checkpoint.Steps[command.GetName()] = step
+	checkpoint.UpdatedAt = time.Now()
+	if err := c.checkpoints.Save(ctx, checkpoint); err != nil {
+		log.Printf("failed to save checkpoint for run %s: %v\n", checkpoint.RunID, err)
+	}
+}
@@ -117,6 +117,18 @@ func (c *BaseCommand) GetOutputParam() string {
 	return c.OutputParamName
 }
 
+// InputKeys returns the keys the command reads. By default this is only the
+// input parameter; commands that read other keys override it (see `KeyDeclarer`).
+func (c *BaseCommand) InputKeys() []string {
+	return []string{c.GetInputParam()}
+}
+
+// OutputKeys returns the keys the command writes. By default this is only the
+// output parameter; commands that write other keys override it (see `KeyDeclarer`).
+func (c *BaseCommand) OutputKeys() []string {
+	return []string{c.GetOutputParam()}
+}
+
 // GetTracer returns the OpenTelemetry Tracer for this command.
 func (c *BaseCommand) GetTracer() trace.Tracer {
 	return c.Tracer
@@ -28,17 +28,22 @@
 //     they can be cleaned up at the end (`tempFiles`).
 //   - A standard Go `context.Context` for handling cancellations, deadlines,
 //     and passing request-scoped values like OpenTelemetry spans.
+//   - A read/write mutex guarding all of the above, so that commands which fan
+//     work out to goroutines (e.g. `SceneExtractor`, `ParallelChain`) can read
+//     and write the context concurrently.
 package cor
 
 import (
 	"context"
 	"log"
 	"os"
+	"sync"
 )
 
 // BaseContext is the default implementation of the Context interface. It holds
-// the shared state for a workflow execution.
+// the shared state for a workflow execution and is safe for concurrent use.
 type BaseContext struct {
+	mu        sync.RWMutex           // Guards every field below.
 	data      map[string]interface{} // A map to store arbitrary key-value data.
 	errors    map[string]error       // A map to store errors, keyed by the command name that produced them.
 	tempFiles []string               // A slice of paths to temporary files that need to be cleaned up.
@@ -64,6 +69,8 @@ func NewBaseContext() Context {
 // Inputs:
 //   - context: The standard `context.Context` to set.
 func (c *BaseContext) SetContext(context context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.context = context
 }
 
@@ -72,6 +79,8 @@ func (c *BaseContext) SetContext(context context.Context) {
 // Outputs:
 //   - context.Context: The currently set Go context.
 func (c *BaseContext) GetContext() context.Context {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.context
 }
 
@@ -97,6 +106,8 @@ func (c *BaseContext) Close() {
 // Outputs:
 //   - Context: The context instance, allowing for fluent method chaining.
 func (c *BaseContext) Add(key string, value interface{}) Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.data[key] = value
 	return c
 }
@@ -106,15 +117,19 @@ func (c *BaseContext) Add(key string, value interface{}) Context {
 // Inputs:
 //   - file: The string path to the temporary file.
 func (c *BaseContext) AddTempFile(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.tempFiles = append(c.tempFiles, file)
 }
 
-// GetTempFiles returns the slice of all tracked temporary file paths.
+// GetTempFiles returns a copy of all tracked temporary file paths.
 //
 // Outputs:
 //   - []string: A slice of file paths.
 func (c *BaseContext) GetTempFiles() []string {
-	return c.tempFiles
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append(make([]string, 0, len(c.tempFiles)), c.tempFiles...)
 }
 
 // AddError adds an error to the context's error map, keyed by the command name.
@@ -123,15 +138,23 @@ func (c *BaseContext) GetTempFiles() []string {
 //   - key: The name of the command that generated the error.
 //   - err: The error object.
 func (c *BaseContext) AddError(key string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.errors[key] = err
 }
 
-// GetErrors returns the map of all errors collected during the workflow.
+// GetErrors returns a copy of all errors collected during the workflow.
 //
 // Outputs:
 //   - map[string]error: A map where keys are command names and values are the errors.
 func (c *BaseContext) GetErrors() map[string]error {
-	return c.errors
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make(map[string]error, len(c.errors))
+	for k, v := range c.errors {
+		out[k] = v
+	}
+	return out
 }
 
 // Get retrieves a value from the context's data map by its key.
@@ -142,6 +165,8 @@ func (c *BaseContext) GetErrors() map[string]error {
 // Outputs:
 //   - interface{}: The stored value, or `nil` if the key does not exist.
 func (c *BaseContext) Get(key string) interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.data[key]
 }
 
@@ -150,6 +175,8 @@ func (c *BaseContext) Get(key string) interface{} {
 // Inputs:
 //   - key: The key of the item to remove.
 func (c *BaseContext) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	delete(c.data, key)
 }
 
@@ -158,5 +185,7 @@ func (c *BaseContext) Remove(key string) {
 // Outputs:
 //   - bool: True if the error map is not empty, false otherwise.
 func (c *BaseContext) HasErrors() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return len(c.errors) > 0
 }
@@ -0,0 +1,227 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor (Chain of Responsibility) provides the fundamental building blocks
+// for creating workflows. This file defines `branchContext`, an internal
+// implementation of the `Context` interface that layers its own writes on top
+// of a parent context.
+//
+// A branch context is used whenever a command has to run in isolation from the
+// shared workflow state, for example when several commands run at the same time
+// in a `ParallelChain`. Reads fall through to the parent, while writes, removals,
+// errors and temporary files are kept locally until `merge` copies them back.
+// Because the parent is only read while the branch is running, any number of
+// branches can safely share a single parent. The branch itself is guarded by a
+// mutex, so commands running on it may also fan out to goroutines.
+package cor
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// branchContext is a copy-on-write view over a parent Context.
+type branchContext struct {
+	mu        sync.RWMutex           // Guards every field below except parent.
+	parent    Context                // The context that reads fall through to.
+	data      map[string]interface{} // Values written by this branch.
+	removed   map[string]bool        // Keys removed by this branch; these hide the parent's value.
+	errors    map[string]error       // Errors recorded by this branch.
+	tempFiles []string               // Temporary files created by this branch.
+	context   context.Context        // The Go context used while this branch executes.
+}
+
+// newBranchContext creates a branch over the given parent. The branch starts
+// with the parent's Go context; callers usually replace it with a child span.
+//
+// Inputs:
+//   - parent: The context that the branch reads from and later merges into.
+//
+// Outputs:
+//   - *branchContext: A new, empty branch.
+func newBranchContext(parent Context) *branchContext {
+	return &branchContext{
+		parent:    parent,
+		data:      make(map[string]interface{}),
+		removed:   make(map[string]bool),
+		errors:    make(map[string]error),
+		tempFiles: make([]string, 0),
+		context:   parent.GetContext(),
+	}
+}
+
+// SetContext sets the Go context used by commands running on this branch.
+func (c *branchContext) SetContext(context context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.context = context
+}
+
+// GetContext returns the Go context used by commands running on this branch.
+func (c *branchContext) GetContext() context.Context {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.context
+}
+
+// Add stores a value on the branch without touching the parent.
+func (c *branchContext) Add(key string, value interface{}) Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.removed, key)
+	c.data[key] = value
+	return c
+}
+
+// AddError records an error on the branch.
+func (c *branchContext) AddError(key string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errors[key] = err
+}
+
+// GetErrors returns the parent's errors combined with the errors recorded on
+// this branch. Branch errors take precedence when both use the same key.
+func (c *branchContext) GetErrors() map[string]error {
+	out := make(map[string]error)
+	for k, v := range c.parent.GetErrors() {
+		out[k] = v
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for k, v := range c.errors {
+		out[k] = v
+	}
+	return out
+}
+
+// Get returns the branch's own value for the key, falling back to the parent
+// unless the key has been removed on this branch.
+func (c *branchContext) Get(key string) interface{} {
+	c.mu.RLock()
+	v, ok := c.data[key]
+	removed := c.removed[key]
+	c.mu.RUnlock()
+	if ok {
+		return v
+	}
+	if removed {
+		return nil
+	}
+	return c.parent.Get(key)
+}
+
+// Remove hides the key on this branch. The parent is only changed on merge.
+func (c *branchContext) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, key)
+	c.removed[key] = true
+}
+
+// HasErrors reports whether either the branch or its parent has errors.
+func (c *branchContext) HasErrors() bool {
+	return c.failed() || c.parent.HasErrors()
+}
+
+// AddTempFile tracks a temporary file created on this branch.
+func (c *branchContext) AddTempFile(file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tempFiles = append(c.tempFiles, file)
+}
+
+// GetTempFiles returns the parent's temporary files followed by the branch's own.
+func (c *branchContext) GetTempFiles() []string {
+	out := c.parent.GetTempFiles()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append(out, c.tempFiles...)
+}
+
+// Close is a no-op. Temporary files are handed to the parent on merge and
+// cleaned up when the parent is closed.
+func (c *branchContext) Close() {}
+
+// failed reports whether this branch itself recorded any errors.
+func (c *branchContext) failed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.errors) > 0
+}
+
+// local returns the value written to the key on this branch only, ignoring the parent.
+func (c *branchContext) local(key string) interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data[key]
+}
+
+// err joins the errors recorded on this branch itself, ordered by key.
+func (c *branchContext) err() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]string, 0, len(c.errors))
+	for k := range c.errors {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	errs := make([]error, 0, len(keys))
+	for _, k := range keys {
+		errs = append(errs, c.errors[k])
+	}
+	return errors.Join(errs...)
+}
+
+// discard drops the branch's writes and errors but still hands its temporary
+// files to the parent, so they are cleaned up when the parent is closed.
+func (c *branchContext) discard() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, f := range c.tempFiles {
+		c.parent.AddTempFile(f)
+	}
+}
+
+// merge copies the branch's writes, removals, errors and temporary files into
+// the parent context.
+//
+// Inputs:
+//   - skip: Keys that should not be copied back (e.g. the CtxIn/CtxOut piping keys).
+func (c *branchContext) merge(skip ...string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	skipped := make(map[string]bool, len(skip))
+	for _, k := range skip {
+		skipped[k] = true
+	}
+	for k := range c.removed {
+		if !skipped[k] {
+			c.parent.Remove(k)
+		}
+	}
+	for k, v := range c.data {
+		if !skipped[k] {
+			c.parent.Add(k, v)
+		}
+	}
+	for k, v := range c.errors {
+		c.parent.AddError(k, v)
+	}
+	for _, f := range c.tempFiles {
+		c.parent.AddTempFile(f)
+	}
+}
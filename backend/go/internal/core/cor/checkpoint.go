@@ -0,0 +1,220 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor (Chain of Responsibility) provides the fundamental building blocks
+// for creating workflows. This file defines the checkpoint model that lets a
+// `BaseChain` resume a run after a failure instead of starting over.
+//
+// Logic Flow:
+//  1. While a checkpointed chain runs, every command executes against a
+//     `recordingContext` that remembers which keys the command wrote or removed.
+//  2. After a command succeeds, its writes are encoded and saved to a
+//     `CheckpointStore` under the run ID.
+//  3. When the same run ID is executed again (e.g. a redelivered Pub/Sub message),
+//     commands with a saved step are not executed; their recorded writes are
+//     replayed onto the context instead.
+//  4. When the whole chain succeeds, the checkpoint is deleted.
+//
+// Values are stored as JSON together with a registered type name, so only types
+// registered with `RegisterCheckpointType` can be checkpointed. A command whose
+// outputs cannot be encoded, or which created temporary files (which do not
+// survive the run), is simply executed again on resume.
+package cor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Checkpoint is the persisted progress of a single chain run.
+type Checkpoint struct {
+	RunID     string                     `json:"run_id"`     // The identifier of the run, e.g. bucket/object#generation.
+	Steps     map[string]*CheckpointStep `json:"steps"`      // The completed commands, keyed by command name.
+	UpdatedAt time.Time                  `json:"updated_at"` // When the checkpoint was last saved.
+}
+
+// CheckpointStep holds the context writes made by one completed command.
+type CheckpointStep struct {
+	Outputs map[string]CheckpointValue `json:"outputs"`           // Values the command added, keyed by context key.
+	Removed []string                   `json:"removed,omitempty"` // Keys the command removed.
+}
+
+// CheckpointValue is a single encoded context value.
+type CheckpointValue struct {
+	Type  string          `json:"type"`  // The name the value's type was registered with.
+	Value json.RawMessage `json:"value"` // The JSON encoding of the value.
+}
+
+// CheckpointStore persists checkpoints between runs.
+type CheckpointStore interface {
+	// Load returns the checkpoint for the run, or nil if there is none.
+	Load(ctx context.Context, runID string) (*Checkpoint, error)
+	// Save creates or replaces the checkpoint for checkpoint.RunID.
+	Save(ctx context.Context, checkpoint *Checkpoint) error
+	// Delete removes the checkpoint for the run. Deleting a missing checkpoint is not an error.
+	Delete(ctx context.Context, runID string) error
+}
+
+// checkpointTypes maps registered names to types and back.
+var checkpointTypes = struct {
+	sync.RWMutex
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}{byName: make(map[string]reflect.Type), byType: make(map[reflect.Type]string)}
+
+func init() {
+	RegisterCheckpointType("string", "")
+	RegisterCheckpointType("int", 0)
+	RegisterCheckpointType("float64", float64(0))
+	RegisterCheckpointType("bool", false)
+	RegisterCheckpointType("[]string", []string{})
+	RegisterCheckpointType("map[string]interface{}", map[string]interface{}{})
+}
+
+// RegisterCheckpointType makes values of the prototype's type checkpointable
+// under the given name. Pointer types are registered as such, so registering
+// `&model.Media{}` makes `*model.Media` values checkpointable. The name is
+// persisted, so it must stay stable across releases.
+//
+// Inputs:
+//   - name: A stable name for the type, e.g. "model.Media".
+//   - prototype: Any value of the type to register.
+func RegisterCheckpointType(name string, prototype interface{}) {
+	t := reflect.TypeOf(prototype)
+	checkpointTypes.Lock()
+	defer checkpointTypes.Unlock()
+	checkpointTypes.byName[name] = t
+	checkpointTypes.byType[t] = name
+}
+
+// encodeCheckpointValue encodes a context value, failing for unregistered types.
+func encodeCheckpointValue(value interface{}) (CheckpointValue, error) {
+	checkpointTypes.RLock()
+	name, ok := checkpointTypes.byType[reflect.TypeOf(value)]
+	checkpointTypes.RUnlock()
+	if !ok {
+		return CheckpointValue{}, fmt.Errorf("type %T is not registered for checkpoints", value)
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return CheckpointValue{}, err
+	}
+	return CheckpointValue{Type: name, Value: raw}, nil
+}
+
+// decode restores the Go value, with the same type it was encoded from.
+func (v CheckpointValue) decode() (interface{}, error) {
+	checkpointTypes.RLock()
+	t, ok := checkpointTypes.byName[v.Type]
+	checkpointTypes.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("checkpoint type %q is not registered", v.Type)
+	}
+	if t.Kind() == reflect.Pointer {
+		ptr := reflect.New(t.Elem())
+		if err := json.Unmarshal(v.Value, ptr.Interface()); err != nil {
+			return nil, err
+		}
+		return ptr.Interface(), nil
+	}
+	ptr := reflect.New(t)
+	if err := json.Unmarshal(v.Value, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// restore decodes every output of the step. It fails if any value cannot be
+// decoded, in which case the command should be executed again.
+func (s *CheckpointStep) restore() (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(s.Outputs))
+	for k, v := range s.Outputs {
+		value, err := v.decode()
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", k, err)
+		}
+		out[k] = value
+	}
+	return out, nil
+}
+
+// recordingContext wraps a Context and remembers what a single command wrote.
+type recordingContext struct {
+	Context
+	mu        sync.Mutex
+	written   map[string]interface{}
+	removed   map[string]bool
+	tempFiles bool
+}
+
+// newRecordingContext wraps the given context.
+func newRecordingContext(parent Context) *recordingContext {
+	return &recordingContext{Context: parent, written: make(map[string]interface{}), removed: make(map[string]bool)}
+}
+
+// Add records the write and forwards it.
+func (r *recordingContext) Add(key string, value interface{}) Context {
+	r.mu.Lock()
+	delete(r.removed, key)
+	r.written[key] = value
+	r.mu.Unlock()
+	r.Context.Add(key, value)
+	return r
+}
+
+// Remove records the removal and forwards it.
+func (r *recordingContext) Remove(key string) {
+	r.mu.Lock()
+	delete(r.written, key)
+	r.removed[key] = true
+	r.mu.Unlock()
+	r.Context.Remove(key)
+}
+
+// AddTempFile notes that the command produced local files and forwards the call.
+func (r *recordingContext) AddTempFile(file string) {
+	r.mu.Lock()
+	r.tempFiles = true
+	r.mu.Unlock()
+	r.Context.AddTempFile(file)
+}
+
+// step encodes the recorded writes.
+func (r *recordingContext) step() (*CheckpointStep, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tempFiles {
+		return nil, fmt.Errorf("command created temporary files")
+	}
+	step := &CheckpointStep{Outputs: make(map[string]CheckpointValue, len(r.written))}
+	for k, v := range r.written {
+		if v == nil {
+			step.Removed = append(step.Removed, k)
+			continue
+		}
+		encoded, err := encodeCheckpointValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to checkpoint %s: %w", k, err)
+		}
+		step.Outputs[k] = encoded
+	}
+	for k := range r.removed {
+		step.Removed = append(step.Removed, k)
+	}
+	return step, nil
+}
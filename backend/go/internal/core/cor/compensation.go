@@ -0,0 +1,118 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor (Chain of Responsibility) provides the fundamental building blocks
+// for creating workflows. This file defines the optional `Compensator`
+// interface, which lets a failed chain undo the side effects of the commands
+// that already ran.
+//
+// Logic Flow:
+//  1. A command with an external side effect (an uploaded object, an inserted
+//     row) records how to undo it in the context with `SetUndo` once the side
+//     effect has happened.
+//  2. When a `BaseChain` fails and `continueOnFailure` is false, it calls
+//     `Compensate` on its commands in reverse order. Chains, routers and the
+//     retry decorator forward the call to the commands they contain.
+//  3. A compensator only acts on its own undo record and removes it afterwards,
+//     so commands that never ran are no-ops and compensating twice is harmless.
+//     It reports whether it found a record, so that a checkpointing chain only
+//     forgets the steps whose side effects were actually undone.
+package cor
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Compensator is implemented by commands whose side effects can be undone.
+type Compensator interface {
+	// Compensate undoes the command's side effect, using the undo record the
+	// command left in the context. It must do nothing if there is no record,
+	// and reports whether there was one (for a command containing others,
+	// whether any of them had one).
+	Compensate(context Context) bool
+}
+
+// undoKey returns the context key holding the undo record of a command.
+func undoKey(owner string) string {
+	return fmt.Sprintf("__UNDO__%s", owner)
+}
+
+// SetUndo records how to undo the side effect of the named command. The value
+// is stored in the context, so it is checkpointed along with the command's
+// other outputs and must therefore be of a checkpointable type.
+//
+// Inputs:
+//   - context: The shared workflow context.
+//   - owner: The name of the command that performed the side effect.
+//   - value: Whatever the command needs to undo it (e.g. an object name or row ID).
+func SetUndo(context Context, owner string, value interface{}) {
+	context.Add(undoKey(owner), value)
+}
+
+// TakeUndo returns and removes the undo record of the named command. The
+// boolean is false if there is no record of the expected type, in which case
+// there is nothing to compensate.
+//
+// Inputs:
+//   - context: The shared workflow context.
+//   - owner: The name of the command that performed the side effect.
+//
+// Outputs:
+//   - T: The undo record.
+//   - bool: True if a record was present.
+func TakeUndo[T any](context Context, owner string) (T, bool) {
+	key := NewKey[T](undoKey(owner))
+	v, ok := key.Get(context)
+	if ok {
+		context.Remove(key.Name())
+	}
+	return v, ok
+}
+
+// compensateAll calls Compensate on every command that supports it, in reverse
+// order, each under its own child span.
+//
+// Inputs:
+//   - tracer: The tracer of the command that owns the list.
+//   - chCtx: The shared workflow context.
+//   - commands: The commands, in execution order.
+//
+// Outputs:
+//   - map[string]bool: The names of the commands that found an undo record.
+func compensateAll(tracer trace.Tracer, chCtx Context, commands []Command) map[string]bool {
+	parentCtx := chCtx.GetContext()
+	// Compensation usually runs because something went wrong, possibly a canceled
+	// workflow, so it must not inherit the cancellation.
+	undoCtx := context.WithoutCancel(parentCtx)
+	compensated := make(map[string]bool)
+	for i := len(commands) - 1; i >= 0; i-- {
+		compensator, ok := commands[i].(Compensator)
+		if !ok {
+			continue
+		}
+		spanCtx, span := tracer.Start(undoCtx, fmt.Sprintf("%s_compensate", commands[i].GetName()))
+		chCtx.SetContext(spanCtx)
+		if compensator.Compensate(chCtx) {
+			compensated[commands[i].GetName()] = true
+		}
+		chCtx.SetContext(parentCtx)
+		span.SetStatus(codes.Ok, "compensation completed")
+		span.End()
+	}
+	return compensated
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor (Chain of Responsibility) provides the fundamental building blocks
+// for creating workflows. This file defines `FileCheckpointStore`, a
+// `CheckpointStore` that keeps one JSON file per run in a local directory.
+package cor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FileCheckpointStore stores checkpoints as JSON files in a directory. File
+// names are derived from a hash of the run ID, so any run ID is safe to use.
+type FileCheckpointStore struct {
+	dir string // The directory holding the checkpoint files.
+}
+
+// NewFileCheckpointStore is the constructor for FileCheckpointStore. The
+// directory is created on the first save if it does not exist.
+//
+// Inputs:
+//   - dir: The directory in which to keep checkpoint files.
+//
+// Outputs:
+//   - *FileCheckpointStore: A pointer to the newly instantiated store.
+func NewFileCheckpointStore(dir string) *FileCheckpointStore {
+	return &FileCheckpointStore{dir: dir}
+}
+
+// path returns the file used for the run.
+func (s *FileCheckpointStore) path(runID string) string {
+	sum := sha256.Sum256([]byte(runID))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Load reads the checkpoint for the run, returning nil if there is none.
+func (s *FileCheckpointStore) Load(_ context.Context, runID string) (*Checkpoint, error) {
+	data, err := os.ReadFile(s.path(runID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := &Checkpoint{}
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Save writes the checkpoint atomically by writing a temporary file and
+// renaming it over the previous version.
+func (s *FileCheckpointStore) Save(_ context.Context, checkpoint *Checkpoint) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, "checkpoint-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(checkpoint.RunID))
+}
+
+// Delete removes the checkpoint for the run, if any.
+func (s *FileCheckpointStore) Delete(_ context.Context, runID string) error {
+	err := os.Remove(s.path(runID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,239 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor (Chain of Responsibility) provides the fundamental building blocks
+// for creating workflows. This file defines interceptors, which wrap the
+// execution of every command in a chain so that cross-cutting behavior
+// (metrics, logging, panic recovery, timing) lives in one place instead of in
+// every command.
+//
+// Logic Flow:
+//  1. **Registration**: Interceptors are registered on a `BaseChain` with `Use`.
+//     They also apply to every chain, router branch and parallel branch nested
+//     in it, so they are usually only registered on the outermost chain.
+//  2. **Invocation**: For each command, the chain creates an `Invocation` and
+//     calls the interceptors in registration order, the first being the
+//     outermost. Each interceptor calls `next` to continue towards the command.
+//  3. **Outcome**: The invocation's context records the errors added while the
+//     command ran, so interceptors can tell success from failure without the
+//     command reporting it twice.
+package cor
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Interceptor wraps one execution of a command. It must call next exactly once
+// for the command (and any inner interceptors) to run, unless it deliberately
+// short-circuits the execution.
+type Interceptor func(invocation *Invocation, next func())
+
+// Before creates an interceptor that runs the hook before the command.
+func Before(hook func(invocation *Invocation)) Interceptor {
+	return func(invocation *Invocation, next func()) {
+		hook(invocation)
+		next()
+	}
+}
+
+// After creates an interceptor that runs the hook after the command, even if
+// an inner interceptor recovered from a panic.
+func After(hook func(invocation *Invocation)) Interceptor {
+	return func(invocation *Invocation, next func()) {
+		next()
+		hook(invocation)
+	}
+}
+
+// Invocation describes a single execution of a command.
+type Invocation struct {
+	Command Command   // The command being executed.
+	Context Context   // The context the command executes with.
+	Start   time.Time // When the invocation started.
+
+	mu     sync.Mutex
+	errors []error // Errors added to Context while the command ran.
+}
+
+// Failed reports whether the command added any error to the context.
+func (i *Invocation) Failed() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.errors) > 0
+}
+
+// Err returns the errors added while the command ran, joined, or nil.
+func (i *Invocation) Err() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return errors.Join(i.errors...)
+}
+
+// Elapsed returns the time since the invocation started.
+func (i *Invocation) Elapsed() time.Duration {
+	return time.Since(i.Start)
+}
+
+// record notes an error added during the invocation.
+func (i *Invocation) record(err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.errors = append(i.errors, err)
+}
+
+// invocationContext passes everything through to the chain's context while
+// recording the errors added during the invocation.
+type invocationContext struct {
+	Context
+	invocation *Invocation
+}
+
+// AddError records the error on the invocation and the underlying context.
+func (c *invocationContext) AddError(key string, err error) {
+	c.invocation.record(err)
+	c.Context.AddError(key, err)
+}
+
+// interceptorsKey is the Go context key under which a chain hands its
+// interceptors to the chains and routers nested in it.
+type interceptorsKey struct{}
+
+// withInterceptors returns a Go context carrying the interceptors.
+func withInterceptors(ctx context.Context, interceptors []Interceptor) context.Context {
+	if len(interceptors) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, interceptorsKey{}, interceptors)
+}
+
+// interceptorsFrom returns the interceptors inherited through the Go context.
+func interceptorsFrom(ctx context.Context) []Interceptor {
+	if ctx == nil {
+		return nil
+	}
+	interceptors, _ := ctx.Value(interceptorsKey{}).([]Interceptor)
+	return interceptors
+}
+
+// invoke executes the command through the interceptors.
+//
+// Inputs:
+//   - interceptors: The interceptors to apply, outermost first; may be empty.
+//   - command: The command to execute.
+//   - chCtx: The context to execute it with.
+func invoke(interceptors []Interceptor, command Command, chCtx Context) {
+	// A safety net for chains without the RecoveryInterceptor and for panics in
+	// the interceptors themselves.
+	defer recoverCommand(command, chCtx)
+
+	if len(interceptors) == 0 {
+		command.Execute(chCtx)
+		return
+	}
+	invocation := &Invocation{Command: command, Start: time.Now()}
+	invocation.Context = &invocationContext{Context: chCtx, invocation: invocation}
+
+	next := func() { command.Execute(invocation.Context) }
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := interceptors[i], next
+		next = func() { interceptor(invocation, inner) }
+	}
+	next()
+}
+
+// DefaultInterceptors returns the interceptors every workflow should use, in
+// order: metrics, timing, logging and panic recovery. Recovery is innermost,
+// so a recovered panic is seen as an ordinary failure by the others.
+func DefaultInterceptors() []Interceptor {
+	return []Interceptor{
+		MetricsInterceptor(),
+		TimingInterceptor(),
+		LoggingInterceptor(),
+		RecoveryInterceptor(),
+	}
+}
+
+// MetricsInterceptor increments the command's success or error counter.
+func MetricsInterceptor() Interceptor {
+	return func(invocation *Invocation, next func()) {
+		next()
+		ctx := invocation.Context.GetContext()
+		counter := invocation.Command.GetSuccessCounter()
+		if invocation.Failed() {
+			counter = invocation.Command.GetErrorCounter()
+		}
+		if counter != nil {
+			counter.Add(ctx, 1)
+		}
+	}
+}
+
+// TimingInterceptor records the duration of every command in the
+// `cor.command.duration` histogram, in milliseconds.
+func TimingInterceptor() Interceptor {
+	meter := otel.Meter("github.com/GoogleCloudPlatform/solutions/media")
+	histogram, err := meter.Float64Histogram("cor.command.duration",
+		metric.WithUnit("ms"),
+		metric.WithDescription("The duration of command executions."))
+	if err != nil {
+		log.Printf("error creating command duration histogram: %v\n", err)
+	}
+	return func(invocation *Invocation, next func()) {
+		next()
+		if histogram == nil {
+			return
+		}
+		histogram.Record(invocation.Context.GetContext(),
+			float64(invocation.Elapsed())/float64(time.Millisecond),
+			metric.WithAttributes(
+				attribute.String("cor.command", invocation.Command.GetName()),
+				attribute.Bool("cor.failed", invocation.Failed())))
+	}
+}
+
+// LoggingInterceptor logs the start and outcome of every command with slog.
+// The command's Go context is passed along, so the configured handler can add
+// the trace and span IDs.
+func LoggingInterceptor() Interceptor {
+	return func(invocation *Invocation, next func()) {
+		name := invocation.Command.GetName()
+		slog.InfoContext(invocation.Context.GetContext(), "command started", "command", name)
+		next()
+		ctx := invocation.Context.GetContext()
+		if err := invocation.Err(); err != nil {
+			slog.ErrorContext(ctx, "command failed", "command", name, "duration", invocation.Elapsed(), "error", err)
+		} else {
+			slog.InfoContext(ctx, "command completed", "command", name, "duration", invocation.Elapsed())
+		}
+	}
+}
+
+// RecoveryInterceptor turns a panic in the command into a `*PanicError` on the
+// context (see panic.go). Chains recover panics even without it; registering it
+// inside other interceptors lets them see the panic as an ordinary failure.
+func RecoveryInterceptor() Interceptor {
+	return func(invocation *Invocation, next func()) {
+		defer recoverCommand(invocation.Command, invocation.Context)
+		next()
+	}
+}
@@ -42,7 +42,11 @@ const (
 // Context defines the interface for a shared state object that is passed
 // through a chain of commands. It acts as a "property bag" or "state machine"
 // for a single workflow execution, carrying data, errors, and other state
-// between commands.
+// between commands. Implementations must be safe for concurrent use, and
+// GetErrors/GetTempFiles must return copies rather than internal state.
+//
+// Prefer the typed accessors in `Key[T]` over calling Get and asserting the
+// result, so that a missing or mistyped value becomes a recorded error.
 type Context interface {
 	// SetContext sets the standard Go `context.Context`. This is primarily
 	// used for passing request-scoped data like cancellation signals and
@@ -0,0 +1,99 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor (Chain of Responsibility) provides the fundamental building blocks
+// for creating workflows. This file defines `Key[T]`, a typed accessor for
+// values stored in a `Context`.
+//
+// The `Context` itself is an untyped property bag, so a command that reads a
+// value with `Get` and a bare type assertion will panic when a previous step
+// forgot to set it or set a different type. A `Key[T]` pairs the string name
+// with the expected type, so a missing or mistyped value is reported as an
+// ordinary error on the context instead of crashing the worker.
+package cor
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	// ErrMissingKey is recorded when a required key is not present in the context.
+	ErrMissingKey = errors.New("missing context key")
+	// ErrWrongType is recorded when a key holds a value of an unexpected type.
+	ErrWrongType = errors.New("unexpected type for context key")
+)
+
+// Key is a typed handle for a value stored in a Context.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey creates a typed key for the given context parameter name.
+//
+// Inputs:
+//   - name: The string key under which the value is stored in the Context.
+//
+// Outputs:
+//   - Key[T]: The typed key.
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{name: name}
+}
+
+// Name returns the string key under which the value is stored.
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+// Get returns the value stored under the key. The boolean is false when the
+// key is missing or holds a different type. Get has no side effects, so it is
+// suitable for optional values and for IsExecutable checks.
+func (k Key[T]) Get(ctx Context) (T, bool) {
+	v, ok := ctx.Get(k.name).(T)
+	return v, ok
+}
+
+// MustGet returns the value stored under the key. When the key is missing or
+// holds a different type, an error wrapping ErrMissingKey or ErrWrongType is
+// recorded on the context under the owner's name and false is returned, so
+// the calling command can simply return.
+//
+// Inputs:
+//   - ctx: The context to read from.
+//   - owner: The name of the command reading the value, used as the error key.
+//
+// Outputs:
+//   - T: The value, or the zero value of T on failure.
+//   - bool: True if the value was present and of the expected type.
+func (k Key[T]) MustGet(ctx Context, owner string) (T, bool) {
+	raw := ctx.Get(k.name)
+	if raw == nil {
+		var zero T
+		ctx.AddError(owner, fmt.Errorf("%w: %s", ErrMissingKey, k.name))
+		return zero, false
+	}
+	v, ok := raw.(T)
+	if !ok {
+		ctx.AddError(owner, fmt.Errorf("%w: %s holds %T, expected %s",
+			ErrWrongType, k.name, raw, reflect.TypeOf((*T)(nil)).Elem()))
+		return v, false
+	}
+	return v, true
+}
+
+// Set stores the value under the key.
+func (k Key[T]) Set(ctx Context, value T) Context {
+	return ctx.Add(k.name, value)
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor (Chain of Responsibility) provides the fundamental building blocks
+// for creating workflows. This file isolates panics raised by commands, so that
+// one bad message fails its own workflow instead of the whole server.
+//
+// Logic Flow:
+//  1. Chains, routers and parallel branches run every command (and its
+//     `IsExecutable` check) behind a deferred `recover`.
+//  2. A recovered panic becomes a `*PanicError` on the context, under the
+//     command's name. It matches `ErrPanic` with `errors.Is`.
+//  3. The panic and its stack trace are recorded on the command's span, and the
+//     `cor.command.panic` counter is incremented with the command name.
+//  4. Execution then continues as for any other failed command.
+package cor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrPanic is matched by every error recorded for a recovered panic.
+var ErrPanic = errors.New("command panicked")
+
+// PanicError is recorded on the context when a command panics.
+type PanicError struct {
+	Command string      // The name of the command that panicked.
+	Value   interface{} // The value passed to panic.
+	Stack   string      // The stack trace at the point of the panic.
+}
+
+// Error describes the panic without the stack trace.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%v: %s: %v", ErrPanic, e.Command, e.Value)
+}
+
+// Unwrap makes a PanicError match ErrPanic.
+func (e *PanicError) Unwrap() error {
+	return ErrPanic
+}
+
+// panicCounter counts recovered panics, with the command name as an attribute.
+var panicCounter = sync.OnceValue(func() metric.Int64Counter {
+	meter := otel.Meter("github.com/GoogleCloudPlatform/solutions/media")
+	counter, err := meter.Int64Counter("cor.command.panic",
+		metric.WithDescription("The number of panics recovered from commands."))
+	if err != nil {
+		log.Printf("error creating panic counter: %v\n", err)
+	}
+	return counter
+})
+
+// RecordPanic reports a recovered panic: it logs it, attaches it and its stack
+// trace to the current span, counts it and returns the error to record. It is
+// exported for code outside a chain that runs commands, such as message
+// listeners.
+//
+// Inputs:
+//   - ctx: The Go context whose span should record the panic.
+//   - command: The name of the command (or component) that panicked.
+//   - value: The value returned by recover.
+//
+// Outputs:
+//   - *PanicError: The error describing the panic.
+func RecordPanic(ctx context.Context, command string, value interface{}) *PanicError {
+	err := &PanicError{Command: command, Value: value, Stack: string(debug.Stack())}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	slog.ErrorContext(ctx, "command panicked", "command", command, "panic", fmt.Sprint(value), "stack", err.Stack)
+
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err, trace.WithAttributes(
+		attribute.String("exception.stacktrace", err.Stack),
+		attribute.String("cor.command", command)))
+	span.SetAttributes(attribute.Bool("cor.panic", true))
+	span.SetStatus(codes.Error, err.Error())
+
+	if counter := panicCounter(); counter != nil {
+		counter.Add(ctx, 1, metric.WithAttributes(attribute.String("cor.command", command)))
+	}
+	return err
+}
+
+// recoverCommand must be deferred. It turns a panic of the command into an
+// error on the context.
+func recoverCommand(command Command, chCtx Context) {
+	if r := recover(); r != nil {
+		chCtx.AddError(command.GetName(), RecordPanic(chCtx.GetContext(), command.GetName(), r))
+	}
+}
+
+// isExecutable calls the command's IsExecutable, treating a panic as a failed
+// check that is recorded on the context.
+func isExecutable(command Command, chCtx Context) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			chCtx.AddError(command.GetName(), RecordPanic(chCtx.GetContext(), command.GetName(), r))
+			ok = false
+		}
+	}()
+	return command.IsExecutable(chCtx)
+}
@@ -0,0 +1,191 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor (Chain of Responsibility) provides the fundamental building blocks
+// for creating workflows. This file defines `ParallelChain`, a fan-out/fan-in
+// implementation of the `Chain` interface.
+//
+// Logic Flow:
+// Where a `BaseChain` runs its commands one after another, a `ParallelChain`
+// runs all of them at the same time against the same starting state and then
+// merges what they produced. This is useful when several independent steps
+// consume the same input, e.g. resizing a video and summarizing it with Gemini
+// after a single GCS download.
+//
+//  1. **Execution starts**: A span is created for the whole parallel group.
+//  2. **Fan-out**: Every command gets its own branch context (reads fall through
+//     to the shared context, writes stay on the branch) and its own child span,
+//     and is executed in a separate goroutine through the interceptors inherited
+//     from the enclosing chain.
+//  3. **Failure handling**: With `FailFast` (the default) the first branch that
+//     records an error cancels the Go context handed to its siblings. With
+//     `CollectAll` every branch runs to completion.
+//  4. **Fan-in**: Once all branches are done, their writes, errors and temporary
+//     files are merged into the shared context in the order the commands were
+//     added, so the result is deterministic when two branches write the same key.
+//  5. **Output**: The `CtxOut` value of each branch is collected into a
+//     `map[string]interface{}` keyed by command name and stored under the
+//     chain's output parameter.
+package cor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// FailurePolicy controls how a ParallelChain reacts when one of its branches fails.
+type FailurePolicy int
+
+const (
+	// FailFast cancels the Go context of the remaining branches as soon as one
+	// branch records an error.
+	FailFast FailurePolicy = iota
+	// CollectAll lets every branch run to completion and collects all errors.
+	CollectAll
+)
+
+// ParallelChain is a Chain that executes its commands concurrently and merges
+// their outputs.
+type ParallelChain struct {
+	BaseCommand
+	failurePolicy FailurePolicy // How to react when a branch fails.
+	commands      []Command     // The commands to run concurrently.
+}
+
+// NewParallelChain is the constructor for ParallelChain.
+//
+// Inputs:
+//   - name: A string name for this chain instance, used for logging and telemetry.
+//
+// Outputs:
+//   - *ParallelChain: A pointer to the newly instantiated chain, using the FailFast policy.
+func NewParallelChain(name string) *ParallelChain {
+	return &ParallelChain{BaseCommand: *NewBaseCommand(name), failurePolicy: FailFast}
+}
+
+// WithFailurePolicy is a builder method that sets how the chain reacts to a failing branch.
+//
+// Inputs:
+//   - policy: Either FailFast or CollectAll.
+//
+// Outputs:
+//   - *ParallelChain: The chain instance, allowing for fluent method chaining.
+func (c *ParallelChain) WithFailurePolicy(policy FailurePolicy) *ParallelChain {
+	c.failurePolicy = policy
+	return c
+}
+
+// ContinueOnFailure maps the generic Chain setting onto a failure policy:
+// true selects CollectAll and false selects FailFast.
+func (c *ParallelChain) ContinueOnFailure(continueOnFailure bool) Chain {
+	if continueOnFailure {
+		c.failurePolicy = CollectAll
+	} else {
+		c.failurePolicy = FailFast
+	}
+	return c
+}
+
+// AddCommand adds a command to be run as a separate branch.
+func (c *ParallelChain) AddCommand(command Command) Chain {
+	c.commands = append(c.commands, command)
+	return c
+}
+
+// IsExecutable checks if the chain can be executed. Like BaseChain, this only
+// requires a valid Go context; each branch checks its own preconditions.
+func (c *ParallelChain) IsExecutable(context Context) bool {
+	return context != nil && context.GetContext() != nil
+}
+
+// Execute runs every command concurrently and merges the results into chCtx.
+//
+// Inputs:
+//   - chCtx: The shared `cor.Context` for the workflow execution.
+func (c *ParallelChain) Execute(chCtx Context) {
+	parentCtx := chCtx.GetContext()
+
+	outerCtx, chainSpan := c.Tracer.Start(parentCtx, fmt.Sprintf("%s_execute", c.GetName()))
+	defer chainSpan.End()
+
+	// All branches share a cancelable context so that FailFast can stop siblings.
+	runCtx, cancel := context.WithCancel(outerCtx)
+	defer cancel()
+
+	branches := make([]*branchContext, len(c.commands))
+	var wg sync.WaitGroup
+
+	for i, command := range c.commands {
+		branch := newBranchContext(chCtx)
+		branches[i] = branch
+
+		branchCtx, branchSpan := c.Tracer.Start(runCtx, command.GetName())
+		branch.SetContext(branchCtx)
+
+		wg.Add(1)
+		go func(command Command, branch *branchContext, span trace.Span) {
+			defer wg.Done()
+			defer span.End()
+
+			if !isExecutable(command, branch) {
+				span.SetStatus(codes.Error, fmt.Sprintf("command not executable: %s", command.GetName()))
+				return
+			}
+
+			invoke(interceptorsFrom(runCtx), command, branch)
+
+			if branch.failed() {
+				span.SetStatus(codes.Error, "error during command execution")
+				if c.failurePolicy == FailFast {
+					cancel()
+				}
+			} else {
+				span.SetStatus(codes.Ok, "command completed successfully")
+			}
+		}(command, branch, branchSpan)
+	}
+
+	wg.Wait()
+
+	// Merge the branches back in declaration order and gather their outputs.
+	outputs := make(map[string]interface{})
+	for i, branch := range branches {
+		if out := branch.local(CtxOut); out != nil {
+			outputs[c.commands[i].GetName()] = out
+		}
+		branch.merge(CtxIn, CtxOut)
+	}
+
+	chCtx.SetContext(parentCtx)
+	chCtx.Add(c.GetOutputParam(), outputs)
+
+	if !chCtx.HasErrors() {
+		chainSpan.SetStatus(codes.Ok, "parallel chain completed successfully")
+	} else {
+		// Like BaseChain, a FailFast group undoes the side effects of its branches.
+		if c.failurePolicy == FailFast {
+			c.Compensate(chCtx)
+		}
+		chainSpan.SetStatus(codes.Error, "parallel chain failed to execute")
+	}
+}
+
+// Compensate undoes the side effects of the branches in reverse declaration order.
+func (c *ParallelChain) Compensate(context Context) bool {
+	return len(compensateAll(c.Tracer, context, c.commands)) > 0
+}
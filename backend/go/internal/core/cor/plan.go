@@ -0,0 +1,327 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor (Chain of Responsibility) provides the fundamental building blocks
+// for creating workflows. This file implements the dry-run planner, which shows
+// what a chain would do without executing any of its commands.
+//
+// Logic Flow:
+//  1. **Simulation**: The chain is walked on a copy-on-write view of the given
+//     context, so the caller's context is never changed. No command's `Execute`
+//     is called.
+//  2. **Steps**: For every command, the keys it reads and writes are taken from
+//     `KeyDeclarer` and `IsExecutable` is evaluated against the simulated
+//     context. An executable command's outputs are then filled with placeholder
+//     values, and the chain's usual `CtxOut`→`CtxIn` piping is applied.
+//  3. **Composites**: Nested chains are walked in order and parallel branches
+//     each on their own branch. Routers are not evaluated, since their
+//     predicates would only see placeholders; instead every route is planned,
+//     and the keys written on any route are treated as available afterwards.
+//     A `RetryCommand` is planned as the command it wraps.
+//  4. **Diagnostics**: Every key that a command reads but that is not present
+//     at that point is reported, naming the step that produces it later, if any.
+package cor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CtxPlan is the key under which a chain in dry-run mode stores its `*ExecutionPlan`.
+const CtxPlan = "__PLAN__"
+
+// KeyDeclarer is implemented by commands that can describe which context keys
+// they read and write. `BaseCommand` declares its input and output parameters;
+// commands that use additional keys override these methods.
+type KeyDeclarer interface {
+	// InputKeys returns the keys the command reads and requires.
+	InputKeys() []string
+	// OutputKeys returns the keys the command writes on success.
+	OutputKeys() []string
+}
+
+// Kinds of steps in an ExecutionPlan.
+const (
+	PlanKindCommand  = "command"
+	PlanKindChain    = "chain"
+	PlanKindParallel = "parallel"
+	PlanKindIf       = "if"
+	PlanKindSwitch   = "switch"
+)
+
+// PlanStep describes what a single command would do.
+type PlanStep struct {
+	Name     string   // The command name.
+	Kind     string   // One of the PlanKind constants.
+	Depth    int      // The nesting depth; 0 for the planned chain itself.
+	Route    string   // The route that selects this command, if it is a branch of a router.
+	Attempts int      // The maximum attempts if the command is retried; 0 otherwise.
+	Inputs   []string // The keys the command reads.
+	Outputs  []string // The keys the command writes.
+	Skipped  bool     // True if the command would not be executable.
+	Reason   string   // Why the command would be skipped.
+}
+
+// Diagnostic reports a key that a step reads but that is not available to it.
+type Diagnostic struct {
+	Step    string // The step that reads the key.
+	Key     string // The missing key.
+	Message string // A human-readable description of the problem.
+}
+
+// String formats the diagnostic for logs.
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s", d.Step, d.Message)
+}
+
+// ExecutionPlan is the result of a dry run.
+type ExecutionPlan struct {
+	Chain       string       // The name of the planned chain.
+	Steps       []PlanStep   // The steps in execution order.
+	Diagnostics []Diagnostic // The problems found; empty if none.
+}
+
+// OK reports whether the plan has no diagnostics.
+func (p *ExecutionPlan) OK() bool {
+	return len(p.Diagnostics) == 0
+}
+
+// String formats the plan as an indented, human-readable report.
+func (p *ExecutionPlan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "plan for %s:\n", p.Chain)
+	for _, step := range p.Steps {
+		b.WriteString(strings.Repeat("  ", step.Depth))
+		if len(step.Route) > 0 {
+			fmt.Fprintf(&b, "[%s] ", step.Route)
+		}
+		fmt.Fprintf(&b, "%s (%s)", step.Name, step.Kind)
+		if step.Attempts > 1 {
+			fmt.Fprintf(&b, " retried up to %d times", step.Attempts)
+		}
+		if step.Kind == PlanKindCommand {
+			fmt.Fprintf(&b, " reads %v writes %v", step.Inputs, step.Outputs)
+		}
+		if step.Skipped {
+			fmt.Fprintf(&b, " SKIPPED: %s", step.Reason)
+		}
+		b.WriteString("\n")
+	}
+	if p.OK() {
+		b.WriteString("no problems found\n")
+	}
+	for _, d := range p.Diagnostics {
+		fmt.Fprintf(&b, "problem: %s\n", d)
+	}
+	return b.String()
+}
+
+// plannedValue is the placeholder stored in the simulated context for every
+// key a step would write.
+type plannedValue struct {
+	step string
+	key  string
+}
+
+// missingRead is a read of a key that was not available when the step ran.
+type missingRead struct {
+	step string
+	key  string
+}
+
+// planner accumulates an ExecutionPlan while walking a chain.
+type planner struct {
+	plan     *ExecutionPlan
+	produced map[string]string // The first step to write each key.
+	missing  []missingRead     // Diagnosed once every producer is known.
+}
+
+// newPlan walks the commands of a chain on a simulated copy of the context.
+//
+// Inputs:
+//   - chain: The chain being planned.
+//   - chCtx: The context the chain would be executed with.
+//
+// Outputs:
+//   - *ExecutionPlan: The plan, including diagnostics.
+func newPlan(chain *BaseChain, chCtx Context) *ExecutionPlan {
+	p := &planner{plan: &ExecutionPlan{Chain: chain.GetName()}, produced: make(map[string]string)}
+	sim := newBranchContext(chCtx)
+	if sim.GetContext() == nil {
+		// Commands are never executed in a dry run, so the Go context is only
+		// seen by IsExecutable.
+		sim.SetContext(context.Background())
+	}
+	p.walk(chain, sim, 0, "", 0)
+	p.diagnose()
+	return p.plan
+}
+
+// walk adds the command, and anything it contains, to the plan.
+func (p *planner) walk(command Command, sim Context, depth int, route string, attempts int) {
+	switch cmd := command.(type) {
+	case *RetryCommand:
+		p.walk(cmd.Command, sim, depth, route, cmd.policy.MaxAttempts)
+
+	case *BaseChain:
+		p.add(PlanStep{Name: cmd.GetName(), Kind: PlanKindChain, Depth: depth, Route: route, Attempts: attempts})
+		for _, child := range cmd.commands {
+			p.walk(child, sim, depth+1, "", 0)
+			pipe(sim)
+		}
+
+	case *ParallelChain:
+		p.add(PlanStep{Name: cmd.GetName(), Kind: PlanKindParallel, Depth: depth, Route: route, Attempts: attempts})
+		outputs := make(map[string]interface{})
+		branches := make([]*branchContext, len(cmd.commands))
+		for i, child := range cmd.commands {
+			branches[i] = newBranchContext(sim)
+			p.walk(child, branches[i], depth+1, "", 0)
+			if out := branches[i].local(CtxOut); out != nil {
+				outputs[child.GetName()] = out
+			}
+		}
+		for _, branch := range branches {
+			branch.merge(CtxIn, CtxOut)
+		}
+		sim.Add(cmd.GetOutputParam(), outputs)
+		p.produce(cmd.GetOutputParam(), cmd.GetName())
+
+	case *IfCommand:
+		p.add(PlanStep{Name: cmd.GetName(), Kind: PlanKindIf, Depth: depth, Route: route, Attempts: attempts})
+		p.walkRoutes(sim, depth+1, []string{"then", "else"}, []Command{cmd.then, cmd.otherwise})
+
+	case *SwitchCommand:
+		p.add(PlanStep{Name: cmd.GetName(), Kind: PlanKindSwitch, Depth: depth, Route: route, Attempts: attempts})
+		labels := make([]string, 0, len(cmd.cases)+1)
+		for label := range cmd.cases {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		branches := make([]Command, 0, len(labels)+1)
+		for _, label := range labels {
+			branches = append(branches, cmd.cases[label])
+		}
+		labels = append(labels, "default")
+		branches = append(branches, cmd.defaultCase)
+		p.walkRoutes(sim, depth+1, labels, branches)
+
+	default:
+		p.walkCommand(command, sim, depth, route, attempts)
+	}
+}
+
+// walkRoutes plans every route of a router on its own branch and then merges
+// all of them, so that a key written on any route counts as available.
+func (p *planner) walkRoutes(sim Context, depth int, labels []string, routes []Command) {
+	branches := make([]*branchContext, 0, len(routes))
+	for i, route := range routes {
+		if route == nil {
+			continue
+		}
+		branch := newBranchContext(sim)
+		p.walk(route, branch, depth, labels[i], 0)
+		forwardInput(branch)
+		branches = append(branches, branch)
+	}
+	for _, branch := range branches {
+		branch.merge()
+	}
+	forwardInput(sim)
+}
+
+// walkCommand plans a single, non-composite command.
+func (p *planner) walkCommand(command Command, sim Context, depth int, route string, attempts int) {
+	inputs, outputs := declaredKeys(command)
+	step := PlanStep{
+		Name:     command.GetName(),
+		Kind:     PlanKindCommand,
+		Depth:    depth,
+		Route:    route,
+		Attempts: attempts,
+		Inputs:   inputs,
+		Outputs:  outputs,
+	}
+
+	absent := make([]string, 0)
+	for _, key := range inputs {
+		if sim.Get(key) == nil {
+			absent = append(absent, key)
+			p.missing = append(p.missing, missingRead{step: step.Name, key: key})
+		}
+	}
+
+	if isExecutable(command, sim) {
+		for _, key := range outputs {
+			sim.Add(key, plannedValue{step: step.Name, key: key})
+			p.produce(key, step.Name)
+		}
+	} else {
+		step.Skipped = true
+		if len(absent) > 0 {
+			step.Reason = fmt.Sprintf("missing %s", strings.Join(absent, ", "))
+		} else {
+			step.Reason = "not executable with the simulated context"
+		}
+	}
+	p.add(step)
+}
+
+// add appends a step to the plan.
+func (p *planner) add(step PlanStep) {
+	p.plan.Steps = append(p.plan.Steps, step)
+}
+
+// produce records the first step that writes a key.
+func (p *planner) produce(key string, step string) {
+	if _, ok := p.produced[key]; !ok {
+		p.produced[key] = step
+	}
+}
+
+// diagnose turns the missing reads into diagnostics.
+func (p *planner) diagnose() {
+	for _, read := range p.missing {
+		message := fmt.Sprintf("reads %s, which no step produces", read.key)
+		if producer, ok := p.produced[read.key]; ok {
+			message = fmt.Sprintf("reads %s before it is produced (by %s)", read.key, producer)
+		}
+		p.plan.Diagnostics = append(p.plan.Diagnostics, Diagnostic{Step: read.step, Key: read.key, Message: message})
+	}
+}
+
+// declaredKeys returns the keys a command reads and writes, without duplicates.
+// Commands that do not implement KeyDeclarer are assumed to use only their
+// input and output parameters.
+func declaredKeys(command Command) ([]string, []string) {
+	if declarer, ok := command.(KeyDeclarer); ok {
+		return uniqueKeys(declarer.InputKeys()), uniqueKeys(declarer.OutputKeys())
+	}
+	return []string{command.GetInputParam()}, []string{command.GetOutputParam()}
+}
+
+// uniqueKeys removes empty and repeated keys, preserving order.
+func uniqueKeys(keys []string) []string {
+	out := make([]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if len(key) > 0 && !seen[key] {
+			seen[key] = true
+			out = append(out, key)
+		}
+	}
+	return out
+}
@@ -0,0 +1,194 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor (Chain of Responsibility) provides the fundamental building blocks
+// for creating workflows. This file defines `RetryCommand`, a decorator that
+// re-executes any `Command` according to a `RetryPolicy`.
+//
+// Logic Flow:
+//  1. **Attempt**: The wrapped command runs on a branch context (see
+//     `branchContext`) whose Go context carries the per-attempt timeout, so a
+//     failed attempt leaves no partial writes or errors in the shared context.
+//  2. **Telemetry**: Every attempt is recorded as a `retry.attempt` event on the
+//     current span and counted in the `<command>.retry.attempt` metric.
+//  3. **Success**: The branch is merged into the shared context and the
+//     decorator returns.
+//  4. **Failure**: If attempts remain, the errors are retryable and the workflow
+//     has not been canceled, the decorator waits for an exponentially growing,
+//     jittered backoff and tries again. Otherwise the last attempt's results,
+//     including its errors, are merged so the enclosing chain sees the failure.
+//
+// Temporary files created by failed attempts are always handed to the shared
+// context so they are still cleaned up when the workflow closes.
+package cor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RetryPolicy describes how often and how quickly a command is retried.
+type RetryPolicy struct {
+	MaxAttempts    int                  // Total number of attempts, including the first. Values below 1 mean 1.
+	InitialBackoff time.Duration        // The wait before the second attempt.
+	MaxBackoff     time.Duration        // The upper bound for any single wait. Zero means unbounded.
+	Multiplier     float64              // The factor applied to the wait after each attempt. Values below 1 mean 1.
+	Jitter         float64              // The fraction (0-1) of each wait that is randomized.
+	AttemptTimeout time.Duration        // The deadline applied to each attempt. Zero means no deadline.
+	Retryable      func(err error) bool // Decides whether an error is worth retrying. Nil uses IsRetryable.
+}
+
+// DefaultRetryPolicy returns a policy suitable for calls to Google Cloud
+// services: 3 attempts, starting at 1 second and doubling up to 30 seconds
+// with 20% jitter.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// IsRetryable is the default retry predicate. Every error is retried except
+// the cancellation of the workflow itself, and errors that declare themselves
+// permanent through a `Retryable() bool` method (e.g., a generation blocked by
+// safety filters).
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var classified interface{ Retryable() bool }
+	if errors.As(err, &classified) {
+		return classified.Retryable()
+	}
+	return true
+}
+
+// Backoff returns the wait before the given attempt (starting at 1 for the
+// wait after the first attempt).
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	multiplier := math.Max(p.Multiplier, 1)
+	wait := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 {
+		wait = math.Min(wait, float64(p.MaxBackoff))
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		wait = wait * (1 - jitter + 2*jitter*rand.Float64())
+	}
+	return time.Duration(wait)
+}
+
+// RetryCommand wraps a Command and re-executes it according to a RetryPolicy.
+// Everything other than Execute is delegated to the wrapped command, so it can
+// be used anywhere the wrapped command could.
+type RetryCommand struct {
+	Command
+	policy         RetryPolicy
+	attemptCounter metric.Int64Counter
+}
+
+// NewRetryCommand is the constructor for RetryCommand.
+//
+// Inputs:
+//   - command: The command to decorate.
+//   - policy: The retry policy to apply.
+//
+// Outputs:
+//   - *RetryCommand: A pointer to the newly instantiated decorator.
+func NewRetryCommand(command Command, policy RetryPolicy) *RetryCommand {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = IsRetryable
+	}
+	meter := otel.Meter("github.com/GoogleCloudPlatform/solutions/media")
+	counter, err := meter.Int64Counter(fmt.Sprintf("%s.retry.attempt", command.GetName()))
+	if err != nil {
+		log.Printf("error creating retry counter for command '%s': %v\n", command.GetName(), err)
+	}
+	return &RetryCommand{Command: command, policy: policy, attemptCounter: counter}
+}
+
+// Execute runs the wrapped command until it succeeds, a non-retryable error is
+// recorded, the workflow is canceled or the policy's attempts are exhausted.
+//
+// Inputs:
+//   - chCtx: The shared `cor.Context` for this workflow execution.
+func (r *RetryCommand) Execute(chCtx Context) {
+	parentCtx := chCtx.GetContext()
+	span := trace.SpanFromContext(parentCtx)
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := parentCtx, context.CancelFunc(func() {})
+		if r.policy.AttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(parentCtx, r.policy.AttemptTimeout)
+		}
+
+		branch := newBranchContext(chCtx)
+		branch.SetContext(attemptCtx)
+
+		span.AddEvent("retry.attempt", trace.WithAttributes(
+			attribute.String("cor.command", r.GetName()),
+			attribute.Int("cor.attempt", attempt)))
+		if r.attemptCounter != nil {
+			r.attemptCounter.Add(parentCtx, 1, metric.WithAttributes(attribute.Int("attempt", attempt)))
+		}
+
+		r.Command.Execute(branch)
+		cancel()
+
+		if !branch.failed() {
+			branch.merge()
+			return
+		}
+
+		err := branch.err()
+		if attempt >= r.policy.MaxAttempts || !r.policy.Retryable(err) || parentCtx.Err() != nil {
+			branch.merge()
+			return
+		}
+		branch.discard()
+
+		wait := r.policy.Backoff(attempt)
+		log.Printf("%s failed on attempt %d/%d, retrying in %s: %v\n", r.GetName(), attempt, r.policy.MaxAttempts, wait, err)
+		select {
+		case <-parentCtx.Done():
+			chCtx.AddError(r.GetName(), parentCtx.Err())
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Compensate forwards compensation to the wrapped command, if it supports it.
+func (r *RetryCommand) Compensate(context Context) bool {
+	if compensator, ok := r.Command.(Compensator); ok {
+		return compensator.Compensate(context)
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor (Chain of Responsibility) provides the fundamental building blocks
+// for creating workflows. This file defines the routing commands `IfCommand`
+// and `SwitchCommand`, which let a chain choose a sub-chain at runtime based on
+// the contents of the context.
+//
+// Logic Flow:
+//  1. **Selection**: The router evaluates its predicate (If) or selector (Switch)
+//     against the shared context and picks at most one branch.
+//  2. **Execution**: The selected branch runs on the shared context under its own
+//     child span and through the enclosing chain's interceptors, exactly as a
+//     command in a `BaseChain` would.
+//  3. **Piping**: A nested `BaseChain` leaves its final result in `CtxIn` rather
+//     than `CtxOut`. So that a router is transparent to the enclosing chain, any
+//     branch that does not produce a `CtxOut` has its `CtxIn` forwarded as the
+//     router's output. When no branch is selected, the router is a pass-through.
+package cor
+
+import (
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Predicate decides whether an IfCommand takes its "then" branch.
+type Predicate func(context Context) bool
+
+// Selector returns the case value a SwitchCommand should route on.
+type Selector func(context Context) string
+
+// IfCommand runs one of two commands depending on a predicate.
+type IfCommand struct {
+	BaseCommand
+	predicate Predicate // Decides which branch to run.
+	then      Command   // Run when the predicate returns true.
+	otherwise Command   // Run when the predicate returns false; may be nil.
+}
+
+// NewIf is the constructor for IfCommand.
+//
+// Inputs:
+//   - name: A string name for this command instance, used for logging and telemetry.
+//   - predicate: The condition evaluated against the context.
+//   - then: The command (often a chain) to run when the predicate is true.
+//   - otherwise: The command to run when the predicate is false. When nil, the
+//     data in the context is passed through unchanged.
+//
+// Outputs:
+//   - *IfCommand: A pointer to the newly instantiated command.
+func NewIf(name string, predicate Predicate, then Command, otherwise Command) *IfCommand {
+	return &IfCommand{BaseCommand: *NewBaseCommand(name), predicate: predicate, then: then, otherwise: otherwise}
+}
+
+// IsExecutable checks if the router can be executed. Like a chain, this only
+// requires a valid Go context; the selected branch checks its own preconditions.
+func (c *IfCommand) IsExecutable(context Context) bool {
+	return context != nil && context.GetContext() != nil
+}
+
+// Execute evaluates the predicate and runs the matching branch.
+//
+// Inputs:
+//   - context: The shared `cor.Context` for this workflow execution.
+func (c *IfCommand) Execute(context Context) {
+	branch, label := c.otherwise, "else"
+	if c.predicate(context) {
+		branch, label = c.then, "then"
+	}
+	executeRoute(c.Tracer, context, label, branch)
+}
+
+// SwitchCommand runs the command registered for the value returned by its selector.
+type SwitchCommand struct {
+	BaseCommand
+	selector    Selector           // Produces the value to route on.
+	cases       map[string]Command // The command to run for each value.
+	defaultCase Command            // Run when no case matches; may be nil.
+}
+
+// NewSwitch is the constructor for SwitchCommand.
+//
+// Inputs:
+//   - name: A string name for this command instance, used for logging and telemetry.
+//   - selector: A function that returns the case value for the current context.
+//
+// Outputs:
+//   - *SwitchCommand: A pointer to the newly instantiated command.
+func NewSwitch(name string, selector Selector) *SwitchCommand {
+	return &SwitchCommand{BaseCommand: *NewBaseCommand(name), selector: selector, cases: make(map[string]Command)}
+}
+
+// NewSwitchOnKey creates a SwitchCommand that routes on the string value stored
+// under the given context key. A missing or non-string value selects the default.
+//
+// Inputs:
+//   - name: A string name for this command instance, used for logging and telemetry.
+//   - key: The context key holding the value to route on.
+//
+// Outputs:
+//   - *SwitchCommand: A pointer to the newly instantiated command.
+func NewSwitchOnKey(name string, key string) *SwitchCommand {
+	k := NewKey[string](key)
+	return NewSwitch(name, func(context Context) string {
+		v, _ := k.Get(context)
+		return v
+	})
+}
+
+// Case is a builder method that registers the command to run for a value.
+//
+// Outputs:
+//   - *SwitchCommand: The command instance, allowing for fluent method chaining.
+func (c *SwitchCommand) Case(value string, command Command) *SwitchCommand {
+	c.cases[value] = command
+	return c
+}
+
+// Default is a builder method that registers the command to run when no case
+// matches. Without a default, unmatched values pass the data through unchanged.
+//
+// Outputs:
+//   - *SwitchCommand: The command instance, allowing for fluent method chaining.
+func (c *SwitchCommand) Default(command Command) *SwitchCommand {
+	c.defaultCase = command
+	return c
+}
+
+// IsExecutable checks if the router can be executed. Like a chain, this only
+// requires a valid Go context; the selected branch checks its own preconditions.
+func (c *SwitchCommand) IsExecutable(context Context) bool {
+	return context != nil && context.GetContext() != nil
+}
+
+// Execute evaluates the selector and runs the matching case.
+//
+// Inputs:
+//   - context: The shared `cor.Context` for this workflow execution.
+func (c *SwitchCommand) Execute(context Context) {
+	value := c.selector(context)
+	branch, ok := c.cases[value]
+	if !ok {
+		branch = c.defaultCase
+	}
+	executeRoute(c.Tracer, context, value, branch)
+}
+
+// executeRoute runs the selected branch under a child span and makes sure the
+// branch's result ends up in CtxOut for the enclosing chain.
+//
+// Inputs:
+//   - tracer: The router's tracer.
+//   - context: The shared `cor.Context` for this workflow execution.
+//   - label: The route taken, recorded on the span.
+//   - branch: The command to run; nil means pass-through.
+func executeRoute(tracer trace.Tracer, context Context, label string, branch Command) {
+	if branch != nil {
+		parentCtx := context.GetContext()
+		branchCtx, span := tracer.Start(parentCtx, branch.GetName(),
+			trace.WithAttributes(attribute.String("cor.route", label)))
+
+		if isExecutable(branch, context) {
+			context.SetContext(branchCtx)
+			invoke(interceptorsFrom(parentCtx), branch, context)
+			context.SetContext(parentCtx)
+		} else {
+			span.SetStatus(codes.Error, fmt.Sprintf("command not executable: %s", branch.GetName()))
+		}
+
+		if context.HasErrors() {
+			span.SetStatus(codes.Error, "error during or after command execution")
+		} else {
+			span.SetStatus(codes.Ok, "command completed successfully")
+		}
+		span.End()
+	}
+
+	forwardInput(context)
+}
+
+// forwardInput copies CtxIn to CtxOut if the branch did not produce an output.
+func forwardInput(context Context) {
+	if context.Get(CtxOut) == nil {
+		if in := context.Get(CtxIn); in != nil {
+			context.Add(CtxOut, in)
+		}
+	}
+}
+
+// Compensate forwards compensation to both branches. Only the branch that ran
+// has undo records, so the other one is a no-op.
+func (c *IfCommand) Compensate(context Context) bool {
+	branches := make([]Command, 0, 2)
+	for _, branch := range []Command{c.then, c.otherwise} {
+		if branch != nil {
+			branches = append(branches, branch)
+		}
+	}
+	return len(compensateAll(c.Tracer, context, branches)) > 0
+}
+
+// Compensate forwards compensation to every case and the default. Only the
+// case that ran has undo records, so the others are no-ops.
+func (c *SwitchCommand) Compensate(context Context) bool {
+	branches := make([]Command, 0, len(c.cases)+1)
+	for _, branch := range c.cases {
+		branches = append(branches, branch)
+	}
+	if c.defaultCase != nil {
+		branches = append(branches, c.defaultCase)
+	}
+	return len(compensateAll(c.Tracer, context, branches)) > 0
+}
@@ -0,0 +1,151 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor_test contains unit tests for the chain of responsibility
+// building blocks. This file tests resumable `BaseChain` runs backed by a
+// `FileCheckpointStore`.
+package cor_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+)
+
+// summary is a domain type used to check that registered types round-trip.
+type summary struct {
+	Title string `json:"title"`
+}
+
+func init() {
+	cor.RegisterCheckpointType("cor_test.summary", &summary{})
+}
+
+// TestBaseChainResumesFromCheckpoint verifies that a failed run saves the
+// completed steps, that a second run with the same run ID restores them
+// without executing the commands again, and that success deletes the checkpoint.
+func TestBaseChainResumesFromCheckpoint(t *testing.T) {
+	store := cor.NewFileCheckpointStore(t.TempDir())
+	runID := func(ctx cor.Context) string { return ctx.Get(cor.CtxIn).(string) }
+
+	summarized, persisted := 0, 0
+	failPersist := true
+	chain := cor.NewBaseChain("resumable").WithCheckpoints(store, runID)
+	chain.AddCommand(NewFuncCommand("summarize", func(ctx cor.Context) {
+		summarized++
+		ctx.Add("summary", &summary{Title: "Big Buck Bunny"})
+		ctx.Add(cor.CtxOut, "scenes")
+	}))
+	chain.AddCommand(NewFuncCommand("persist", func(ctx cor.Context) {
+		persisted++
+		if failPersist {
+			ctx.AddError("persist", errors.New("bigquery unavailable"))
+			return
+		}
+		ctx.Add("persisted-input", ctx.Get(cor.CtxIn))
+	}))
+
+	chainCtx := newTestContext("bucket/video.mp4#1")
+	chain.Execute(chainCtx)
+	assert.True(t, chainCtx.HasErrors())
+
+	saved, err := store.Load(context.Background(), "bucket/video.mp4#1")
+	assert.NoError(t, err)
+	assert.Contains(t, saved.Steps, "summarize")
+	assert.NotContains(t, saved.Steps, "persist")
+
+	failPersist = false
+	chainCtx = newTestContext("bucket/video.mp4#1")
+	chain.Execute(chainCtx)
+
+	assert.False(t, chainCtx.HasErrors())
+	assert.Equal(t, 1, summarized)
+	assert.Equal(t, 2, persisted)
+	assert.Equal(t, &summary{Title: "Big Buck Bunny"}, chainCtx.Get("summary"))
+	assert.Equal(t, "scenes", chainCtx.Get("persisted-input"))
+
+	saved, err = store.Load(context.Background(), "bucket/video.mp4#1")
+	assert.NoError(t, err)
+	assert.Nil(t, saved)
+}
+
+// TestBaseChainDoesNotCheckpointTempFiles verifies that commands producing
+// local temporary files are executed again on resume.
+func TestBaseChainDoesNotCheckpointTempFiles(t *testing.T) {
+	store := cor.NewFileCheckpointStore(t.TempDir())
+	runID := func(ctx cor.Context) string { return "run" }
+
+	downloads := 0
+	chain := cor.NewBaseChain("downloads").WithCheckpoints(store, runID)
+	chain.AddCommand(NewFuncCommand("download", func(ctx cor.Context) {
+		downloads++
+		ctx.AddTempFile("/tmp/video.mp4")
+		ctx.Add(cor.CtxOut, "/tmp/video.mp4")
+	}))
+	chain.AddCommand(NewFuncCommand("fail", func(ctx cor.Context) {
+		ctx.AddError("fail", errors.New("boom"))
+	}))
+
+	chain.Execute(newTestContext("input"))
+	chain.Execute(newTestContext("input"))
+	assert.Equal(t, 2, downloads)
+}
+
+// TestBaseChainKeepsUncompensatedRouterSteps verifies that a router step with
+// nothing to undo keeps its checkpoint when a later step fails, so that the
+// resumed run does not route again, while a step that was undone runs again.
+func TestBaseChainKeepsUncompensatedRouterSteps(t *testing.T) {
+	store := cor.NewFileCheckpointStore(t.TempDir())
+	runID := func(ctx cor.Context) string { return "run" }
+
+	extracted, persisted := 0, 0
+	failPersist := true
+	undone := &undoLog{}
+	router := cor.NewSwitchOnKey("route-media-scenes", "category")
+	router.Case("trailer", NewFuncCommand("extract-scenes", func(ctx cor.Context) {
+		extracted++
+		ctx.Add(cor.CtxOut, "scenes")
+	}))
+	chain := cor.NewBaseChain("resumable").WithCheckpoints(store, runID)
+	chain.AddCommand(NewSideEffectCommand("upload", undone))
+	chain.AddCommand(router)
+	chain.AddCommand(NewFuncCommand("write-to-bigquery", func(ctx cor.Context) {
+		persisted++
+		if failPersist {
+			ctx.AddError("write-to-bigquery", errors.New("bigquery unavailable"))
+		}
+	}))
+
+	chainCtx := newTestContext("input")
+	chainCtx.Add("category", "trailer")
+	chain.Execute(chainCtx)
+	assert.True(t, chainCtx.HasErrors())
+	assert.Equal(t, []string{"resource-upload"}, undone.entries)
+
+	saved, err := store.Load(context.Background(), "run")
+	assert.NoError(t, err)
+	assert.NotContains(t, saved.Steps, "upload")
+	assert.Contains(t, saved.Steps, "route-media-scenes")
+
+	failPersist = false
+	chainCtx = newTestContext("input")
+	chainCtx.Add("category", "trailer")
+	chain.Execute(chainCtx)
+	assert.False(t, chainCtx.HasErrors())
+	assert.Equal(t, 1, extracted)
+	assert.Equal(t, 2, persisted)
+}
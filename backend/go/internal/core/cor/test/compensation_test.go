@@ -0,0 +1,155 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor_test contains unit tests for the chain of responsibility
+// building blocks. This file tests how failed chains compensate the side
+// effects of the commands that already ran.
+package cor_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+)
+
+// undoLog records compensations in the order they happen.
+type undoLog struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (l *undoLog) add(entry string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+// SideEffectCommand records an undo record on success and logs its compensation.
+type SideEffectCommand struct {
+	cor.BaseCommand
+	log *undoLog
+}
+
+// NewSideEffectCommand creates a SideEffectCommand writing to the given log.
+func NewSideEffectCommand(name string, log *undoLog) *SideEffectCommand {
+	return &SideEffectCommand{BaseCommand: *cor.NewBaseCommand(name), log: log}
+}
+
+// Execute pretends to perform a side effect and records how to undo it.
+func (c *SideEffectCommand) Execute(context cor.Context) {
+	cor.SetUndo(context, c.GetName(), "resource-"+c.GetName())
+	context.Add(cor.CtxOut, context.Get(cor.CtxIn))
+}
+
+// Compensate logs the undo record, if there is one.
+func (c *SideEffectCommand) Compensate(context cor.Context) bool {
+	resource, ok := cor.TakeUndo[string](context, c.GetName())
+	if ok {
+		c.log.add(resource)
+	}
+	return ok
+}
+
+// failingCommand returns a command that always records an error.
+func failingCommand(name string) cor.Command {
+	return NewFuncCommand(name, func(ctx cor.Context) {
+		ctx.AddError(name, errors.New("boom"))
+	})
+}
+
+// TestChainCompensatesInReverseOrder verifies that a failing chain undoes the
+// commands that ran, newest first, and skips those that never ran.
+func TestChainCompensatesInReverseOrder(t *testing.T) {
+	undone := &undoLog{}
+	chain := cor.NewBaseChain("chain")
+	chain.AddCommand(NewSideEffectCommand("first", undone))
+	chain.AddCommand(NewSideEffectCommand("second", undone))
+	chain.AddCommand(failingCommand("fails"))
+	chain.AddCommand(NewSideEffectCommand("never-runs", undone))
+
+	chainCtx := newTestContext("input")
+	chain.Execute(chainCtx)
+
+	assert.True(t, chainCtx.HasErrors())
+	assert.Equal(t, []string{"resource-second", "resource-first"}, undone.entries)
+}
+
+// TestChainDoesNotCompensateOnSuccess verifies that undo records are left
+// alone when the chain succeeds.
+func TestChainDoesNotCompensateOnSuccess(t *testing.T) {
+	undone := &undoLog{}
+	chain := cor.NewBaseChain("chain")
+	chain.AddCommand(NewSideEffectCommand("first", undone))
+
+	chainCtx := newTestContext("input")
+	chain.Execute(chainCtx)
+
+	assert.False(t, chainCtx.HasErrors())
+	assert.Empty(t, undone.entries)
+}
+
+// TestChainContinueOnFailureSkipsCompensation verifies that a chain that
+// tolerates failures keeps the side effects of its commands.
+func TestChainContinueOnFailureSkipsCompensation(t *testing.T) {
+	undone := &undoLog{}
+	chain := cor.NewBaseChain("chain")
+	chain.ContinueOnFailure(true)
+	chain.AddCommand(NewSideEffectCommand("first", undone))
+	chain.AddCommand(failingCommand("fails"))
+
+	chainCtx := newTestContext("input")
+	chain.Execute(chainCtx)
+
+	assert.True(t, chainCtx.HasErrors())
+	assert.Empty(t, undone.entries)
+}
+
+// TestNestedChainCompensatedOnce verifies that a nested chain that already
+// compensated itself is not undone a second time by the enclosing chain.
+func TestNestedChainCompensatedOnce(t *testing.T) {
+	undone := &undoLog{}
+	inner := cor.NewBaseChain("inner")
+	inner.AddCommand(NewSideEffectCommand("inner-step", undone))
+	inner.AddCommand(failingCommand("fails"))
+
+	outer := cor.NewBaseChain("outer")
+	outer.AddCommand(NewSideEffectCommand("outer-step", undone))
+	outer.AddCommand(inner)
+
+	chainCtx := newTestContext("input")
+	outer.Execute(chainCtx)
+
+	assert.True(t, chainCtx.HasErrors())
+	assert.Equal(t, []string{"resource-inner-step", "resource-outer-step"}, undone.entries)
+}
+
+// TestRouterForwardsCompensation verifies that a later failure undoes the
+// branch an IfCommand selected.
+func TestRouterForwardsCompensation(t *testing.T) {
+	undone := &undoLog{}
+	chain := cor.NewBaseChain("chain")
+	chain.AddCommand(cor.NewRetryCommand(cor.NewIf("route",
+		func(cor.Context) bool { return true },
+		NewSideEffectCommand("then", undone),
+		NewSideEffectCommand("else", undone)), cor.RetryPolicy{MaxAttempts: 1}))
+	chain.AddCommand(failingCommand("fails"))
+
+	chainCtx := newTestContext("input")
+	chain.Execute(chainCtx)
+
+	assert.Equal(t, []string{"resource-then"}, undone.entries)
+}
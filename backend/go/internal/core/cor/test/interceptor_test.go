@@ -0,0 +1,120 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor_test contains unit tests for the chain of responsibility
+// building blocks. This file tests the interceptors that `BaseChain` applies
+// around every command.
+package cor_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+)
+
+// eventLog records events from interceptors and commands in order.
+type eventLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *eventLog) add(event string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, event)
+}
+
+// tracing returns an interceptor that logs around every command.
+func tracing(label string, log *eventLog) cor.Interceptor {
+	return func(invocation *cor.Invocation, next func()) {
+		log.add(label + ">" + invocation.Command.GetName())
+		next()
+		log.add(label + "<" + invocation.Command.GetName())
+	}
+}
+
+// TestInterceptorsWrapInRegistrationOrder verifies that the first interceptor
+// registered is the outermost and that Before/After hooks run around the command.
+func TestInterceptorsWrapInRegistrationOrder(t *testing.T) {
+	log := &eventLog{}
+	chain := cor.NewBaseChain("chain").Use(
+		tracing("a", log),
+		cor.Before(func(i *cor.Invocation) { log.add("before " + i.Command.GetName()) }),
+		cor.After(func(i *cor.Invocation) { log.add("after " + i.Command.GetName()) }),
+		tracing("b", log))
+	chain.AddCommand(NewFuncCommand("step", func(cor.Context) { log.add("step") }))
+
+	chain.Execute(newTestContext("input"))
+
+	assert.Equal(t, []string{"a>step", "before step", "b>step", "step", "b<step", "after step", "a<step"}, log.events)
+}
+
+// TestInvocationReportsOwnFailure verifies that an invocation only counts as
+// failed when its own command adds an error, even if earlier steps failed.
+func TestInvocationReportsOwnFailure(t *testing.T) {
+	outcomes := make(map[string]bool)
+	chain := cor.NewBaseChain("chain")
+	chain.ContinueOnFailure(true)
+	chain.Use(cor.After(func(i *cor.Invocation) { outcomes[i.Command.GetName()] = i.Failed() }))
+	chain.AddCommand(NewFuncCommand("fails", func(ctx cor.Context) {
+		ctx.Add(cor.CtxOut, ctx.Get(cor.CtxIn))
+		ctx.AddError("fails", errors.New("boom"))
+	}))
+	chain.AddCommand(NewFuncCommand("succeeds", func(ctx cor.Context) { ctx.Add(cor.CtxOut, "ok") }))
+
+	chain.Execute(newTestContext("input"))
+
+	assert.Equal(t, map[string]bool{"fails": true, "succeeds": false}, outcomes)
+}
+
+// TestRecoveryInterceptorTurnsPanicIntoError verifies that a panicking command
+// fails the chain through the context instead of crashing.
+func TestRecoveryInterceptorTurnsPanicIntoError(t *testing.T) {
+	ran := false
+	chain := cor.NewBaseChain("chain").Use(cor.DefaultInterceptors()...)
+	chain.AddCommand(NewFuncCommand("panics", func(cor.Context) { panic("bad input") }))
+	chain.AddCommand(NewFuncCommand("after", func(cor.Context) { ran = true }))
+
+	chainCtx := newTestContext("input")
+	assert.NotPanics(t, func() { chain.Execute(chainCtx) })
+
+	assert.False(t, ran)
+	assert.True(t, chainCtx.HasErrors())
+	assert.True(t, errors.Is(chainCtx.GetErrors()["panics"], cor.ErrPanic))
+}
+
+// TestInterceptorsApplyToNestedCommands verifies that nested chains, router
+// branches and parallel branches inherit the outer chain's interceptors.
+func TestInterceptorsApplyToNestedCommands(t *testing.T) {
+	log := &eventLog{}
+	passThrough := func(ctx cor.Context) { ctx.Add(cor.CtxOut, ctx.Get(cor.CtxIn)) }
+
+	inner := cor.NewBaseChain("inner")
+	inner.AddCommand(NewFuncCommand("inner-step", passThrough))
+
+	parallel := cor.NewParallelChain("parallel")
+	parallel.AddCommand(NewFuncCommand("branch", passThrough))
+
+	outer := cor.NewBaseChain("outer").Use(cor.Before(func(i *cor.Invocation) { log.add(i.Command.GetName()) }))
+	outer.AddCommand(cor.NewIf("route", func(cor.Context) bool { return true }, NewFuncCommand("routed", passThrough), nil))
+	outer.AddCommand(parallel)
+	outer.AddCommand(inner)
+
+	outer.Execute(newTestContext("input"))
+
+	assert.Equal(t, []string{"route", "routed", "parallel", "branch", "inner", "inner-step"}, log.events)
+}
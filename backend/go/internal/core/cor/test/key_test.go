@@ -0,0 +1,84 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor_test contains unit tests for the chain of responsibility
+// building blocks. This file tests the typed `Key[T]` accessors and the
+// concurrency safety of `BaseContext`.
+package cor_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestKeyMustGet verifies that MustGet returns stored values and records
+// errors, rather than panicking, for missing or mistyped values.
+func TestKeyMustGet(t *testing.T) {
+	key := cor.NewKey[string]("path")
+
+	chainCtx := newTestContext(nil)
+	key.Set(chainCtx, "/tmp/video.mp4")
+	v, ok := key.MustGet(chainCtx, "reader")
+	assert.True(t, ok)
+	assert.Equal(t, "/tmp/video.mp4", v)
+	assert.False(t, chainCtx.HasErrors())
+
+	chainCtx = newTestContext(nil)
+	_, ok = key.MustGet(chainCtx, "reader")
+	assert.False(t, ok)
+	assert.ErrorIs(t, chainCtx.GetErrors()["reader"], cor.ErrMissingKey)
+
+	chainCtx = newTestContext(nil)
+	chainCtx.Add("path", 42)
+	_, ok = key.MustGet(chainCtx, "reader")
+	assert.False(t, ok)
+	assert.ErrorIs(t, chainCtx.GetErrors()["reader"], cor.ErrWrongType)
+}
+
+// TestKeyGetHasNoSideEffects verifies that Get does not record errors.
+func TestKeyGetHasNoSideEffects(t *testing.T) {
+	chainCtx := newTestContext(nil)
+	chainCtx.Add("path", 42)
+	_, ok := cor.NewKey[string]("path").Get(chainCtx)
+	assert.False(t, ok)
+	assert.False(t, chainCtx.HasErrors())
+}
+
+// TestBaseContextConcurrentAccess exercises the context from many goroutines;
+// it is meant to be run with -race.
+func TestBaseContextConcurrentAccess(t *testing.T) {
+	chainCtx := newTestContext(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("k%d", i)
+			chainCtx.Add(key, i)
+			chainCtx.Get(key)
+			chainCtx.AddTempFile(key)
+			chainCtx.AddError(key, fmt.Errorf("err %d", i))
+			_ = chainCtx.GetErrors()
+			_ = chainCtx.GetTempFiles()
+			chainCtx.HasErrors()
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, chainCtx.GetErrors(), 50)
+	assert.Len(t, chainCtx.GetTempFiles(), 50)
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor_test contains unit tests for the chain of responsibility
+// building blocks. This file tests that panics raised by commands are
+// isolated to the chain that executes them.
+package cor_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+)
+
+// panickyCheckCommand panics in IsExecutable.
+type panickyCheckCommand struct {
+	cor.BaseCommand
+}
+
+func (c *panickyCheckCommand) IsExecutable(cor.Context) bool { panic("bad check") }
+
+func (c *panickyCheckCommand) Execute(cor.Context) {}
+
+// TestChainRecoversPanicWithoutInterceptors verifies that a chain without any
+// interceptors still turns a panic into a PanicError with a stack trace and
+// stops before the next command.
+func TestChainRecoversPanicWithoutInterceptors(t *testing.T) {
+	ran := false
+	chain := cor.NewBaseChain("chain")
+	chain.AddCommand(NewFuncCommand("panics", func(cor.Context) { panic("bad input") }))
+	chain.AddCommand(NewFuncCommand("after", func(cor.Context) { ran = true }))
+
+	chainCtx := newTestContext("input")
+	assert.NotPanics(t, func() { chain.Execute(chainCtx) })
+
+	assert.False(t, ran)
+	var panicErr *cor.PanicError
+	assert.True(t, errors.As(chainCtx.GetErrors()["panics"], &panicErr))
+	assert.Equal(t, "panics", panicErr.Command)
+	assert.Equal(t, "bad input", panicErr.Value)
+	assert.NotEmpty(t, panicErr.Stack)
+	assert.True(t, errors.Is(panicErr, cor.ErrPanic))
+}
+
+// TestParallelChainRecoversBranchPanic verifies that a panic in a parallel
+// branch's goroutine is recovered and does not affect the other branches.
+func TestParallelChainRecoversBranchPanic(t *testing.T) {
+	parallel := cor.NewParallelChain("parallel")
+	parallel.AddCommand(NewFuncCommand("panics", func(cor.Context) { panic("branch failure") }))
+	parallel.AddCommand(NewFuncCommand("succeeds", func(ctx cor.Context) { ctx.Add(cor.CtxOut, "ok") }))
+
+	chainCtx := newTestContext("input")
+	assert.NotPanics(t, func() { parallel.Execute(chainCtx) })
+
+	assert.True(t, errors.Is(chainCtx.GetErrors()["panics"], cor.ErrPanic))
+	assert.NotContains(t, chainCtx.GetErrors(), "succeeds")
+}
+
+// TestPanicInIsExecutableIsRecovered verifies that a panicking executability
+// check fails the command instead of the chain's caller.
+func TestPanicInIsExecutableIsRecovered(t *testing.T) {
+	chain := cor.NewBaseChain("chain")
+	chain.AddCommand(&panickyCheckCommand{BaseCommand: *cor.NewBaseCommand("check")})
+
+	chainCtx := newTestContext("input")
+	assert.NotPanics(t, func() { chain.Execute(chainCtx) })
+
+	assert.True(t, chainCtx.HasErrors())
+	assert.True(t, errors.Is(chainCtx.GetErrors()["check"], cor.ErrPanic))
+}
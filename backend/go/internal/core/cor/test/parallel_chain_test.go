@@ -0,0 +1,120 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor_test contains unit tests for the chain of responsibility
+// building blocks. This file tests the fan-out/fan-in behavior of
+// `ParallelChain`, including how branch outputs are merged and how the
+// FailFast and CollectAll policies behave.
+package cor_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+)
+
+// FuncCommand is a small test command whose behavior is supplied as a function.
+type FuncCommand struct {
+	cor.BaseCommand
+	fn func(context cor.Context)
+}
+
+// NewFuncCommand creates a FuncCommand with the given name and behavior.
+func NewFuncCommand(name string, fn func(context cor.Context)) *FuncCommand {
+	return &FuncCommand{BaseCommand: *cor.NewBaseCommand(name), fn: fn}
+}
+
+// Execute runs the supplied function.
+func (c *FuncCommand) Execute(context cor.Context) {
+	c.fn(context)
+}
+
+// newTestContext returns a BaseContext with a Go context and the given input.
+func newTestContext(in interface{}) cor.Context {
+	chainCtx := cor.NewBaseContext()
+	chainCtx.SetContext(context.Background())
+	chainCtx.Add(cor.CtxIn, in)
+	return chainCtx
+}
+
+// TestParallelChainMergesOutputs verifies that every branch sees the shared
+// input, that each branch's output is collected under its command name and
+// that other keys written by branches are merged back into the shared context.
+func TestParallelChainMergesOutputs(t *testing.T) {
+	chain := cor.NewParallelChain("fan-out")
+	chain.AddCommand(NewFuncCommand("upper", func(ctx cor.Context) {
+		ctx.Add("upper-seen", ctx.Get(cor.CtxIn))
+		ctx.Add(cor.CtxOut, "A")
+	}))
+	chain.AddCommand(NewFuncCommand("lower", func(ctx cor.Context) {
+		ctx.Add("lower-seen", ctx.Get(cor.CtxIn))
+		ctx.Add(cor.CtxOut, "a")
+	}))
+
+	chainCtx := newTestContext("input")
+	chain.Execute(chainCtx)
+
+	assert.False(t, chainCtx.HasErrors())
+	assert.Equal(t, "input", chainCtx.Get("upper-seen"))
+	assert.Equal(t, "input", chainCtx.Get("lower-seen"))
+	assert.Equal(t, map[string]interface{}{"upper": "A", "lower": "a"}, chainCtx.Get(cor.CtxOut))
+}
+
+// TestParallelChainFailFast verifies that a failing branch cancels the Go
+// context handed to its siblings.
+func TestParallelChainFailFast(t *testing.T) {
+	chain := cor.NewParallelChain("fail-fast")
+	chain.AddCommand(NewFuncCommand("fails", func(ctx cor.Context) {
+		ctx.AddError("fails", errors.New("boom"))
+	}))
+	chain.AddCommand(NewFuncCommand("waits", func(ctx cor.Context) {
+		select {
+		case <-ctx.GetContext().Done():
+			ctx.AddError("waits", ctx.GetContext().Err())
+		case <-time.After(5 * time.Second):
+			ctx.Add(cor.CtxOut, "finished")
+		}
+	}))
+
+	chainCtx := newTestContext("input")
+	chain.Execute(chainCtx)
+
+	assert.Len(t, chainCtx.GetErrors(), 2)
+	assert.ErrorIs(t, chainCtx.GetErrors()["waits"], context.Canceled)
+}
+
+// TestParallelChainCollectAll verifies that with CollectAll the remaining
+// branches run to completion and their outputs are kept.
+func TestParallelChainCollectAll(t *testing.T) {
+	chain := cor.NewParallelChain("collect-all").WithFailurePolicy(cor.CollectAll)
+	chain.AddCommand(NewFuncCommand("fails", func(ctx cor.Context) {
+		ctx.AddError("fails", errors.New("boom"))
+	}))
+	chain.AddCommand(NewFuncCommand("succeeds", func(ctx cor.Context) {
+		time.Sleep(10 * time.Millisecond)
+		if ctx.GetContext().Err() == nil {
+			ctx.Add(cor.CtxOut, "finished")
+		}
+	}))
+
+	chainCtx := newTestContext("input")
+	chain.Execute(chainCtx)
+
+	assert.Len(t, chainCtx.GetErrors(), 1)
+	assert.Equal(t, map[string]interface{}{"succeeds": "finished"}, chainCtx.Get(cor.CtxOut))
+}
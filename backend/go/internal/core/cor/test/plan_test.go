@@ -0,0 +1,156 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor_test contains unit tests for the chain of responsibility
+// building blocks. This file tests the dry-run planner of `BaseChain`.
+package cor_test
+
+import (
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+)
+
+// KeyedCommand declares the keys it reads and writes and records whether it
+// was ever executed.
+type KeyedCommand struct {
+	cor.BaseCommand
+	inputs   []string
+	outputs  []string
+	executed bool
+}
+
+// NewKeyedCommand creates a KeyedCommand reading and writing the given keys.
+func NewKeyedCommand(name string, inputs []string, outputs []string) *KeyedCommand {
+	return &KeyedCommand{BaseCommand: *cor.NewBaseCommand(name), inputs: inputs, outputs: outputs}
+}
+
+// IsExecutable requires every declared input.
+func (c *KeyedCommand) IsExecutable(context cor.Context) bool {
+	for _, key := range c.inputs {
+		if context.Get(key) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// InputKeys returns the declared inputs.
+func (c *KeyedCommand) InputKeys() []string { return c.inputs }
+
+// OutputKeys returns the declared outputs.
+func (c *KeyedCommand) OutputKeys() []string { return c.outputs }
+
+// Execute records that the command ran.
+func (c *KeyedCommand) Execute(cor.Context) { c.executed = true }
+
+// TestPlanListsStepsWithoutExecuting verifies that a plan shows every step in
+// order with its keys, and that neither the commands nor the caller's context
+// are touched.
+func TestPlanListsStepsWithoutExecuting(t *testing.T) {
+	parse := NewKeyedCommand("parse", []string{cor.CtxIn}, []string{"__OBJECT__", cor.CtxOut})
+	upload := NewKeyedCommand("upload", []string{"__OBJECT__"}, []string{"__FILE__", cor.CtxOut})
+	summarize := NewKeyedCommand("summarize", []string{cor.CtxIn, "__FILE__"}, []string{cor.CtxOut})
+
+	chain := cor.NewBaseChain("reader")
+	chain.AddCommand(parse)
+	chain.AddCommand(cor.NewRetryCommand(upload, cor.RetryPolicy{MaxAttempts: 3}))
+	chain.AddCommand(summarize)
+
+	chainCtx := newTestContext("message")
+	plan := chain.Plan(chainCtx)
+
+	assert.True(t, plan.OK(), plan.String())
+	assert.Equal(t, []string{"reader", "parse", "upload", "summarize"}, stepNames(plan))
+	assert.Equal(t, 3, plan.Steps[2].Attempts)
+	assert.Equal(t, []string{"__OBJECT__"}, plan.Steps[2].Inputs)
+	assert.Equal(t, []string{"__FILE__", cor.CtxOut}, plan.Steps[2].Outputs)
+	for _, step := range plan.Steps {
+		assert.False(t, step.Skipped, step.Name)
+	}
+
+	assert.False(t, parse.executed || upload.executed || summarize.executed)
+	assert.Equal(t, "message", chainCtx.Get(cor.CtxIn))
+	assert.Nil(t, chainCtx.Get("__OBJECT__"))
+}
+
+// TestPlanReportsMissingKeys verifies that a key nobody produces, and a key
+// produced only by a later step, are both diagnosed and skip the reader.
+func TestPlanReportsMissingKeys(t *testing.T) {
+	chain := cor.NewBaseChain("reader")
+	chain.AddCommand(NewKeyedCommand("scenes", []string{cor.CtxIn, "__VIDEO_UPLOAD_FILE__"}, []string{cor.CtxOut}))
+	chain.AddCommand(NewKeyedCommand("assemble", []string{"__SUMMARY__"}, []string{cor.CtxOut}))
+	chain.AddCommand(NewKeyedCommand("summarize", []string{}, []string{"__SUMMARY__"}))
+
+	plan := chain.Plan(newTestContext("message"))
+
+	assert.False(t, plan.OK())
+	assert.Len(t, plan.Diagnostics, 2)
+	assert.Equal(t, "scenes", plan.Diagnostics[0].Step)
+	assert.Equal(t, "__VIDEO_UPLOAD_FILE__", plan.Diagnostics[0].Key)
+	assert.Contains(t, plan.Diagnostics[0].Message, "no step produces")
+	assert.Equal(t, "assemble", plan.Diagnostics[1].Step)
+	assert.Contains(t, plan.Diagnostics[1].Message, "before it is produced (by summarize)")
+
+	assert.True(t, plan.Steps[1].Skipped)
+	assert.Equal(t, "missing __VIDEO_UPLOAD_FILE__", plan.Steps[1].Reason)
+}
+
+// TestPlanCoversEveryRoute verifies that all routes of a router are planned
+// and that keys written on a route are available afterwards.
+func TestPlanCoversEveryRoute(t *testing.T) {
+	sw := cor.NewSwitch("route", func(cor.Context) string { return "never-evaluated" }).
+		Case("trailer", NewKeyedCommand("trailer-scenes", []string{cor.CtxIn}, []string{"__SCENES__"})).
+		Default(NewKeyedCommand("default-scenes", []string{cor.CtxIn}, []string{"__SCENES__"}))
+
+	chain := cor.NewBaseChain("reader")
+	chain.AddCommand(sw)
+	chain.AddCommand(NewKeyedCommand("assemble", []string{"__SCENES__"}, []string{cor.CtxOut}))
+
+	plan := chain.Plan(newTestContext("message"))
+
+	assert.True(t, plan.OK(), plan.String())
+	assert.Equal(t, []string{"reader", "route", "trailer-scenes", "default-scenes", "assemble"}, stepNames(plan))
+	assert.Equal(t, "trailer", plan.Steps[2].Route)
+	assert.Equal(t, "default", plan.Steps[3].Route)
+	assert.Equal(t, cor.PlanKindSwitch, plan.Steps[1].Kind)
+}
+
+// TestDryRunStoresPlan verifies that a chain in dry-run mode stores its plan
+// in the context instead of executing its commands.
+func TestDryRunStoresPlan(t *testing.T) {
+	step := NewKeyedCommand("step", []string{cor.CtxIn}, []string{cor.CtxOut})
+	chain := cor.NewBaseChain("dry").DryRun(true)
+	chain.AddCommand(step)
+
+	chainCtx := newTestContext("message")
+	chain.Execute(chainCtx)
+
+	assert.False(t, step.executed)
+	assert.False(t, chainCtx.HasErrors())
+	plan, ok := chainCtx.Get(cor.CtxPlan).(*cor.ExecutionPlan)
+	assert.True(t, ok)
+	assert.Equal(t, "dry", plan.Chain)
+	assert.Equal(t, []string{"dry", "step"}, stepNames(plan))
+}
+
+// stepNames returns the names of the plan's steps in order.
+func stepNames(plan *cor.ExecutionPlan) []string {
+	out := make([]string, 0, len(plan.Steps))
+	for _, step := range plan.Steps {
+		out = append(out, step.Name)
+	}
+	return out
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor_test contains unit tests for the chain of responsibility
+// building blocks. This file tests the `RetryCommand` decorator.
+package cor_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+)
+
+// fastPolicy returns a policy with tiny backoffs so tests run quickly.
+func fastPolicy(attempts int) cor.RetryPolicy {
+	return cor.RetryPolicy{MaxAttempts: attempts, InitialBackoff: time.Millisecond, Multiplier: 2}
+}
+
+// TestRetryCommandSucceedsAfterFailures verifies that errors from failed
+// attempts are discarded once an attempt succeeds, while their temp files are kept.
+func TestRetryCommandSucceedsAfterFailures(t *testing.T) {
+	calls := 0
+	flaky := NewFuncCommand("flaky", func(ctx cor.Context) {
+		calls++
+		ctx.AddTempFile("attempt")
+		if calls < 3 {
+			ctx.AddError("flaky", errors.New("transient"))
+			return
+		}
+		ctx.Add(cor.CtxOut, "ok")
+	})
+
+	chainCtx := newTestContext("input")
+	cor.NewRetryCommand(flaky, fastPolicy(3)).Execute(chainCtx)
+
+	assert.Equal(t, 3, calls)
+	assert.False(t, chainCtx.HasErrors())
+	assert.Equal(t, "ok", chainCtx.Get(cor.CtxOut))
+	assert.Len(t, chainCtx.GetTempFiles(), 3)
+}
+
+// TestRetryCommandGivesUp verifies that the last error is kept after the final
+// attempt and that non-retryable errors stop immediately.
+func TestRetryCommandGivesUp(t *testing.T) {
+	calls := 0
+	failing := NewFuncCommand("failing", func(ctx cor.Context) {
+		calls++
+		ctx.AddError("failing", errors.New("still broken"))
+	})
+
+	chainCtx := newTestContext("input")
+	cor.NewRetryCommand(failing, fastPolicy(2)).Execute(chainCtx)
+	assert.Equal(t, 2, calls)
+	assert.EqualError(t, chainCtx.GetErrors()["failing"], "still broken")
+
+	calls = 0
+	policy := fastPolicy(5)
+	policy.Retryable = func(err error) bool { return false }
+	chainCtx = newTestContext("input")
+	cor.NewRetryCommand(failing, policy).Execute(chainCtx)
+	assert.Equal(t, 1, calls)
+	assert.True(t, chainCtx.HasErrors())
+}
+
+// TestRetryCommandAttemptTimeout verifies that each attempt gets its own deadline.
+func TestRetryCommandAttemptTimeout(t *testing.T) {
+	slow := NewFuncCommand("slow", func(ctx cor.Context) {
+		<-ctx.GetContext().Done()
+		ctx.AddError("slow", ctx.GetContext().Err())
+	})
+
+	policy := fastPolicy(2)
+	policy.AttemptTimeout = 10 * time.Millisecond
+	chainCtx := newTestContext("input")
+	cor.NewRetryCommand(slow, policy).Execute(chainCtx)
+
+	assert.ErrorIs(t, chainCtx.GetErrors()["slow"], context.DeadlineExceeded)
+	assert.NoError(t, chainCtx.GetContext().Err())
+}
+
+// permanentError declares whether it is worth retrying.
+type permanentError struct{ retryable bool }
+
+func (e permanentError) Error() string   { return "classified" }
+func (e permanentError) Retryable() bool { return e.retryable }
+
+// TestIsRetryableClassifiedErrors verifies that the default predicate
+// follows the Retryable method of an error, even when it is wrapped.
+func TestIsRetryableClassifiedErrors(t *testing.T) {
+	assert.True(t, cor.IsRetryable(errors.New("plain")))
+	assert.False(t, cor.IsRetryable(context.Canceled))
+	assert.True(t, cor.IsRetryable(fmt.Errorf("request: %w", permanentError{retryable: true})))
+	assert.False(t, cor.IsRetryable(fmt.Errorf("request: %w", permanentError{retryable: false})))
+
+	calls := 0
+	blocked := NewFuncCommand("blocked", func(ctx cor.Context) {
+		calls++
+		ctx.AddError("blocked", permanentError{retryable: false})
+	})
+	cor.NewRetryCommand(blocked, fastPolicy(3)).Execute(newTestContext("input"))
+	assert.Equal(t, 1, calls)
+}
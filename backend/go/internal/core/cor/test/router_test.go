@@ -0,0 +1,85 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cor_test contains unit tests for the chain of responsibility
+// building blocks. This file tests the `IfCommand` and `SwitchCommand`
+// routers, both on their own and nested inside a `BaseChain`.
+package cor_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/stretchr/testify/assert"
+)
+
+// upper is a command that upper-cases its string input.
+func upper() cor.Command {
+	return NewFuncCommand("upper", func(ctx cor.Context) {
+		ctx.Add(cor.CtxOut, strings.ToUpper(ctx.Get(cor.CtxIn).(string)))
+	})
+}
+
+// TestIfRoutesOnPredicate verifies that the "then" branch runs when the
+// predicate holds and that a missing "else" branch passes the input through.
+func TestIfRoutesOnPredicate(t *testing.T) {
+	isShort := func(ctx cor.Context) bool { return len(ctx.Get(cor.CtxIn).(string)) < 5 }
+
+	chain := cor.NewBaseChain("if-chain")
+	chain.AddCommand(cor.NewIf("short-only", isShort, upper(), nil))
+	chain.AddCommand(NewFuncCommand("collect", func(ctx cor.Context) {
+		ctx.Add("result", ctx.Get(cor.CtxIn))
+	}))
+
+	chainCtx := newTestContext("abc")
+	chain.Execute(chainCtx)
+	assert.Equal(t, "ABC", chainCtx.Get("result"))
+
+	chainCtx = newTestContext("abcdef")
+	chain.Execute(chainCtx)
+	assert.Equal(t, "abcdef", chainCtx.Get("result"))
+}
+
+// TestSwitchRoutesOnKey verifies case selection, the default case and that the
+// result of a nested chain is forwarded to the enclosing chain.
+func TestSwitchRoutesOnKey(t *testing.T) {
+	nested := cor.NewBaseChain("nested")
+	nested.AddCommand(upper())
+	nested.AddCommand(NewFuncCommand("suffix", func(ctx cor.Context) {
+		ctx.Add(cor.CtxOut, ctx.Get(cor.CtxIn).(string)+"!")
+	}))
+
+	router := cor.NewSwitchOnKey("by-kind", "kind").
+		Case("loud", nested).
+		Default(NewFuncCommand("quiet", func(ctx cor.Context) {
+			ctx.Add(cor.CtxOut, "shh")
+		}))
+
+	chain := cor.NewBaseChain("switch-chain")
+	chain.AddCommand(router)
+	chain.AddCommand(NewFuncCommand("collect", func(ctx cor.Context) {
+		ctx.Add("result", ctx.Get(cor.CtxIn))
+	}))
+
+	chainCtx := newTestContext("hello")
+	chainCtx.Add("kind", "loud")
+	chain.Execute(chainCtx)
+	assert.False(t, chainCtx.HasErrors())
+	assert.Equal(t, "HELLO!", chainCtx.Get("result"))
+
+	chainCtx = newTestContext("hello")
+	chain.Execute(chainCtx)
+	assert.Equal(t, "shh", chainCtx.Get("result"))
+}
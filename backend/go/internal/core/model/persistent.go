@@ -23,6 +23,7 @@ package model
 import (
 	"time"
 
+	"cloud.google.com/go/bigquery"
 	"github.com/google/uuid"
 )
 
@@ -61,6 +62,7 @@ type Media struct {
 	Rating          string        `json:"rating,omitempty" bigquery:"rating"`             // The content rating (e.g., "PG-13"), if available.
 	Cast            []*CastMember `json:"cast,omitempty" bigquery:"cast"`                 // A list of cast members in the media. This is a nested repeated record in BigQuery.
 	Scenes          []*Scene      `json:"scenes,omitempty" bigquery:"scenes"`             // A list of scenes extracted from the media. This is a nested repeated record in BigQuery.
+	Usage           *MediaUsage   `json:"usage,omitempty" bigquery:"usage"`               // The tokens, and estimated cost, of generating the summary and scenes; nil for media indexed before usage was recorded.
 }
 
 // NewMedia is a constructor function that creates and initializes a new Media object.
@@ -87,13 +89,67 @@ func NewMedia(fileName string) *Media {
 // Scene represents a single, time-indexed segment within a media file.
 // It contains the script and other details for that specific time span.
 // Scenes are stored as a nested repeated record within the main Media object in BigQuery.
+// The usage columns are NULL for scenes indexed before usage was recorded,
+// hence their nullable types.
 type Scene struct {
-	SequenceNumber   int    `json:"sequence" bigquery:"sequence"`                     // The sequential order of the scene in the media.
-	TokensToGenerate int    `json:"tokens_to_generate" bigquery:"tokens_to_generate"` // Placeholder for tracking token usage (not currently used).
-	TokensGenerated  int    `json:"tokens_generated" bigquery:"tokens_generated"`     // Placeholder for tracking token usage (not currently used).
-	Start            string `json:"start" bigquery:"start"`                           // The start time of the scene in HH:MM:SS format.
-	End              string `json:"end" bigquery:"end"`                               // The end time of the scene in HH:MM:SS format.
-	Script           string `json:"script" bigquery:"script"`                         // The detailed script/description of the scene, generated by the AI.
+	SequenceNumber   int                  `json:"sequence" bigquery:"sequence"`                     // The sequential order of the scene in the media.
+	TokensToGenerate bigquery.NullInt64   `json:"tokens_to_generate" bigquery:"tokens_to_generate"` // The prompt tokens, media included, of the request that generated the scene.
+	TokensGenerated  bigquery.NullInt64   `json:"tokens_generated" bigquery:"tokens_generated"`     // The candidate tokens generated for the scene.
+	Cost             bigquery.NullFloat64 `json:"cost" bigquery:"cost"`                             // The estimated cost of generating the scene, in USD; zero if the model has no pricing.
+	Start            string               `json:"start" bigquery:"start"`                           // The start time of the scene in HH:MM:SS format.
+	End              string               `json:"end" bigquery:"end"`                               // The end time of the scene in HH:MM:SS format.
+	Script           string               `json:"script" bigquery:"script"`                         // The detailed script/description of the scene, generated by the AI.
+}
+
+// TokenUsage is the token usage, and estimated cost, of one or more requests to
+// a generative model.
+type TokenUsage struct {
+	Model        string  `json:"model" bigquery:"model"`                 // The name of the model (e.g., "gemini-2.5-pro"); empty if the requests used several.
+	InputTokens  int     `json:"input_tokens" bigquery:"input_tokens"`   // The prompt tokens, media included.
+	OutputTokens int     `json:"output_tokens" bigquery:"output_tokens"` // The candidate tokens.
+	Cost         float64 `json:"cost" bigquery:"cost"`                   // The estimated cost, in USD; zero if the model has no pricing.
+}
+
+// Add adds the usage of other requests.
+//
+// Inputs:
+//   - other: The usage to add.
+func (u *TokenUsage) Add(other TokenUsage) {
+	if u.InputTokens == 0 && u.OutputTokens == 0 && len(u.Model) == 0 {
+		u.Model = other.Model
+	} else if u.Model != other.Model {
+		u.Model = ""
+	}
+	u.InputTokens += other.InputTokens
+	u.OutputTokens += other.OutputTokens
+	u.Cost += other.Cost
+}
+
+// MediaUsage is what indexing a media file cost: the generation of its
+// summary, of its scenes, and their total. It is stored as a nested record of
+// the media object.
+type MediaUsage struct {
+	Summary TokenUsage `json:"summary" bigquery:"summary"` // The request generating the summary.
+	Scenes  TokenUsage `json:"scenes" bigquery:"scenes"`   // The requests generating the scenes, whose own usage is on each scene.
+	Total   TokenUsage `json:"total" bigquery:"total"`     // The summary and the scenes.
+}
+
+// MediaTombstone marks a media object as deleted. BigQuery rejects deletes of
+// rows still in its streaming buffer, so a deletion is recorded as a streamed
+// tombstone, which hides the media object from reads until it is gone.
+type MediaTombstone struct {
+	MediaId   string    `json:"media_id" bigquery:"media_id"`     // The ID of the deleted media object.
+	DeletedAt time.Time `json:"deleted_at" bigquery:"deleted_at"` // When it was deleted; media saved later are not hidden.
+}
+
+// UsageRecord is an entry of the usage ledger: the tokens, and estimated cost,
+// of one generation. The budgets sum them over a day or a month.
+type UsageRecord struct {
+	RecordedAt   time.Time `json:"recorded_at" bigquery:"recorded_at"`     // When the generation completed.
+	Model        string    `json:"model" bigquery:"model"`                 // The name of the model (e.g., "gemini-2.5-pro").
+	InputTokens  int       `json:"input_tokens" bigquery:"input_tokens"`   // The prompt tokens, media included.
+	OutputTokens int       `json:"output_tokens" bigquery:"output_tokens"` // The candidate tokens.
+	Cost         float64   `json:"cost" bigquery:"cost"`                   // The estimated cost, in USD; zero if the model has no pricing.
 }
 
 // CastMember is a mapping object that links a character's name to the actor
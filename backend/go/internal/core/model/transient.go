@@ -63,3 +63,22 @@ type SceneMatchResult struct {
 	MediaId        string `json:"media_id" bigquery:"media_id"`               // The unique ID of the media file that contains the matching scene.
 	SequenceNumber int    `json:"sequence_number" bigquery:"sequence_number"` // The sequence number of the specific scene that matched the search query.
 }
+
+// MediaUsageReport is what indexing a media file cost, as served by the usage
+// endpoint: the usage stored on the media object, with a line per scene.
+type MediaUsageReport struct {
+	MediaId string        `json:"media_id"` // The unique ID of the media file.
+	Title   string        `json:"title"`    // The title of the media.
+	Usage   *MediaUsage   `json:"usage"`    // The usage of the summary, the scenes and their total; null if it was not recorded.
+	Scenes  []*SceneUsage `json:"scenes"`   // The usage of each scene, in sequence order.
+}
+
+// SceneUsage is the token usage, and estimated cost, of generating one scene.
+type SceneUsage struct {
+	SequenceNumber int     `json:"sequence"`      // The sequence number of the scene.
+	Start          string  `json:"start"`         // The start time of the scene in HH:MM:SS format.
+	End            string  `json:"end"`           // The end time of the scene in HH:MM:SS format.
+	InputTokens    int     `json:"input_tokens"`  // The prompt tokens, media included.
+	OutputTokens   int     `json:"output_tokens"` // The candidate tokens.
+	Cost           float64 `json:"cost"`          // The estimated cost, in USD.
+}
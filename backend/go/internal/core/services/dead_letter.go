@@ -0,0 +1,221 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package services contains the business logic for interacting with data sources.
+// This file, `dead_letter.go`, defines the DeadLetterService, which backs the
+// admin API for the messages the listeners gave up on: it lists them, discards
+// them, and replays them into the workflow of the listener that received them.
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+)
+
+// ErrReplayInProgress is returned when a dead letter is already being replayed.
+var ErrReplayInProgress = errors.New("dead letter replay already in progress")
+
+// ErrReplaysDrained is returned for a replay requested after Drain was called.
+var ErrReplaysDrained = errors.New("dead letter replays are shutting down")
+
+// DeadLetterService lists, discards and replays dead letters.
+type DeadLetterService struct {
+	Store     cloud.DeadLetterStore             // The store of dead letters; nil if dead letters are not kept.
+	Listeners map[string]*cloud.MessageListener // The listeners whose workflows replay the dead letters, keyed by logical name.
+
+	mu       sync.Mutex                    // Guards replays and draining.
+	replays  map[string]context.CancelFunc // Cancels the replays running, keyed by dead letter ID.
+	draining bool                          // Set by Drain; no replay starts after it.
+	running  sync.WaitGroup                // The replays running.
+}
+
+// List returns all dead letters, oldest first.
+//
+// Inputs:
+//   - ctx: The context for the request.
+//
+// Outputs:
+//   - []*cloud.DeadLetter: The dead letters; empty if dead letters are not kept.
+//   - error: An error if the store cannot be read.
+func (s *DeadLetterService) List(ctx context.Context) ([]*cloud.DeadLetter, error) {
+	if s.Store == nil {
+		return make([]*cloud.DeadLetter, 0), nil
+	}
+	return s.Store.List(ctx)
+}
+
+// Get returns a dead letter.
+//
+// Inputs:
+//   - ctx: The context for the request.
+//   - id: The ID of the dead letter.
+//
+// Outputs:
+//   - *cloud.DeadLetter: The dead letter.
+//   - error: cloud.ErrDeadLetterNotFound if there is no such dead letter.
+func (s *DeadLetterService) Get(ctx context.Context, id string) (*cloud.DeadLetter, error) {
+	if s.Store == nil {
+		return nil, fmt.Errorf("%w: %s", cloud.ErrDeadLetterNotFound, id)
+	}
+	return s.Store.Get(ctx, id)
+}
+
+// Discard deletes a dead letter without replaying it, with the checkpoint a
+// failed replay may have left.
+//
+// Inputs:
+//   - ctx: The context for the request.
+//   - id: The ID of the dead letter.
+//
+// Outputs:
+//   - error: cloud.ErrDeadLetterNotFound if there is no such dead letter.
+func (s *DeadLetterService) Discard(ctx context.Context, id string) error {
+	if s.Store == nil {
+		return fmt.Errorf("%w: %s", cloud.ErrDeadLetterNotFound, id)
+	}
+	letter, err := s.Store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.Delete(ctx, id); err != nil {
+		return err
+	}
+	if listener, ok := s.Listeners[letter.Listener]; ok {
+		listener.DropCheckpoint(ctx, letter.Data)
+	}
+	return nil
+}
+
+// Replay starts running a dead letter through the workflow of its listener in
+// the background, within the listener's flow control and circuit breakers. On
+// success the dead letter is deleted; on failure it is kept with the errors of
+// the replay and its replay count increased. A replay canceled by Drain keeps
+// the dead letter as it was.
+//
+// Inputs:
+//   - ctx: The context of the replay; it should outlive the request that starts it.
+//   - id: The ID of the dead letter.
+//
+// Outputs:
+//   - <-chan error: Receives the outcome of the replay once it completes, then is closed.
+//   - error: An error if the dead letter or its listener is unknown, if it is
+//     already being replayed, or if the service is draining.
+func (s *DeadLetterService) Replay(ctx context.Context, id string) (<-chan error, error) {
+	letter, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	listener, ok := s.Listeners[letter.Listener]
+	if !ok {
+		return nil, fmt.Errorf("dead letter %s: unknown listener %q", id, letter.Listener)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if err := s.startReplay(id, cancel); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer close(done)
+		defer s.endReplay(id)
+		done <- s.replay(ctx, listener, letter)
+	}()
+	return done, nil
+}
+
+// Drain refuses new replays and waits for the running ones to finish. If the
+// context expires first, they are canceled; their dead letters are kept.
+//
+// Inputs:
+//   - ctx: The context bounding the wait for the running replays.
+//
+// Outputs:
+//   - error: The context's error if the replays had to be canceled.
+func (s *DeadLetterService) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	for _, cancel := range s.replays {
+		cancel()
+	}
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+// replay runs a dead letter and updates the store with the outcome.
+func (s *DeadLetterService) replay(ctx context.Context, listener *cloud.MessageListener, letter *cloud.DeadLetter) error {
+	errs := listener.Replay(ctx, letter)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("replay of dead letter %s canceled: %w", letter.ID, err)
+	}
+	if len(errs) == 0 {
+		return s.Store.Delete(ctx, letter.ID)
+	}
+	letter.Errors = cloud.ErrorStrings(errs)
+	letter.Replays++
+	letter.DeadLetteredAt = time.Now().UTC()
+	if err := s.Store.Save(ctx, letter); err != nil {
+		return err
+	}
+	return fmt.Errorf("replay of dead letter %s failed in %v", letter.ID, letter.Commands())
+}
+
+// startReplay marks a dead letter as being replayed, unless it already is or
+// the service is draining.
+func (s *DeadLetterService) startReplay(id string, cancel context.CancelFunc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return ErrReplaysDrained
+	}
+	if s.replays == nil {
+		s.replays = make(map[string]context.CancelFunc)
+	}
+	if _, ok := s.replays[id]; ok {
+		return fmt.Errorf("%w: %s", ErrReplayInProgress, id)
+	}
+	s.replays[id] = cancel
+	s.running.Add(1)
+	return nil
+}
+
+// endReplay clears the mark of startReplay.
+func (s *DeadLetterService) endReplay(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cancel, ok := s.replays[id]; ok {
+		cancel()
+		delete(s.replays, id)
+	}
+	s.running.Done()
+}
@@ -15,37 +15,29 @@
 // Package services contains the business logic for interacting with data sources.
 // This file, `search.go`, defines the SearchService, which is responsible for
 // handling the core semantic search functionality. It takes a natural language
-// query, converts it into a vector embedding using a generative AI model, and
-// then uses that vector to find the most similar items in a BigQuery table.
+// query, converts it into a vector embedding using an embedding model, and
+// then uses that vector to find the most similar scenes in the media repository.
 package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strconv"
-	"strings"
 
-	"cloud.google.com/go/bigquery"
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
-	"google.golang.org/api/iterator"
-	"google.golang.org/genai"
 )
 
 // SearchService encapsulates the clients and configuration needed to perform
-// semantic search operations. It holds references to the BigQuery client for
-// database interaction and a GenAI embedding model for converting text to vectors.
+// semantic search operations. It holds references to the media repository for
+// the vector search and an embedder for converting text to vectors.
 type SearchService struct {
-	BigqueryClient *bigquery.Client // Client for interacting with Google BigQuery.
-	EmbeddingModel *genai.Models    // The generative AI model used to create vector embeddings from text.
-	//Muziris Change: Accomodate the latest genai libraries
-	ModelName      string // The name of the model
-	DatasetName    string // The name of the BigQuery dataset.
-	MediaTable     string // The name of the table holding primary media metadata.
-	EmbeddingTable string // The name of the table holding the vector embeddings for scenes.
+	Repository cloud.MediaRepository // The repository holding the scene embeddings.
+	Embedder   cloud.Embedder        // The model used to create vector embeddings from text; must match the stored embeddings.
 }
 
 // FindScenes takes a text query, generates a vector embedding for it, and then
-// performs a vector search (k-nearest neighbor) in BigQuery to find the most
+// performs a vector search (k-nearest neighbor) in the repository to find the most
 // semantically similar scenes.
 //
 // Inputs:
@@ -62,62 +54,15 @@ func (s *SearchService) FindScenes(ctx context.Context, query string, maxResults
 	out = make([]*model.SceneMatchResult, 0)
 
 	// --- Step 1: Generate Embedding for the Query ---
-	// Call the generative AI model to convert the user's text query into a vector embedding.
-	//Muziris Change: new Embedcontent call because of deprecrated genai libraries
-
-	contents := []*genai.Content{
-		genai.NewContentFromText(query, genai.RoleUser),
-	}
-
-	// Embed the content using the specified embedding model.
-	// Replace "gemini-embedding-exp-03-07" with your desired embedding model.
-	searchEmbeddings, erremb := s.EmbeddingModel.EmbedContent(ctx, s.ModelName, contents, nil)
+	// Call the embedding model to convert the user's text query into a vector embedding.
+	vectors, err := s.Embedder.Embed(ctx, []string{query})
 	if err != nil {
-		fmt.Print("Fatal error when creating embeddings", erremb)
-	}
-
-	// --- Step 2: Prepare the Query for BigQuery ---
-	// Get the fully qualified name of the embeddings table (e.g., `project.dataset.table`).
-	fqEmbeddingTable := strings.Replace(s.BigqueryClient.Dataset(s.DatasetName).Table(s.EmbeddingTable).FullyQualifiedName(), ":", ".", -1)
-
-	// The BigQuery VECTOR_SEARCH function expects the query vector as a comma-separated
-	// string of float values. We convert the float32 slice from the embedding model
-	// into a slice of strings.
-	var stringArray []string
-	for _, f := range searchEmbeddings.Embeddings[0].Values {
-		stringArray = append(stringArray, strconv.FormatFloat(float64(f), 'f', -1, 64))
+		return out, fmt.Errorf("failed to create query embedding: %w", err)
 	}
-
-	// Construct the final SQL query by injecting the table name, the vector string,
-	// and the max number of results into the QrySequenceKnn template.
-	queryText := fmt.Sprintf(QrySequenceKnn, fqEmbeddingTable, strings.Join(stringArray, ","), maxResults)
-
-	// --- Step 3: Execute the Query and Process Results ---
-	// Create a new BigQuery query object.
-	q := s.BigqueryClient.Query(queryText)
-	// Execute the query and get an iterator for the results.
-	itr, err := q.Read(ctx)
-	if err != nil {
-		return out, fmt.Errorf("failed to read from BigQuery: %w", err)
-	}
-
-	// Iterate through all the rows returned by BigQuery.
-	for {
-		var r = &model.SceneMatchResult{}
-		// Scan the next row into the SceneMatchResult struct.
-		err := itr.Next(r)
-		// If we've reached the end of the results, break the loop.
-		if err == iterator.Done {
-			break
-		}
-		// If any other error occurs during iteration, return it.
-		if err != nil {
-			return out, fmt.Errorf("failed to iterate results: %w", err)
-		}
-		// If the row was scanned successfully, append the result to our output slice.
-		out = append(out, r)
+	if len(vectors) == 0 {
+		return out, errors.New("the embedding model returned no embeddings")
 	}
 
-	// Return the populated slice of results and a nil error, indicating success.
-	return out, nil
+	// --- Step 2: Search the Repository ---
+	return s.Repository.FindScenes(ctx, vectors[0], maxResults)
 }
@@ -0,0 +1,145 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/services"
+	"github.com/zeebo/assert"
+)
+
+// replayCommand fails while fail is set, and blocks while release is not
+// closed, unless its context is canceled.
+type replayCommand struct {
+	cor.BaseCommand
+	fail    bool
+	release chan struct{}
+}
+
+func (c *replayCommand) Execute(context cor.Context) {
+	select {
+	case <-c.release:
+	case <-context.GetContext().Done():
+		context.AddError(c.GetName(), context.GetContext().Err())
+		return
+	}
+	if c.fail {
+		context.AddError(c.GetName(), errors.New("no scenes"))
+	}
+}
+
+// TestDeadLetterServiceReplay verifies that a replayed dead letter is kept
+// with the new errors when it fails again, and deleted once it succeeds.
+func TestDeadLetterServiceReplay(t *testing.T) {
+	ctx := context.Background()
+	store, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.NoError(t, err)
+	letter := cloud.NewDeadLetter("LowResTopic", &cloud.Message{ID: "42", Data: []byte("payload")},
+		map[string]error{"generate-media-summary": errors.New("quota exceeded")})
+	assert.NoError(t, store.Save(ctx, letter))
+
+	command := &replayCommand{BaseCommand: *cor.NewBaseCommand("media-reader"), fail: true, release: make(chan struct{})}
+	service := &services.DeadLetterService{
+		Store:     store,
+		Listeners: map[string]*cloud.MessageListener{"LowResTopic": cloud.NewMessageListener(nil, command)},
+	}
+
+	done, err := service.Replay(ctx, letter.ID)
+	assert.NoError(t, err)
+	_, err = service.Replay(ctx, letter.ID)
+	assert.True(t, errors.Is(err, services.ErrReplayInProgress))
+	close(command.release)
+	assert.Error(t, <-done)
+
+	kept, err := service.Get(ctx, letter.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, kept.Replays)
+	assert.Equal(t, map[string]string{"media-reader": "no scenes"}, kept.Errors)
+
+	command.fail = false
+	done, err = service.Replay(ctx, letter.ID)
+	assert.NoError(t, err)
+	assert.NoError(t, <-done)
+	letters, err := service.List(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(letters))
+
+	_, err = service.Replay(ctx, letter.ID)
+	assert.True(t, errors.Is(err, cloud.ErrDeadLetterNotFound))
+}
+
+// TestDeadLetterServiceDrain verifies that Drain refuses new replays, and
+// cancels the running ones once its context expires, keeping their dead
+// letters as they were.
+func TestDeadLetterServiceDrain(t *testing.T) {
+	ctx := context.Background()
+	store, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.NoError(t, err)
+	letter := cloud.NewDeadLetter("LowResTopic", &cloud.Message{ID: "42", Data: []byte("payload")},
+		map[string]error{"generate-media-summary": errors.New("quota exceeded")})
+	assert.NoError(t, store.Save(ctx, letter))
+
+	command := &replayCommand{BaseCommand: *cor.NewBaseCommand("media-reader"), release: make(chan struct{})}
+	service := &services.DeadLetterService{
+		Store:     store,
+		Listeners: map[string]*cloud.MessageListener{"LowResTopic": cloud.NewMessageListener(nil, command)},
+	}
+	done, err := service.Replay(ctx, letter.ID)
+	assert.NoError(t, err)
+
+	drainCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.True(t, errors.Is(service.Drain(drainCtx), context.DeadlineExceeded))
+	assert.True(t, errors.Is(<-done, context.Canceled))
+
+	kept, err := service.Get(ctx, letter.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, kept.Replays)
+	_, err = service.Replay(ctx, letter.ID)
+	assert.True(t, errors.Is(err, services.ErrReplaysDrained))
+}
+
+// TestDeadLetterServiceDiscard verifies that a discarded dead letter is
+// deleted with the checkpoint a failed replay left.
+func TestDeadLetterServiceDiscard(t *testing.T) {
+	ctx := context.Background()
+	store, err := cloud.NewFileDeadLetterStore(t.TempDir())
+	assert.NoError(t, err)
+	letter := cloud.NewDeadLetter("LowResTopic", &cloud.Message{ID: "42", Data: []byte("payload")},
+		map[string]error{"generate-media-summary": errors.New("quota exceeded")})
+	assert.NoError(t, store.Save(ctx, letter))
+	checkpoints := cor.NewFileCheckpointStore(t.TempDir())
+	assert.NoError(t, checkpoints.Save(ctx, &cor.Checkpoint{RunID: "payload", Steps: map[string]*cor.CheckpointStep{}}))
+
+	listener := cloud.NewMessageListener(nil, &replayCommand{BaseCommand: *cor.NewBaseCommand("media-reader")})
+	listener.SetCheckpoints(checkpoints, func(context cor.Context) string {
+		return context.Get(cor.CtxIn).(string)
+	})
+	service := &services.DeadLetterService{Store: store, Listeners: map[string]*cloud.MessageListener{"LowResTopic": listener}}
+
+	assert.NoError(t, service.Discard(ctx, letter.ID))
+	_, err = service.Get(ctx, letter.ID)
+	assert.True(t, errors.Is(err, cloud.ErrDeadLetterNotFound))
+	checkpoint, err := checkpoints.Load(ctx, "payload")
+	assert.NoError(t, err)
+	assert.Nil(t, checkpoint)
+	assert.True(t, errors.Is(service.Discard(ctx, letter.ID), cloud.ErrDeadLetterNotFound))
+}
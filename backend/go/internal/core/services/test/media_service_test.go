@@ -0,0 +1,108 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/services"
+	"github.com/zeebo/assert"
+)
+
+// TestMediaServiceWithSQLite verifies that the MediaService reads media and
+// scenes through an embedded repository, without any cloud services.
+func TestMediaServiceWithSQLite(t *testing.T) {
+	ctx := context.Background()
+	repo, err := cloud.NewSQLiteMediaRepository(ctx, filepath.Join(t.TempDir(), "media.db"), cloud.DistanceEuclidean)
+	assert.NoError(t, err)
+	defer repo.Close()
+
+	media := model.NewMedia("trailer.mp4")
+	media.Title = "Trailer"
+	media.Scenes = append(media.Scenes, &model.Scene{SequenceNumber: 1, Script: "the opening shot"})
+	assert.NoError(t, repo.SaveMedia(ctx, media))
+
+	mediaService := &services.MediaService{Repository: repo}
+	got, err := mediaService.Get(ctx, media.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "Trailer", got.Title)
+
+	scene, err := mediaService.GetScene(ctx, media.Id, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "the opening shot", scene.Script)
+
+	_, err = mediaService.Get(ctx, "missing")
+	assert.True(t, errors.Is(err, cloud.ErrMediaNotFound))
+}
+
+// TestMediaServiceGetUsage verifies that the usage of a media object is
+// reported with a line per scene.
+func TestMediaServiceGetUsage(t *testing.T) {
+	ctx := context.Background()
+	repo, err := cloud.NewSQLiteMediaRepository(ctx, filepath.Join(t.TempDir(), "media.db"), cloud.DistanceEuclidean)
+	assert.NoError(t, err)
+	defer repo.Close()
+
+	media := model.NewMedia("trailer.mp4")
+	media.Title = "Trailer"
+	media.Scenes = append(media.Scenes,
+		&model.Scene{SequenceNumber: 1, Start: "00:00:00", End: "00:00:05",
+			TokensToGenerate: bigquery.NullInt64{Int64: 1000, Valid: true}, TokensGenerated: bigquery.NullInt64{Int64: 200, Valid: true}, Cost: bigquery.NullFloat64{Float64: 0.003, Valid: true}},
+		&model.Scene{SequenceNumber: 2, Start: "00:00:05", End: "00:00:09",
+			TokensToGenerate: bigquery.NullInt64{Int64: 800, Valid: true}, TokensGenerated: bigquery.NullInt64{Int64: 100, Valid: true}, Cost: bigquery.NullFloat64{Float64: 0.002, Valid: true}})
+	media.Usage = &model.MediaUsage{
+		Summary: model.TokenUsage{Model: "gemini-2.5-pro", InputTokens: 5000, OutputTokens: 400, Cost: 0.01},
+		Scenes:  model.TokenUsage{Model: "gemini-2.5-pro", InputTokens: 1800, OutputTokens: 300, Cost: 0.005},
+		Total:   model.TokenUsage{Model: "gemini-2.5-pro", InputTokens: 6800, OutputTokens: 700, Cost: 0.015},
+	}
+	assert.NoError(t, repo.SaveMedia(ctx, media))
+
+	mediaService := &services.MediaService{Repository: repo}
+	report, err := mediaService.GetUsage(ctx, media.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, media.Id, report.MediaId)
+	assert.Equal(t, media.Usage, report.Usage)
+	assert.Equal(t, 2, len(report.Scenes))
+	assert.Equal(t, &model.SceneUsage{SequenceNumber: 2, Start: "00:00:05", End: "00:00:09", InputTokens: 800, OutputTokens: 100, Cost: 0.002}, report.Scenes[1])
+
+	_, err = mediaService.GetUsage(ctx, "missing")
+	assert.True(t, errors.Is(err, cloud.ErrMediaNotFound))
+}
+
+// TestMediaServiceGetUsageNotRecorded verifies that media indexed before usage
+// was recorded is reported without usage rather than failing.
+func TestMediaServiceGetUsageNotRecorded(t *testing.T) {
+	ctx := context.Background()
+	repo, err := cloud.NewSQLiteMediaRepository(ctx, filepath.Join(t.TempDir(), "media.db"), cloud.DistanceEuclidean)
+	assert.NoError(t, err)
+	defer repo.Close()
+
+	media := model.NewMedia("trailer.mp4")
+	media.Title = "Trailer"
+	media.Scenes = append(media.Scenes, &model.Scene{SequenceNumber: 1, Start: "00:00:00", End: "00:00:05"})
+	assert.NoError(t, repo.SaveMedia(ctx, media))
+
+	mediaService := &services.MediaService{Repository: repo}
+	report, err := mediaService.GetUsage(ctx, media.Id)
+	assert.NoError(t, err)
+	assert.Nil(t, report.Usage)
+	assert.Equal(t, &model.SceneUsage{SequenceNumber: 1, Start: "00:00:00", End: "00:00:05"}, report.Scenes[0])
+}
@@ -19,9 +19,11 @@ package services_test
 import (
 	"context"
 	"fmt"
+	"path/filepath"
 	"testing"
 
 	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/services"
 	test "github.com/jaycherian/gcp-go-media-search/internal/testutil"
 	"github.com/zeebo/assert"
@@ -47,12 +49,17 @@ func TestSearchService(t *testing.T) {
 	// Load the application configuration from .toml files using a test helper.
 	// This helper sets the necessary environment variables to load test-specific configs.
 	config := test.GetConfig()
+	// Without credentials for the live services, there is nothing to test against.
+	test.SkipWithoutCredentials(t)
 
 	// Initialize all necessary Google Cloud service clients (Storage, Pub/Sub, GenAI, BigQuery)
 	// based on the loaded configuration. This creates the 'live' environment for the test.
 	cloudClients, err := cloud.NewCloudServiceClients(ctx, config)
-	// Use a test helper to fail the test immediately if client initialization fails.
+	// Use a test helper to fail the test if client initialization fails.
 	test.HandleErr(err, t)
+	if err != nil {
+		return
+	}
 	// Ensure that all client connections are closed when the test function completes.
 	defer cloudClients.Close()
 
@@ -66,14 +73,11 @@ func TestSearchService(t *testing.T) {
 	// for the SearchService to convert text queries into vector embeddings.
 	embeddingModel := cloudClients.EmbeddingModels["multi-lingual"]
 
-	// Instantiate the SearchService with its dependencies: the BigQuery client,
-	// the embedding model, and the names of the dataset and tables to query.
+	// Instantiate the SearchService with its dependencies: the media repository
+	// and the embedding model.
 	searchService := &services.SearchService{
-		BigqueryClient: cloudClients.BiqQueryClient,
-		EmbeddingModel: embeddingModel,
-		DatasetName:    "media_ds",
-		MediaTable:     "media",
-		EmbeddingTable: "scene_embeddings",
+		Repository: cloudClients.MediaRepository,
+		Embedder:   embeddingModel,
 	}
 
 	// Execute the method under test: FindScenes.
@@ -99,3 +103,38 @@ func TestSearchService(t *testing.T) {
 		fmt.Printf("%s - %d\n", o.MediaId, o.SequenceNumber)
 	}
 }
+
+// TestSearchServiceOffline verifies the search flow without any cloud
+// services: scene scripts are embedded with the hashing embedder into a SQLite
+// repository, and a query sharing words with one script finds that scene first.
+func TestSearchServiceOffline(t *testing.T) {
+	ctx := context.Background()
+	repo, err := cloud.NewSQLiteMediaRepository(ctx, filepath.Join(t.TempDir(), "media.db"), cloud.DistanceCosine)
+	assert.NoError(t, err)
+	defer repo.Close()
+
+	embedder, err := cloud.NewEmbedder("offline", cloud.VertexAiEmbeddingModel{Provider: cloud.EmbeddingProviderHashing, Dimension: 64}, nil)
+	assert.NoError(t, err)
+
+	scripts := []string{
+		"A red car races through the desert at night",
+		"Two friends share a quiet dinner in Paris",
+		"A dog chases a ball across the snowy park",
+	}
+	vectors, err := embedder.Embed(ctx, scripts)
+	assert.NoError(t, err)
+	embeddings := make([]*model.SceneEmbedding, 0, len(scripts))
+	for i, vector := range vectors {
+		embedding := model.NewSceneEmbedding("trailer", i+1, embedder.Name())
+		embedding.Embeddings = vector
+		embeddings = append(embeddings, embedding)
+	}
+	assert.NoError(t, repo.SaveEmbeddings(ctx, embeddings))
+
+	searchService := &services.SearchService{Repository: repo, Embedder: embedder}
+	out, err := searchService.FindScenes(ctx, "dinner with friends in Paris", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(out))
+	assert.Equal(t, "trailer", out[0].MediaId)
+	assert.Equal(t, 2, out[0].SequenceNumber)
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package workflow defines the high-level business logic orchestrations,
+// combining various commands into coherent pipelines. This file registers the
+// domain types that workflows store in the context, so that checkpointed
+// chains can save and restore them, and derives checkpoint run IDs.
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+	"google.golang.org/genai"
+)
+
+// The names are stored in checkpoint files, so they must not change.
+func init() {
+	cor.RegisterCheckpointType("cloud.GCSObject", &cloud.GCSObject{})
+	cor.RegisterCheckpointType("genai.FileData", &genai.FileData{})
+	cor.RegisterCheckpointType("model.MediaSummary", &model.MediaSummary{})
+	cor.RegisterCheckpointType("model.Media", &model.Media{})
+	cor.RegisterCheckpointType("model.TokenUsage", &model.TokenUsage{})
+	cor.RegisterCheckpointType("[]*model.TokenUsage", []*model.TokenUsage{})
+}
+
+// GCSNotificationRunID derives a checkpoint run ID from the GCS Pub/Sub
+// notification that starts a workflow. The ID includes the object generation,
+// so a redelivered message resumes the run while a re-upload of the same
+// object name starts a new one.
+//
+// Inputs:
+//   - context: The workflow context, with the raw notification JSON in `cor.CtxIn`.
+//
+// Outputs:
+//   - string: The run ID in the form bucket/name#generation, or "" if the
+//     input is not a GCS notification (which disables checkpointing).
+func GCSNotificationRunID(context cor.Context) string {
+	in, ok := cor.NewKey[string](cor.CtxIn).Get(context)
+	if !ok {
+		return ""
+	}
+	var notification cloud.GCSPubSubNotification
+	if err := json.Unmarshal([]byte(in), &notification); err != nil || len(notification.Name) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s#%s", notification.Bucket, notification.Name, notification.Generation)
+}
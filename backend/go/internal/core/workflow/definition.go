@@ -0,0 +1,157 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package workflow defines the high-level business logic orchestrations,
+// combining various commands into coherent pipelines. This file validates and
+// builds chains from the declarative `[workflows.<name>]` configuration.
+//
+// Logic Flow:
+//  1. **Validation**: Every step must have a unique name and reference a
+//     registered command type. Walking the steps in order, every key a step
+//     reads must have been written by an earlier step (the piped `cor.CtxIn`
+//     is always available).
+//  2. **Build**: Each step's factory creates its command, which is optionally
+//     wrapped in a `cor.RetryCommand`, and added to a `cor.BaseChain`.
+//
+// Workflows without a definition keep using the chain wired in Go.
+package workflow
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+)
+
+// Names of the workflows that can be overridden in the configuration.
+const (
+	MediaReaderWorkflowName = "media-reader"
+	MediaResizeWorkflowName = "media-resize"
+)
+
+// ValidateWorkflowDefinition checks a definition without building it.
+//
+// Inputs:
+//   - name: The workflow name, used in error messages.
+//   - def: The definition to validate.
+//
+// Outputs:
+//   - error: All problems found, joined, or nil if the definition is valid.
+func ValidateWorkflowDefinition(name string, def cloud.WorkflowDefinition) error {
+	var errs []error
+	if len(def.Steps) == 0 {
+		errs = append(errs, fmt.Errorf("workflow %s: no steps defined", name))
+	}
+
+	names := make(map[string]bool)
+	available := map[string]bool{cor.CtxIn: true}
+
+	for i, step := range def.Steps {
+		if len(step.Name) == 0 {
+			errs = append(errs, fmt.Errorf("workflow %s: step %d has no name", name, i+1))
+		} else if names[step.Name] {
+			errs = append(errs, fmt.Errorf("workflow %s: duplicate step name %s", name, step.Name))
+		}
+		names[step.Name] = true
+
+		spec, ok := lookupCommand(step.Command)
+		if !ok {
+			errs = append(errs, fmt.Errorf("workflow %s: step %s uses unknown command %q (registered: %v)",
+				name, step.Name, step.Command, RegisteredCommands()))
+			continue
+		}
+		if len(step.Output) > 0 && !spec.NamedOutput {
+			errs = append(errs, fmt.Errorf("workflow %s: step %s: command %s does not support an output key",
+				name, step.Name, step.Command))
+		}
+
+		params := StepParams(step.Params)
+		consumes := make([]string, 0)
+		if len(step.Input) > 0 {
+			consumes = append(consumes, step.Input)
+		}
+		if spec.Consumes != nil {
+			consumes = append(consumes, spec.Consumes(step, params)...)
+		}
+		for _, key := range consumes {
+			if !available[key] {
+				errs = append(errs, fmt.Errorf("workflow %s: step %s reads %s, which no earlier step produces",
+					name, step.Name, key))
+			}
+		}
+
+		if len(step.Output) > 0 {
+			available[step.Output] = true
+		}
+		if spec.Produces != nil {
+			for _, key := range spec.Produces(step, params) {
+				available[key] = true
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NewChainFromDefinition validates a definition and builds its chain.
+//
+// Inputs:
+//   - name: The workflow name, used as the chain name.
+//   - def: The definition to build.
+//   - env: The configuration and clients available to command factories.
+//
+// Outputs:
+//   - cor.Chain: The built chain.
+//   - error: Validation or construction errors.
+func NewChainFromDefinition(name string, def cloud.WorkflowDefinition, env *BuildEnv) (cor.Chain, error) {
+	if err := ValidateWorkflowDefinition(name, def); err != nil {
+		return nil, err
+	}
+
+	out := cor.NewBaseChain(name).Use(cor.DefaultInterceptors()...).DryRun(env.Config.Application.DryRun)
+	out.ContinueOnFailure(def.ContinueOnFailure)
+	if len(env.Config.Application.CheckpointDir) > 0 {
+		out.WithCheckpoints(cor.NewFileCheckpointStore(env.Config.Application.CheckpointDir), GCSNotificationRunID)
+	}
+
+	for _, step := range def.Steps {
+		spec, _ := lookupCommand(step.Command)
+		command, err := spec.Factory(step, StepParams(step.Params), env)
+		if err != nil {
+			return nil, fmt.Errorf("workflow %s: step %s: %w", name, step.Name, err)
+		}
+		if step.RetryAttempts > 1 {
+			policy := cor.DefaultRetryPolicy()
+			policy.MaxAttempts = step.RetryAttempts
+			command = cor.NewRetryCommand(command, policy)
+		}
+		out.AddCommand(command)
+	}
+	return out, nil
+}
+
+// chainFromConfig builds the named workflow from the configuration, if it is
+// defined there. It panics on an invalid definition, as the application cannot
+// run with a broken pipeline.
+func chainFromConfig(name string, config *cloud.Config, serviceClients *cloud.ServiceClients) (cor.Chain, bool) {
+	def, ok := config.Workflows[name]
+	if !ok {
+		return nil, false
+	}
+	chain, err := NewChainFromDefinition(name, def, &BuildEnv{Config: config, Clients: serviceClients})
+	if err != nil {
+		panic(err)
+	}
+	return chain, true
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/workflow"
+	test "github.com/jaycherian/gcp-go-media-search/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// readerCassetteDir holds the Gemini calls of the media reader workflow on a
+// trailer of the low-res bucket. Their responses are those of the fixtures of
+// `testutil/testdata/llm`, in the Vertex AI format. Running the test with
+// GCP_TEST_MODE=record and default credentials records live responses
+// instead, after which the expected title and usage must be updated.
+const readerCassetteDir = "testdata/cassettes/media_reader"
+
+// TestMediaReaderWorkflowReplaysRecordedModelCalls runs the media reader
+// workflow end to end against the recorded Gemini calls, with the local blob
+// store and the SQLite repository, and verifies the media it persists.
+func TestMediaReaderWorkflowReplaysRecordedModelCalls(t *testing.T) {
+	config := test.NewHermeticConfig(t)
+	// The project and location are part of the recorded request paths.
+	config.Application.GoogleProjectId = "media-search-test"
+	config.Application.GoogleLocation = "us-central1"
+	for key, model := range config.AgentModels {
+		model.Provider = cloud.ModelProviderVertex
+		model.FixtureDir = ""
+		config.AgentModels[key] = model
+	}
+	mode := cloud.TestModeReplay
+	if os.Getenv(cloud.EnvTestMode) == cloud.TestModeRecord {
+		mode = cloud.TestModeRecord
+	}
+	t.Setenv(cloud.EnvTestMode, mode)
+	dir, err := filepath.Abs(readerCassetteDir)
+	assert.NoError(t, err)
+	t.Setenv(cloud.EnvCassetteDir, dir)
+
+	ctx := context.Background()
+	clients, err := cloud.NewCloudServiceClients(ctx, config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer clients.Close()
+
+	w, err := clients.BlobStore.Create(ctx, test.HermeticLowResBucket, "trailer.mp4", "video/mp4")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("frames"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	data, err := json.Marshal(&cloud.GCSPubSubNotification{Kind: "storage#object", Bucket: test.HermeticLowResBucket,
+		Name: "trailer.mp4", Generation: "1", ContentType: "video/mp4", Size: "6"})
+	assert.NoError(t, err)
+
+	reader := workflow.NewMediaReaderPipeline(config, clients, "creative-flash")
+	chainCtx := cor.NewBaseContext()
+	defer chainCtx.Close()
+	chainCtx.SetContext(ctx)
+	chainCtx.Add(cor.CtxIn, string(data))
+	reader.Execute(chainCtx)
+	assert.Empty(t, chainCtx.GetErrors())
+
+	saved, err := clients.MediaRepository.ListUnembeddedMedia(ctx)
+	assert.NoError(t, err)
+	if !assert.Len(t, saved, 1) {
+		return
+	}
+	media := saved[0]
+	assert.Equal(t, "Hermetic Test Pattern", media.Title)
+	if assert.Len(t, media.Scenes, 2) {
+		assert.Equal(t, "00:00:00", media.Scenes[0].Start)
+		assert.NotEmpty(t, media.Scenes[0].Script)
+	}
+	if assert.NotNil(t, media.Usage) {
+		assert.Equal(t, 3000, media.Usage.Total.InputTokens)
+		assert.Equal(t, 270, media.Usage.Total.OutputTokens)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/workflow"
+	"github.com/stretchr/testify/assert"
+)
+
+// resizeTrigger runs the resize workflow on the notification of an object
+// and returns the errors of its chain.
+func resizeTrigger(t *testing.T, resize *workflow.MediaResizeWorkflow, name string, contentType string) map[string]error {
+	data, err := json.Marshal(&cloud.GCSPubSubNotification{Kind: "storage#object", Bucket: "hi-res", Name: name, ContentType: contentType})
+	assert.NoError(t, err)
+	chainCtx := cor.NewBaseContext()
+	defer chainCtx.Close()
+	chainCtx.SetContext(context.Background())
+	chainCtx.Add(cor.CtxIn, string(data))
+	resize.Execute(chainCtx)
+	return chainCtx.GetErrors()
+}
+
+// TestMediaResizeWorkflowSkipsObjectsThatAreNotVideos verifies that only
+// videos are resized, and that a video whose store reported no useful content
+// type is recognized by its extension.
+func TestMediaResizeWorkflowSkipsObjectsThatAreNotVideos(t *testing.T) {
+	store, err := cloud.NewLocalBlobStore(t.TempDir(), "http://localhost:8080", []byte("key"))
+	assert.NoError(t, err)
+	config := &cloud.Config{}
+	config.Storage.LowResOutputBucket = "low-res"
+	resize := workflow.NewMediaResizeWorkflow(config, &cloud.ServiceClients{BlobStore: store}, "", nil)
+
+	assert.Empty(t, resizeTrigger(t, resize, "notes.txt", "application/octet-stream"))
+	assert.Empty(t, resizeTrigger(t, resize, "poster.png", ""))
+
+	// The video is not a valid one, so the resize chain fails once it runs.
+	w, err := store.Create(context.Background(), "hi-res", "trailer.mp4", "")
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	for _, contentType := range []string{"video/mp4", "", "application/octet-stream"} {
+		assert.NotEmpty(t, resizeTrigger(t, resize, "trailer.mp4", contentType), contentType)
+	}
+}
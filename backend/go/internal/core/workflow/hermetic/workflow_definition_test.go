@@ -0,0 +1,55 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package workflow_test contains the tests of the core application workflows
+// that need no cloud services, unlike the integration tests of the test
+// directory, whose TestMain connects to them. This file tests the validation
+// of declarative workflow definitions.
+package workflow_test
+
+import (
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/workflow"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestValidateWorkflowDefinition verifies that a well-formed reader definition
+// passes and that unknown commands and unproduced keys are reported.
+func TestValidateWorkflowDefinition(t *testing.T) {
+	valid := cloud.WorkflowDefinition{Steps: []cloud.WorkflowStep{
+		{Name: "trigger", Command: "media-trigger-to-gcs-object"},
+		{Name: "upload", Command: "media-upload"},
+		{Name: "summary", Command: "media-summary-creator"},
+		{Name: "convert", Command: "media-summary-json-to-struct", Output: "summary"},
+		{Name: "scenes", Command: "scene-extractor", Output: "scenes"},
+		{Name: "assemble", Command: "media-assembly", Output: "media",
+			Params: map[string]interface{}{"summary_key": "summary", "scene_key": "scenes"}},
+		{Name: "persist", Command: "media-persist-to-bigquery", RetryAttempts: 3,
+			Params: map[string]interface{}{"media_key": "media"}},
+	}}
+	assert.NoError(t, workflow.ValidateWorkflowDefinition("reader", valid))
+
+	invalid := cloud.WorkflowDefinition{Steps: []cloud.WorkflowStep{
+		{Name: "upload", Command: "media-upload"},
+		{Name: "upload", Command: "does-not-exist"},
+		{Name: "resize", Command: "ffmpeg", Output: "resized"},
+	}}
+	err := workflow.ValidateWorkflowDefinition("broken", invalid)
+	assert.ErrorContains(t, err, "reads __GCS__OBJ__")
+	assert.ErrorContains(t, err, "duplicate step name upload")
+	assert.ErrorContains(t, err, `unknown command "does-not-exist"`)
+	assert.ErrorContains(t, err, "does not support an output key")
+}
@@ -19,90 +19,121 @@ package workflow
 
 import (
 	goctx "context"
-	"errors"
-	"fmt"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
-	"cloud.google.com/go/bigquery"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
-	"google.golang.org/api/iterator"
-	"google.golang.org/genai"
 )
 
 // MediaEmbeddingGeneratorWorkflow defines a background job that periodically
-// scans for media records in BigQuery that haven't been processed for embeddings.
+// scans the media repository for media records that haven't been processed for embeddings.
 // For each unprocessed media, it generates vector embeddings for every scene's
-// script using a Vertex AI model and saves them back to a separate BigQuery table.
+// script using the configured embedding model and saves them back to the repository.
 // This implements the cor.Command interface, allowing it to be part of a larger chain,
 // although it's designed to run independently as a background task.
 
 type MediaEmbeddingGeneratorWorkflow struct {
 	cor.BaseCommand
-	// Muziris change genai does not have an EmbeddingModels structure but has a Models structure now.
-	genaiEmbedding *genai.Models
-	bigqueryClient *bigquery.Client
-	//Muziris change need model name for later in the code when embedding content
-	modelName              string
-	dataset                string
-	mediaTable             string
-	embeddingTable         string
-	findEligibleMediaQuery string
+	embedder   cloud.Embedder
+	repository cloud.MediaRepository
+	interval   time.Duration // The time between two runs of StartTimer.
+
+	stopOnce    sync.Once        // Guards the closing of closeTicker.
+	closeTicker chan struct{}    // Closed by Stop to end the timer; set by StartTimer.
+	done        chan struct{}    // Closed when the timer goroutine returns; set by StartTimer.
+	cancel      goctx.CancelFunc // Cancels the running batch; set by StartTimer.
 }
 
 // StartTimer kicks off the background process for the workflow. It creates a
-// time.Ticker that fires at a regular interval (every 60 seconds). On each tick,
+// time.Ticker that fires at a regular interval (every 60 seconds, unless
+// `embedding_interval_seconds` is configured). On each tick,
 // it executes the embedding generation logic within a new trace span for observability.
-// This function runs indefinitely in a separate goroutine until the application is shut down.
+// This function runs in a separate goroutine until Stop is called.
 func (m *MediaEmbeddingGeneratorWorkflow) StartTimer() {
 	// Obtain a tracer for creating spans.
 	tracer := otel.Tracer("embedding-batch")
-	// Set the ticker to run the job every 60 seconds.
-	ticker := time.NewTicker(60 * time.Second)
-	// A channel to signal when the ticker should be stopped (for graceful shutdown).
-	closeTicker := make(chan struct{})
+	// Set the ticker to run the job at the configured interval.
+	ticker := time.NewTicker(m.interval)
+	// A channel to signal when the ticker should be stopped (for graceful shutdown),
+	// and one to signal that the last batch has finished.
+	m.closeTicker = make(chan struct{})
+	m.done = make(chan struct{})
+	// The batches run on a context that Stop cancels if they take too long.
+	var runCtx goctx.Context
+	runCtx, m.cancel = goctx.WithCancel(goctx.Background())
 
 	// Start a new goroutine to handle the timed execution.
 	go func(m *MediaEmbeddingGeneratorWorkflow) {
+		defer close(m.done)
+		defer ticker.Stop()
 		for {
 			select {
 			// This case is triggered each time the ticker fires.
 			case <-ticker.C:
-				// Start a new OpenTelemetry trace span for this execution run.
-				traceCtx, span := tracer.Start(goctx.Background(), "media-embeddings")
-				// Create a fresh context for this run of the workflow.
-				chainCtx := cor.NewBaseContext()
-				chainCtx.SetContext(traceCtx)
-
-				// Execute the main logic of the workflow.
-				m.Execute(chainCtx)
-
-				// Check if any errors occurred during execution and update the span status.
-				if chainCtx.HasErrors() {
-					span.SetStatus(codes.Error, "failed to execute embedding chain")
-				} else {
-					span.SetStatus(codes.Ok, "executed embeddings")
-				}
-				// End the span for this execution.
-				span.End()
-			// This case would be triggered if a value is sent to the closeTicker channel.
-			case <-closeTicker:
-				ticker.Stop()
+				m.run(runCtx, tracer)
+			// This case is triggered when Stop closes the closeTicker channel.
+			case <-m.closeTicker:
 				return
 			}
 		}
 	}(m)
 }
 
+// run executes one batch of the workflow.
+func (m *MediaEmbeddingGeneratorWorkflow) run(ctx goctx.Context, tracer trace.Tracer) {
+	// Start a new OpenTelemetry trace span for this execution run.
+	traceCtx, span := tracer.Start(ctx, "media-embeddings")
+	// End the span for this execution.
+	defer span.End()
+	// Create a fresh context for this run of the workflow.
+	chainCtx := cor.NewBaseContext()
+	defer chainCtx.Close()
+	chainCtx.SetContext(traceCtx)
+
+	// Execute the main logic of the workflow.
+	m.Execute(chainCtx)
+
+	// Check if any errors occurred during execution and update the span status.
+	if chainCtx.HasErrors() {
+		span.SetStatus(codes.Error, "failed to execute embedding chain")
+	} else {
+		span.SetStatus(codes.Ok, "executed embeddings")
+	}
+}
+
+// Stop ends the timer started by StartTimer and waits for the running batch,
+// if any, to finish. If the context expires first, the batch is canceled; the
+// media it did not embed are picked up again by the next run of the server.
+//
+// Inputs:
+//   - ctx: The context bounding the wait for the running batch.
+//
+// Outputs:
+//   - error: The context's error if the batch had to be canceled.
+func (m *MediaEmbeddingGeneratorWorkflow) Stop(ctx goctx.Context) error {
+	if m.closeTicker == nil {
+		// StartTimer was never called.
+		return nil
+	}
+	m.stopOnce.Do(func() { close(m.closeTicker) })
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		m.cancel()
+		<-m.done
+		return ctx.Err()
+	}
+}
+
 // NewMediaEmbeddingGeneratorWorkflow is the constructor for the embedding workflow.
 // It initializes the workflow with all necessary clients and configuration.
-// It also constructs the specific BigQuery query needed to find media records
-// that are missing embeddings.
 //
 // Inputs:
 //   - config: The application's overall configuration object.
@@ -111,26 +142,15 @@ func (m *MediaEmbeddingGeneratorWorkflow) StartTimer() {
 // Returns:
 //   - A pointer to a newly created and configured MediaEmbeddingGeneratorWorkflow.
 func NewMediaEmbeddingGeneratorWorkflow(config *cloud.Config, serviceClients *cloud.ServiceClients) *MediaEmbeddingGeneratorWorkflow {
-
-	// Construct fully qualified names for the BigQuery tables to prevent ambiguity.
-	fqMediaTableName := strings.Replace(serviceClients.BiqQueryClient.Dataset(config.BigQueryDataSource.DatasetName).Table(config.BigQueryDataSource.MediaTable).FullyQualifiedName(), ":", ".", -1)
-	fqEmbeddingTable := strings.Replace(serviceClients.BiqQueryClient.Dataset(config.BigQueryDataSource.DatasetName).Table(config.BigQueryDataSource.EmbeddingTable).FullyQualifiedName(), ":", ".", -1)
-
-	// Define the SQL query to find all media IDs from the main media table that do NOT
-	// exist in the embedding table. This identifies unprocessed media.
-	query := fmt.Sprintf("SELECT * FROM `%s` WHERE ID NOT IN (SELECT MEDIA_ID FROM `%s`)", fqMediaTableName, fqEmbeddingTable)
-
-	// Return a new instance of the workflow struct, populated with clients,
-	// configuration, and the generated query.
+	interval := time.Duration(config.Application.EmbeddingIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
 	return &MediaEmbeddingGeneratorWorkflow{
-		BaseCommand:            *cor.NewBaseCommand("media-embedding-generator"),
-		genaiEmbedding:         serviceClients.EmbeddingModels["multi-lingual"],
-		bigqueryClient:         serviceClients.BiqQueryClient,
-		modelName:              config.EmbeddingModels["multi-lingual"].Model,
-		dataset:                config.BigQueryDataSource.DatasetName,
-		mediaTable:             config.BigQueryDataSource.MediaTable,
-		embeddingTable:         config.BigQueryDataSource.EmbeddingTable,
-		findEligibleMediaQuery: query,
+		BaseCommand: *cor.NewBaseCommand("media-embedding-generator"),
+		embedder:    serviceClients.EmbeddingModels["multi-lingual"],
+		repository:  serviceClients.MediaRepository,
+		interval:    interval,
 	}
 }
 
@@ -141,76 +161,43 @@ func (m *MediaEmbeddingGeneratorWorkflow) IsExecutable(_ cor.Context) bool {
 	return true
 }
 
-// Execute contains the core logic for the workflow. It queries BigQuery for
+// Execute contains the core logic for the workflow. It asks the repository for
 // unprocessed media, iterates through them, generates embeddings for each scene,
-// and inserts the new embeddings back into BigQuery.
+// and saves the new embeddings back to the repository.
 //
 // Inputs:
 //   - context: The chain of responsibility context, used for passing state and errors.
 func (m *MediaEmbeddingGeneratorWorkflow) Execute(context cor.Context) {
-	// Create a BigQuery query object from the predefined SQL string.
-	q := m.bigqueryClient.Query(m.findEligibleMediaQuery)
-	// Execute the query and get an iterator for the results.
-	it, err := q.Read(context.GetContext())
+	// Find the media records that do not have any embeddings yet.
+	unembedded, err := m.repository.ListUnembeddedMedia(context.GetContext())
 	if err != nil {
 		context.AddError(m.GetName(), err)
 		return
 	}
 
-	// Loop through all the rows (unprocessed media records) returned by the query.
-	for {
-		var value model.Media
-		// Get the next row and deserialize it into a Media struct.
-		err := it.Next(&value)
-		// `iterator.Done` is the standard way to detect the end of the results.
-		if errors.Is(err, iterator.Done) {
-			break
+	for _, value := range unembedded {
+		// Embed the scripts of all the scenes of the media file in one batch.
+		scripts := make([]string, 0, len(value.Scenes))
+		for _, scene := range value.Scenes {
+			scripts = append(scripts, scene.Script)
 		}
+		vectors, err := m.embedder.Embed(context.GetContext(), scripts)
 		if err != nil {
 			context.AddError(m.GetName(), err)
 			return
 		}
 
-		// Create a slice to hold the new embedding objects for the current media file.
-		toInsert := make([]*model.SceneEmbedding, 0)
-
-		// Iterate over each scene within the media object.
-		for _, scene := range value.Scenes {
-			// Create a new embedding object, initializing it with metadata.
-			in := model.NewSceneEmbedding(value.Id, scene.SequenceNumber, m.modelName)
-			// Call the Vertex AI model to generate an embedding for the scene's script text.
-
-			contents := []*genai.Content{
-				genai.NewContentFromText(scene.Script, genai.RoleUser),
-			}
-
-			// Embed the content using the specified embedding model.
-			// Replace "gemini-embedding-exp-03-07" with your desired embedding model.
-			resultemb, erremb := m.genaiEmbedding.EmbedContent(context.GetContext(), m.modelName, contents, nil)
-			if erremb != nil {
-				fmt.Print("Fatal error when creating embeddings", erremb)
-			}
-			// Commented for Muziris
-			// resp, err := m.genaiEmbedding.EmbedContent(context.GetContext(), genai.Text(scene.Script))
-			// if err != nil {
-			// 	context.AddError(m.GetName(), err)
-			// 	return
-			// }
-			// The response contains the vector embedding as a slice of floats.
-			// Append these values to our embedding object.
-			for _, f := range resultemb.Embeddings {
-				for _, g := range f.Values {
-					in.Embeddings = append(in.Embeddings, float64(g))
-				}
-			}
-			// Add the fully populated embedding object to the list for insertion.
+		// Create an embedding object for each scene, tagged with the model ID.
+		toInsert := make([]*model.SceneEmbedding, 0, len(value.Scenes))
+		for i, scene := range value.Scenes {
+			in := model.NewSceneEmbedding(value.Id, scene.SequenceNumber, m.embedder.Name())
+			in.Embeddings = vectors[i]
 			toInsert = append(toInsert, in)
 		}
 
-		// Once all scenes for a media file are processed, insert the batch of
-		// new embeddings into the BigQuery embedding table.
-		inserter := m.bigqueryClient.Dataset(m.dataset).Table(m.embeddingTable).Inserter()
-		if err := inserter.Put(context.GetContext(), toInsert); err != nil {
+		// Once all scenes for a media file are processed, save the batch of
+		// new embeddings.
+		if err := m.repository.SaveEmbeddings(context.GetContext(), toInsert); err != nil {
 			context.AddError(m.GetName(), err)
 			return
 		}
@@ -18,14 +18,14 @@
 package workflow
 
 import (
+	"strings"
 	"text/template"
 	"time"
 
-	"cloud.google.com/go/bigquery"
-	"cloud.google.com/go/storage"
 	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/commands"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
 	"google.golang.org/genai"
 )
 
@@ -39,14 +39,16 @@ import (
 type MediaReaderWorkflow struct {
 	cor.BaseCommand
 	config          *cloud.Config
-	bigqueryClient  *bigquery.Client
+	repository      cloud.MediaRepository
 	genaiClient     *genai.Client
-	genaiModel      *cloud.QuotaAwareGenerativeAIModel
-	storageClient   *storage.Client
+	genaiModel      cloud.GenerativeModel
+	blobStore       cloud.BlobStore
+	budgets         *cloud.BudgetManager // The budgets of ingestion; nil if unlimited.
 	numberOfWorkers int
 	summaryTemplate *template.Template
 	sceneTemplate   *template.Template
-	chain           cor.Chain // The underlying chain of commands to be executed.
+	categoryScenes  map[string]*template.Template // Scene prompt overrides, keyed by lower-case category config key.
+	chain           cor.Chain                     // The underlying chain of commands to be executed.
 }
 
 // Execute runs the entire media reader workflow by invoking the underlying chain.
@@ -70,8 +72,14 @@ func (m *MediaReaderWorkflow) initializeChain() {
 	const SceneOutputParamName = "__scene_output__"
 	const MediaOutputParamName = "__media_output__"
 
-	// Create the chain that will hold all the command steps.
-	out := cor.NewBaseChain(m.GetName())
+	// Create the chain that will hold all the command steps. When a checkpoint
+	// directory is configured, a redelivered message for the same object
+	// generation resumes after the last successful step instead of starting over.
+	// The default interceptors add metrics, logging and panic recovery to every command.
+	out := cor.NewBaseChain(m.GetName()).Use(cor.DefaultInterceptors()...).DryRun(m.config.Application.DryRun)
+	if len(m.config.Application.CheckpointDir) > 0 {
+		out.WithCheckpoints(cor.NewFileCheckpointStore(m.config.Application.CheckpointDir), GCSNotificationRunID)
+	}
 
 	// Step 1: Parse the incoming Pub/Sub message (which is in JSON format)
 	// and extract a structured GCS object reference from it.
@@ -81,7 +89,9 @@ func (m *MediaReaderWorkflow) initializeChain() {
 	// message and save it to a temporary local file on the server's disk.
 	// Muziris change: With the new libraries it is no longer necessary to have a temp file locally and upload it.
 	// We can analyze and extract scenes right from the file in GCS bucket
-	out.AddCommand(commands.NewGCSToTempFile("gcs-to-temp-file", m.storageClient, "media-summary-"))
+	out.AddCommand(cor.NewRetryCommand(
+		commands.NewGCSToTempFile("gcs-to-temp-file", m.blobStore, "media-summary-"),
+		cor.DefaultRetryPolicy()))
 
 	// Step 3: Upload the temporary local file to the Vertex AI File Service.
 	// This service makes the file available for analysis by Gemini models.
@@ -90,6 +100,12 @@ func (m *MediaReaderWorkflow) initializeChain() {
 	// We can analyze and extract scenes right from the file in GCS bucket
 	out.AddCommand(commands.NewMediaUpload("media-upload", m.genaiClient, 300*time.Second))
 
+	// The media is only sent to the model while the budgets of ingestion allow
+	// it; a spent budget defers the message (see cloud.DeferralQueue).
+	if m.budgets != nil {
+		out.AddCommand(commands.NewBudgetCheck("check-summary-budget", m.budgets, ""))
+	}
+
 	// Step 4: Generate a high-level summary of the media file using Gemini.
 	// This command takes the file handle from the previous step and a prompt template
 	// as input and produces a JSON string with the summary, cast, scenes, etc.
@@ -100,25 +116,43 @@ func (m *MediaReaderWorkflow) initializeChain() {
 	// in the context with the key `SummaryOutputParamName`.
 	out.AddCommand(commands.NewMediaSummaryJsonToStruct("convert-media-summary", SummaryOutputParamName))
 
+	// The scenes are checked against the budgets as well, including the
+	// per-media budget, estimated from the usage of the summary.
+	if m.budgets != nil {
+		out.AddCommand(commands.NewBudgetCheck("check-scene-budget", m.budgets, SummaryOutputParamName))
+	}
+
 	// Step 6: Extract detailed descriptions for each scene timestamp identified in the summary.
 	// This command runs scene analysis jobs in parallel using a worker pool for efficiency.
 	// The collected scene descriptions are stored in the context with the key `SceneOutputParamName`.
-	sceneExtractor := commands.NewSceneExtractor("extract-media-scenes", m.genaiModel, m.sceneTemplate, m.numberOfWorkers)
-	sceneExtractor.BaseCommand.OutputParamName = SceneOutputParamName
-	out.AddCommand(sceneExtractor)
+	// Categories that define their own scene prompt in the configuration (e.g. sports
+	// vs. trailers) are routed to a dedicated extractor; everything else uses the default.
+	sceneRouter := cor.NewSwitch("route-media-scenes", func(context cor.Context) string {
+		summary, _ := cor.NewKey[*model.MediaSummary](SummaryOutputParamName).Get(context)
+		if summary == nil {
+			return ""
+		}
+		return strings.ToLower(summary.Category)
+	})
+	for category, sceneTemplate := range m.categoryScenes {
+		sceneRouter.Case(category, m.newSceneExtractor("extract-"+category+"-scenes", sceneTemplate, SceneOutputParamName))
+	}
+	sceneRouter.Default(m.newSceneExtractor("extract-media-scenes", m.sceneTemplate, SceneOutputParamName))
+	out.AddCommand(sceneRouter)
 
 	// Step 7: Assemble the final, complete `model.Media` object. This command takes the
 	// summary struct and the list of scene descriptions and combines them into a single,
 	// unified data structure. The result is stored with the key `MediaOutputParamName`.
 	out.AddCommand(commands.NewMediaAssembly("assemble-media-scenes", SummaryOutputParamName, SceneOutputParamName, MediaOutputParamName))
 
-	// Step 8: Persist the final assembled media object to the main 'media' table in BigQuery.
-	// This makes the structured data available for querying but does not include the vector embeddings yet.
-	out.AddCommand(commands.NewMediaPersistToBigQuery(
-		"write-to-bigquery",
-		m.bigqueryClient,
-		m.config.BigQueryDataSource.DatasetName,
-		m.config.BigQueryDataSource.MediaTable, MediaOutputParamName))
+	// Step 8: Persist the final assembled media object to the media repository (the 'media'
+	// table in BigQuery, or the SQLite database). This makes the structured data available
+	// for querying but does not include the vector embeddings yet.
+	// Each insert attempt is bounded so a stalled streaming insert is retried instead of hanging the worker.
+	persistPolicy := cor.DefaultRetryPolicy()
+	persistPolicy.AttemptTimeout = 60 * time.Second
+	out.AddCommand(cor.NewRetryCommand(commands.NewMediaPersist(
+		"write-to-bigquery", m.repository, MediaOutputParamName), persistPolicy))
 
 	// Step 9: Clean up by deleting the temporary file from the Vertex AI File Service
 	// to avoid incurring unnecessary storage costs.
@@ -128,6 +162,13 @@ func (m *MediaReaderWorkflow) initializeChain() {
 	m.chain = out
 }
 
+// newSceneExtractor creates a scene extractor for the given prompt template.
+func (m *MediaReaderWorkflow) newSceneExtractor(name string, sceneTemplate *template.Template, outputParamName string) *commands.SceneExtractor {
+	sceneExtractor := commands.NewSceneExtractor(name, m.genaiModel, sceneTemplate, m.numberOfWorkers)
+	sceneExtractor.BaseCommand.OutputParamName = outputParamName
+	return sceneExtractor
+}
+
 // NewMediaReaderPipeline is the constructor for the MediaReaderWorkflow. It sets up
 // all dependencies, compiles the prompt templates, and initializes the command chain.
 //
@@ -154,19 +195,42 @@ func NewMediaReaderPipeline(
 		panic(err)
 	}
 
+	// Parse the per-category scene prompt overrides. They are keyed by the
+	// lower-case config key of the category (e.g. "trailer_comp"), not its
+	// display name: the summary prompt lists the categories by key, so that is
+	// what the model returns in the summary.
+	categoryScenes := make(map[string]*template.Template)
+	for key, category := range config.Categories {
+		if len(strings.TrimSpace(category.Scene)) == 0 {
+			continue
+		}
+		t, err := template.New("scene-template-" + key).Parse(category.Scene)
+		if err != nil {
+			panic(err)
+		}
+		categoryScenes[strings.ToLower(key)] = t
+	}
+
 	// Create the MediaReaderWorkflow instance with all its dependencies.
 	pipeline := &MediaReaderWorkflow{
 		BaseCommand:     *cor.NewBaseCommand("media-reader-pipeline"),
 		config:          config,
-		bigqueryClient:  serviceClients.BiqQueryClient,
+		repository:      serviceClients.MediaRepository,
 		genaiClient:     serviceClients.GenAIClient,
 		genaiModel:      serviceClients.AgentModels[agentModelName],
-		storageClient:   serviceClients.StorageClient,
+		blobStore:       serviceClients.BlobStore,
+		budgets:         serviceClients.Budgets,
 		numberOfWorkers: config.Application.ThreadPoolSize,
 		summaryTemplate: summaryTemplate,
 		sceneTemplate:   sceneTemplate,
+		categoryScenes:  categoryScenes,
+	}
+	// Build the command chain for the new pipeline instance. A `[workflows.media-reader]`
+	// definition in the configuration takes precedence over the chain wired in Go.
+	if chain, ok := chainFromConfig(MediaReaderWorkflowName, config, serviceClients); ok {
+		pipeline.chain = chain
+	} else {
+		pipeline.initializeChain()
 	}
-	// Build the command chain for the new pipeline instance.
-	pipeline.initializeChain()
 	return pipeline
 }
@@ -18,9 +18,16 @@
 package workflow
 
 import (
+	"log"
+	"log/slog"
+	"path/filepath"
+	"strconv"
 	"strings"
 
-	"cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
 	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/commands"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
@@ -31,6 +38,10 @@ import (
 // It assumes `ffmpeg` is available in the system's PATH.
 const DefaultFfmpegCommand = "ffmpeg"
 
+// VideoWidthParamName is the context key under which the probed width of the
+// downloaded video is stored.
+const VideoWidthParamName = "__video_width__"
+
 // DefaultWidth sets the default target width for video resizing, a common size for previews.
 const DefaultWidth = "240"
 
@@ -41,10 +52,14 @@ const DefaultWidth = "240"
 type MediaResizeWorkflow struct {
 	cor.BaseCommand
 	ffmpegCommand    string
+	ffprobeCommand   string
 	videoFormat      *model.MediaFormatFilter
-	storageClient    *storage.Client
+	blobStore        cloud.BlobStore
 	outputBucketName string
-	chain            cor.Chain // The underlying chain of commands to be executed.
+	ffmpegLimiter    *cloud.Limiter      // Caps the FFmpeg processes running at once, across workflows.
+	dryRun           bool                // If true, the chain only logs its execution plan.
+	skipped          metric.Int64Counter // Counts the objects that are not resized because they are not videos.
+	chain            cor.Chain           // The underlying chain of commands to be executed.
 }
 
 // Execute runs the media resize workflow by invoking the underlying command chain.
@@ -60,28 +75,83 @@ func (m *MediaResizeWorkflow) Execute(context cor.Context) {
 // initializeChain constructs the sequence of commands that define the resize workflow.
 // This method is called by the constructor to set up the processing pipeline.
 func (m *MediaResizeWorkflow) initializeChain() {
-	// Create a new chain instance to hold the sequence of commands.
-	out := cor.NewBaseChain(m.GetName())
+	// Create a new chain instance to hold the sequence of commands. The default
+	// interceptors add metrics, logging and panic recovery to every command,
+	// including those of the nested video chain.
+	out := cor.NewBaseChain(m.GetName()).Use(cor.DefaultInterceptors()...).DryRun(m.dryRun)
 
 	// Step 1: Parse the incoming Pub/Sub trigger message to get the GCS object details.
 	out.AddCommand(commands.NewMediaTriggerToGCSObject("gcs-topic-listener"))
 
-	// Step 2: Download the high-resolution video from GCS to a temporary local file.
-	// This makes the file accessible to the local FFmpeg process.
-	out.AddCommand(commands.NewGCSToTempFile("copy-from-gcs-to-temp", m.storageClient, "ffmpeg-tmp-"))
+	// The remaining steps only apply to video files; anything else (images,
+	// sidecar files, etc.) is ignored.
+	video := cor.NewBaseChain("video-resize-chain")
 
-	// Step 3: Execute the FFmpeg command on the local file to resize it.
-	// The `videoFormat.Width` determines the target resolution.
-	out.AddCommand(commands.NewFFMpegCommand("video-resize", m.ffmpegCommand, m.videoFormat.Width))
-
-	// Step 4: Upload the newly created low-resolution (resized) file from the local
+	// Step 2: Download the high-resolution video from GCS to a temporary local file.
+	// This makes the file accessible to the local FFmpeg process. Transient GCS
+	// failures are retried with backoff.
+	video.AddCommand(cor.NewRetryCommand(
+		commands.NewGCSToTempFile("copy-from-gcs-to-temp", m.blobStore, "ffmpeg-tmp-"),
+		cor.DefaultRetryPolicy()))
+
+	// Step 3: Measure the video so that files which are already small enough
+	// are not transcoded again.
+	video.AddCommand(commands.NewFFProbeWidthCommand("video-probe", m.ffprobeCommand, VideoWidthParamName))
+
+	// Step 4: Execute the FFmpeg command on the local file to resize it.
+	// The `videoFormat.Width` determines the target resolution. When the video is
+	// already at or below that width, the original file is passed through as-is.
+	resize := commands.NewFFMpegCommand("video-resize", m.ffmpegCommand, m.videoFormat.Width)
+	resize.SetLimiter(m.ffmpegLimiter)
+	video.AddCommand(cor.NewIf("needs-resize", m.needsResize, resize, nil))
+
+	// Step 5: Upload the low-resolution file (resized or original) from the local
 	// temporary directory to the designated low-resolution GCS bucket.
-	out.AddCommand(commands.NewGCSFileUpload("resized-file-upload-to-gcs", m.storageClient, m.outputBucketName))
+	video.AddCommand(cor.NewRetryCommand(
+		commands.NewGCSFileUpload("resized-file-upload-to-gcs", m.blobStore, m.outputBucketName),
+		cor.DefaultRetryPolicy()))
+
+	out.AddCommand(cor.NewIf("is-video", m.isVideo, video, nil))
 
 	// Assign the fully constructed chain to the workflow instance.
 	m.chain = out
 }
 
+// isVideo reports whether the GCS object that triggered the workflow is a
+// video. When the store reported no content type, or only the generic
+// "application/octet-stream", the type is derived from the object's name.
+// The objects skipped are logged and counted.
+func (m *MediaResizeWorkflow) isVideo(context cor.Context) bool {
+	obj, ok := cloud.GCSObjectKey.Get(context)
+	if !ok || obj == nil {
+		return false
+	}
+	contentType := obj.MIMEType
+	if len(contentType) == 0 || contentType == "application/octet-stream" {
+		contentType = cloud.ContentTypeByName(obj.Name)
+	}
+	if strings.HasPrefix(contentType, "video/") {
+		return true
+	}
+	slog.InfoContext(context.GetContext(), "skipping resize of an object that is not a video",
+		"bucket", obj.Bucket, "object", obj.Name, "content_type", obj.MIMEType)
+	if m.skipped != nil {
+		m.skipped.Add(context.GetContext(), 1, metric.WithAttributes(attribute.String("content_type", contentType)))
+	}
+	return false
+}
+
+// needsResize reports whether the probed video is wider than the target width.
+// An unknown width (e.g. FFprobe is unavailable) is treated as needing a resize.
+func (m *MediaResizeWorkflow) needsResize(context cor.Context) bool {
+	target, err := strconv.Atoi(m.videoFormat.Width)
+	if err != nil {
+		return true
+	}
+	width, ok := cor.NewKey[int](VideoWidthParamName).Get(context)
+	return !ok || width <= 0 || width > target
+}
+
 // NewMediaResizeWorkflow is the constructor for the MediaResizeWorkflow. It initializes
 // the workflow with all necessary clients and configurations, and builds the command chain.
 //
@@ -115,10 +185,31 @@ func NewMediaResizeWorkflow(
 	out := &MediaResizeWorkflow{
 		BaseCommand:      *cor.NewBaseCommand("media-resize-workflow"),
 		ffmpegCommand:    ffmpegCommand,
+		ffprobeCommand:   ffprobePath(ffmpegCommand),
 		videoFormat:      videoFormat,
-		storageClient:    serviceClients.StorageClient,
-		outputBucketName: config.Storage.LowResOutputBucket}
-	// Build the command chain for the new pipeline instance.
-	out.initializeChain()
+		blobStore:        serviceClients.BlobStore,
+		outputBucketName: config.Storage.LowResOutputBucket,
+		ffmpegLimiter:    serviceClients.FFmpegLimiter,
+		dryRun:           config.Application.DryRun}
+	skipped, err := otel.Meter("github.com/GoogleCloudPlatform/solutions/media").Int64Counter(
+		"media_resize.skipped", metric.WithDescription("The objects not resized because they are not videos."))
+	if err != nil {
+		log.Printf("error creating skip counter for the media resize workflow: %v\n", err)
+	}
+	out.skipped = skipped
+	// Build the command chain for the new pipeline instance. A `[workflows.media-resize]`
+	// definition in the configuration takes precedence over the chain wired in Go.
+	if chain, ok := chainFromConfig(MediaResizeWorkflowName, config, serviceClients); ok {
+		out.chain = chain
+	} else {
+		out.initializeChain()
+	}
 	return out
 }
+
+// ffprobePath derives the FFprobe executable from the FFmpeg one, which ships
+// alongside it (e.g. "/usr/bin/ffmpeg" becomes "/usr/bin/ffprobe").
+func ffprobePath(ffmpegCommand string) string {
+	base := strings.Replace(filepath.Base(ffmpegCommand), "ffmpeg", "ffprobe", 1)
+	return filepath.Join(filepath.Dir(ffmpegCommand), base)
+}
@@ -0,0 +1,386 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package workflow defines the high-level business logic orchestrations,
+// combining various commands into coherent pipelines. This file defines the
+// command registry used to build workflows declared in the TOML configuration
+// (see `cloud.WorkflowDefinition`).
+//
+// Every command type that can appear in a `[[workflows.<name>.steps]]` entry is
+// registered here under a stable name, together with a factory that builds the
+// command from the step's parameters and a description of which context keys
+// the command reads and writes. The key descriptions are what allows a
+// definition to be validated at startup, before any message is processed.
+package workflow
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/commands"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
+)
+
+// BuildEnv carries the dependencies that command factories may use.
+type BuildEnv struct {
+	Config  *cloud.Config         // The application configuration.
+	Clients *cloud.ServiceClients // The initialized service clients.
+}
+
+// CommandFactory builds the command for a workflow step.
+type CommandFactory func(step cloud.WorkflowStep, params StepParams, env *BuildEnv) (cor.Command, error)
+
+// KeyFunc lists the context keys a step reads or writes, in addition to the
+// piped `cor.CtxIn`/`cor.CtxOut` values and the step's own input/output keys.
+type KeyFunc func(step cloud.WorkflowStep, params StepParams) []string
+
+// CommandSpec describes a command type that can be used in workflow definitions.
+type CommandSpec struct {
+	Factory  CommandFactory // Builds the command.
+	Consumes KeyFunc        // The keys the command requires; may be nil.
+	Produces KeyFunc        // The keys the command writes; may be nil.
+	// NamedOutput reports whether the command honors the step's `output` key.
+	// Commands that always write to `cor.CtxOut` must leave this false.
+	NamedOutput bool
+}
+
+// registry holds the registered command types, keyed by type name.
+var registry = struct {
+	sync.RWMutex
+	specs map[string]CommandSpec
+}{specs: make(map[string]CommandSpec)}
+
+// RegisterCommand makes a command type available to workflow definitions.
+// Registering an existing name replaces the previous spec.
+//
+// Inputs:
+//   - commandType: The name used in the `command` field of a step.
+//   - spec: The factory and key descriptions for the command.
+func RegisterCommand(commandType string, spec CommandSpec) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.specs[commandType] = spec
+}
+
+// lookupCommand returns the spec registered for the command type.
+func lookupCommand(commandType string) (CommandSpec, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	spec, ok := registry.specs[commandType]
+	return spec, ok
+}
+
+// RegisteredCommands returns the names of all registered command types, sorted.
+func RegisteredCommands() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	out := make([]string, 0, len(registry.specs))
+	for k := range registry.specs {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// StepParams gives typed access to the `params` table of a workflow step.
+type StepParams map[string]interface{}
+
+// String returns the string parameter, or def if it is not set.
+func (p StepParams) String(name string, def string) (string, error) {
+	v, ok := p[name]
+	if !ok {
+		return def, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("parameter %s must be a string, got %T", name, v)
+	}
+	return s, nil
+}
+
+// Int returns the integer parameter, or def if it is not set. TOML integers
+// are decoded as int64, so both int and int64 are accepted.
+func (p StepParams) Int(name string, def int) (int, error) {
+	v, ok := p[name]
+	if !ok {
+		return def, nil
+	}
+	switch n := v.(type) {
+	case int64:
+		return int(n), nil
+	case int:
+		return n, nil
+	default:
+		return 0, fmt.Errorf("parameter %s must be an integer, got %T", name, v)
+	}
+}
+
+// RequiredString returns the string parameter, failing if it is not set.
+func (p StepParams) RequiredString(name string) (string, error) {
+	s, err := p.String(name, "")
+	if err != nil {
+		return "", err
+	}
+	if len(s) == 0 {
+		return "", fmt.Errorf("parameter %s is required", name)
+	}
+	return s, nil
+}
+
+// keys returns a KeyFunc for a fixed set of keys.
+func keys(names ...string) KeyFunc {
+	return func(cloud.WorkflowStep, StepParams) []string { return names }
+}
+
+// paramKeys returns a KeyFunc for keys named by the given parameters.
+func paramKeys(params ...string) KeyFunc {
+	return func(_ cloud.WorkflowStep, p StepParams) []string {
+		out := make([]string, 0, len(params))
+		for _, name := range params {
+			if v, _ := p.String(name, ""); len(v) > 0 {
+				out = append(out, v)
+			}
+		}
+		return out
+	}
+}
+
+// requireOutput fails if the step does not declare an output key.
+func requireOutput(step cloud.WorkflowStep) error {
+	if len(step.Output) == 0 {
+		return fmt.Errorf("step %s: command %s requires an output key", step.Name, step.Command)
+	}
+	return nil
+}
+
+// agentModel resolves the `agent_model` parameter to an initialized model.
+func agentModel(params StepParams, env *BuildEnv) (cloud.GenerativeModel, error) {
+	name, err := params.String("agent_model", DefaultAgentModel)
+	if err != nil {
+		return nil, err
+	}
+	model, ok := env.Clients.AgentModels[name]
+	if !ok || model == nil {
+		return nil, fmt.Errorf("agent model %s is not configured", name)
+	}
+	return model, nil
+}
+
+// promptTemplate parses the `prompt` parameter, falling back to def.
+func promptTemplate(step cloud.WorkflowStep, params StepParams, def string) (*template.Template, error) {
+	text, err := params.String("prompt", def)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(step.Name + "-template").Parse(text)
+}
+
+// DefaultAgentModel is the agent model used when a step does not set `agent_model`.
+const DefaultAgentModel = "creative-flash"
+
+func init() {
+	RegisterCommand("media-trigger-to-gcs-object", CommandSpec{
+		Produces:    keys(cloud.GetGCSObjectName()),
+		NamedOutput: true,
+		Factory: func(step cloud.WorkflowStep, _ StepParams, _ *BuildEnv) (cor.Command, error) {
+			cmd := commands.NewMediaTriggerToGCSObject(step.Name)
+			cmd.InputParamName, cmd.OutputParamName = step.Input, step.Output
+			return cmd, nil
+		},
+	})
+
+	RegisterCommand("gcs-to-temp-file", CommandSpec{
+		NamedOutput: true,
+		Factory: func(step cloud.WorkflowStep, params StepParams, env *BuildEnv) (cor.Command, error) {
+			prefix, err := params.String("temp_file_prefix", "media-")
+			if err != nil {
+				return nil, err
+			}
+			cmd := commands.NewGCSToTempFile(step.Name, env.Clients.BlobStore, prefix)
+			cmd.InputParamName, cmd.OutputParamName = step.Input, step.Output
+			return cmd, nil
+		},
+	})
+
+	RegisterCommand("media-upload", CommandSpec{
+		Consumes:    keys(cloud.GetGCSObjectName()),
+		Produces:    keys(commands.GetVideoUploadFileParameterName()),
+		NamedOutput: true,
+		Factory: func(step cloud.WorkflowStep, params StepParams, env *BuildEnv) (cor.Command, error) {
+			timeout, err := params.Int("timeout_in_seconds", 300)
+			if err != nil {
+				return nil, err
+			}
+			cmd := commands.NewMediaUpload(step.Name, env.Clients.GenAIClient, time.Duration(timeout)*time.Second)
+			cmd.InputParamName, cmd.OutputParamName = step.Input, step.Output
+			return cmd, nil
+		},
+	})
+
+	RegisterCommand("media-summary-creator", CommandSpec{
+		NamedOutput: true,
+		Factory: func(step cloud.WorkflowStep, params StepParams, env *BuildEnv) (cor.Command, error) {
+			model, err := agentModel(params, env)
+			if err != nil {
+				return nil, err
+			}
+			prompt, err := promptTemplate(step, params, env.Config.PromptTemplates.SummaryPrompt)
+			if err != nil {
+				return nil, err
+			}
+			cmd := commands.NewMediaSummaryCreator(step.Name, env.Config, model, prompt)
+			cmd.InputParamName, cmd.OutputParamName = step.Input, step.Output
+			return cmd, nil
+		},
+	})
+
+	RegisterCommand("budget-check", CommandSpec{
+		Factory: func(step cloud.WorkflowStep, params StepParams, env *BuildEnv) (cor.Command, error) {
+			if env.Clients.Budgets == nil {
+				return nil, fmt.Errorf("step %s: command %s requires a [budget] limit", step.Name, step.Command)
+			}
+			summaryKey, err := params.String("summary_key", "")
+			if err != nil {
+				return nil, err
+			}
+			cmd := commands.NewBudgetCheck(step.Name, env.Clients.Budgets, summaryKey)
+			cmd.InputParamName = step.Input
+			return cmd, nil
+		},
+	})
+
+	RegisterCommand("media-summary-json-to-struct", CommandSpec{
+		Consumes:    keys(cloud.GetGCSObjectName()),
+		NamedOutput: true,
+		Factory: func(step cloud.WorkflowStep, _ StepParams, _ *BuildEnv) (cor.Command, error) {
+			if err := requireOutput(step); err != nil {
+				return nil, err
+			}
+			cmd := commands.NewMediaSummaryJsonToStruct(step.Name, step.Output)
+			cmd.InputParamName = step.Input
+			return cmd, nil
+		},
+	})
+
+	RegisterCommand("scene-extractor", CommandSpec{
+		Consumes:    keys(commands.GetVideoUploadFileParameterName()),
+		NamedOutput: true,
+		Factory: func(step cloud.WorkflowStep, params StepParams, env *BuildEnv) (cor.Command, error) {
+			model, err := agentModel(params, env)
+			if err != nil {
+				return nil, err
+			}
+			prompt, err := promptTemplate(step, params, env.Config.PromptTemplates.ScenePrompt)
+			if err != nil {
+				return nil, err
+			}
+			workers, err := params.Int("workers", env.Config.Application.ThreadPoolSize)
+			if err != nil {
+				return nil, err
+			}
+			cmd := commands.NewSceneExtractor(step.Name, model, prompt, workers)
+			cmd.InputParamName, cmd.OutputParamName = step.Input, step.Output
+			return cmd, nil
+		},
+	})
+
+	RegisterCommand("media-assembly", CommandSpec{
+		Consumes:    paramKeys("summary_key", "scene_key"),
+		NamedOutput: true,
+		Factory: func(step cloud.WorkflowStep, params StepParams, _ *BuildEnv) (cor.Command, error) {
+			if err := requireOutput(step); err != nil {
+				return nil, err
+			}
+			summaryKey, err := params.RequiredString("summary_key")
+			if err != nil {
+				return nil, err
+			}
+			sceneKey, err := params.RequiredString("scene_key")
+			if err != nil {
+				return nil, err
+			}
+			return commands.NewMediaAssembly(step.Name, summaryKey, sceneKey, step.Output), nil
+		},
+	})
+
+	mediaPersist := CommandSpec{
+		Consumes: paramKeys("media_key"),
+		Factory: func(step cloud.WorkflowStep, params StepParams, env *BuildEnv) (cor.Command, error) {
+			mediaKey, err := params.RequiredString("media_key")
+			if err != nil {
+				return nil, err
+			}
+			return commands.NewMediaPersist(step.Name, env.Clients.MediaRepository, mediaKey), nil
+		},
+	}
+	RegisterCommand("media-persist", mediaPersist)
+	// The original name, kept so that existing definitions continue to work.
+	RegisterCommand("media-persist-to-bigquery", mediaPersist)
+
+	RegisterCommand("media-cleanup", CommandSpec{
+		Consumes: keys(commands.GetVideoUploadFileParameterName()),
+		Factory: func(step cloud.WorkflowStep, _ StepParams, env *BuildEnv) (cor.Command, error) {
+			return commands.NewMediaCleanup(step.Name, env.Clients.GenAIClient), nil
+		},
+	})
+
+	RegisterCommand("ffprobe-width", CommandSpec{
+		NamedOutput: true,
+		Factory: func(step cloud.WorkflowStep, params StepParams, _ *BuildEnv) (cor.Command, error) {
+			if err := requireOutput(step); err != nil {
+				return nil, err
+			}
+			path, err := params.String("ffprobe", ffprobePath(DefaultFfmpegCommand))
+			if err != nil {
+				return nil, err
+			}
+			cmd := commands.NewFFProbeWidthCommand(step.Name, path, step.Output)
+			cmd.InputParamName = step.Input
+			return cmd, nil
+		},
+	})
+
+	RegisterCommand("ffmpeg", CommandSpec{
+		Factory: func(step cloud.WorkflowStep, params StepParams, env *BuildEnv) (cor.Command, error) {
+			path, err := params.String("ffmpeg", DefaultFfmpegCommand)
+			if err != nil {
+				return nil, err
+			}
+			width, err := params.String("width", DefaultWidth)
+			if err != nil {
+				return nil, err
+			}
+			cmd := commands.NewFFMpegCommand(step.Name, path, width)
+			cmd.InputParamName = step.Input
+			cmd.SetLimiter(env.Clients.FFmpegLimiter)
+			return cmd, nil
+		},
+	})
+
+	RegisterCommand("gcs-file-upload", CommandSpec{
+		Factory: func(step cloud.WorkflowStep, params StepParams, env *BuildEnv) (cor.Command, error) {
+			bucket, err := params.String("bucket", env.Config.Storage.LowResOutputBucket)
+			if err != nil {
+				return nil, err
+			}
+			cmd := commands.NewGCSFileUpload(step.Name, env.Clients.BlobStore, bucket)
+			cmd.InputParamName = step.Input
+			return cmd, nil
+		},
+	})
+}
@@ -84,6 +84,9 @@ func TestMain(m *testing.M) {
 	// Initialize all the Google Cloud service clients (Storage, BigQuery, etc.)
 	// using the loaded configuration. These clients are stored in the global `cloudClients`
 	// variable, making them accessible to all tests in the package.
+	// Run with GCP_TEST_MODE=record and GCP_CASSETTE_DIR=<dir> once to save the
+	// Gemini and embedding calls, then with GCP_TEST_MODE=replay to serve them
+	// from the cassettes without Vertex AI.
 	cloudClients, err = cloud.NewCloudServiceClients(ctx, config)
 	if err != nil {
 		panic(err)
@@ -0,0 +1,188 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package test provides utility functions and mock data to support the application's
+// test suite. This file builds a hermetic configuration, in which every cloud
+// service is replaced by a local stand-in, so that the full server can be run
+// by a test without credentials or network access.
+//
+// Logic Flow:
+//  1. The base configuration (`configs/.env.toml`) is loaded from the module
+//     root, whatever the working directory of the test, for its prompt
+//     templates, categories and models.
+//  2. The cloud services are then replaced, below a temporary directory:
+//     - Cloud Storage by the local blob store;
+//     - BigQuery by a SQLite database, searched with the cosine distance;
+//     - the Pub/Sub subscriptions by directory sources watching the buckets
+//     of the local blob store, so that an upload triggers its workflow;
+//     - the Gemini models by fake models answering from `testdata/llm`;
+//     - the embedding models by the hashing embedder.
+//  3. The poll and embedding intervals are shortened to one second.
+//
+// A test can point a listener at the Pub/Sub emulator instead by setting its
+// source back to "pubsub" and exporting PUBSUB_EMULATOR_HOST.
+package test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/workflow"
+)
+
+// Buckets of the hermetic configuration.
+const (
+	HermeticHiResBucket  = "media-high-res" // The bucket uploads are written to.
+	HermeticLowResBucket = "media-low-res"  // The bucket resized videos are written to.
+)
+
+// ModuleRoot returns the directory of the module's go.mod file, found by
+// walking up from the working directory of the test.
+//
+// Inputs:
+//   - t: The current test; it fails if no go.mod file is found.
+//
+// Outputs:
+//   - string: The absolute path of the module root.
+func ModuleRoot(t testing.TB) string {
+	t.Helper()
+	root, err := moduleRoot()
+	if err != nil {
+		t.Fatalf("failed to find the module root: %v", err)
+	}
+	return root
+}
+
+// moduleRoot walks up from the working directory to the directory holding go.mod.
+func moduleRoot() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("no go.mod found above the working directory")
+		}
+		dir = parent
+	}
+}
+
+// NewHermeticConfig creates a configuration whose services all run in process
+// or below a temporary directory of the test.
+//
+// Inputs:
+//   - t: The current test; the temporary directory is removed when it ends.
+//
+// Outputs:
+//   - *cloud.Config: The hermetic configuration.
+func NewHermeticConfig(t testing.TB) *cloud.Config {
+	t.Helper()
+	root := ModuleRoot(t)
+	// No ".env.hermetic.toml" exists, so only the base configuration is loaded.
+	t.Setenv(cloud.EnvConfigFilePrefix, filepath.Join(root, "configs"))
+	t.Setenv(cloud.EnvConfigRuntime, "hermetic")
+	config := cloud.NewConfig()
+	cloud.LoadConfig(&config)
+
+	dir := t.TempDir()
+	config.Application.CheckpointDir = filepath.Join(dir, "checkpoints")
+	config.Application.DryRun = false
+	config.Application.EmbeddingIntervalSeconds = 1
+	config.Application.DeadLetterDir = filepath.Join(dir, "dead_letters")
+
+	config.Storage = cloud.Storage{
+		HiResInputBucket:   HermeticHiResBucket,
+		LowResOutputBucket: HermeticLowResBucket,
+		Backend:            cloud.BlobBackendLocal,
+		LocalRoot:          filepath.Join(dir, "blobs"),
+		PublicURL:          "http://localhost:8080",
+		SigningKey:         "hermetic",
+	}
+	config.MetadataStore = cloud.MetadataStore{
+		Backend:      cloud.MetadataBackendSQLite,
+		SQLitePath:   filepath.Join(dir, "media.db"),
+		DistanceType: "COSINE",
+	}
+
+	// Each bucket is watched by the listener of the workflow it feeds.
+	config.TopicSubscriptions = map[string]cloud.TopicSubscription{
+		"HiResTopic": {
+			Source:              cloud.MessageSourceDirectory,
+			Bucket:              HermeticHiResBucket,
+			Workflow:            workflow.MediaResizeWorkflowName,
+			TimeoutInSeconds:    60,
+			PollIntervalSeconds: 1,
+		},
+		"LowResTopic": {
+			Source:              cloud.MessageSourceDirectory,
+			Bucket:              HermeticLowResBucket,
+			Workflow:            workflow.MediaReaderWorkflowName,
+			TimeoutInSeconds:    60,
+			PollIntervalSeconds: 1,
+		},
+	}
+
+	fixtures := filepath.Join(root, "internal", "testutil", "testdata", "llm")
+	for key, model := range config.AgentModels {
+		model.Provider = cloud.ModelProviderFake
+		model.FixtureDir = fixtures
+		config.AgentModels[key] = model
+	}
+	for key, model := range config.EmbeddingModels {
+		config.EmbeddingModels[key] = cloud.VertexAiEmbeddingModel{
+			Model:    model.Model,
+			Provider: cloud.EmbeddingProviderHashing,
+		}
+	}
+	return config
+}
+
+// NewTestVideo creates a small synthetic MP4 video (a test pattern) with
+// FFmpeg. The test is skipped if FFmpeg or FFprobe is not installed.
+//
+// Inputs:
+//   - t: The current test.
+//   - name: The file name of the video (e.g., "trailer.mp4").
+//   - seconds: The length of the video.
+//
+// Outputs:
+//   - string: The path of the video, in a temporary directory of the test.
+func NewTestVideo(t testing.TB, name string, seconds int) string {
+	t.Helper()
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		t.Skip("ffprobe is not installed")
+	}
+	out := filepath.Join(t.TempDir(), name)
+	// 320 pixels is wider than the 240 of the resize workflow, so the video is resized.
+	cmd := exec.Command(ffmpeg, "-y", "-loglevel", "error",
+		"-f", "lavfi", "-i", fmt.Sprintf("testsrc=duration=%d:size=320x240:rate=10", seconds),
+		"-pix_fmt", "yuv420p", out)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to create test video: %v: %s", err, output)
+	}
+	return out
+}
@@ -20,8 +20,10 @@ package test
 import (
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"cloud.google.com/go/auth/credentials"
 	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
 )
 
@@ -49,6 +51,21 @@ func HandleErr(err error, t *testing.T) {
 	}
 }
 
+// SkipWithoutCredentials skips a test against the live Google Cloud services
+// when no Application Default Credentials can be found. Any other failure to
+// reach the services must still fail the test.
+//
+// Inputs:
+//   - t: The *testing.T object from the current test.
+func SkipWithoutCredentials(t *testing.T) {
+	_, err := credentials.DetectDefault(&credentials.DetectOptions{
+		Scopes: []string{"https://www.googleapis.com/auth/cloud-platform"},
+	})
+	if err != nil {
+		t.Skipf("no Google Cloud credentials for the live services: %v", err)
+	}
+}
+
 // GetTestHighResMessageText returns a hardcoded JSON string that simulates a
 // Pub/Sub notification message from Google Cloud Storage for a file finalized
 // in the "high-resolution" bucket. This mock data is used to test the media
@@ -118,8 +135,13 @@ func GetTestLowResMessageText() string {
 // Returns:
 //   - An error if setting any environment variable fails.
 func SetupOS() (err error) {
-	// Set the directory where the configuration files are located.
-	err = os.Setenv(cloud.EnvConfigFilePrefix, "configs")
+	// Set the directory where the configuration files are located. Tests run
+	// in the directory of their package, so it is found from the module root.
+	configs := "configs"
+	if root, err := moduleRoot(); err == nil {
+		configs = filepath.Join(root, configs)
+	}
+	err = os.Setenv(cloud.EnvConfigFilePrefix, configs)
 	if err != nil {
 		return err
 	}
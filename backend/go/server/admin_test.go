@@ -0,0 +1,63 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+)
+
+// TestAdminAuth verifies that the admin routes are only served to requests
+// carrying the configured bearer token.
+func TestAdminAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/admin/quotas", AdminAuth("secret"), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for header, status := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/quotas", nil)
+		if len(header) > 0 {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, status, w.Code, header)
+	}
+}
+
+// TestAdminToken verifies that the admin API is disabled unless the
+// configured environment variable holds a token.
+func TestAdminToken(t *testing.T) {
+	config := &cloud.Config{}
+	assert.Empty(t, adminToken(config))
+
+	config.Application.AdminTokenEnv = "MEDIA_SEARCH_TEST_ADMIN_TOKEN"
+	assert.Empty(t, adminToken(config))
+	t.Setenv("MEDIA_SEARCH_TEST_ADMIN_TOKEN", "secret")
+	assert.Equal(t, "secret", adminToken(config))
+}
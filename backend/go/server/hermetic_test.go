@@ -0,0 +1,126 @@
+// Copyright 2024 Google, LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The end-to-end tests live in package main, since the server cannot be
+// imported. They run the whole server against the hermetic configuration of
+// the testutil package.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+	test "github.com/jaycherian/gcp-go-media-search/internal/testutil"
+)
+
+// TestHermeticUploadAndSearch uploads a synthetic video and waits until the
+// resize, reader and embedding workflows make it searchable.
+func TestHermeticUploadAndSearch(t *testing.T) {
+	video := test.NewTestVideo(t, "hermetic-test.mp4", 12)
+	gin.SetMode(gin.TestMode)
+
+	state.config = test.NewHermeticConfig(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	InitState(ctx)
+	defer func() { assert.Nil(t, state.lifecycle.Shutdown(context.Background())) }()
+	server := httptest.NewServer(NewRouter())
+	defer server.Close()
+
+	// Upload the video as the web client does.
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("files", "hermetic-test.mp4")
+	assert.Nil(t, err)
+	file, err := os.Open(video)
+	assert.Nil(t, err)
+	_, err = io.Copy(part, file)
+	assert.Nil(t, err)
+	_ = file.Close()
+	assert.Nil(t, writer.Close())
+
+	resp, err := http.Post(server.URL+"/api/v1/uploads", writer.FormDataContentType(), &body)
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The scene scripts of the fake model mention a red car.
+	search := server.URL + "/api/v1/media?s=" + url.QueryEscape("red car in the desert")
+	var results []*model.Media
+	deadline := time.Now().Add(90 * time.Second)
+	for len(results) == 0 && time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+		resp, err := http.Get(search)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if resp.StatusCode == http.StatusOK {
+			_ = json.NewDecoder(resp.Body).Decode(&results)
+		}
+		_ = resp.Body.Close()
+	}
+	if !assert.Equal(t, 1, len(results)) {
+		return
+	}
+	assert.Equal(t, "Hermetic Test Pattern", results[0].Title)
+	assert.Equal(t, "trailer", results[0].Category)
+	assert.NotEmpty(t, results[0].Scenes)
+
+	// The media can be read back by its ID.
+	resp, err = http.Get(server.URL + "/api/v1/media/" + results[0].Id)
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The tokens, and estimated cost, of indexing the media are reported.
+	resp, err = http.Get(server.URL + "/api/v1/media/" + results[0].Id + "/usage")
+	assert.Nil(t, err)
+	var report model.MediaUsageReport
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&report))
+	_ = resp.Body.Close()
+	if assert.NotNil(t, report.Usage) {
+		assert.Greater(t, report.Usage.Summary.InputTokens, 0)
+		assert.Greater(t, report.Usage.Total.Cost, 0.0)
+	}
+	assert.NotEmpty(t, report.Scenes)
+	for _, scene := range report.Scenes {
+		assert.Greater(t, scene.OutputTokens, 0)
+	}
+
+	// Only the repository calls a service with a circuit breaker, and it is up.
+	resp, err = http.Get(server.URL + "/health")
+	assert.Nil(t, err)
+	var health struct {
+		Status          string                       `json:"status"`
+		CircuitBreakers []cloud.CircuitBreakerStatus `json:"circuit_breakers"`
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&health))
+	_ = resp.Body.Close()
+	assert.Equal(t, "ok", health.Status)
+	assert.Equal(t, []cloud.CircuitBreakerStatus{{Name: "repository", State: "closed"}}, health.CircuitBreakers)
+}
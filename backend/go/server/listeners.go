@@ -12,26 +12,35 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Package main contains the logic for setting up and starting the Pub/Sub message listeners.
+// Package main contains the logic for setting up and starting the message listeners.
 // These listeners are responsible for initiating backend processing workflows in response to events,
-// such as new file uploads to Google Cloud Storage.
+// such as new file uploads to Google Cloud Storage or to a watched local directory.
 //
 // Functions:
-//   - SetupListeners: Initializes and starts the listeners for both high-resolution
-//     and low-resolution media topics, attaching the corresponding processing workflows.
+//   - SetupListeners: Attaches the configured workflow to every listener and starts it.
+//   - listenerWorkflow: Builds the workflow run by a listener.
 package main
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/cor"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/workflow"
 )
 
-// SetupListeners configures and starts the background Pub/Sub listeners.
-// It creates the necessary media processing workflows and attaches them to the
-// appropriate topic listeners.
+// defaultListenerWorkflows maps the original listener names to their workflows,
+// for configurations that do not set `workflow`.
+var defaultListenerWorkflows = map[string]string{
+	"HiResTopic":  workflow.MediaResizeWorkflowName,
+	"LowResTopic": workflow.MediaReaderWorkflowName,
+}
+
+// SetupListeners configures and starts the background message listeners.
+// It creates the workflow selected by each `[topic_subscriptions.<name>]`
+// entry and attaches it to that entry's listener, whatever its message source.
 //
 // Inputs:
 //   - config: The application's configuration, containing settings for storage, topics, etc.
@@ -40,23 +49,50 @@ import (
 //
 // Outputs:
 //   - This function does not return any value. It starts the listeners as background goroutines.
+//     It panics if a listener names an unknown workflow.
 func SetupListeners(config *cloud.Config, cloudClients *cloud.ServiceClients, ctx context.Context) {
-	// TODO - Externalize the destination topic and ffmpeg command
-
-	// Create the workflow for resizing high-resolution videos.
-	// This workflow is triggered by messages on the HiResTopic and uses FFmpeg to transcode files.
-	mediaResizeWorkflow := workflow.NewMediaResizeWorkflow(config, cloudClients, "ffmpeg", &model.MediaFormatFilter{Width: "240"})
-	// Assign the resize workflow as the command to be executed by the listener for the high-resolution topic.
-	cloudClients.PubSubListeners["HiResTopic"].SetCommand(mediaResizeWorkflow)
-	// Start the listener in a background goroutine. It will now begin receiving and processing messages from its subscription.
-	cloudClients.PubSubListeners["HiResTopic"].Listen(ctx)
-
-	// Create the workflow for ingesting and analyzing low-resolution videos.
-	// This workflow uses the "creative-flash" GenAI model for analysis.
-	mediaIngestion := workflow.NewMediaReaderPipeline(config, cloudClients, "creative-flash")
+	for name, listener := range cloudClients.Listeners {
+		command, err := listenerWorkflow(name, config, cloudClients)
+		if err != nil {
+			panic(err)
+		}
+		// Assign the workflow as the command to be executed by the listener.
+		listener.SetCommand(command)
+		// The checkpoints of the messages the listener dead-letters are deleted.
+		if len(config.Application.CheckpointDir) > 0 {
+			listener.SetCheckpoints(cor.NewFileCheckpointStore(config.Application.CheckpointDir), workflow.GCSNotificationRunID)
+		}
+		// Start the listener in a background goroutine. It will now begin receiving and processing messages from its source.
+		listener.Listen(ctx)
+	}
+}
 
-	// Assign the ingestion workflow to the listener for the low-resolution topic.
-	cloudClients.PubSubListeners["LowResTopic"].SetCommand(mediaIngestion)
-	// Start the listener for the low-resolution topic.
-	cloudClients.PubSubListeners["LowResTopic"].Listen(ctx)
+// listenerWorkflow builds the workflow run by a listener.
+//
+// Inputs:
+//   - name: The logical name of the listener (e.g., "HiResTopic").
+//   - config: The application's configuration.
+//   - cloudClients: The initialized service clients.
+//
+// Outputs:
+//   - cor.Command: The workflow.
+//   - error: An error if the listener has no workflow or an unknown one.
+func listenerWorkflow(name string, config *cloud.Config, cloudClients *cloud.ServiceClients) (cor.Command, error) {
+	workflowName := config.TopicSubscriptions[name].Workflow
+	if len(workflowName) == 0 {
+		workflowName = defaultListenerWorkflows[name]
+	}
+	switch workflowName {
+	case workflow.MediaResizeWorkflowName:
+		// TODO - Externalize the ffmpeg command
+		// The resize workflow uses FFmpeg to transcode high-resolution files.
+		return workflow.NewMediaResizeWorkflow(config, cloudClients, "ffmpeg", &model.MediaFormatFilter{Width: "240"}), nil
+	case workflow.MediaReaderWorkflowName:
+		// The ingestion workflow uses the "creative-flash" GenAI model for analysis.
+		return workflow.NewMediaReaderPipeline(config, cloudClients, "creative-flash"), nil
+	case "":
+		return nil, fmt.Errorf("listener %s does not set a workflow", name)
+	default:
+		return nil, fmt.Errorf("listener %s: unknown workflow %q", name, workflowName)
+	}
 }
@@ -28,22 +28,35 @@
 //
 // Functions:
 //   - main: The main entry point of the application. It sets up the server, configures routes,
-//     initializes services, and handles graceful shutdown.
+//     initializes services, and handles graceful shutdown: the HTTP server, the listeners
+//     and the embedding generator are drained, then the clients are closed and the
+//     telemetry flushed (see `cloud.Lifecycle`).
+//   - NewRouter: Creates the Gin engine with its middleware and all API routes.
+//   - Health: Serves the health of the server and the state of its circuit breakers.
 //   - MediaRouter: Sets up the API routes related to media, such as searching for media,
 //     retrieving specific media items and scenes, and generating signed URLs for streaming.
 //   - FileUpload: Configures the API endpoint for handling multipart/form-data file uploads,
-//     saving the uploaded files to a Google Cloud Storage bucket.
+//     saving the uploaded files to the high-resolution bucket of the blob store.
+//   - AdminRouter: Sets up the administrative API routes, which list, replay and discard
+//     the messages the listeners dead-lettered, and report the quotas and budgets.
+//     They are only served when a token is configured (see AdminAuth).
+//   - AdminAuth: Rejects the admin requests that do not carry the configured bearer token.
+//   - LocalBlobs: Serves the files of the local blob store to holders of a signed URL.
 package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
 	"log"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -51,7 +64,9 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 
+	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
 	"github.com/jaycherian/gcp-go-media-search/internal/core/model"
+	"github.com/jaycherian/gcp-go-media-search/internal/core/services"
 	"github.com/jaycherian/gcp-go-media-search/internal/telemetry"
 )
 
@@ -73,7 +88,7 @@ func main() {
 	config := GetConfig()
 
 	// Initialize OpenTelemetry for distributed tracing and metrics.
-	_, err := telemetry.SetupOpenTelemetry(ctx, config)
+	shutdownTelemetry, err := telemetry.SetupOpenTelemetry(ctx, config)
 	if err != nil {
 		slog.Error("Failed to setup OpenTelemetry", "error", err)
 		log.Fatal(err)
@@ -84,25 +99,8 @@ func main() {
 	InitState(ctx)
 	slog.Info("Initialized State")
 
-	// Set up the Gin web server with default middleware.
-	r := gin.Default()
-
-	// Add OpenTelemetry middleware to the Gin router to trace incoming requests.
-	// This will automatically create spans for each request.
-	r.Use(otelgin.Middleware("media-search-server"))
-
-	// Configure Cross-Origin Resource Sharing (CORS) middleware.
-	// Using cors.Default() provides a permissive configuration suitable for development,
-	// allowing requests from any origin.
-	r.Use(cors.Default())
-
-	// Group routes under the "/api/v1" prefix.
-	apiV1 := r.Group("/api/v1")
-	{
-		// Register the routes for media and file upload functionality within the API group.
-		MediaRouter(apiV1)
-		FileUpload(apiV1)
-	}
+	// Set up the Gin web server with its middleware and API routes.
+	r := NewRouter()
 
 	// Configure the HTTP server with the address and handler.
 	srv := &http.Server{
@@ -120,6 +118,11 @@ func main() {
 	}()
 	slog.Info("Server Ready on port 8080")
 
+	// On shutdown, the server stops accepting requests while the listeners
+	// drain; once everything has stopped, the buffered telemetry is flushed.
+	state.lifecycle.OnDrain("http server", srv.Shutdown)
+	state.lifecycle.OnClose("telemetry", shutdownTelemetry)
+
 	// Set up a channel to listen for OS interrupt signals (e.g., Ctrl+C).
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -127,19 +130,77 @@ func main() {
 	<-quit
 	slog.Info("Shutdown Server ...")
 
-	// Create a context with a timeout for the graceful shutdown.
-	// This gives active requests 5 seconds to complete.
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer shutdownCancel()
-
-	// Attempt to gracefully shut down the server.
-	if err := srv.Shutdown(shutdownCtx); err != nil {
+	// Drain the running requests and workflows, within the configured
+	// shutdown timeout, then release the clients and flush the telemetry.
+	if err := state.lifecycle.Shutdown(context.Background()); err != nil {
 		slog.Error("Server Shutdown Failed:", "error", err)
 	}
 
 	log.Println("Server exiting")
 }
 
+// NewRouter creates the Gin engine serving the API from the initialized state.
+// It is shared by main and the end-to-end tests, which serve it with httptest.
+//
+// Outputs:
+//   - *gin.Engine: The router with its middleware and all API routes.
+func NewRouter() *gin.Engine {
+	// Set up the Gin web server with default middleware.
+	r := gin.Default()
+
+	// Add OpenTelemetry middleware to the Gin router to trace incoming requests.
+	// This will automatically create spans for each request.
+	r.Use(otelgin.Middleware("media-search-server"))
+
+	// Configure Cross-Origin Resource Sharing (CORS) middleware.
+	// Using cors.Default() provides a permissive configuration suitable for development,
+	// allowing requests from any origin.
+	r.Use(cors.Default())
+
+	// Group routes under the "/api/v1" prefix.
+	apiV1 := r.Group("/api/v1")
+	{
+		// Register the routes for media and file upload functionality within the API group.
+		MediaRouter(apiV1)
+		FileUpload(apiV1)
+	}
+
+	// The admin API replays and discards messages, so it is only served to
+	// holders of the configured token.
+	if token := adminToken(state.config); len(token) > 0 {
+		AdminRouter(apiV1.Group("", AdminAuth(token)))
+	} else {
+		slog.Info("Admin API disabled; set application.admin_token_env to enable it")
+	}
+	r.GET("/health", Health)
+
+	// With the local storage backend, signed URLs point back at this server.
+	if store, ok := state.cloud.BlobStore.(*cloud.LocalBlobStore); ok {
+		LocalBlobs(r, store)
+	}
+	return r
+}
+
+// Health serves GET /health: the state of every circuit breaker, and a status
+// of "degraded" while one of them is not closed. It answers 200 either way,
+// since the server keeps serving, from the services that are up, during an
+// outage of another.
+//
+// Inputs:
+//   - c: The Gin context of the request.
+func Health(c *gin.Context) {
+	status := "ok"
+	breakers := make([]cloud.CircuitBreakerStatus, 0, len(state.cloud.Breakers))
+	for _, breaker := range state.cloud.Breakers {
+		breakerStatus := breaker.Status()
+		if breakerStatus.State != cloud.CircuitClosed.String() {
+			status = "degraded"
+		}
+		breakers = append(breakers, breakerStatus)
+	}
+	c.JSON(http.StatusOK, gin.H{"status": status, "circuit_breakers": breakers})
+}
+
 // MediaRouter sets up the API routes for media-related actions.
 //
 // Inputs:
@@ -155,6 +216,8 @@ func main() {
 //   - GET /media/:id: Retrieves the full details of a specific media object by its ID.
 //   - GET /media/:id/stream: Generates a time-limited, signed URL for securely streaming a media file.
 //   - GET /media/:id/scenes/:scene_id: Fetches the details of a specific scene within a media object.
+//   - GET /media/:id/usage: Reports the tokens, and estimated cost, of indexing a media object,
+//     for its summary, its scenes and in total, with a line per scene.
 func MediaRouter(r *gin.RouterGroup) {
 	// Group all media-related routes under the "/media" path.
 	media := r.Group("/media")
@@ -280,6 +343,21 @@ func MediaRouter(r *gin.RouterGroup) {
 			// Return the scene object as JSON.
 			c.JSON(http.StatusOK, out)
 		})
+
+		// Handler for GET /media/:id/usage
+		media.GET("/:id/usage", func(c *gin.Context) {
+			out, err := state.mediaService.GetUsage(c, c.Param("id"))
+			if errors.Is(err, cloud.ErrMediaNotFound) {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("Error getting usage of media %s: %v\n", c.Param("id"), err)
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.JSON(http.StatusOK, out)
+		})
 	}
 }
 
@@ -293,9 +371,8 @@ func MediaRouter(r *gin.RouterGroup) {
 //     provided router group.
 //
 // This function configures a POST endpoint at "/uploads" that accepts multipart/form-data.
-// It processes one or more files sent under the "files" form field, saves them
-// temporarily to the local disk, and then uploads them to a configured
-// Google Cloud Storage bucket before deleting the local temporary file.
+// It processes one or more files sent under the "files" form field and streams each
+// of them to the configured high-resolution bucket of the blob store.
 func FileUpload(r *gin.RouterGroup) {
 	// Group the upload route under "/uploads".
 	upload := r.Group("/uploads")
@@ -310,46 +387,212 @@ func FileUpload(r *gin.RouterGroup) {
 			}
 			// Get all files associated with the "files" field.
 			files := form.File["files"]
-			// Get a handle to the configured GCS bucket for high-resolution files.
-			bucket := state.cloud.StorageClient.Bucket(state.config.Storage.HiResInputBucket)
+			bucket := state.config.Storage.HiResInputBucket
 
-			// Loop through all the uploaded files.
+			// Loop through all the uploaded files and stream each one to the bucket.
 			for _, file := range files {
-				// Define a temporary local path to save the file.
-				localPath := filepath.Join(os.TempDir(), file.Filename)
-				// Save the uploaded file to the local temporary path.
-				if err := c.SaveUploadedFile(file, localPath); err != nil {
-					c.String(http.StatusBadRequest, "upload file err: %s", err.Error())
-					return
-				}
-
-				// Read the file content from the local path.
-				content, err := os.ReadFile(localPath)
-				if err != nil {
-					log.Println(err)
-					c.Status(http.StatusInternalServerError)
-					return
-				}
-				// Get a writer for the new object in the GCS bucket.
-				wc := bucket.Object(file.Filename).NewWriter(c)
-				// Set the content type for the GCS object.
-				wc.ContentType = "video/mp4"
-				// Write the file content to the GCS object.
-				if _, err = wc.Write(content); err != nil {
+				if err := uploadFile(c, bucket, file); err != nil {
 					c.String(http.StatusInternalServerError, "write file to bucket err: %s", err.Error())
 					return
 				}
-				// Close the GCS writer to finalize the upload.
-				if err := wc.Close(); err != nil {
-					log.Printf("failed to close bucket handle: %v\n", err)
-				}
-				// Remove the temporary local file after successful upload.
-				if err := os.Remove(localPath); err != nil {
-					log.Printf("failed to remove file from server: %v\n", err)
-				}
 			}
 			// Respond with a success message.
 			c.String(http.StatusOK, "Uploaded successfully %d files.", len(files))
 		})
 	}
 }
+
+// uploadFile streams one uploaded file to a new object of the bucket. If the
+// copy fails, the write is aborted so that no partial object is created.
+//
+// Inputs:
+//   - ctx: The request's context.
+//   - bucket: The destination bucket.
+//   - file: The uploaded file.
+//
+// Outputs:
+//   - error: An error if the file cannot be read or written.
+func uploadFile(ctx context.Context, bucket string, file *multipart.FileHeader) error {
+	// Open the uploaded file; gin keeps large files on disk until the request ends.
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Canceling the writer's context before Close aborts the upload.
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc, err := state.cloud.BlobStore.Create(writeCtx, bucket, file.Filename, "video/mp4")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(wc, src); err != nil {
+		cancel()
+		_ = wc.Close()
+		return err
+	}
+	// Close the writer to finalize the upload.
+	return wc.Close()
+}
+
+// AdminRouter sets up the administrative API routes. They act on the
+// ingestion, so NewRouter only registers them behind AdminAuth.
+//
+// Inputs:
+//   - r: A *gin.RouterGroup to which the admin routes will be added.
+//
+// This function defines the following endpoints:
+//   - GET /admin/dead-letters: Lists the dead-lettered messages, oldest first.
+//   - GET /admin/dead-letters/:id: Retrieves a dead-lettered message with the errors of its last attempt.
+//   - POST /admin/dead-letters/:id/replay: Runs a dead-lettered message through its listener's
+//     workflow in the background; the message is removed once the replay succeeds.
+//   - DELETE /admin/dead-letters/:id: Discards a dead-lettered message.
+//   - GET /admin/quotas: Returns the quota state of every model used so far: its
+//     quotas, its requests and tokens of the last minute, and its throttling.
+//   - GET /admin/budgets: Returns the spend of the daily and monthly budgets, and
+//     the messages deferred until the budgets allow them.
+func AdminRouter(r *gin.RouterGroup) {
+	deadLetters := r.Group("/admin/dead-letters")
+	{
+		// Handler for GET /admin/dead-letters
+		deadLetters.GET("", func(c *gin.Context) {
+			out, err := state.deadLetterService.List(c)
+			if err != nil {
+				log.Printf("Error listing dead letters: %v\n", err)
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.JSON(http.StatusOK, out)
+		})
+
+		// Handler for GET /admin/dead-letters/:id
+		deadLetters.GET("/:id", func(c *gin.Context) {
+			out, err := state.deadLetterService.Get(c, c.Param("id"))
+			if err != nil {
+				c.Status(deadLetterStatus(err))
+				return
+			}
+			c.JSON(http.StatusOK, out)
+		})
+
+		// Handler for POST /admin/dead-letters/:id/replay
+		deadLetters.POST("/:id/replay", func(c *gin.Context) {
+			id := c.Param("id")
+			// The replay outlives the request, so it must not be canceled with it.
+			done, err := state.deadLetterService.Replay(context.WithoutCancel(c.Request.Context()), id)
+			if err != nil {
+				c.JSON(deadLetterStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			go func() {
+				if err := <-done; err != nil {
+					log.Printf("Error replaying dead letter %s: %v\n", id, err)
+				}
+			}()
+			c.JSON(http.StatusAccepted, gin.H{"id": id})
+		})
+
+		// Handler for DELETE /admin/dead-letters/:id
+		deadLetters.DELETE("/:id", func(c *gin.Context) {
+			if err := state.deadLetterService.Discard(c, c.Param("id")); err != nil {
+				c.Status(deadLetterStatus(err))
+				return
+			}
+			c.Status(http.StatusNoContent)
+		})
+	}
+
+	// Handler for GET /admin/quotas
+	r.GET("/admin/quotas", func(c *gin.Context) {
+		c.JSON(http.StatusOK, state.cloud.Quotas.Snapshot())
+	})
+
+	// Handler for GET /admin/budgets
+	r.GET("/admin/budgets", func(c *gin.Context) {
+		deferred := make([]*cloud.DeadLetter, 0)
+		if queue := state.cloud.Deferrals; queue != nil {
+			var err error
+			if deferred, err = queue.List(c); err != nil {
+				log.Printf("Error listing deferred messages: %v\n", err)
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"budgets": state.cloud.Budgets.Snapshot(), "deferred": deferred})
+	})
+}
+
+// adminToken returns the bearer token of the admin API, read from the
+// environment variable named by the configuration; empty if it is disabled.
+func adminToken(config *cloud.Config) string {
+	if config == nil || len(config.Application.AdminTokenEnv) == 0 {
+		return ""
+	}
+	return os.Getenv(config.Application.AdminTokenEnv)
+}
+
+// AdminAuth is the middleware of the admin API: it rejects the requests that
+// do not carry the token as "Authorization: Bearer <token>".
+//
+// Inputs:
+//   - token: The bearer token of the admin API.
+//
+// Outputs:
+//   - gin.HandlerFunc: The middleware answering 401 to the other requests.
+func AdminAuth(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), expected) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// deadLetterStatus maps an error of the DeadLetterService to an HTTP status.
+func deadLetterStatus(err error) int {
+	switch {
+	case errors.Is(err, cloud.ErrDeadLetterNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrReplayInProgress):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrReplaysDrained):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// LocalBlobs serves the files of the local blob store. Every request must carry
+// the "expires" and "signature" parameters of a URL created by the store's SignURL.
+//
+// Inputs:
+//   - r: The router to register the route on.
+//   - store: The local blob store whose files are served.
+//
+// This function defines the following endpoint:
+//   - GET /api/v1/blobs/:bucket/*name: Streams the object, supporting range requests.
+func LocalBlobs(r *gin.Engine, store *cloud.LocalBlobStore) {
+	r.GET(cloud.LocalBlobPath+"/:bucket/*name", func(c *gin.Context) {
+		bucket := c.Param("bucket")
+		name := strings.TrimPrefix(c.Param("name"), "/")
+		if err := store.Verify(bucket, name, c.Query("expires"), c.Query("signature")); err != nil {
+			c.Status(http.StatusForbidden)
+			return
+		}
+		path, err := store.FilePath(bucket, name)
+		if err != nil {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		// c.File uses http.ServeFile, which handles range requests for video seeking.
+		c.File(path)
+	})
+}
@@ -18,7 +18,7 @@
 // and application-level services for search and media handling.
 //
 // It ensures that the application is configured correctly based on the environment,
-// initializes all necessary clients (Storage, BigQuery, IAM, etc.), and starts
+// initializes all necessary clients (the blob store, BigQuery, IAM, etc.), and starts
 // background processes like Pub/Sub listeners and the embedding generator workflow.
 //
 // Functions:
@@ -28,13 +28,16 @@
 //     from TOML files. It ensures the configuration is loaded only once.
 //   - InitState: The core initialization function that creates all service clients,
 //     configures application services (MediaService, SearchService), and starts
-//     background workflows and Pub/Sub listeners.
+//     background workflows, Pub/Sub listeners and the replay of the messages
+//     deferred by the budgets, registering each of them with the lifecycle that
+//     shuts them down.
 package main
 
 import (
 	"context"
 	"log"
 	"os"
+	"time"
 
 	credentials "cloud.google.com/go/iam/credentials/apiv1"
 	"github.com/jaycherian/gcp-go-media-search/internal/cloud"
@@ -46,10 +49,12 @@ import (
 // centralized container for service clients and configurations. This avoids the
 // need for global variables and makes dependency management cleaner.
 type StateManager struct {
-	config        *cloud.Config
-	cloud         *cloud.ServiceClients
-	searchService *services.SearchService
-	mediaService  *services.MediaService
+	config            *cloud.Config
+	cloud             *cloud.ServiceClients
+	searchService     *services.SearchService
+	mediaService      *services.MediaService
+	deadLetterService *services.DeadLetterService
+	lifecycle         *cloud.Lifecycle // Drains the listeners and timers, then closes the clients, on shutdown.
 }
 
 // state is a package-level variable that holds the single instance of StateManager.
@@ -112,11 +117,15 @@ func GetConfig() *cloud.Config {
 //
 // This function performs the following steps:
 //  1. Loads the application configuration.
-//  2. Initializes all Google Cloud service clients (Storage, Pub/Sub, GenAI, BigQuery, IAM).
-//  3. Instantiates the application-specific services (SearchService, MediaService)
+//  2. Initializes the blob store and the Google Cloud service clients (Pub/Sub, GenAI, BigQuery, IAM)
+//     that the configuration uses.
+//  3. Instantiates the application-specific services (SearchService, MediaService, DeadLetterService)
 //     with the required client dependencies.
 //  4. Starts background workflows, such as the media embedding generator.
-//  5. Sets up and starts the Pub/Sub listeners for processing GCS events.
+//  5. Sets up and starts the Pub/Sub listeners for processing GCS events, and
+//     the replay of the messages deferred until the budgets allow them.
+//  6. Registers the listeners, the embedding generator, the deferral queue and
+//     the clients with the lifecycle, so that shutdown drains and closes them in order.
 func InitState(ctx context.Context) {
 	// Get the application configuration.
 	config := GetConfig()
@@ -127,40 +136,38 @@ func InitState(ctx context.Context) {
 		panic(err)
 	}
 
-	// Specifically initialize the IAM credentials client, required for signing URLs.
-	iamClient, err := credentials.NewIamCredentialsClient(ctx)
-	if err != nil {
-		panic(err)
+	// Specifically initialize the IAM credentials client, required for signing GCS URLs.
+	// The local blob store signs its URLs itself.
+	if backend := config.Storage.Backend; backend == "" || backend == cloud.BlobBackendGCS {
+		iamClient, err := credentials.NewIamCredentialsClient(ctx)
+		if err != nil {
+			panic(err)
+		}
+		// Add the IAM client to our set of cloud clients.
+		cloudClients.IAMClient = iamClient
 	}
-	// Add the IAM client to our set of cloud clients.
-	cloudClients.IAMClient = iamClient
 
 	// Store the initialized clients in the global state.
 	state.cloud = cloudClients
 
-	// Get BigQuery dataset and table names from the config for easier access.
-	datasetName := config.BigQueryDataSource.DatasetName
-	mediaTableName := config.BigQueryDataSource.MediaTable
-	embeddingTableName := config.BigQueryDataSource.EmbeddingTable
-
 	// Initialize the SearchService with its dependencies.
 	state.searchService = &services.SearchService{
-		BigqueryClient: cloudClients.BiqQueryClient,
-		EmbeddingModel: cloudClients.EmbeddingModels["multi-lingual"],
-		ModelName:      config.EmbeddingModels["multi-lingual"].Model,
-		DatasetName:    datasetName,
-		MediaTable:     mediaTableName,
-		EmbeddingTable: embeddingTableName,
+		Repository: cloudClients.MediaRepository,
+		Embedder:   cloudClients.EmbeddingModels["multi-lingual"],
 	}
 
 	// Initialize the MediaService with its dependencies.
 	state.mediaService = &services.MediaService{
-		BigqueryClient: cloudClients.BiqQueryClient,
-		StorageClient:  cloudClients.StorageClient, // Pass the storage client here
-		IAMClient:      cloudClients.IAMClient,
-		SignerEmail:    config.Application.SignerServiceAccountEmail,
-		DatasetName:    datasetName,
-		MediaTable:     mediaTableName,
+		Repository:  cloudClients.MediaRepository,
+		BlobStore:   cloudClients.BlobStore, // Pass the blob store here, for signing URLs
+		IAMClient:   cloudClients.IAMClient,
+		SignerEmail: config.Application.SignerServiceAccountEmail,
+	}
+
+	// Initialize the DeadLetterService, which replays dead letters through the listeners' workflows.
+	state.deadLetterService = &services.DeadLetterService{
+		Store:     cloudClients.DeadLetters,
+		Listeners: cloudClients.Listeners,
 	}
 
 	// Create and start the background workflow for generating embeddings for new media.
@@ -170,4 +177,26 @@ func InitState(ctx context.Context) {
 	// Configure and start the Pub/Sub listeners that react to GCS bucket events.
 	SetupListeners(config, cloudClients, ctx)
 
+	// Replay the messages deferred by a spent budget through the listeners'
+	// workflows, once the budgets allow them.
+	if cloudClients.Deferrals != nil {
+		cloudClients.Deferrals.Start()
+	}
+
+	// On shutdown, the listeners, the embedding generator and the replays of
+	// dead letters finish (or cancel) their running work before the clients
+	// they use are closed.
+	state.lifecycle = cloud.NewLifecycle(time.Duration(config.Application.ShutdownTimeoutSeconds) * time.Second)
+	for name, listener := range cloudClients.Listeners {
+		state.lifecycle.OnDrain("listener "+name, listener.Shutdown)
+	}
+	state.lifecycle.OnDrain("embedding generator", embeddingGenerator.Stop)
+	state.lifecycle.OnDrain("dead letter replays", state.deadLetterService.Drain)
+	if cloudClients.Deferrals != nil {
+		state.lifecycle.OnDrain("deferral queue", cloudClients.Deferrals.Stop)
+	}
+	state.lifecycle.OnClose("service clients", func(context.Context) error {
+		cloudClients.Close()
+		return nil
+	})
 }
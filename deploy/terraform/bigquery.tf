@@ -153,6 +153,11 @@ resource "google_bigquery_table" "media_ds_media" {
                 "type": "INTEGER",
                 "mode": "NULLABLE"
             },
+            {
+                "name": "cost",
+                "type": "FLOAT",
+                "mode": "NULLABLE"
+            },
             {
                 "name": "start",
                 "type": "STRING",
@@ -169,7 +174,154 @@ resource "google_bigquery_table" "media_ds_media" {
                 "mode": "NULLABLE"
             }
         ]
+    },
+    {
+        "name": "usage",
+        "type": "RECORD",
+        "mode": "NULLABLE",
+        "fields": [
+            {
+                "name": "summary",
+                "type": "RECORD",
+                "mode": "NULLABLE",
+                "fields": [
+                    {
+                        "name": "model",
+                        "type": "STRING",
+                        "mode": "NULLABLE"
+                    },
+                    {
+                        "name": "input_tokens",
+                        "type": "INTEGER",
+                        "mode": "NULLABLE"
+                    },
+                    {
+                        "name": "output_tokens",
+                        "type": "INTEGER",
+                        "mode": "NULLABLE"
+                    },
+                    {
+                        "name": "cost",
+                        "type": "FLOAT",
+                        "mode": "NULLABLE"
+                    }
+                ]
+            },
+            {
+                "name": "scenes",
+                "type": "RECORD",
+                "mode": "NULLABLE",
+                "fields": [
+                    {
+                        "name": "model",
+                        "type": "STRING",
+                        "mode": "NULLABLE"
+                    },
+                    {
+                        "name": "input_tokens",
+                        "type": "INTEGER",
+                        "mode": "NULLABLE"
+                    },
+                    {
+                        "name": "output_tokens",
+                        "type": "INTEGER",
+                        "mode": "NULLABLE"
+                    },
+                    {
+                        "name": "cost",
+                        "type": "FLOAT",
+                        "mode": "NULLABLE"
+                    }
+                ]
+            },
+            {
+                "name": "total",
+                "type": "RECORD",
+                "mode": "NULLABLE",
+                "fields": [
+                    {
+                        "name": "model",
+                        "type": "STRING",
+                        "mode": "NULLABLE"
+                    },
+                    {
+                        "name": "input_tokens",
+                        "type": "INTEGER",
+                        "mode": "NULLABLE"
+                    },
+                    {
+                        "name": "output_tokens",
+                        "type": "INTEGER",
+                        "mode": "NULLABLE"
+                    },
+                    {
+                        "name": "cost",
+                        "type": "FLOAT",
+                        "mode": "NULLABLE"
+                    }
+                ]
+            }
+        ]
+    }
+]
+EOF
+}
+
+resource "google_bigquery_table" "media_ds_usage_records" {
+  dataset_id = google_bigquery_dataset.media_ds.dataset_id
+  table_id   = "usage_records"
+  deletion_protection = false
+  time_partitioning {
+    type  = "DAY"
+    field = "recorded_at"
+  }
+  schema = <<EOF
+[
+    {
+        "name": "recorded_at",
+        "type": "TIMESTAMP",
+        "mode": "REQUIRED"
+    },
+    {
+        "name": "model",
+        "type": "STRING",
+        "mode": "NULLABLE"
+    },
+    {
+        "name": "input_tokens",
+        "type": "INTEGER",
+        "mode": "NULLABLE"
+    },
+    {
+        "name": "output_tokens",
+        "type": "INTEGER",
+        "mode": "NULLABLE"
+    },
+    {
+        "name": "cost",
+        "type": "FLOAT",
+        "mode": "NULLABLE"
+    }
+]
+EOF
+}
+
+resource "google_bigquery_table" "media_ds_media_tombstones" {
+  dataset_id = google_bigquery_dataset.media_ds.dataset_id
+  table_id   = "media_tombstones"
+  deletion_protection = false
+  schema = <<EOF
+[
+    {
+        "name": "media_id",
+        "type": "STRING",
+        "mode": "REQUIRED"
+    },
+    {
+        "name": "deleted_at",
+        "type": "TIMESTAMP",
+        "mode": "REQUIRED"
     }
 ]
 EOF
-}
\ No newline at end of file
+}